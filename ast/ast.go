@@ -23,35 +23,34 @@ type FileSet struct {
 	Files []*File
 }
 
-// Sort sorts fs.Files topologically.
+// Sort sorts fs.Files topologically, so that each file comes after the
+// files it imports. As in protoc, files are taken in their current order,
+// and each is preceded by its imports, in the order they are declared,
+// if they have not already been placed; so the result depends only on the
+// current order of the files that nothing else imports.
+// Imports of files that aren't in fs (such as missing weak imports) are ignored.
 func (fs *FileSet) Sort() {
-	in := fs.Files                   // old version of fs.Files; shrinks each loop
-	out := make([]*File, 0, len(in)) // new version of fs.Files; grows each loop
-	done := make(map[string]bool)    // filenames that we've seen and that don't have un-done imports
-	for len(in) > 0 {
-		// Find a file that doesn't have an un-done import.
-		var next *File
-		for i, f := range in {
-			ok := true
-			for _, imp := range f.Imports {
-				if !done[imp] {
-					ok = false
-					break
-				}
-			}
-			if !ok {
-				continue
-			}
-			next = f
-			copy(in[i:], in[i+1:])
-			in = in[:len(in)-1]
-			break
+	byName := make(map[string]*File)
+	for _, f := range fs.Files {
+		byName[f.Name] = f
+	}
+	out := make([]*File, 0, len(fs.Files))
+	seen := make(map[*File]bool)
+	var visit func(f *File)
+	visit = func(f *File) {
+		if seen[f] {
+			return
 		}
-		if next == nil {
-			panic("import loop!") // shouldn't happen
+		seen[f] = true
+		for _, imp := range f.Imports {
+			if dep, ok := byName[imp]; ok {
+				visit(dep)
+			}
 		}
-		out = append(out, next)
-		done[next.Name] = true
+		out = append(out, f)
+	}
+	for _, f := range fs.Files {
+		visit(f)
 	}
 	fs.Files = out
 }
@@ -61,10 +60,13 @@ type File struct {
 	Name    string // filename
 	Syntax  string // "proto2" or "proto3"
 	Package []string
-	Options [][2]string // slice of key/value pairs
+	// Options is a slice of key/value pairs. Values are as written,
+	// except that a message literal has its tokens separated by single spaces.
+	Options [][2]string
 
 	Imports       []string
 	PublicImports []int // list of indexes in the Imports slice
+	WeakImports   []int // list of indexes in the Imports slice
 
 	Messages   []*Message   // top-level messages
 	Enums      []*Enum      // top-level enums
@@ -72,26 +74,40 @@ type File struct {
 	Extensions []*Extension // top-level extensions
 
 	Comments []*Comment // all the comments for this file, sorted by position
+
+	// The syntax, package, import and option statements, if the file was
+	// parsed from source. ImportStatements and OptionStatements are in the
+	// same order as Imports and Options.
+	SyntaxStatement, PackageStatement  *Statement
+	ImportStatements, OptionStatements []*Statement
+
+	Lines *LineTable // set by the parser, if the file was parsed from source
 }
 
 // Message represents a proto message.
 type Message struct {
-	Position   Position // position of the "message" token
-	Name       string
-	Group      bool
-	Fields     []*Field
-	Extensions []*Extension
-	Oneofs     []*Oneof
+	Position    Position // position of the "message" token
+	EndPosition Position // position just after the closing "}"
+	Name        string
+	Group       bool
+	Fields      []*Field
+	Extensions  []*Extension
+	Oneofs      []*Oneof
 
 	Messages []*Message // includes groups
 	Enums    []*Enum
 
 	ExtensionRanges [][2]int // extension ranges (inclusive at both ends)
+	ReservedRanges  [][2]int // reserved field numbers (inclusive at both ends)
+	ReservedNames   []string // reserved field names
+
+	Options [][2]string // key/value pairs, as for File.Options
 
 	Up interface{} // either *File or *Message
 }
 
 func (m *Message) Pos() Position { return m.Position }
+func (m *Message) End() Position { return m.EndPosition }
 func (m *Message) File() *File {
 	for x := m.Up; ; {
 		switch up := x.(type) {
@@ -107,18 +123,27 @@ func (m *Message) File() *File {
 
 // Oneof represents a oneof bracketing a set of fields in a message.
 type Oneof struct {
-	Position Position // position of "oneof" token
-	Name     string
+	Position    Position // position of "oneof" token
+	EndPosition Position // position just after the closing "}"
+	Name        string
+
+	Options [][2]string // key/value pairs, as for File.Options
 
 	Up *Message
 }
 
+func (o *Oneof) Pos() Position { return o.Position }
+func (o *Oneof) End() Position { return o.EndPosition }
+func (o *Oneof) File() *File   { return o.Up.File() }
+
 // Field represents a field in a message.
 type Field struct {
-	Position Position // position of "required"/"optional"/"repeated"/type
+	Position    Position // position of "required"/"optional"/"repeated"/type
+	EndPosition Position // position just after the ";", or a group's "}"
 
 	// TypeName is the raw name parsed from the input.
 	// Type is set during resolution; it will be a FieldType, *Message or *Enum.
+	// An AST built from a descriptor (see package descast) has Type set already.
 	TypeName string
 	Type     interface{}
 
@@ -127,26 +152,47 @@ type Field struct {
 	KeyTypeName string
 	KeyType     FieldType
 
-	// At most one of {required,repeated} is set.
+	// At most one of {required,optional,repeated} is set.
+	// Optional records an explicit "optional" label,
+	// which only makes a difference in proto3.
 	Required bool
+	Optional bool
 	Repeated bool
 	Name     string
 	Tag      int
 
 	HasDefault bool
-	Default    string // e.g. "foo", 7, true
+	Default    string // e.g. foo, 7, true; strings and bytes are unquoted
 
 	HasPacked bool
 	Packed    bool
 
+	JSONName string // from the json_name option, or "" if there is none
+
+	Options [][2]string // other options, as key/value pairs
+
 	Oneof *Oneof
 
 	Up Node // either *Message or *Extension
 }
 
 func (f *Field) Pos() Position { return f.Position }
+func (f *Field) End() Position { return f.EndPosition }
 func (f *Field) File() *File   { return f.Up.File() }
 
+// GroupFieldName returns the name of the field declared by a group,
+// which is the group's name with its ASCII letters lower-cased.
+// A group field's Name is that of its group.
+func GroupFieldName(groupName string) string {
+	b := []byte(groupName)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
 type FieldType int8
 
 const (
@@ -197,14 +243,21 @@ func (ft FieldType) String() string {
 }
 
 type Enum struct {
-	Position Position // position of "enum" token
-	Name     string
-	Values   []*EnumValue
+	Position    Position // position of "enum" token
+	EndPosition Position // position just after the closing "}"
+	Name        string
+	Values      []*EnumValue
+
+	ReservedRanges [][2]int // reserved values (inclusive at both ends)
+	ReservedNames  []string // reserved value names
+
+	Options [][2]string // key/value pairs, as for File.Options
 
 	Up interface{} // either *File or *Message
 }
 
 func (enum *Enum) Pos() Position { return enum.Position }
+func (enum *Enum) End() Position { return enum.EndPosition }
 func (enum *Enum) File() *File {
 	for x := enum.Up; ; {
 		switch up := x.(type) {
@@ -219,33 +272,42 @@ func (enum *Enum) File() *File {
 }
 
 type EnumValue struct {
-	Position Position // position of Name
-	Name     string
-	Number   int32
+	Position    Position // position of Name
+	EndPosition Position // position just after the ";"
+	Name        string
+	Number      int32
+
+	Options [][2]string // key/value pairs, as for File.Options
 
 	Up *Enum
 }
 
 func (ev *EnumValue) Pos() Position { return ev.Position }
+func (ev *EnumValue) End() Position { return ev.EndPosition }
 func (ev *EnumValue) File() *File   { return ev.Up.File() }
 
 // Service represents an RPC service.
 type Service struct {
-	Position Position // position of the "service" token
-	Name     string
+	Position    Position // position of the "service" token
+	EndPosition Position // position just after the closing "}"
+	Name        string
 
 	Methods []*Method
 
+	Options [][2]string // key/value pairs, as for File.Options
+
 	Up *File
 }
 
 func (s *Service) Pos() Position { return s.Position }
+func (s *Service) End() Position { return s.EndPosition }
 func (s *Service) File() *File   { return s.Up }
 
 // Method represents an RPC method.
 type Method struct {
-	Position Position // position of the "rpc" token
-	Name     string
+	Position    Position // position of the "rpc" token
+	EndPosition Position // position just after the ";" or the body's "}"
+	Name        string
 
 	// InTypeName/OutTypeName are the raw names parsed from the input.
 	// InType/OutType is set during resolution; it will be a *Message.
@@ -256,15 +318,19 @@ type Method struct {
 	// return value to the rpc are streams.
 	ClientStreaming, ServerStreaming bool
 
+	Options [][2]string // key/value pairs, as for File.Options
+
 	Up *Service
 }
 
 func (m *Method) Pos() Position { return m.Position }
+func (m *Method) End() Position { return m.EndPosition }
 func (m *Method) File() *File   { return m.Up.Up }
 
 // Extension represents an extension definition.
 type Extension struct {
-	Position Position // position of the "extend" token
+	Position    Position // position of the "extend" token
+	EndPosition Position // position just after the closing "}"
 
 	Extendee     string   // the thing being extended
 	ExtendeeType *Message // set during resolution
@@ -275,6 +341,7 @@ type Extension struct {
 }
 
 func (e *Extension) Pos() Position { return e.Position }
+func (e *Extension) End() Position { return e.EndPosition }
 func (e *Extension) File() *File {
 	switch up := e.Up.(type) {
 	case *File:
@@ -287,9 +354,21 @@ func (e *Extension) File() *File {
 	panic("unreachable")
 }
 
+// Statement represents a top-level statement that is not a declaration,
+// such as an import statement.
+type Statement struct {
+	Position    Position // position of the first token
+	EndPosition Position // position just after the ";"
+	Up          *File
+}
+
+func (s *Statement) Pos() Position { return s.Position }
+func (s *Statement) End() Position { return s.EndPosition }
+func (s *Statement) File() *File   { return s.Up }
+
 // Comment represents a comment.
 type Comment struct {
-	Start, End Position // position of first and last "//"
+	Start, End Position // position of first and last "//", or of "/*" and "*/"
 	Text       []string
 }
 
@@ -312,12 +391,10 @@ func LeadingComment(n Node) *Comment {
 
 // InlineComment returns the comment on the same line as a node,
 // or nil if there's no inline comment.
-// The returned comment is guaranteed to be a single line.
+// The returned comment is guaranteed to be a single line;
+// a block comment that starts on the node's line but ends
+// on a later one is not considered inline.
 func InlineComment(n Node) *Comment {
-	// TODO: Do we care about comments line this?
-	// 	string name = 1; /* foo
-	// 	bar */
-
 	f := n.File()
 	pos := n.Pos()
 	ci := sort.Search(len(f.Comments), func(i int) bool {
@@ -327,13 +404,30 @@ func InlineComment(n Node) *Comment {
 		return nil
 	}
 	c := f.Comments[ci]
+	if c.End.Line != c.Start.Line {
+		return nil
+	}
 	// Sanity check; it should only be one line.
-	if c.Start != c.End || len(c.Text) != 1 {
+	if len(c.Text) != 1 {
 		log.Panicf("internal error: bad inline comment: %+v", c)
 	}
 	return c
 }
 
+// Span returns the number of bytes of source that n occupies, from its
+// position to its end position, or 0 if either is unknown (e.g. because n
+// was not built by the parser).
+func Span(n interface {
+	Pos() Position
+	End() Position
+}) int {
+	start, end := n.Pos(), n.End()
+	if !start.IsValid() || !end.IsValid() {
+		return 0
+	}
+	return end.Offset - start.Offset
+}
+
 // Position describes a source position in an input file.
 // It is only valid if the line number is positive.
 type Position struct {
@@ -341,6 +435,47 @@ type Position struct {
 	Offset int // 0-based byte offset
 }
 
+// LineTable records where the lines of a file start,
+// so that byte offsets can be converted to line and column numbers.
+//
+// A line ends with "\n", so "\r\n" ends a line once; a lone "\r" is
+// just whitespace, as it is to protoc. Columns are 0-based byte counts,
+// except that a tab advances to the next multiple of 8, as in protoc's
+// source locations.
+type LineTable struct {
+	src    string
+	starts []int // offset of the start of each line
+}
+
+// NewLineTable returns the LineTable for src.
+func NewLineTable(src string) *LineTable {
+	lt := &LineTable{src: src, starts: []int{0}}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			lt.starts = append(lt.starts, i+1)
+		}
+	}
+	return lt
+}
+
+// Line returns the 1-based line number of the byte at offset.
+func (lt *LineTable) Line(offset int) int {
+	return sort.Search(len(lt.starts), func(i int) bool { return lt.starts[i] > offset })
+}
+
+// Column returns the 0-based column number of the byte at offset.
+func (lt *LineTable) Column(offset int) int {
+	col := 0
+	for i := lt.starts[lt.Line(offset)-1]; i < offset && i < len(lt.src); i++ {
+		if lt.src[i] == '\t' {
+			col += 8 - col%8
+		} else {
+			col++
+		}
+	}
+	return col
+}
+
 func (pos Position) IsValid() bool              { return pos.Line > 0 }
 func (pos Position) Before(other Position) bool { return pos.Offset < other.Offset }
 func (pos Position) String() string {
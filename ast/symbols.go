@@ -0,0 +1,145 @@
+package ast
+
+import (
+	"sort"
+	"strings"
+)
+
+// A SymbolTable indexes the declarations in a resolved FileSet by their full
+// names, and records which declarations refer to each message and enum.
+type SymbolTable struct {
+	nodes map[string]Node // by full name, without a leading dot
+	names map[Node]string
+	refs  map[Node][]Node
+}
+
+// NewSymbolTable returns a SymbolTable for fs, whose types must be resolved.
+//
+// It has the messages, enums, enum values, fields (including extensions),
+// oneofs, services and methods of fs. As in protoc, enum values are named
+// as siblings of their enum, not children of it, and the field declared by
+// a group is named by lower-casing the group's name.
+// If two declarations share a name, the first is kept.
+func NewSymbolTable(fs *FileSet) *SymbolTable {
+	st := &SymbolTable{
+		nodes: make(map[string]Node),
+		names: make(map[Node]string),
+		refs:  make(map[Node][]Node),
+	}
+	for _, f := range fs.Files {
+		pkg := strings.Join(f.Package, ".")
+		st.addMessages(pkg, f.Messages)
+		st.addEnums(pkg, f.Enums)
+		st.addExtensions(pkg, f.Extensions)
+		for _, srv := range f.Services {
+			name := join(pkg, srv.Name)
+			st.add(name, srv)
+			for _, mth := range srv.Methods {
+				st.add(join(name, mth.Name), mth)
+				st.addRef(mth.InType, mth)
+				if mth.OutType != mth.InType {
+					st.addRef(mth.OutType, mth)
+				}
+			}
+		}
+	}
+	return st
+}
+
+func join(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func (st *SymbolTable) add(name string, n Node) {
+	if _, ok := st.nodes[name]; ok {
+		return
+	}
+	st.nodes[name] = n
+	st.names[n] = name
+}
+
+// addRef records that n refers to typ, if typ is a message or enum.
+func (st *SymbolTable) addRef(typ interface{}, n Node) {
+	switch t := typ.(type) {
+	case *Message:
+		st.refs[t] = append(st.refs[t], n)
+	case *Enum:
+		st.refs[t] = append(st.refs[t], n)
+	}
+}
+
+func (st *SymbolTable) addMessages(scope string, msgs []*Message) {
+	for _, m := range msgs {
+		name := join(scope, m.Name)
+		st.add(name, m)
+		st.addFields(name, m.Fields)
+		for _, oo := range m.Oneofs {
+			st.add(join(name, oo.Name), oo)
+		}
+		st.addMessages(name, m.Messages)
+		st.addEnums(name, m.Enums)
+		st.addExtensions(name, m.Extensions)
+	}
+}
+
+func (st *SymbolTable) addFields(scope string, fields []*Field) {
+	for _, f := range fields {
+		name := f.Name
+		if m, ok := f.Type.(*Message); ok && m.Group {
+			name = GroupFieldName(name)
+		}
+		st.add(join(scope, name), f)
+		st.addRef(f.Type, f)
+	}
+}
+
+func (st *SymbolTable) addEnums(scope string, enums []*Enum) {
+	for _, enum := range enums {
+		st.add(join(scope, enum.Name), enum)
+		for _, ev := range enum.Values {
+			st.add(join(scope, ev.Name), ev)
+		}
+	}
+}
+
+func (st *SymbolTable) addExtensions(scope string, exts []*Extension) {
+	for _, ext := range exts {
+		if ext.ExtendeeType != nil {
+			st.refs[ext.ExtendeeType] = append(st.refs[ext.ExtendeeType], ext)
+		}
+		st.addFields(scope, ext.Fields)
+	}
+}
+
+// Lookup returns the declaration with the given full name, or nil if there is none.
+// The name may have a leading dot.
+func (st *SymbolTable) Lookup(fullName string) Node {
+	return st.nodes[strings.TrimPrefix(fullName, ".")]
+}
+
+// FullName returns the full name of n, without a leading dot,
+// or "" if n is not in st.
+func (st *SymbolTable) FullName(n Node) string {
+	return st.names[n]
+}
+
+// Names returns the full names in st, sorted.
+func (st *SymbolTable) Names() []string {
+	names := make([]string, 0, len(st.nodes))
+	for name := range st.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// References returns the declarations that refer to n, a message or enum,
+// in the order they appear in the FileSet. These are fields of type n,
+// methods with n as their input or output type, and, for a message,
+// the extensions of it.
+func (st *SymbolTable) References(n Node) []Node {
+	return st.refs[n]
+}
@@ -0,0 +1,117 @@
+package ast
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Unquote interprets s as a single-quoted or double-quoted string literal,
+// as written in a .proto file, returning the string value that s quotes.
+// It accepts the escapes that protoc does, which differ from Go's:
+// octal escapes may have one to three digits, hex escapes one or two,
+// and "\?" is allowed.
+// Errors are of type *UnquoteError.
+func Unquote(s string) (string, error) {
+	if len(s) < 2 || (s[0] != '"' && s[0] != '\'') || s[len(s)-1] != s[0] {
+		return "", &UnquoteError{0, "not a quoted string"}
+	}
+	quote := s[0]
+	s = s[1 : len(s)-1]
+
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == quote:
+			return "", &UnquoteError{i + 1, fmt.Sprintf("unescaped %c in string", quote)}
+		case c == '\n':
+			return "", &UnquoteError{i + 1, "string crosses a line boundary"}
+		case c != '\\':
+			buf = append(buf, c)
+			i++
+			continue
+		}
+		start := i // of the backslash
+		errorf := func(format string, args ...interface{}) error {
+			return &UnquoteError{start + 1, fmt.Sprintf(format, args...)}
+		}
+		i++
+		if i >= len(s) {
+			return "", errorf(`string ends with "\"`)
+		}
+		c = s[i]
+		i++
+		switch c {
+		case 'a':
+			buf = append(buf, '\a')
+		case 'b':
+			buf = append(buf, '\b')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		case 't':
+			buf = append(buf, '\t')
+		case 'v':
+			buf = append(buf, '\v')
+		case '\\', '?', '\'', '"':
+			buf = append(buf, c)
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// Up to three octal digits. Like protoc, values over 0377
+			// keep only their low eight bits.
+			code := int(c - '0')
+			for n := 1; n < 3 && i < len(s) && isOctal(s[i]); n++ {
+				code = code*8 + int(s[i]-'0')
+				i++
+			}
+			buf = append(buf, byte(code))
+		case 'x', 'X':
+			// One or two hex digits.
+			n := 0
+			for n < 2 && i+n < len(s) && isHex(s[i+n]) {
+				n++
+			}
+			if n == 0 {
+				return "", errorf(`invalid escape \%c: no hex digits`, c)
+			}
+			code, _ := strconv.ParseUint(s[i:i+n], 16, 8)
+			buf = append(buf, byte(code))
+			i += n
+		case 'u', 'U':
+			// A Unicode code point, as four or eight hex digits.
+			n := 4
+			if c == 'U' {
+				n = 8
+			}
+			if i+n > len(s) {
+				return "", errorf(`invalid escape \%c%s: needs %d hex digits`, c, s[i:], n)
+			}
+			code, err := strconv.ParseUint(s[i:i+n], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return "", errorf(`invalid escape \%c%s`, c, s[i:i+n])
+			}
+			buf = append(buf, string(rune(code))...)
+			i += n
+		default:
+			return "", errorf(`invalid escape \%c`, c)
+		}
+	}
+	return string(buf), nil
+}
+
+// An UnquoteError describes a problem with a string literal.
+type UnquoteError struct {
+	Offset int // of the problem in the literal, including its opening quote
+	Msg    string
+}
+
+func (e *UnquoteError) Error() string { return e.Msg }
+
+func isOctal(c byte) bool { return '0' <= c && c <= '7' }
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
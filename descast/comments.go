@@ -0,0 +1,198 @@
+package descast
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dsymonds/gotoc/ast"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Field numbers in the descriptor protos, for SourceCodeInfo paths.
+// These match the ones in package gendesc.
+const (
+	fileMessageTypeNumber = 4
+	fileEnumTypeNumber    = 5
+	fileServiceNumber     = 6
+	fileExtensionNumber   = 7
+
+	messageFieldNumber      = 2
+	messageNestedTypeNumber = 3
+	messageEnumTypeNumber   = 4
+	messageExtensionNumber  = 6
+	messageOneofDeclNumber  = 8
+
+	filePackageNumber = 2
+	fileSyntaxNumber  = 12
+
+	enumValueNumber     = 2
+	serviceMethodNumber = 2
+)
+
+// pathKey returns a map key for a SourceCodeInfo path.
+func pathKey(path []int32) string { return fmt.Sprint(path) }
+
+// comments fills in f.Comments from the SourceCodeInfo of fdp.
+//
+// A descriptor has no source positions, so the declarations of f are
+// given made-up line numbers, in the order of the locations, that leave
+// room for their comments: each leading comment ends on the line before
+// its declaration, a one-line trailing comment is on the declaration's line,
+// and other comments are separated from what follows by a blank line.
+// That is enough for ast.LeadingComment and ast.InlineComment, and for
+// package printer to put the comments back where they were.
+func (c *converter) comments(f *ast.File, fdp *pb.FileDescriptorProto) {
+	nodes := make(map[string][]ast.Node)
+	add := func(path []int32, n ast.Node) {
+		k := pathKey(path)
+		nodes[k] = append(nodes[k], n)
+	}
+	var message func(path []int32, dp *pb.DescriptorProto)
+	enum := func(path []int32, edp *pb.EnumDescriptorProto) {
+		add(path, c.nodes[edp])
+		for i, evdp := range edp.Value {
+			add(append(path, enumValueNumber, int32(i)), c.nodes[evdp])
+		}
+	}
+	extensions := func(path []int32, fdps []*pb.FieldDescriptorProto) {
+		// As in gendesc, each extend block has the path of the list of
+		// extension fields.
+		var last ast.Node
+		for i, fdp := range fdps {
+			f := c.nodes[fdp].(*ast.Field)
+			if ext := f.Up.(*ast.Extension); ext != last {
+				add(path, ext)
+				last = ext
+			}
+			add(append(path, int32(i)), f)
+		}
+	}
+	message = func(path []int32, dp *pb.DescriptorProto) {
+		n, ok := c.nodes[dp]
+		if !ok {
+			// A map entry, which has no place in the AST.
+			return
+		}
+		add(path, n)
+		for i, fdp := range dp.Field {
+			add(append(path, messageFieldNumber, int32(i)), c.nodes[fdp])
+		}
+		for i, ndp := range dp.NestedType {
+			message(append(path, messageNestedTypeNumber, int32(i)), ndp)
+		}
+		for i, edp := range dp.EnumType {
+			enum(append(path, messageEnumTypeNumber, int32(i)), edp)
+		}
+		extensions(append(path, messageExtensionNumber), dp.Extension)
+		for i, odp := range dp.OneofDecl {
+			if n, ok := c.nodes[odp]; ok {
+				add(append(path, messageOneofDeclNumber, int32(i)), n)
+			}
+		}
+	}
+	for i, dp := range fdp.MessageType {
+		message([]int32{fileMessageTypeNumber, int32(i)}, dp)
+	}
+	for i, edp := range fdp.EnumType {
+		enum([]int32{fileEnumTypeNumber, int32(i)}, edp)
+	}
+	for i, sdp := range fdp.Service {
+		path := []int32{fileServiceNumber, int32(i)}
+		add(path, c.nodes[sdp])
+		for j, mdp := range sdp.Method {
+			add(append(path, serviceMethodNumber, int32(j)), c.nodes[mdp])
+		}
+	}
+	extensions([]int32{fileExtensionNumber}, fdp.Extension)
+
+	// Line 1 is kept for a comment at the top of the file, which protoc
+	// records as detached from the syntax or package statement.
+	line := 2
+	comment := func(text string) {
+		cm := &ast.Comment{Text: commentLines(text)}
+		cm.Start.Line = line
+		line += len(cm.Text)
+		cm.End.Line = line - 1
+		f.Comments = append(f.Comments, cm)
+	}
+	for _, loc := range fdp.GetSourceCodeInfo().GetLocation() {
+		var n ast.Node
+		if len(loc.Path) > 0 {
+			switch loc.Path[0] {
+			case fileMessageTypeNumber, fileEnumTypeNumber, fileServiceNumber, fileExtensionNumber:
+				// Part of a declaration; skip it unless it is the whole thing.
+				k := pathKey(loc.Path)
+				if len(nodes[k]) == 0 {
+					continue
+				}
+				n = nodes[k][0]
+				nodes[k] = nodes[k][1:]
+			}
+		}
+		if len(f.Comments) == 0 && len(loc.LeadingDetachedComments) > 0 && len(loc.Path) == 1 && (loc.Path[0] == fileSyntaxNumber || loc.Path[0] == filePackageNumber) {
+			line = 1
+		}
+		for _, d := range loc.LeadingDetachedComments {
+			comment(d)
+			line++
+		}
+		if loc.LeadingComments != nil {
+			comment(loc.GetLeadingComments())
+		}
+		if n == nil {
+			// A statement such as an import or option, which is not
+			// a node; keep its comments apart from what follows.
+			if loc.LeadingComments != nil {
+				line++
+			}
+			if loc.TrailingComments != nil {
+				comment(loc.GetTrailingComments())
+				line++
+			}
+			continue
+		}
+		setLine(n, line)
+		if t := loc.TrailingComments; t != nil && len(commentLines(*t)) == 1 {
+			comment(*t)
+			continue
+		}
+		line++
+		if loc.TrailingComments != nil {
+			comment(loc.GetTrailingComments())
+			line++
+		}
+	}
+}
+
+// setLine sets the line number of a declaration.
+func setLine(n ast.Node, line int) {
+	pos := ast.Position{Line: line}
+	switch n := n.(type) {
+	case *ast.Message:
+		n.Position = pos
+	case *ast.Field:
+		n.Position = pos
+	case *ast.Oneof:
+		n.Position = pos
+	case *ast.Enum:
+		n.Position = pos
+	case *ast.EnumValue:
+		n.Position = pos
+	case *ast.Service:
+		n.Position = pos
+	case *ast.Method:
+		n.Position = pos
+	case *ast.Extension:
+		n.Position = pos
+	}
+}
+
+// commentLines splits a comment from SourceCodeInfo into lines,
+// removing the space that protoc leaves at the start of each.
+func commentLines(text string) []string {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimPrefix(l, " ")
+	}
+	return lines
+}
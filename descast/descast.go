@@ -0,0 +1,437 @@
+/*
+Package descast converts descriptor protos into gotoc's AST representation.
+It is the reverse of package gendesc, and allows precompiled files
+to take part in a compilation alongside parsed .proto files.
+*/
+package descast
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/dsymonds/gotoc/options"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Files converts a set of file descriptors into AST files.
+// Type references are resolved against the converted files and against deps,
+// which may be nil. All types referenced by fdps must be defined in one
+// of those places.
+// Comments are taken from the SourceCodeInfo of fdps, if there is any.
+// Custom options are kept if the extensions they are stored in are declared
+// in fdps or deps.
+func Files(fdps []*pb.FileDescriptorProto, deps []*ast.File) ([]*ast.File, error) {
+	c := &converter{
+		types: make(map[string]interface{}),
+		nodes: make(map[interface{}]ast.Node),
+	}
+	decls := fdps
+	for _, f := range deps {
+		c.indexFile(f)
+		if fdp, err := gendesc.GenerateFile(f, gendesc.Options{}); err == nil {
+			decls = append(decls[:len(decls):len(decls)], fdp)
+		}
+	}
+	c.ext = options.NewResolver(decls)
+	var files []*ast.File
+	for _, fdp := range fdps {
+		f, err := c.file(fdp)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fdp.GetName(), err)
+		}
+		files = append(files, f)
+	}
+	// All types are now known, so links can be made.
+	for _, link := range c.links {
+		if err := link(); err != nil {
+			return nil, err
+		}
+	}
+	for i, fdp := range fdps {
+		if fdp.SourceCodeInfo != nil {
+			c.comments(files[i], fdp)
+		}
+	}
+	return files, nil
+}
+
+type converter struct {
+	types map[string]interface{}   // fully-qualified name => *ast.Message or *ast.Enum
+	links []func() error           // deferred type resolution
+	nodes map[interface{}]ast.Node // descriptor => node made from it
+	ext   *options.Resolver        // for custom options
+}
+
+// indexFile records all the types defined in an existing AST file.
+func (c *converter) indexFile(f *ast.File) {
+	prefix := ""
+	if len(f.Package) > 0 {
+		prefix = "." + strings.Join(f.Package, ".")
+	}
+	for _, msg := range f.Messages {
+		c.indexMessage(prefix, msg)
+	}
+	for _, enum := range f.Enums {
+		c.types[prefix+"."+enum.Name] = enum
+	}
+}
+
+func (c *converter) indexMessage(prefix string, msg *ast.Message) {
+	name := prefix + "." + msg.Name
+	c.types[name] = msg
+	for _, nmsg := range msg.Messages {
+		c.indexMessage(name, nmsg)
+	}
+	for _, enum := range msg.Enums {
+		c.types[name+"."+enum.Name] = enum
+	}
+}
+
+func (c *converter) file(fdp *pb.FileDescriptorProto) (*ast.File, error) {
+	f := &ast.File{
+		Name:    fdp.GetName(),
+		Syntax:  fdp.GetSyntax(),
+		Imports: fdp.Dependency,
+	}
+	prefix := ""
+	if pkg := fdp.GetPackage(); pkg != "" {
+		f.Package = strings.Split(pkg, ".")
+		prefix = "." + pkg
+	}
+	for _, i := range fdp.PublicDependency {
+		f.PublicImports = append(f.PublicImports, int(i))
+	}
+	for _, i := range fdp.WeakDependency {
+		f.WeakImports = append(f.WeakImports, int(i))
+	}
+	f.Options = c.options(fdp.Options)
+
+	for _, dp := range fdp.MessageType {
+		msg, err := c.message(prefix, dp, f)
+		if err != nil {
+			return nil, err
+		}
+		f.Messages = append(f.Messages, msg)
+	}
+	for _, edp := range fdp.EnumType {
+		f.Enums = append(f.Enums, c.enum(prefix, edp, f))
+	}
+	for _, sdp := range fdp.Service {
+		f.Services = append(f.Services, c.service(sdp, f))
+	}
+	exts, err := c.extensions(fdp.Extension, f)
+	if err != nil {
+		return nil, err
+	}
+	f.Extensions = exts
+	return f, nil
+}
+
+func (c *converter) message(prefix string, dp *pb.DescriptorProto, up interface{}) (*ast.Message, error) {
+	msg := &ast.Message{
+		Name:    dp.GetName(),
+		Options: c.options(dp.Options, "map_entry"),
+		Up:      up,
+	}
+	name := prefix + "." + msg.Name
+	c.types[name] = msg
+	c.nodes[dp] = msg
+
+	// Map entry messages are synthesized by gendesc, so they are not
+	// part of the AST; remember them so map fields can be rebuilt.
+	mapEntries := make(map[string]*pb.DescriptorProto)
+	for _, ndp := range dp.NestedType {
+		if ndp.GetOptions().GetMapEntry() {
+			mapEntries[name+"."+ndp.GetName()] = ndp
+			continue
+		}
+		nmsg, err := c.message(name, ndp, msg)
+		if err != nil {
+			return nil, err
+		}
+		msg.Messages = append(msg.Messages, nmsg)
+	}
+	for _, edp := range dp.EnumType {
+		msg.Enums = append(msg.Enums, c.enum(name, edp, msg))
+	}
+	// The synthetic oneofs of proto3 optional fields are made by gendesc
+	// too, so they are not part of the AST either.
+	synthetic := make(map[int32]bool)
+	for _, fdp := range dp.Field {
+		if fdp.GetProto3Optional() && fdp.OneofIndex != nil {
+			synthetic[fdp.GetOneofIndex()] = true
+		}
+	}
+	oneofs := make([]*ast.Oneof, len(dp.OneofDecl))
+	for i, odp := range dp.OneofDecl {
+		if synthetic[int32(i)] {
+			continue
+		}
+		oneofs[i] = &ast.Oneof{
+			Name:    odp.GetName(),
+			Options: c.options(odp.Options),
+			Up:      msg,
+		}
+		c.nodes[odp] = oneofs[i]
+		msg.Oneofs = append(msg.Oneofs, oneofs[i])
+	}
+	for _, fdp := range dp.Field {
+		f, err := c.field(fdp, msg, mapEntries[fdp.GetTypeName()])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if fdp.OneofIndex != nil && !fdp.GetProto3Optional() {
+			i := int(fdp.GetOneofIndex())
+			if i < 0 || i >= len(oneofs) {
+				return nil, fmt.Errorf("%s.%s: oneof index %d out of range", name, f.Name, i)
+			}
+			f.Oneof = oneofs[i]
+		}
+		msg.Fields = append(msg.Fields, f)
+	}
+	for _, r := range dp.ExtensionRange {
+		// DescriptorProto.ExtensionRange uses a half-open interval.
+		msg.ExtensionRanges = append(msg.ExtensionRanges, [2]int{int(r.GetStart()), int(r.GetEnd()) - 1})
+	}
+	for _, r := range dp.ReservedRange {
+		// So does DescriptorProto.ReservedRange.
+		msg.ReservedRanges = append(msg.ReservedRanges, [2]int{int(r.GetStart()), int(r.GetEnd()) - 1})
+	}
+	msg.ReservedNames = append(msg.ReservedNames, dp.ReservedName...)
+	exts, err := c.extensions(dp.Extension, msg)
+	if err != nil {
+		return nil, err
+	}
+	msg.Extensions = exts
+	return msg, nil
+}
+
+// field converts a field descriptor. If the field is a map field,
+// entry is its map entry message.
+func (c *converter) field(fdp *pb.FieldDescriptorProto, up ast.Node, entry *pb.DescriptorProto) (*ast.Field, error) {
+	f := &ast.Field{
+		Name: fdp.GetName(),
+		Tag:  int(fdp.GetNumber()),
+		Up:   up,
+	}
+	c.nodes[fdp] = f
+	switch fdp.GetLabel() {
+	case pb.FieldDescriptorProto_LABEL_REQUIRED:
+		f.Required = true
+	case pb.FieldDescriptorProto_LABEL_REPEATED:
+		f.Repeated = true
+	}
+	f.Optional = fdp.GetProto3Optional()
+	if fdp.DefaultValue != nil {
+		f.HasDefault = true
+		f.Default = fdp.GetDefaultValue()
+		if fdp.GetType() == pb.FieldDescriptorProto_TYPE_BYTES {
+			// protoc escapes bytes defaults with C escapes.
+			v, err := ast.Unquote(`"` + f.Default + `"`)
+			if err != nil {
+				return nil, fmt.Errorf("bad default for field %s: %v", f.Name, err)
+			}
+			f.Default = v
+		}
+	}
+	// protoc sets json_name for every field; only a non-default one
+	// comes from an option.
+	if j := fdp.GetJsonName(); j != gendesc.JSONName(fdp.GetName()) {
+		f.JSONName = j
+	}
+	if opts := fdp.Options; opts != nil && opts.Packed != nil {
+		f.HasPacked = true
+		f.Packed = opts.GetPacked()
+	}
+	f.Options = c.options(fdp.Options, "packed")
+	if entry != nil {
+		if err := c.mapField(f, entry); err != nil {
+			return nil, fmt.Errorf("field %s: %v", f.Name, err)
+		}
+		return f, nil
+	}
+
+	switch t := fdp.GetType(); t {
+	case pb.FieldDescriptorProto_TYPE_MESSAGE, pb.FieldDescriptorProto_TYPE_GROUP, pb.FieldDescriptorProto_TYPE_ENUM:
+		f.TypeName = fdp.GetTypeName()
+		c.link(f.TypeName, func(x interface{}) error {
+			switch x := x.(type) {
+			case *ast.Message:
+				if t == pb.FieldDescriptorProto_TYPE_ENUM {
+					return fmt.Errorf("field %s: %s is a message, not an enum", f.Name, f.TypeName)
+				}
+				if t == pb.FieldDescriptorProto_TYPE_GROUP {
+					// The AST names group fields after their group type.
+					x.Group = true
+					f.Name = x.Name
+				}
+			case *ast.Enum:
+				if t != pb.FieldDescriptorProto_TYPE_ENUM {
+					return fmt.Errorf("field %s: %s is an enum, not a message", f.Name, f.TypeName)
+				}
+			}
+			f.Type = x
+			return nil
+		})
+	default:
+		ft, ok := fieldTypeMap[t]
+		if !ok {
+			return nil, fmt.Errorf("field %s has unknown type %v", f.Name, t)
+		}
+		f.TypeName = ft.String()
+		f.Type = ft
+	}
+	return f, nil
+}
+
+// mapField turns f into a map field, according to its map entry message.
+func (c *converter) mapField(f *ast.Field, entry *pb.DescriptorProto) error {
+	if len(entry.Field) != 2 {
+		return fmt.Errorf("map entry has %d fields, want 2", len(entry.Field))
+	}
+	kdp, vdp := entry.Field[0], entry.Field[1]
+	kt, ok := fieldTypeMap[kdp.GetType()]
+	if !ok {
+		return fmt.Errorf("bad map key type %v", kdp.GetType())
+	}
+	f.KeyTypeName = kt.String()
+	f.KeyType = kt
+
+	switch vdp.GetType() {
+	case pb.FieldDescriptorProto_TYPE_MESSAGE, pb.FieldDescriptorProto_TYPE_ENUM:
+		f.TypeName = vdp.GetTypeName()
+		c.link(f.TypeName, func(x interface{}) error {
+			f.Type = x
+			return nil
+		})
+	default:
+		vt, ok := fieldTypeMap[vdp.GetType()]
+		if !ok {
+			return fmt.Errorf("bad map value type %v", vdp.GetType())
+		}
+		f.TypeName = vt.String()
+		f.Type = vt
+	}
+	return nil
+}
+
+func (c *converter) enum(prefix string, edp *pb.EnumDescriptorProto, up interface{}) *ast.Enum {
+	enum := &ast.Enum{
+		Name:    edp.GetName(),
+		Options: c.options(edp.Options),
+		Up:      up,
+	}
+	c.types[prefix+"."+enum.Name] = enum
+	c.nodes[edp] = enum
+	for _, evdp := range edp.Value {
+		ev := &ast.EnumValue{
+			Name:    evdp.GetName(),
+			Number:  evdp.GetNumber(),
+			Options: c.options(evdp.Options),
+			Up:      enum,
+		}
+		c.nodes[evdp] = ev
+		enum.Values = append(enum.Values, ev)
+	}
+	for _, r := range edp.ReservedRange {
+		// EnumDescriptorProto.ReservedRange is inclusive at both ends.
+		enum.ReservedRanges = append(enum.ReservedRanges, [2]int{int(r.GetStart()), int(r.GetEnd())})
+	}
+	enum.ReservedNames = append(enum.ReservedNames, edp.ReservedName...)
+	return enum
+}
+
+func (c *converter) service(sdp *pb.ServiceDescriptorProto, f *ast.File) *ast.Service {
+	srv := &ast.Service{
+		Name:    sdp.GetName(),
+		Options: c.options(sdp.Options),
+		Up:      f,
+	}
+	c.nodes[sdp] = srv
+	for _, mdp := range sdp.Method {
+		mth := &ast.Method{
+			Name:            mdp.GetName(),
+			InTypeName:      mdp.GetInputType(),
+			OutTypeName:     mdp.GetOutputType(),
+			ClientStreaming: mdp.GetClientStreaming(),
+			ServerStreaming: mdp.GetServerStreaming(),
+			Options:         c.options(mdp.Options),
+			Up:              srv,
+		}
+		c.nodes[mdp] = mth
+		c.link(mth.InTypeName, func(x interface{}) error {
+			mth.InType = x
+			return nil
+		})
+		c.link(mth.OutTypeName, func(x interface{}) error {
+			mth.OutType = x
+			return nil
+		})
+		srv.Methods = append(srv.Methods, mth)
+	}
+	return srv
+}
+
+// extensions converts extension fields into ast.Extensions,
+// grouping consecutive fields with the same extendee.
+func (c *converter) extensions(fdps []*pb.FieldDescriptorProto, up interface{}) ([]*ast.Extension, error) {
+	var exts []*ast.Extension
+	for _, fdp := range fdps {
+		if len(exts) == 0 || exts[len(exts)-1].Extendee != fdp.GetExtendee() {
+			ext := &ast.Extension{
+				Extendee: fdp.GetExtendee(),
+				Up:       up,
+			}
+			c.link(ext.Extendee, func(x interface{}) error {
+				m, ok := x.(*ast.Message)
+				if !ok {
+					return fmt.Errorf("extendee %s is not a message", ext.Extendee)
+				}
+				ext.ExtendeeType = m
+				return nil
+			})
+			exts = append(exts, ext)
+		}
+		ext := exts[len(exts)-1]
+		f, err := c.field(fdp, ext, nil)
+		if err != nil {
+			return nil, err
+		}
+		ext.Fields = append(ext.Fields, f)
+	}
+	return exts, nil
+}
+
+// link arranges for set to be called with the type called name
+// once all types are known.
+func (c *converter) link(name string, set func(interface{}) error) {
+	c.links = append(c.links, func() error {
+		x, ok := c.types[name]
+		if !ok {
+			return fmt.Errorf("unknown type %q", name)
+		}
+		return set(x)
+	})
+}
+
+// A mapping of the proto type to ast.FieldType.
+// Does not include TYPE_ENUM, TYPE_MESSAGE or TYPE_GROUP.
+var fieldTypeMap = map[pb.FieldDescriptorProto_Type]ast.FieldType{
+	pb.FieldDescriptorProto_TYPE_DOUBLE:   ast.Double,
+	pb.FieldDescriptorProto_TYPE_FLOAT:    ast.Float,
+	pb.FieldDescriptorProto_TYPE_INT64:    ast.Int64,
+	pb.FieldDescriptorProto_TYPE_UINT64:   ast.Uint64,
+	pb.FieldDescriptorProto_TYPE_INT32:    ast.Int32,
+	pb.FieldDescriptorProto_TYPE_FIXED64:  ast.Fixed64,
+	pb.FieldDescriptorProto_TYPE_FIXED32:  ast.Fixed32,
+	pb.FieldDescriptorProto_TYPE_BOOL:     ast.Bool,
+	pb.FieldDescriptorProto_TYPE_STRING:   ast.String,
+	pb.FieldDescriptorProto_TYPE_BYTES:    ast.Bytes,
+	pb.FieldDescriptorProto_TYPE_UINT32:   ast.Uint32,
+	pb.FieldDescriptorProto_TYPE_SFIXED32: ast.Sfixed32,
+	pb.FieldDescriptorProto_TYPE_SFIXED64: ast.Sfixed64,
+	pb.FieldDescriptorProto_TYPE_SINT32:   ast.Sint32,
+	pb.FieldDescriptorProto_TYPE_SINT64:   ast.Sint64,
+}
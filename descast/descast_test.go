@@ -0,0 +1,325 @@
+package descast
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/dsymonds/gotoc/parser"
+	"github.com/dsymonds/gotoc/printer"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Each of these descriptor sets should survive a trip through descast and gendesc.
+var roundTripTests = []struct {
+	name string
+	fds  string
+}{
+	{
+		"Basics",
+		`file {
+		   name: "a.proto" package: "foo.bar"
+		   message_type {
+		     name: "A"
+		     field { name:"x" number:1 label:LABEL_REQUIRED type:TYPE_INT32 default_value:"7" json_name:"x" }
+		     field { name:"b" number:2 label:LABEL_REPEATED type:TYPE_MESSAGE type_name:".foo.bar.A.B" json_name:"b" }
+		     field { name:"e" number:3 label:LABEL_OPTIONAL type:TYPE_ENUM type_name:".foo.bar.E" json_name:"e" }
+		     field { name:"y" number:4 label:LABEL_OPTIONAL type:TYPE_BYTES default_value:"a\\001\\\"\\377" json_name:"y" }
+		     nested_type { name: "B" }
+		     extension_range { start:100 end:200 }
+		   }
+		   enum_type { name: "E" value { name:"ZERO" number:0 } value { name:"ONE" number:1 } }
+		   service {
+		     name: "S"
+		     method { name:"M" input_type:".foo.bar.A" output_type:".foo.bar.A.B" server_streaming:true }
+		   }
+		   extension { name:"ext" number:100 label:LABEL_OPTIONAL type:TYPE_STRING extendee:".foo.bar.A" json_name:"ext" }
+		 }`,
+	},
+	{
+		"MapsGroupsOneofs",
+		`file {
+		   name: "b.proto"
+		   message_type {
+		     name: "M"
+		     field { name:"a" number:1 label:LABEL_OPTIONAL type:TYPE_INT32 oneof_index:0 json_name:"a" }
+		     field { name:"b" number:2 label:LABEL_OPTIONAL type:TYPE_STRING oneof_index:0 json_name:"b" }
+		     field { name:"g" number:3 label:LABEL_OPTIONAL type:TYPE_GROUP type_name:".M.G" json_name:"g" }
+		     field { name:"m" number:4 label:LABEL_REPEATED type:TYPE_MESSAGE type_name:".M.MEntry" json_name:"m" }
+		     nested_type { name: "G" field { name:"i" number:5 label:LABEL_OPTIONAL type:TYPE_INT32 json_name:"i" } }
+		     nested_type {
+		       name: "MEntry"
+		       field { name:"key" number:1 label:LABEL_OPTIONAL type:TYPE_STRING json_name:"key" }
+		       field { name:"value" number:2 label:LABEL_OPTIONAL type:TYPE_MESSAGE type_name:".M" json_name:"value" }
+		       options { map_entry: true }
+		     }
+		     oneof_decl { name: "choice" }
+		   }
+		 }`,
+	},
+	{
+		"CrossFile",
+		`file {
+		   name: "dep.proto" package: "dep"
+		   message_type { name: "D" }
+		 }
+		 file {
+		   name: "user.proto" package: "user"
+		   dependency: "dep.proto"
+		   public_dependency: 0
+		   syntax: "proto3"
+		   message_type {
+		     name: "U"
+		     field { name:"d" number:1 label:LABEL_OPTIONAL type:TYPE_MESSAGE type_name:".dep.D" json_name:"d" }
+		   }
+		 }`,
+	},
+	{
+		"WeakImports",
+		`file { name: "dep.proto" package: "dep" }
+		 file { name: "weak.proto" package: "weak" }
+		 file {
+		   name: "user.proto" package: "user"
+		   dependency: "weak.proto"
+		   dependency: "dep.proto"
+		   public_dependency: 1
+		   weak_dependency: 0
+		 }`,
+	},
+	{
+		"Proto3Optional",
+		`file {
+		   name: "c.proto"
+		   syntax: "proto3"
+		   message_type {
+		     name: "M"
+		     field { name:"a" number:1 label:LABEL_OPTIONAL type:TYPE_INT32 json_name:"a" oneof_index:1 proto3_optional:true }
+		     field { name:"b" number:2 label:LABEL_OPTIONAL type:TYPE_INT32 json_name:"b" oneof_index:0 }
+		     oneof_decl { name: "choice" }
+		     oneof_decl { name: "_a" }
+		   }
+		 }`,
+	},
+	{
+		"ReservedAndOptions",
+		`file {
+		   name: "d.proto" package: "d"
+		   message_type {
+		     name: "M"
+		     field {
+		       name:"a" number:1 label:LABEL_OPTIONAL type:TYPE_INT32 json_name:"a"
+		       options {
+		         deprecated: true ctype: CORD
+		         uninterpreted_option { name { name_part: "unknown.opt" is_extension: true } negative_int_value: -3 }
+		         uninterpreted_option { name { name_part: "x" is_extension: true } identifier_value: "FOO" }
+		       }
+		     }
+		     field { name:"b" number:2 label:LABEL_REPEATED type:TYPE_INT32 json_name:"b" options { packed: true } }
+		     oneof_decl { name: "o" options { uninterpreted_option { name { name_part: "o" is_extension: true } double_value: 1 } } }
+		     reserved_range { start:5 end:6 }
+		     reserved_name: "old"
+		     options { deprecated: true }
+		   }
+		   enum_type {
+		     name: "E"
+		     value { name:"ZERO" number:0 }
+		     value { name:"NIL" number:0 options { deprecated: true } }
+		     reserved_range { start:2 end:3 }
+		     reserved_name: "GONE"
+		     options { allow_alias: true }
+		   }
+		   service {
+		     name: "S"
+		     method {
+		       name:"M" input_type:".d.M" output_type:".d.M"
+		       options {
+		         idempotency_level: NO_SIDE_EFFECTS
+		         uninterpreted_option { name { name_part: "a.b" is_extension: true } name { name_part: "c" is_extension: false } aggregate_value: "x: \"y\"" }
+		       }
+		     }
+		     options { deprecated: true uninterpreted_option { name { name_part: "s" is_extension: false } string_value: "a\001\"" } }
+		   }
+		   options { java_package: "com.d" optimize_for: LITE_RUNTIME cc_enable_arenas: true }
+		 }`,
+	},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tt := range roundTripTests {
+		want := new(pb.FileDescriptorSet)
+		if err := proto.UnmarshalText(tt.fds, want); err != nil {
+			t.Fatalf("%s: Test failure parsing a wanted proto: %v", tt.name, err)
+		}
+		files, err := Files(want.File, nil)
+		if err != nil {
+			t.Errorf("%s: Files: %v", tt.name, err)
+			continue
+		}
+		got, err := gendesc.Generate(&ast.FileSet{Files: files})
+		if err != nil {
+			t.Errorf("%s: Generating FileDescriptorSet: %v", tt.name, err)
+			continue
+		}
+		if !proto.Equal(got, want) {
+			t.Errorf("%s: Mismatch!\nGot:\n%v\nWant:\n%v", tt.name, got, want)
+		}
+	}
+}
+
+func TestCustomOptions(t *testing.T) {
+	const descriptor = `package google.protobuf;
+message ServiceOptions { extensions 1000 to max; }
+message MethodOptions { extensions 1000 to max; }
+`
+	const src = `package d;
+import "google/protobuf/descriptor.proto";
+message Rule {
+  optional string get = 1;
+  optional double n = 2;
+  repeated int32 xs = 3;
+  optional Rule sub = 4;
+  optional E e = 5;
+}
+enum E { ZERO = 0; ONE = 1; }
+extend google.protobuf.ServiceOptions {
+  optional string tag = 50000;
+  optional sint32 level = 50001;
+}
+extend google.protobuf.MethodOptions {
+  optional Rule rule = 50000;
+}
+service S {
+  option (tag) = "svc";
+  option deprecated = true;
+  option (level) = -2;
+  rpc M(Rule) returns (Rule) {
+    option (rule) = { get: "/v1" n: 2.5 xs: 1 xs: 2 sub { e: ONE } };
+  }
+}
+`
+	fs, err := parser.ParseSource([]string{"d.proto"}, map[string][]byte{
+		"d.proto":                          []byte(src),
+		"google/protobuf/descriptor.proto": []byte(descriptor),
+	})
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	fds, err := gendesc.Generate(fs)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	dep, want := fs.Files[0], fds.File[1]
+	if want.GetName() != "d.proto" {
+		t.Fatalf("Files were generated in the wrong order: %v", fds.File)
+	}
+
+	files, err := Files([]*pb.FileDescriptorProto{want}, []*ast.File{dep})
+	if err != nil {
+		t.Fatalf("Files: %v", err)
+	}
+	wantOpts := [][2]string{{"(d.rule)", `{ get: "/v1" n: 2.5 xs: 1 xs: 2 sub { e: ONE } }`}}
+	if got := files[0].Services[0].Methods[0].Options; !reflect.DeepEqual(got, wantOpts) {
+		t.Errorf("Method options are %q, want %q", got, wantOpts)
+	}
+	got, err := gendesc.Generate(&ast.FileSet{Files: []*ast.File{dep, files[0]}})
+	if err != nil {
+		t.Fatalf("Generating FileDescriptorSet: %v", err)
+	}
+	if !proto.Equal(got.File[1], want) {
+		t.Errorf("Mismatch!\nGot:\n%v\nWant:\n%v", got.File[1], want)
+	}
+}
+
+func TestUnknownType(t *testing.T) {
+	fdp := &pb.FileDescriptorProto{
+		Name: proto.String("x.proto"),
+		MessageType: []*pb.DescriptorProto{{
+			Name: proto.String("X"),
+			Field: []*pb.FieldDescriptorProto{{
+				Name:     proto.String("y"),
+				Number:   proto.Int32(1),
+				Label:    pb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:     pb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+				TypeName: proto.String(".Y"),
+			}},
+		}},
+	}
+	if _, err := Files([]*pb.FileDescriptorProto{fdp}, nil); err == nil {
+		t.Errorf("Files succeeded with an unknown type")
+	}
+}
+
+func TestComments(t *testing.T) {
+	const src = `syntax = "proto3";
+
+package c;
+
+// Detached comment.
+
+// Leading comment.
+message M {
+  int32 a = 1; // trailing on a
+  // Leading on b.
+  int32 b = 2;
+}
+
+// An enum.
+enum E {
+  ZERO = 0; // zero
+}
+
+service S {
+  // A method.
+  rpc Call(.c.M) returns (.c.M);
+}
+`
+	fs, err := parser.ParseSource([]string{"c.proto"}, map[string][]byte{"c.proto": []byte(src)})
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	fds, err := gendesc.GenerateWithOptions(fs, gendesc.Options{SourceInfo: true})
+	if err != nil {
+		t.Fatalf("GenerateWithOptions: %v", err)
+	}
+	files, err := Files(fds.File, nil)
+	if err != nil {
+		t.Fatalf("Files: %v", err)
+	}
+	if got := string(printer.Format(files[0])); got != src {
+		t.Errorf("Comments not restored.\nGot:\n%s\nWant:\n%s", got, src)
+	}
+}
+
+func TestHeaderComment(t *testing.T) {
+	fdp := new(pb.FileDescriptorProto)
+	err := proto.UnmarshalText(`
+		name: "h.proto" package: "h" syntax: "proto3"
+		message_type { name: "M" }
+		source_code_info {
+		  location { path: 12 leading_detached_comments: " Copyright notice.\n" }
+		  location { path: 2 }
+		  location { path: [4, 0] leading_comments: " A message.\n" }
+		}`, fdp)
+	if err != nil {
+		t.Fatalf("Test failure parsing a descriptor: %v", err)
+	}
+	files, err := Files([]*pb.FileDescriptorProto{fdp}, nil)
+	if err != nil {
+		t.Fatalf("Files: %v", err)
+	}
+	const want = `// Copyright notice.
+
+syntax = "proto3";
+
+package h;
+
+// A message.
+message M {
+}
+`
+	if got := string(printer.Format(files[0])); got != want {
+		t.Errorf("Wrong output.\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
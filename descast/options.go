@@ -0,0 +1,168 @@
+package descast
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/dsymonds/gotoc/options"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// options converts opts, a pointer to one of the descriptor options messages
+// (e.g. *pb.FileOptions), into the key/value form used by the AST,
+// with values written as they would be in a .proto file.
+//
+// Standard options are named as in descriptor.proto; those named in skip
+// are left out, because the AST records them some other way. Message-valued
+// and repeated standard options are left out too, since they can't be written
+// as a single key/value pair. Uninterpreted options are kept as they are, and
+// custom options stored as extensions are written out if their declarations
+// are known to c.ext.
+func (c *converter) options(opts proto.Message, skip ...string) [][2]string {
+	v := reflect.ValueOf(opts)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil
+	}
+	v = v.Elem()
+	var kv [][2]string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := tagValue(t.Field(i), "name=")
+		f := v.Field(i)
+		if name == "" || f.Kind() != reflect.Ptr || f.IsNil() || contains(skip, name) {
+			continue
+		}
+		switch e := f.Elem(); e.Kind() {
+		case reflect.Bool:
+			kv = append(kv, [2]string{name, strconv.FormatBool(e.Bool())})
+		case reflect.String:
+			kv = append(kv, [2]string{name, strconv.Quote(e.String())})
+		case reflect.Int32, reflect.Int64:
+			if tagValue(t.Field(i), "enum=") != "" {
+				kv = append(kv, [2]string{name, e.Interface().(fmt.Stringer).String()})
+			} else {
+				kv = append(kv, [2]string{name, strconv.FormatInt(e.Int(), 10)})
+			}
+		case reflect.Uint32, reflect.Uint64:
+			kv = append(kv, [2]string{name, strconv.FormatUint(e.Uint(), 10)})
+		case reflect.Float32, reflect.Float64:
+			kv = append(kv, [2]string{name, formatFloat(e.Float())})
+		}
+	}
+
+	uos, _ := v.FieldByName("UninterpretedOption").Interface().([]*pb.UninterpretedOption)
+	for _, uo := range uos {
+		kv = append(kv, [2]string{uninterpretedName(uo), uninterpretedValue(uo)})
+	}
+
+	for _, name := range c.ext.Extensions(opts) {
+		x, ok := c.ext.Get(opts, "("+name+")")
+		if !ok {
+			continue
+		}
+		kv = append(kv, [2]string{"(" + name + ")", optionValue(x)})
+	}
+	return kv
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// tagValue returns the value of the part of the protobuf struct tag
+// of a generated struct field that starts with prefix (e.g. "name=").
+func tagValue(sf reflect.StructField, prefix string) string {
+	for _, part := range strings.Split(sf.Tag.Get("protobuf"), ",") {
+		if strings.HasPrefix(part, prefix) {
+			return part[len(prefix):]
+		}
+	}
+	return ""
+}
+
+// uninterpretedName returns the name of an uninterpreted option as written
+// in source, such as "(google.api.http).get".
+func uninterpretedName(uo *pb.UninterpretedOption) string {
+	var parts []string
+	for _, np := range uo.Name {
+		if np.GetIsExtension() {
+			parts = append(parts, "("+np.GetNamePart()+")")
+		} else {
+			parts = append(parts, np.GetNamePart())
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// uninterpretedValue returns the value of an uninterpreted option as written in source.
+func uninterpretedValue(uo *pb.UninterpretedOption) string {
+	switch {
+	case uo.IdentifierValue != nil:
+		return uo.GetIdentifierValue()
+	case uo.PositiveIntValue != nil:
+		return strconv.FormatUint(uo.GetPositiveIntValue(), 10)
+	case uo.NegativeIntValue != nil:
+		return strconv.FormatInt(uo.GetNegativeIntValue(), 10)
+	case uo.DoubleValue != nil:
+		return formatFloat(uo.GetDoubleValue())
+	case uo.StringValue != nil:
+		return strconv.Quote(string(uo.StringValue))
+	case uo.AggregateValue != nil:
+		return aggregate(uo.GetAggregateValue())
+	}
+	return ""
+}
+
+// optionValue returns a value found by options.Resolver as written in source.
+func optionValue(x interface{}) string {
+	switch x := x.(type) {
+	case options.Identifier:
+		return string(x)
+	case options.Aggregate:
+		return aggregate(string(x))
+	case string:
+		return strconv.Quote(x)
+	case uint64:
+		return strconv.FormatUint(x, 10)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return formatFloat(x)
+	}
+	return fmt.Sprint(x)
+}
+
+// aggregate returns a message literal, given its contents.
+func aggregate(s string) string {
+	if s == "" {
+		return "{ }"
+	}
+	return "{ " + s + " }"
+}
+
+// formatFloat formats x so that it reads back as a floating-point number,
+// rather than an integer.
+func formatFloat(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "inf"
+	case math.IsInf(x, -1):
+		return "-inf"
+	case math.IsNaN(x):
+		return "nan"
+	}
+	s := strconv.FormatFloat(x, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
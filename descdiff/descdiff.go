@@ -0,0 +1,209 @@
+/*
+Package descdiff reports the differences between two descriptor sets.
+
+Files are matched by name. Each file that differs is shown as a line diff
+of its text format, so the report points at the exact fields that changed.
+*/
+package descdiff
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// context is the number of unchanged lines shown around each change.
+const context = 2
+
+// Diff returns a report of the differences between old and new,
+// or the empty string if they are the same.
+func Diff(old, new *pb.FileDescriptorSet) string {
+	i := 0
+	d, _ := Stream(func() (*pb.FileDescriptorProto, error) {
+		if i == len(old.File) {
+			return nil, io.EOF
+		}
+		i++
+		return old.File[i-1], nil
+	}, new)
+	return d
+}
+
+// Stream is like Diff, but reads the old set a file at a time from next,
+// which returns io.EOF after the last file. Each old file is dropped once it
+// has been compared, so only the new set need be held in memory.
+// An error from next other than io.EOF is returned.
+func Stream(next func() (*pb.FileDescriptorProto, error), new *pb.FileDescriptorSet) (string, error) {
+	var b strings.Builder
+	newFiles := index(new)
+	var oldNames []string
+	seen := make(map[string]bool)
+	for {
+		fd, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		name := fd.GetName()
+		oldNames = append(oldNames, name)
+		seen[name] = true
+		nfd, ok := newFiles[name]
+		if !ok {
+			fmt.Fprintf(&b, "file %q removed\n", name)
+			continue
+		}
+		if !proto.Equal(fd, nfd) {
+			fmt.Fprintf(&b, "file %q changed:\n", name)
+			b.WriteString(Lines(proto.MarshalTextString(fd), proto.MarshalTextString(nfd)))
+		}
+	}
+	for _, fd := range new.File {
+		if !seen[fd.GetName()] {
+			fmt.Fprintf(&b, "file %q added\n", fd.GetName())
+		}
+	}
+	if b.Len() == 0 && !sameOrder(oldNames, new) {
+		// The only difference is the order of the files.
+		fmt.Fprintf(&b, "file order changed: was %v, now %v\n", oldNames, names(new))
+	}
+	return b.String(), nil
+}
+
+func index(fds *pb.FileDescriptorSet) map[string]*pb.FileDescriptorProto {
+	m := make(map[string]*pb.FileDescriptorProto)
+	for _, fd := range fds.File {
+		m[fd.GetName()] = fd
+	}
+	return m
+}
+
+func sameOrder(a []string, b *pb.FileDescriptorSet) bool {
+	if len(a) != len(b.File) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b.File[i].GetName() {
+			return false
+		}
+	}
+	return true
+}
+
+func names(fds *pb.FileDescriptorSet) []string {
+	var s []string
+	for _, fd := range fds.File {
+		s = append(s, fd.GetName())
+	}
+	return s
+}
+
+// Lines returns a line diff of a and b in the style of a unified diff,
+// with "-" marking lines only in a and "+" marking lines only in b.
+func Lines(a, b string) string {
+	al, bl := splitLines(a), splitLines(b)
+
+	// Trim the common prefix and suffix, which is usually most of the
+	// input, to keep the quadratic part small.
+	pre := 0
+	for pre < len(al) && pre < len(bl) && al[pre] == bl[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(al)-pre && suf < len(bl)-pre && al[len(al)-1-suf] == bl[len(bl)-1-suf] {
+		suf++
+	}
+	ops := lcsOps(al[pre:len(al)-suf], bl[pre:len(bl)-suf])
+
+	// Add back the common lines, then print the changes with context.
+	var all []op
+	for _, l := range al[:pre] {
+		all = append(all, op{' ', l})
+	}
+	all = append(all, ops...)
+	for _, l := range al[len(al)-suf:] {
+		all = append(all, op{' ', l})
+	}
+	show := make([]bool, len(all))
+	for i, o := range all {
+		if o.kind == ' ' {
+			continue
+		}
+		for j := i - context; j <= i+context; j++ {
+			if j >= 0 && j < len(all) {
+				show[j] = true
+			}
+		}
+	}
+	var out strings.Builder
+	for i, o := range all {
+		if !show[i] {
+			continue
+		}
+		if i > 0 && !show[i-1] {
+			out.WriteString("@@\n")
+		}
+		fmt.Fprintf(&out, "%c %s\n", o.kind, o.line)
+	}
+	return out.String()
+}
+
+type op struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// lcsOps returns the edits turning a into b, via a longest common subsequence.
+func lcsOps(a, b []string) []op {
+	// n[i][j] is the length of the LCS of a[i:] and b[j:].
+	n := make([][]int, len(a)+1)
+	for i := range n {
+		n[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				n[i][j] = n[i+1][j+1] + 1
+			} else if n[i+1][j] >= n[i][j+1] {
+				n[i][j] = n[i+1][j]
+			} else {
+				n[i][j] = n[i][j+1]
+			}
+		}
+	}
+	var ops []op
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, op{' ', a[i]})
+			i++
+			j++
+		case n[i+1][j] >= n[i][j+1]:
+			ops = append(ops, op{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, op{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, op{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, op{'+', b[j]})
+	}
+	return ops
+}
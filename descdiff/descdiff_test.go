@@ -0,0 +1,84 @@
+package descdiff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+const baseSet = `
+file: <
+  name: "a.proto"
+  package: "a"
+  message_type: <
+    name: "M"
+    field: < name: "x" number: 1 label: LABEL_OPTIONAL type: TYPE_INT32 >
+    field: < name: "y" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING >
+  >
+>
+file: <
+  name: "b.proto"
+  package: "b"
+>
+`
+
+func mustParse(t *testing.T, s string) *pb.FileDescriptorSet {
+	fds := new(pb.FileDescriptorSet)
+	if err := proto.UnmarshalText(s, fds); err != nil {
+		t.Fatalf("Bad test set: %v", err)
+	}
+	return fds
+}
+
+func TestDiffSame(t *testing.T) {
+	a, b := mustParse(t, baseSet), mustParse(t, baseSet)
+	if d := Diff(a, b); d != "" {
+		t.Errorf("Diff of equal sets = %q, want empty", d)
+	}
+}
+
+func TestDiffChanged(t *testing.T) {
+	old := mustParse(t, baseSet)
+	new := mustParse(t, baseSet)
+	new.File[0].MessageType[0].Field[1].Type = pb.FieldDescriptorProto_TYPE_BYTES.Enum()
+	new.File = append(new.File[:1], &pb.FileDescriptorProto{Name: proto.String("c.proto")})
+
+	d := Diff(old, new)
+	for _, want := range []string{
+		`file "b.proto" removed`,
+		`file "c.proto" added`,
+		`file "a.proto" changed:`,
+	} {
+		if !strings.Contains(d, want) {
+			t.Errorf("Diff is missing %q; got:\n%s", want, d)
+		}
+	}
+	var removed, added bool
+	for _, line := range strings.Split(d, "\n") {
+		removed = removed || strings.HasPrefix(line, "- ") && strings.Contains(line, "TYPE_STRING")
+		added = added || strings.HasPrefix(line, "+ ") && strings.Contains(line, "TYPE_BYTES")
+	}
+	if !removed || !added {
+		t.Errorf("Diff doesn't show the type change; got:\n%s", d)
+	}
+}
+
+func TestDiffOrder(t *testing.T) {
+	old := mustParse(t, baseSet)
+	new := mustParse(t, baseSet)
+	new.File[0], new.File[1] = new.File[1], new.File[0]
+	if d := Diff(old, new); !strings.Contains(d, "file order changed") {
+		t.Errorf("Diff = %q, want a file order change", d)
+	}
+}
+
+func TestLines(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n"
+	b := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n"
+	want := "@@\n  3\n  4\n- 5\n+ five\n  6\n  7\n"
+	if got := Lines(a, b); got != want {
+		t.Errorf("Lines =\n%s\nwant\n%s", got, want)
+	}
+}
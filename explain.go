@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dsymonds/gotoc/ast"
+)
+
+// explainImports prints, for every file pulled into the compilation of
+// the named files, the shortest chain of imports that caused it to be included.
+// Public imports are shown as "=>", and other imports as "->".
+func explainImports(filenames []string) {
+	if len(filenames) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	fs, names := parseFiles(filenames)
+	for _, line := range importChains(fs, names) {
+		fmt.Println(line)
+	}
+}
+
+// importChains returns a line for each file in fs, in breadth-first order
+// from the roots, explaining how it was reached.
+func importChains(fs *ast.FileSet, roots []string) []string {
+	byName := make(map[string]*ast.File)
+	for _, f := range fs.Files {
+		byName[f.Name] = f
+	}
+
+	type reason struct {
+		from   string // importing file; empty for roots
+		public bool
+	}
+	reasons := make(map[string]reason)
+	var order []string
+	for _, name := range roots {
+		if _, ok := reasons[name]; !ok {
+			reasons[name] = reason{}
+			order = append(order, name)
+		}
+	}
+	for i := 0; i < len(order); i++ {
+		f := byName[order[i]]
+		if f == nil {
+			continue
+		}
+		public := make(map[int]bool)
+		for _, j := range f.PublicImports {
+			public[j] = true
+		}
+		for j, imp := range f.Imports {
+			if _, ok := reasons[imp]; ok {
+				continue
+			}
+			reasons[imp] = reason{from: f.Name, public: public[j]}
+			order = append(order, imp)
+		}
+	}
+
+	var lines []string
+	for _, name := range order {
+		r := reasons[name]
+		if r.from == "" {
+			lines = append(lines, name+": (input)")
+			continue
+		}
+		// Walk back to the root, building the chain in reverse.
+		chain := []string{name}
+		for n := name; reasons[n].from != ""; n = reasons[n].from {
+			arrow := " -> "
+			if reasons[n].public {
+				arrow = " => "
+			}
+			chain = append(chain, arrow, reasons[n].from)
+		}
+		for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+			chain[i], chain[j] = chain[j], chain[i]
+		}
+		line := name + ": " + strings.Join(chain, "")
+		if r.public {
+			line += " (public)"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
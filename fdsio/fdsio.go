@@ -0,0 +1,243 @@
+/*
+Package fdsio reads and writes serialized FileDescriptorSets one file at a time.
+
+A FileDescriptorSet is encoded as a sequence of length-prefixed
+FileDescriptorProtos, so a set can be written as each file becomes
+available, and read back without holding the whole set in memory.
+The output of Writer is an ordinary FileDescriptorSet, and Reader
+accepts any FileDescriptorSet, however it was written.
+*/
+package fdsio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Field numbers and wire types used in the encoding.
+const (
+	fileField = 1 // FileDescriptorSet.file
+	nameField = 1 // FileDescriptorProto.name
+
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// maxLength is the largest length of a field that Reader accepts.
+// Encoded protocol buffers are limited to 2GB.
+const maxLength = 1<<31 - 1
+
+// Writer writes a FileDescriptorSet incrementally.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter returns a Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write appends a file to the set.
+func (w *Writer) Write(fd *pb.FileDescriptorProto) error {
+	raw, err := proto.Marshal(fd)
+	if err != nil {
+		return fmt.Errorf("encoding %s: %v", fd.GetName(), err)
+	}
+	return w.WriteRaw(raw)
+}
+
+// WriteRaw appends an already serialized FileDescriptorProto to the set.
+func (w *Writer) WriteRaw(raw []byte) error {
+	w.buf = appendVarint(w.buf[:0], fileField<<3|wireBytes)
+	w.buf = appendVarint(w.buf, uint64(len(raw)))
+	if _, err := w.w.Write(w.buf); err != nil {
+		return err
+	}
+	_, err := w.w.Write(raw)
+	return err
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(b, tmp[:n]...)
+}
+
+// Reader reads the files of a FileDescriptorSet one at a time.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader returns a Reader that reads from r.
+func NewReader(r io.Reader) *Reader {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &Reader{r: br}
+	}
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Entry is a single file read from a set, not yet decoded.
+type Entry struct {
+	Raw []byte // the serialized FileDescriptorProto
+}
+
+// Name returns the file's name, without decoding the rest of the file.
+func (e *Entry) Name() (string, error) {
+	b := e.Raw
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return "", errors.New("bad field key")
+		}
+		b = b[n:]
+		if key == nameField<<3|wireBytes {
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return "", errors.New("bad name field")
+			}
+			return string(b[n : n+int(l)]), nil
+		}
+		skip, err := fieldLen(b, int(key&7))
+		if err != nil {
+			return "", err
+		}
+		b = b[skip:]
+	}
+	return "", nil
+}
+
+// Decode returns the decoded file.
+func (e *Entry) Decode() (*pb.FileDescriptorProto, error) {
+	fd := new(pb.FileDescriptorProto)
+	if err := proto.Unmarshal(e.Raw, fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// fieldLen returns the length of the encoded value at the start of b.
+func fieldLen(b []byte, wire int) (int, error) {
+	switch wire {
+	case wireVarint:
+		_, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, errors.New("bad varint")
+		}
+		return n, nil
+	case wireFixed64:
+		if len(b) < 8 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 8, nil
+	case wireFixed32:
+		if len(b) < 4 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 4, nil
+	case wireBytes:
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return 0, errors.New("bad length-delimited field")
+		}
+		return n + int(l), nil
+	}
+	return 0, fmt.Errorf("unsupported wire type %d", wire)
+}
+
+// Next returns the next file in the set, or io.EOF if there are no more.
+func (r *Reader) Next() (*Entry, error) {
+	for {
+		key, err := binary.ReadUvarint(r.r)
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading field key: %v", noEOF(err))
+		}
+		wire := int(key & 7)
+		if key>>3 == fileField && wire == wireBytes {
+			l, err := binary.ReadUvarint(r.r)
+			if err != nil {
+				return nil, fmt.Errorf("reading file length: %v", noEOF(err))
+			}
+			if l > maxLength {
+				return nil, fmt.Errorf("file length %d is too large", l)
+			}
+			// The length can't be trusted until the data has been read,
+			// so let the buffer grow rather than allocating it all at once.
+			var buf bytes.Buffer
+			if _, err := io.CopyN(&buf, r.r, int64(l)); err != nil {
+				return nil, fmt.Errorf("reading file: %v", noEOF(err))
+			}
+			return &Entry{Raw: buf.Bytes()}, nil
+		}
+		// Skip unknown fields.
+		if err := r.skip(wire); err != nil {
+			return nil, fmt.Errorf("skipping field %d: %v", key>>3, noEOF(err))
+		}
+	}
+}
+
+func (r *Reader) skip(wire int) error {
+	var n uint64
+	switch wire {
+	case wireVarint:
+		_, err := binary.ReadUvarint(r.r)
+		return err
+	case wireFixed64:
+		n = 8
+	case wireFixed32:
+		n = 4
+	case wireBytes:
+		l, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return err
+		}
+		if l > maxLength {
+			return fmt.Errorf("length %d is too large", l)
+		}
+		n = l
+	default:
+		return fmt.Errorf("unsupported wire type %d", wire)
+	}
+	_, err := io.CopyN(ioutil.Discard, r.r, int64(n))
+	return err
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for truncation part-way through a field.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadAll reads every file from r into a FileDescriptorSet.
+func ReadAll(r *Reader) (*pb.FileDescriptorSet, error) {
+	fds := new(pb.FileDescriptorSet)
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return fds, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		fd, err := e.Decode()
+		if err != nil {
+			return nil, err
+		}
+		fds.File = append(fds.File, fd)
+	}
+}
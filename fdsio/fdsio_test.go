@@ -0,0 +1,106 @@
+package fdsio
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// rawFile returns a serialized FileDescriptorProto with the given name and package.
+// The package comes first, to check that Name skips over other fields.
+func rawFile(name, pkg string) []byte {
+	var b []byte
+	b = append(b, 2<<3|wireBytes, byte(len(pkg)))
+	b = append(b, pkg...)
+	b = append(b, nameField<<3|wireBytes, byte(len(name)))
+	b = append(b, name...)
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	files := [][]byte{
+		rawFile("a.proto", "a"),
+		rawFile("b/c.proto", "b.c"),
+		rawFile("d.proto", ""),
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, f := range files {
+		if err := w.WriteRaw(f); err != nil {
+			t.Fatalf("WriteRaw: %v", err)
+		}
+	}
+
+	r := NewReader(&buf)
+	for i, want := range []string{"a.proto", "b/c.proto", "d.proto"} {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next #%d: %v", i, err)
+		}
+		if !bytes.Equal(e.Raw, files[i]) {
+			t.Errorf("File #%d = %q, want %q", i, e.Raw, files[i])
+		}
+		name, err := e.Name()
+		if err != nil {
+			t.Errorf("Name #%d: %v", i, err)
+		} else if name != want {
+			t.Errorf("Name #%d = %q, want %q", i, name, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next at end returned %v, want io.EOF", err)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	var b []byte
+	b = append(b, 5<<3|wireVarint, 0x96, 0x01)
+	b = append(b, 6<<3|wireFixed32, 1, 2, 3, 4)
+	f := rawFile("x.proto", "x")
+	b = append(b, fileField<<3|wireBytes, byte(len(f)))
+	b = append(b, f...)
+	b = append(b, 7<<3|wireBytes, 2, 'h', 'i')
+
+	r := NewReader(bytes.NewReader(b))
+	e, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if !bytes.Equal(e.Raw, f) {
+		t.Errorf("File = %q, want %q", e.Raw, f)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next at end returned %v, want io.EOF", err)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewWriter(&buf).WriteRaw(rawFile("a.proto", "a")); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	r := NewReader(bytes.NewReader(b[:len(b)-3]))
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Errorf("Next on truncated input returned %v, want an error", err)
+	}
+}
+
+func TestBadLength(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		// A length far beyond the input, which must not be allocated up front.
+		{"Truncated", append([]byte{fileField<<3 | wireBytes}, appendVarint(nil, 1<<30)...), "unexpected EOF"},
+		{"Oversized", append([]byte{fileField<<3 | wireBytes}, appendVarint(nil, 1<<40)...), "too large"},
+		{"OversizedUnknown", append([]byte{2<<3 | wireBytes}, appendVarint(nil, 1<<63)...), "too large"},
+	} {
+		_, err := NewReader(bytes.NewReader(tt.input)).Next()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Next returned %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Package fingerprint computes canonical hashes of messages, enums and services.
+
+A fingerprint covers everything that affects a type's encoding: for a
+message, its fields' names, numbers, labels, types and oneofs, and the
+fingerprints of the message and enum types they refer to. Comments,
+formatting, declaration order and options other than packed are ignored,
+so two versions of a schema with equal fingerprints are wire-identical.
+*/
+package fingerprint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Compute returns the fingerprint of every message, enum and service in fds,
+// keyed by fully-qualified name (without a leading dot).
+func Compute(fds *pb.FileDescriptorSet) map[string]string {
+	c := &computer{
+		msgs:  make(map[string]*pb.DescriptorProto),
+		enums: make(map[string]*pb.EnumDescriptorProto),
+		done:  make(map[string]string),
+
+		index:   make(map[string]int),
+		lowlink: make(map[string]int),
+		onStack: make(map[string]bool),
+	}
+	var services []string
+	srvs := make(map[string]*pb.ServiceDescriptorProto)
+	for _, fd := range fds.File {
+		prefix := ""
+		if fd.GetPackage() != "" {
+			prefix = "." + fd.GetPackage()
+		}
+		c.add(prefix, fd.MessageType, fd.EnumType)
+		for _, srv := range fd.Service {
+			name := prefix + "." + srv.GetName()
+			services = append(services, name)
+			srvs[name] = srv
+		}
+	}
+
+	// Hash the messages a strongly connected component at a time, so that
+	// every component is hashed once, after the components it refers to.
+	names := make([]string, 0, len(c.msgs))
+	for name := range c.msgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := c.index[name]; !ok {
+			c.connect(name)
+		}
+	}
+
+	fps := make(map[string]string)
+	for name := range c.msgs {
+		fps[name[1:]] = c.typeHash(name, nil)
+	}
+	for name := range c.enums {
+		fps[name[1:]] = c.typeHash(name, nil)
+	}
+	for _, name := range services {
+		fps[name[1:]] = hash(c.service(srvs[name]))
+	}
+	return fps
+}
+
+type computer struct {
+	msgs  map[string]*pb.DescriptorProto // keyed by fully-qualified name with a leading dot
+	enums map[string]*pb.EnumDescriptorProto
+	done  map[string]string // fingerprints of the types hashed so far
+
+	// State for Tarjan's strongly connected components algorithm.
+	index, lowlink map[string]int
+	onStack        map[string]bool
+	stack          []string
+}
+
+func (c *computer) add(prefix string, msgs []*pb.DescriptorProto, enums []*pb.EnumDescriptorProto) {
+	for _, msg := range msgs {
+		name := prefix + "." + msg.GetName()
+		c.msgs[name] = msg
+		c.add(name, msg.NestedType, msg.EnumType)
+	}
+	for _, enum := range enums {
+		c.enums[prefix+"."+enum.GetName()] = enum
+	}
+}
+
+// connect visits the named message, as in Tarjan's algorithm, and hashes
+// each strongly connected component as it is found. Components are found
+// after every component they refer to, so those are always already hashed.
+func (c *computer) connect(name string) {
+	c.index[name] = len(c.index)
+	c.lowlink[name] = c.index[name]
+	c.stack = append(c.stack, name)
+	c.onStack[name] = true
+
+	for _, f := range c.msgs[name].Field {
+		t := f.GetTypeName()
+		if _, ok := c.msgs[t]; !ok {
+			continue
+		}
+		if _, ok := c.index[t]; !ok {
+			c.connect(t)
+			if c.lowlink[t] < c.lowlink[name] {
+				c.lowlink[name] = c.lowlink[t]
+			}
+		} else if c.onStack[t] && c.index[t] < c.lowlink[name] {
+			c.lowlink[name] = c.index[t]
+		}
+	}
+	if c.lowlink[name] != c.index[name] {
+		return
+	}
+
+	comp := make(map[string]bool)
+	for {
+		n := c.stack[len(c.stack)-1]
+		c.stack = c.stack[:len(c.stack)-1]
+		c.onStack[n] = false
+		comp[n] = true
+		if n == name {
+			break
+		}
+	}
+	c.hashComponent(comp)
+}
+
+// hashComponent computes the fingerprints of the messages in a strongly
+// connected component. A message that is not part of a cycle is hashed on
+// its own. Otherwise the members are hashed together, in order of name,
+// with references between them represented by name to end the cycle;
+// each member's fingerprint is then derived from that and its own name.
+func (c *computer) hashComponent(comp map[string]bool) {
+	if len(comp) == 1 {
+		for name := range comp {
+			if !c.refersTo(name, name) {
+				c.done[name] = hash(c.message(c.msgs[name], nil))
+				return
+			}
+		}
+	}
+	members := make([]string, 0, len(comp))
+	for name := range comp {
+		members = append(members, name)
+	}
+	sort.Strings(members)
+	var b strings.Builder
+	for _, name := range members {
+		fmt.Fprintf(&b, "member %s\n%s", name, c.message(c.msgs[name], comp))
+	}
+	h := hash(b.String())
+	for _, name := range members {
+		c.done[name] = hash("cycle " + h + " " + name)
+	}
+}
+
+// refersTo reports whether message from has a field of type to.
+func (c *computer) refersTo(from, to string) bool {
+	for _, f := range c.msgs[from].Field {
+		if f.GetTypeName() == to {
+			return true
+		}
+	}
+	return false
+}
+
+// typeHash returns the fingerprint of the named type. A reference to one
+// of the messages in comp, the component being hashed, is represented by its name.
+func (c *computer) typeHash(name string, comp map[string]bool) string {
+	if comp[name] {
+		return "cycle " + name
+	}
+	if h, ok := c.done[name]; ok {
+		return h
+	}
+	if enum, ok := c.enums[name]; ok {
+		h := hash(canonicalEnum(enum))
+		c.done[name] = h
+		return h
+	}
+	// Not in this set; all that's known is its name.
+	return "unknown " + name
+}
+
+func (c *computer) message(msg *pb.DescriptorProto, comp map[string]bool) string {
+	fields := append([]*pb.FieldDescriptorProto(nil), msg.Field...)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].GetNumber() < fields[j].GetNumber() })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "message\n")
+	if msg.GetOptions().GetMapEntry() {
+		fmt.Fprintf(&b, "map_entry\n")
+	}
+	for _, f := range fields {
+		fmt.Fprintf(&b, "field %d %s %s %s", f.GetNumber(), f.GetName(), f.GetLabel(), f.GetType())
+		if t := f.GetTypeName(); t != "" {
+			fmt.Fprintf(&b, " %s", c.typeHash(t, comp))
+		}
+		if f.OneofIndex != nil {
+			fmt.Fprintf(&b, " oneof %s", msg.OneofDecl[f.GetOneofIndex()].GetName())
+		}
+		if f.GetOptions().GetPacked() {
+			fmt.Fprintf(&b, " packed")
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	return b.String()
+}
+
+func canonicalEnum(enum *pb.EnumDescriptorProto) string {
+	values := append([]*pb.EnumValueDescriptorProto(nil), enum.Value...)
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].GetNumber() != values[j].GetNumber() {
+			return values[i].GetNumber() < values[j].GetNumber()
+		}
+		return values[i].GetName() < values[j].GetName()
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "enum\n")
+	for _, v := range values {
+		fmt.Fprintf(&b, "value %d %s\n", v.GetNumber(), v.GetName())
+	}
+	return b.String()
+}
+
+func (c *computer) service(srv *pb.ServiceDescriptorProto) string {
+	methods := append([]*pb.MethodDescriptorProto(nil), srv.Method...)
+	sort.Slice(methods, func(i, j int) bool { return methods[i].GetName() < methods[j].GetName() })
+	var b strings.Builder
+	fmt.Fprintf(&b, "service\n")
+	for _, m := range methods {
+		fmt.Fprintf(&b, "method %s %s %s", m.GetName(), c.typeHash(m.GetInputType(), nil), c.typeHash(m.GetOutputType(), nil))
+		if m.GetClientStreaming() {
+			fmt.Fprintf(&b, " client_streaming")
+		}
+		if m.GetServerStreaming() {
+			fmt.Fprintf(&b, " server_streaming")
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	return b.String()
+}
+
+func hash(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,153 @@
+package fingerprint
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+const base = `
+file: <
+  name: "a.proto"
+  package: "a"
+  message_type: <
+    name: "M"
+    field: < name: "x" number: 1 label: LABEL_OPTIONAL type: TYPE_INT32 >
+    field: < name: "e" number: 2 label: LABEL_OPTIONAL type: TYPE_ENUM type_name: ".a.E" >
+    field: < name: "self" number: 3 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".a.M" >
+  >
+  message_type: <
+    name: "Wrapper"
+    field: < name: "m" number: 1 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".a.M" >
+  >
+  enum_type: < name: "E" value: < name: "A" number: 0 > value: < name: "B" number: 1 > >
+  service: < name: "S" method: < name: "Do" input_type: ".a.M" output_type: ".a.Wrapper" > >
+>
+`
+
+// Equivalent to base, but with declarations in a different order and with comments.
+const reordered = `
+file: <
+  name: "a.proto"
+  package: "a"
+  enum_type: < name: "E" value: < name: "B" number: 1 > value: < name: "A" number: 0 > >
+  message_type: <
+    name: "Wrapper"
+    field: < name: "m" number: 1 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".a.M" >
+  >
+  message_type: <
+    name: "M"
+    field: < name: "self" number: 3 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".a.M" >
+    field: < name: "e" number: 2 label: LABEL_OPTIONAL type: TYPE_ENUM type_name: ".a.E" >
+    field: < name: "x" number: 1 label: LABEL_OPTIONAL type: TYPE_INT32 >
+  >
+  service: < name: "S" method: < name: "Do" input_type: ".a.M" output_type: ".a.Wrapper" > >
+  source_code_info: < location: < path: 4 path: 0 span: 1 span: 0 span: 10 leading_comments: " Hi.\n" > >
+>
+`
+
+// Like base, but with a new enum value.
+const changed = `
+file: <
+  name: "a.proto"
+  package: "a"
+  message_type: <
+    name: "M"
+    field: < name: "x" number: 1 label: LABEL_OPTIONAL type: TYPE_INT32 >
+    field: < name: "e" number: 2 label: LABEL_OPTIONAL type: TYPE_ENUM type_name: ".a.E" >
+    field: < name: "self" number: 3 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".a.M" >
+  >
+  message_type: <
+    name: "Wrapper"
+    field: < name: "m" number: 1 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".a.M" >
+  >
+  enum_type: < name: "E" value: < name: "A" number: 0 > value: < name: "B" number: 1 > value: < name: "C" number: 2 > >
+  service: < name: "S" method: < name: "Do" input_type: ".a.M" output_type: ".a.Wrapper" > >
+>
+`
+
+func compute(t *testing.T, text string) map[string]string {
+	fds := new(pb.FileDescriptorSet)
+	if err := proto.UnmarshalText(text, fds); err != nil {
+		t.Fatalf("Bad test input: %v", err)
+	}
+	return Compute(fds)
+}
+
+func TestCompute(t *testing.T) {
+	a, b, c := compute(t, base), compute(t, reordered), compute(t, changed)
+	names := []string{"a.M", "a.Wrapper", "a.E", "a.S"}
+	for _, name := range names {
+		if a[name] == "" {
+			t.Errorf("No fingerprint for %s", name)
+		}
+		if a[name] != b[name] {
+			t.Errorf("Fingerprint of %s changed when declarations were reordered", name)
+		}
+		// The enum change affects every type, since they all refer to it.
+		if a[name] == c[name] {
+			t.Errorf("Fingerprint of %s did not change when an enum it depends on changed", name)
+		}
+	}
+	if len(a) != len(names) {
+		t.Errorf("Got %d fingerprints, want %d", len(a), len(names))
+	}
+}
+
+// cycles returns a file with n messages that each refer to all the others.
+func cycles(n int) *pb.FileDescriptorSet {
+	fd := &pb.FileDescriptorProto{Name: proto.String("c.proto"), Package: proto.String("c")}
+	for i := 0; i < n; i++ {
+		msg := &pb.DescriptorProto{Name: proto.String(fmt.Sprintf("M%d", i))}
+		for j := 0; j < n; j++ {
+			msg.Field = append(msg.Field, &pb.FieldDescriptorProto{
+				Name:     proto.String(fmt.Sprintf("m%d", j)),
+				Number:   proto.Int32(int32(j + 1)),
+				Label:    pb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:     pb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+				TypeName: proto.String(fmt.Sprintf(".c.M%d", j)),
+			})
+		}
+		fd.MessageType = append(fd.MessageType, msg)
+	}
+	return &pb.FileDescriptorSet{File: []*pb.FileDescriptorProto{fd}}
+}
+
+func TestCycles(t *testing.T) {
+	// Would take far too long if each cycle were walked from every message.
+	fds := cycles(50)
+	fps := Compute(fds)
+	seen := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("c.M%d", i)
+		fp := fps[name]
+		if fp == "" {
+			t.Fatalf("No fingerprint for %s", name)
+		}
+		if other, ok := seen[fp]; ok {
+			t.Errorf("%s and %s have the same fingerprint", other, name)
+		}
+		seen[fp] = name
+	}
+
+	// Declaration order doesn't matter within a cycle either.
+	msgs := fds.File[0].MessageType
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	for name, fp := range Compute(fds) {
+		if fps[name] != fp {
+			t.Errorf("Fingerprint of %s changed when declarations were reordered", name)
+		}
+	}
+
+	// A change to one message in a cycle changes them all.
+	msgs[0].Field[0].Name = proto.String("renamed")
+	for name, fp := range Compute(fds) {
+		if fps[name] == fp {
+			t.Errorf("Fingerprint of %s did not change when a message in its cycle changed", name)
+		}
+	}
+}
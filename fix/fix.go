@@ -0,0 +1,345 @@
+/*
+Package fix makes mechanical improvements to .proto files.
+
+The fixes are those that can be made without judgement:
+  - a missing syntax statement is added, making the implicit proto2 explicit;
+  - proto2 fields without a label are given the implicit "optional";
+  - enum zero values are renamed to ENUM_NAME_UNSPECIFIED;
+  - imports that provide nothing to the file are removed.
+
+Fixes are made to the AST, which can then be written out with package printer.
+Renaming an enum value updates the field defaults that refer to it, so an enum
+is left alone if a field in another file of the FileSet has it as its type,
+or if it is the type of an extension, since option values are not resolved.
+Files outside the FileSet, such as those that import the fixed file, are not seen.
+*/
+package fix
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/dsymonds/gotoc/ast"
+)
+
+// A Change describes a fix made to a file.
+type Change struct {
+	Line    int // 1-based, or 0 if the change isn't on a particular line
+	Message string
+}
+
+// File fixes f, which must be in fs with its types resolved,
+// and returns the changes made. src is the source that f was parsed from.
+func File(fs *ast.FileSet, f *ast.File, src []byte) []Change {
+	fx := &fixer{fs: fs, f: f, src: src}
+	fx.labels()
+	fx.syntax()
+	fx.enumZeroValues()
+	fx.unusedImports()
+	return fx.changes
+}
+
+type fixer struct {
+	fs      *ast.FileSet
+	f       *ast.File
+	src     []byte
+	changes []Change
+}
+
+func (fx *fixer) changef(pos ast.Position, format string, args ...interface{}) {
+	fx.changes = append(fx.changes, Change{Line: pos.Line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (fx *fixer) syntax() {
+	if fx.f.Syntax == "" {
+		fx.f.Syntax = "proto2"
+		fx.changef(ast.Position{}, `added syntax = "proto2"`)
+	}
+}
+
+// labels reports the proto2 fields that have no label.
+// The printer writes "optional" for them.
+func (fx *fixer) labels() {
+	if fx.f.Syntax == "proto3" {
+		return
+	}
+	fx.eachField(func(f *ast.Field) {
+		if f.Required || f.Repeated || f.Oneof != nil || f.KeyTypeName != "" {
+			return
+		}
+		if off := f.Position.Offset; off < len(fx.src) && !bytes.HasPrefix(fx.src[off:], []byte("optional")) {
+			fx.changef(f.Position, "added optional label to field %s", f.Name)
+		}
+	})
+}
+
+// enumZeroValues renames each enum's zero value to ENUM_NAME_UNSPECIFIED,
+// unless it already ends in "_UNSPECIFIED", the new name is taken,
+// or the enum may be referred to where the new name can't be written.
+func (fx *fixer) enumZeroValues() {
+	shared := fx.sharedEnums()
+	// Enum values are scoped as siblings of their enum,
+	// so a new name must be unique among those of all enums in the scope.
+	fix := func(enums []*ast.Enum) {
+		taken := make(map[string]bool)
+		for _, enum := range enums {
+			for _, v := range enum.Values {
+				taken[v.Name] = true
+			}
+		}
+		for _, enum := range enums {
+			if shared[enum] {
+				continue
+			}
+			for _, v := range enum.Values {
+				if v.Number != 0 || strings.HasSuffix(v.Name, "_UNSPECIFIED") {
+					continue
+				}
+				name := upperSnake(enum.Name) + "_UNSPECIFIED"
+				if taken[name] {
+					continue
+				}
+				fx.changef(v.Position, "renamed enum value %s to %s", v.Name, name)
+				fx.renameDefaults(enum, v.Name, name)
+				taken[name] = true
+				v.Name = name
+			}
+		}
+	}
+	var msg func(m *ast.Message)
+	msg = func(m *ast.Message) {
+		fix(m.Enums)
+		for _, nm := range m.Messages {
+			msg(nm)
+		}
+	}
+	fix(fx.f.Enums)
+	for _, m := range fx.f.Messages {
+		msg(m)
+	}
+}
+
+// sharedEnums returns the enums that are the types of fields in files
+// other than fx.f, or of extensions in any file.
+func (fx *fixer) sharedEnums() map[*ast.Enum]bool {
+	shared := make(map[*ast.Enum]bool)
+	for _, f := range fx.fs.Files {
+		eachField(f, func(fld *ast.Field) {
+			enum, ok := fld.Type.(*ast.Enum)
+			if !ok {
+				return
+			}
+			if _, isExt := fld.Up.(*ast.Extension); isExt || f != fx.f {
+				shared[enum] = true
+			}
+		})
+	}
+	return shared
+}
+
+// renameDefaults updates the defaults of fields of type enum in the file.
+func (fx *fixer) renameDefaults(enum *ast.Enum, from, to string) {
+	fx.eachField(func(f *ast.Field) {
+		if f.Type == enum && f.HasDefault && f.Default == from {
+			f.Default = to
+		}
+	})
+}
+
+// unusedImports removes ordinary imports that define none of the types
+// the file uses, directly or through their public imports. An import that
+// defines extensions is kept if the file uses custom options, since
+// options are not resolved and it may define one of them.
+func (fx *fixer) unusedImports() {
+	files := make(map[string]*ast.File)
+	for _, f := range fx.fs.Files {
+		files[f.Name] = f
+	}
+	used := fx.usedFiles()
+	customOpts := fx.hasCustomOptions()
+
+	public, weak := make(map[int]bool), make(map[int]bool)
+	for _, i := range fx.f.PublicImports {
+		public[i] = true
+	}
+	for _, i := range fx.f.WeakImports {
+		weak[i] = true
+	}
+	var imports []string
+	var publicImports, weakImports []int
+	for i, imp := range fx.f.Imports {
+		keep := public[i] || weak[i] || reaches(files, imp, used, map[string]bool{}) ||
+			customOpts && definesExtensions(files[imp])
+		if !keep {
+			fx.changef(ast.Position{}, "removed unused import %q", imp)
+			continue
+		}
+		if public[i] {
+			publicImports = append(publicImports, len(imports))
+		}
+		if weak[i] {
+			weakImports = append(weakImports, len(imports))
+		}
+		imports = append(imports, imp)
+	}
+	fx.f.Imports, fx.f.PublicImports, fx.f.WeakImports = imports, publicImports, weakImports
+}
+
+// reaches reports whether name, or a file it publicly imports, is in used.
+func reaches(files map[string]*ast.File, name string, used, seen map[string]bool) bool {
+	if used[name] {
+		return true
+	}
+	f := files[name]
+	if f == nil || seen[name] {
+		// Unknown files are kept, to be safe.
+		return f == nil
+	}
+	seen[name] = true
+	for _, i := range f.PublicImports {
+		if reaches(files, f.Imports[i], used, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// usedFiles returns the names of the files defining types that fx.f refers to.
+func (fx *fixer) usedFiles() map[string]bool {
+	used := make(map[string]bool)
+	typ := func(t interface{}) {
+		if n, ok := t.(ast.Node); ok {
+			used[n.File().Name] = true
+		}
+	}
+	fx.eachField(func(f *ast.Field) {
+		typ(f.Type)
+		if ext, ok := f.Up.(*ast.Extension); ok && ext.ExtendeeType != nil {
+			typ(ext.ExtendeeType)
+		}
+	})
+	for _, srv := range fx.f.Services {
+		for _, mth := range srv.Methods {
+			typ(mth.InType)
+			typ(mth.OutType)
+		}
+	}
+	return used
+}
+
+// hasCustomOptions reports whether any option in the file is a custom option.
+func (fx *fixer) hasCustomOptions() bool {
+	found := false
+	check := func(opts [][2]string) {
+		for _, opt := range opts {
+			found = found || strings.HasPrefix(opt[0], "(")
+		}
+	}
+	enums := func(enums []*ast.Enum) {
+		for _, enum := range enums {
+			check(enum.Options)
+			for _, v := range enum.Values {
+				check(v.Options)
+			}
+		}
+	}
+	var msg func(m *ast.Message)
+	msg = func(m *ast.Message) {
+		check(m.Options)
+		for _, o := range m.Oneofs {
+			check(o.Options)
+		}
+		enums(m.Enums)
+		for _, nm := range m.Messages {
+			msg(nm)
+		}
+	}
+	check(fx.f.Options)
+	for _, m := range fx.f.Messages {
+		msg(m)
+	}
+	enums(fx.f.Enums)
+	for _, srv := range fx.f.Services {
+		check(srv.Options)
+		for _, mth := range srv.Methods {
+			check(mth.Options)
+		}
+	}
+	fx.eachField(func(f *ast.Field) {
+		check(f.Options)
+	})
+	return found
+}
+
+// eachField calls fn for every field in the file, including extensions.
+func (fx *fixer) eachField(fn func(*ast.Field)) {
+	eachField(fx.f, fn)
+}
+
+// eachField calls fn for every field in f, including extensions.
+func eachField(f *ast.File, fn func(*ast.Field)) {
+	exts := func(exts []*ast.Extension) {
+		for _, ext := range exts {
+			for _, f := range ext.Fields {
+				fn(f)
+			}
+		}
+	}
+	var msg func(m *ast.Message)
+	msg = func(m *ast.Message) {
+		for _, f := range m.Fields {
+			fn(f)
+		}
+		exts(m.Extensions)
+		for _, nm := range m.Messages {
+			msg(nm)
+		}
+	}
+	for _, m := range f.Messages {
+		msg(m)
+	}
+	exts(f.Extensions)
+}
+
+func definesExtensions(f *ast.File) bool {
+	if f == nil {
+		return false
+	}
+	if len(f.Extensions) > 0 {
+		return true
+	}
+	var msg func(m *ast.Message) bool
+	msg = func(m *ast.Message) bool {
+		if len(m.Extensions) > 0 {
+			return true
+		}
+		for _, nm := range m.Messages {
+			if msg(nm) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, m := range f.Messages {
+		if msg(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// upperSnake converts a CamelCase name to UPPER_SNAKE_CASE.
+func upperSnake(s string) string {
+	r := []rune(s)
+	var b strings.Builder
+	for i, c := range r {
+		if unicode.IsUpper(c) && i > 0 && (unicode.IsLower(r[i-1]) || unicode.IsDigit(r[i-1]) ||
+			(i+1 < len(r) && unicode.IsLower(r[i+1]) && unicode.IsUpper(r[i-1]))) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+	return b.String()
+}
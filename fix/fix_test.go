@@ -0,0 +1,186 @@
+package fix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/parser"
+	"github.com/dsymonds/gotoc/printer"
+)
+
+var files = map[string]string{
+	"used.proto":   "syntax = \"proto2\";\npackage used;\nmessage U {}\n",
+	"unused.proto": "syntax = \"proto2\";\npackage unused;\nmessage X {}\n",
+	"reexport.proto": `syntax = "proto2";
+import public "used.proto";
+`,
+	"ext.proto": `syntax = "proto2";
+package ext;
+message Base { extensions 100 to 200; }
+extend Base { optional string route = 100; }
+`,
+	"svc.proto": `syntax = "proto2";
+package svc;
+import "ext.proto";
+message Req {}
+service S {
+  rpc Get(Req) returns (Req) { option (ext.route) = "/v1"; }
+}
+`,
+	"shade.proto": `syntax = "proto2";
+package shade;
+enum Shade {
+  DARK = 0;
+}
+enum Level {
+  LOW = 0;
+}
+message Base { extensions 100 to 200; }
+extend Base { optional Level level = 100; }
+`,
+	"user.proto": `syntax = "proto2";
+package user;
+import "shade.proto";
+message M { optional shade.Shade s = 1 [default = DARK]; }
+`,
+	"test.proto": `import "used.proto";
+import "unused.proto";
+
+package test;
+
+// A message.
+message M {
+  int32 a = 1; // no label
+  optional Color c = 2 [default = RED];
+  repeated used.U u = 3;
+}
+
+enum Color {
+  RED = 0;
+  GREEN = 1;
+}
+
+enum Ok {
+  OK_UNSPECIFIED = 0;
+}
+`,
+}
+
+const want = `syntax = "proto2";
+
+package test;
+
+import "used.proto";
+
+// A message.
+message M {
+  optional int32 a = 1; // no label
+  optional Color c = 2 [default = COLOR_UNSPECIFIED];
+  repeated used.U u = 3;
+}
+
+enum Color {
+  COLOR_UNSPECIFIED = 0;
+  GREEN = 1;
+}
+
+enum Ok {
+  OK_UNSPECIFIED = 0;
+}
+`
+
+func parse(t *testing.T, name string) (*ast.FileSet, *ast.File, []byte) {
+	dir, err := ioutil.TempDir("", "fix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs, err := parser.ParseFiles([]string{name}, []string{dir})
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	for _, f := range fs.Files {
+		if f.Name == name {
+			return fs, f, []byte(files[name])
+		}
+	}
+	t.Fatalf("%s not in parsed files", name)
+	return nil, nil, nil
+}
+
+func TestFile(t *testing.T) {
+	fs, f, src := parse(t, "test.proto")
+	changes := File(fs, f, src)
+	wantChanges := []Change{
+		{8, "added optional label to field a"},
+		{0, `added syntax = "proto2"`},
+		{14, "renamed enum value RED to COLOR_UNSPECIFIED"},
+		{0, `removed unused import "unused.proto"`},
+	}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("Changes:\n%v\nwant\n%v", changes, wantChanges)
+	}
+	if got := string(printer.Format(f)); got != want {
+		t.Errorf("Fixed file:\n%s\nwant\n%s", got, want)
+	}
+
+	// Fixing the result should change nothing.
+	orig := files["test.proto"]
+	defer func() { files["test.proto"] = orig }()
+	files["test.proto"] = want
+	fs, f, src = parse(t, "test.proto")
+	if changes := File(fs, f, src); len(changes) != 0 {
+		t.Errorf("Second fix made changes: %v", changes)
+	}
+}
+
+func TestPublicImportsKept(t *testing.T) {
+	fs, f, src := parse(t, "reexport.proto")
+	if changes := File(fs, f, src); len(changes) != 0 {
+		t.Errorf("Changes to a file with only a public import: %v", changes)
+	}
+}
+
+func TestMethodOptionImportKept(t *testing.T) {
+	fs, f, src := parse(t, "svc.proto")
+	if changes := File(fs, f, src); len(changes) != 0 {
+		t.Errorf("Changes to a file using a custom method option: %v", changes)
+	}
+}
+
+func TestSharedEnumsNotRenamed(t *testing.T) {
+	// Shade is used by user.proto, and Level by an extension.
+	fs, _, _ := parse(t, "user.proto")
+	for _, f := range fs.Files {
+		if f.Name != "shade.proto" {
+			continue
+		}
+		if changes := File(fs, f, []byte(files["shade.proto"])); len(changes) != 0 {
+			t.Errorf("Changes to a file with shared enums: %v", changes)
+		}
+		return
+	}
+	t.Fatalf("shade.proto not in parsed files")
+}
+
+func TestUpperSnake(t *testing.T) {
+	for in, want := range map[string]string{
+		"Color":     "COLOR",
+		"PhoneType": "PHONE_TYPE",
+		"HTTPCode":  "HTTP_CODE",
+		"V2Kind":    "V2_KIND",
+	} {
+		if got := upperSnake(in); got != want {
+			t.Errorf("upperSnake(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
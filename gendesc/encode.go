@@ -0,0 +1,416 @@
+package gendesc
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/lexer"
+)
+
+// This file encodes the values of custom options in the protocol buffer
+// wire format, so they can be set as extensions of the options messages.
+
+// A customOption is a custom option whose name has been resolved.
+type customOption struct {
+	name     string // full name of the extension, followed by any sub-field names
+	num      int32  // field number of the extension
+	repeated bool   // whether the named field is repeated
+	enc      []byte // the encoded extension field
+}
+
+// customOption resolves the name of opt, written in scope, to an extension
+// of the options message named extendee, and encodes its value.
+// It returns nil if the name doesn't resolve.
+func (g *generator) customOption(extendee, scope string, opt [2]string) (*customOption, error) {
+	uo, err := uninterpretedOption(opt)
+	if err != nil {
+		return nil, err
+	}
+	if !uo.Name[0].GetIsExtension() {
+		return nil, nil
+	}
+	name, ext := g.lookupExtension(scope, uo.Name[0].GetNamePart(), extendee)
+	if ext == nil {
+		return nil, nil
+	}
+	fields := []*ast.Field{ext}
+	for _, np := range uo.Name[1:] {
+		last := fields[len(fields)-1]
+		m, ok := last.Type.(*ast.Message)
+		if !ok || last.KeyTypeName != "" {
+			return nil, fmt.Errorf("option %q is an atomic type, not a message", opt[0])
+		}
+		if last.Repeated {
+			return nil, fmt.Errorf("option %q is a repeated message; repeated message options must be set using an aggregate value", opt[0])
+		}
+		var f *ast.Field
+		if np.GetIsExtension() {
+			var n string
+			n, f = g.lookupExtension(scope, np.GetNamePart(), qualifiedName(m))
+			name += ".(" + n + ")"
+		} else {
+			f = findField(m, np.GetNamePart())
+			name += "." + np.GetNamePart()
+		}
+		if f == nil {
+			return nil, fmt.Errorf("option %q: %q is not a field or extension of message %s", opt[0], np.GetNamePart(), qualifiedName(m))
+		}
+		fields = append(fields, f)
+	}
+
+	leaf := fields[len(fields)-1]
+	var b []byte
+	if strings.HasPrefix(opt[1], "{") {
+		m, ok := fieldMessage(leaf)
+		if !ok {
+			return nil, fmt.Errorf("option %q is an atomic type, but was given an aggregate value", opt[0])
+		}
+		p := &aggregateParser{g: g, sc: lexer.New(opt[1])}
+		if err := p.next(); err == nil {
+			err = p.expect("{")
+		}
+		var inner []byte
+		if err == nil {
+			inner, err = p.message(m, "}")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad aggregate value for option %q: %v", opt[0], err)
+		}
+		b = appendMessageField(b, leaf, inner)
+	} else {
+		b, err = appendScalarField(b, leaf, opt[1])
+		if err != nil {
+			return nil, fmt.Errorf("option %q: %v", opt[0], err)
+		}
+	}
+	for i := len(fields) - 2; i >= 0; i-- {
+		b = appendMessageField(nil, fields[i], b)
+	}
+	return &customOption{
+		name:     name,
+		num:      int32(ext.Tag),
+		repeated: leaf.Repeated,
+		enc:      b,
+	}, nil
+}
+
+// findField returns the field of m called name, or nil if there is none.
+// Group fields may be named by either the group's name or the field's.
+func findField(m *ast.Message, name string) *ast.Field {
+	for _, f := range m.Fields {
+		if f.Name == name {
+			return f
+		}
+		if fm, ok := f.Type.(*ast.Message); ok && fm.Group && GroupFieldName(f.Name) == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// fieldMessage returns the message type of f, which for a map field
+// is its map entry message.
+func fieldMessage(f *ast.Field) (*ast.Message, bool) {
+	if f.KeyTypeName != "" {
+		return mapEntry(f), true
+	}
+	m, ok := f.Type.(*ast.Message)
+	return m, ok
+}
+
+// An aggregateParser parses a message literal, such as the value of
+// an option written as { foo: 1 bar { baz: "x" } }, and encodes it.
+type aggregateParser struct {
+	g   *generator
+	sc  *lexer.Scanner
+	tok lexer.Token // the current token; its Value is "" at the end of the input
+}
+
+func (p *aggregateParser) next() error {
+	for {
+		tok, err := p.sc.Scan()
+		if err != nil {
+			p.tok = lexer.Token{}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if tok.Kind != lexer.Comment {
+			p.tok = tok
+			return nil
+		}
+	}
+}
+
+func (p *aggregateParser) expect(s string) error {
+	if p.tok.Value != s {
+		return fmt.Errorf("expected %q, found %q", s, p.tok.Value)
+	}
+	return p.next()
+}
+
+// message parses the fields of a message of type m, up to and including end,
+// and returns their encoding.
+func (p *aggregateParser) message(m *ast.Message, end string) ([]byte, error) {
+	var b []byte
+	for p.tok.Value != end {
+		var f *ast.Field
+		switch {
+		case p.tok.Value == "":
+			return nil, fmt.Errorf("expected %q, found end of input", end)
+		case p.tok.Value == "[":
+			// An extension, named by its full name.
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			name := p.tok.Value
+			if !strings.HasPrefix(name, ".") {
+				name = "." + name
+			}
+			_, f = p.g.lookupExtension("", name, qualifiedName(m))
+			if f == nil {
+				return nil, fmt.Errorf("extension %q of message %s not found", p.tok.Value, qualifiedName(m))
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.tok.Value != "]" {
+				return nil, fmt.Errorf("expected \"]\", found %q", p.tok.Value)
+			}
+		case p.tok.Kind == lexer.Ident:
+			f = findField(m, p.tok.Value)
+			if f == nil {
+				return nil, fmt.Errorf("message %s has no field named %q", qualifiedName(m), p.tok.Value)
+			}
+		default:
+			return nil, fmt.Errorf("expected field name, found %q", p.tok.Value)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		_, isMsg := fieldMessage(f)
+		if p.tok.Value == ":" {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		} else if !isMsg {
+			return nil, fmt.Errorf("expected \":\" after field %s, found %q", f.Name, p.tok.Value)
+		}
+		var err error
+		if p.tok.Value == "[" {
+			if !f.Repeated && f.KeyTypeName == "" {
+				return nil, fmt.Errorf("field %s is not repeated, but was given a list", f.Name)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			for p.tok.Value != "]" {
+				if b, err = p.value(b, f); err != nil {
+					return nil, err
+				}
+				if p.tok.Value == "," {
+					if err := p.next(); err != nil {
+						return nil, err
+					}
+				} else if p.tok.Value != "]" {
+					return nil, fmt.Errorf("expected \",\" or \"]\", found %q", p.tok.Value)
+				}
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		} else if b, err = p.value(b, f); err != nil {
+			return nil, err
+		}
+		if p.tok.Value == "," || p.tok.Value == ";" {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, p.next()
+}
+
+// value parses a single value of f, and appends the encoded field to b.
+func (p *aggregateParser) value(b []byte, f *ast.Field) ([]byte, error) {
+	if v := p.tok.Value; v == "{" || v == "<" {
+		m, ok := fieldMessage(f)
+		if !ok {
+			return nil, fmt.Errorf("field %s is not a message, but was given one", f.Name)
+		}
+		end := "}"
+		if v == "<" {
+			end = ">"
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		inner, err := p.message(m, end)
+		if err != nil {
+			return nil, err
+		}
+		return appendMessageField(b, f, inner), nil
+	}
+	b, err := appendScalarField(b, f, p.tok.Value)
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %v", f.Name, err)
+	}
+	return b, p.next()
+}
+
+// Wire types.
+const (
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
+)
+
+func appendVarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+func appendTag(b []byte, f *ast.Field, wireType int) []byte {
+	return appendVarint(b, uint64(f.Tag)<<3|uint64(wireType))
+}
+
+func appendFixed32(b []byte, x uint32) []byte {
+	return append(b, byte(x), byte(x>>8), byte(x>>16), byte(x>>24))
+}
+
+func appendFixed64(b []byte, x uint64) []byte {
+	b = appendFixed32(b, uint32(x))
+	return appendFixed32(b, uint32(x>>32))
+}
+
+// appendMessageField appends to b the field f, whose value is the encoded message inner.
+func appendMessageField(b []byte, f *ast.Field, inner []byte) []byte {
+	if m, ok := f.Type.(*ast.Message); ok && m.Group && f.KeyTypeName == "" {
+		b = appendTag(b, f, wireStartGroup)
+		b = append(b, inner...)
+		return appendTag(b, f, wireEndGroup)
+	}
+	b = appendTag(b, f, wireBytes)
+	b = appendVarint(b, uint64(len(inner)))
+	return append(b, inner...)
+}
+
+// appendScalarField appends to b the field f, whose value is written as value.
+func appendScalarField(b []byte, f *ast.Field, value string) ([]byte, error) {
+	if enum, ok := f.Type.(*ast.Enum); ok {
+		for _, ev := range enum.Values {
+			if ev.Name == value {
+				b = appendTag(b, f, wireVarint)
+				return appendVarint(b, uint64(int64(ev.Number))), nil
+			}
+		}
+		if !isIdentifier(value) {
+			return nil, fmt.Errorf("value must be identifier for enum-valued field")
+		}
+		return nil, fmt.Errorf("enum type %s has no value named %q", qualifiedName(enum), value)
+	}
+	ft, ok := f.Type.(ast.FieldType)
+	if !ok {
+		return nil, fmt.Errorf("value must be aggregate for message-valued field")
+	}
+
+	var (
+		i   int64
+		u   uint64
+		x   float64
+		err error
+	)
+	switch ft {
+	case ast.Int32, ast.Sint32, ast.Sfixed32:
+		i, err = strconv.ParseInt(value, 0, 32)
+	case ast.Int64, ast.Sint64, ast.Sfixed64:
+		i, err = strconv.ParseInt(value, 0, 64)
+	case ast.Uint32, ast.Fixed32:
+		u, err = strconv.ParseUint(value, 0, 32)
+	case ast.Uint64, ast.Fixed64:
+		u, err = strconv.ParseUint(value, 0, 64)
+	case ast.Float, ast.Double:
+		switch value {
+		case "inf":
+			x = math.Inf(1)
+		case "-inf":
+			x = math.Inf(-1)
+		case "nan", "-nan":
+			x = math.NaN()
+		default:
+			if !isNumber(value) {
+				return nil, fmt.Errorf("value must be number for %s field", ft)
+			}
+			x, err = strconv.ParseFloat(value, 64)
+		}
+	case ast.Bool:
+		if value != "true" && value != "false" {
+			return nil, fmt.Errorf("value must be \"true\" or \"false\" for boolean field")
+		}
+	case ast.String, ast.Bytes:
+		if !strings.HasPrefix(value, `"`) && !strings.HasPrefix(value, "'") {
+			return nil, fmt.Errorf("value must be quoted string for %s field", ft)
+		}
+		s, err := ast.Unquote(value)
+		if err != nil {
+			return nil, err
+		}
+		b = appendTag(b, f, wireBytes)
+		b = appendVarint(b, uint64(len(s)))
+		return append(b, s...), nil
+	}
+	if err != nil {
+		if ft == ast.Float || ft == ast.Double {
+			return nil, fmt.Errorf("value must be number for %s field", ft)
+		}
+		return nil, fmt.Errorf("value must be integer in range for %s field", ft)
+	}
+
+	switch ft {
+	case ast.Int32, ast.Int64:
+		b = appendTag(b, f, wireVarint)
+		b = appendVarint(b, uint64(i))
+	case ast.Sint32, ast.Sint64:
+		b = appendTag(b, f, wireVarint)
+		b = appendVarint(b, uint64(i<<1^i>>63))
+	case ast.Uint32, ast.Uint64:
+		b = appendTag(b, f, wireVarint)
+		b = appendVarint(b, u)
+	case ast.Bool:
+		b = appendTag(b, f, wireVarint)
+		if value == "true" {
+			u = 1
+		}
+		b = appendVarint(b, u)
+	case ast.Fixed32:
+		b = appendTag(b, f, wireFixed32)
+		b = appendFixed32(b, uint32(u))
+	case ast.Sfixed32:
+		b = appendTag(b, f, wireFixed32)
+		b = appendFixed32(b, uint32(i))
+	case ast.Fixed64:
+		b = appendTag(b, f, wireFixed64)
+		b = appendFixed64(b, u)
+	case ast.Sfixed64:
+		b = appendTag(b, f, wireFixed64)
+		b = appendFixed64(b, uint64(i))
+	case ast.Float:
+		b = appendTag(b, f, wireFixed32)
+		b = appendFixed32(b, math.Float32bits(float32(x)))
+	case ast.Double:
+		b = appendTag(b, f, wireFixed64)
+		b = appendFixed64(b, math.Float64bits(x))
+	}
+	return b, nil
+}
@@ -4,6 +4,7 @@ Package gendesc generates descriptor protos from an AST.
 package gendesc
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
 	"strconv"
@@ -15,9 +16,39 @@ import (
 )
 
 func Generate(fs *ast.FileSet) (*pb.FileDescriptorSet, error) {
+	return GenerateWithOptions(fs, Options{})
+}
+
+// Options control how descriptors are generated.
+// The zero value gives the same output as Generate.
+type Options struct {
+	// SourceInfo adds SourceCodeInfo to the descriptors of files that were
+	// parsed from source, as AddSourceCodeInfo does.
+	SourceInfo bool
+
+	// ProtocDefaults normalizes numeric default values as protoc does,
+	// rather than keeping them as written: integers are written in decimal
+	// (e.g. 0x10 becomes 16), and floating-point numbers in the shortest
+	// of %.15g and %.17g that is exact (e.g. 1e9 becomes 1000000000).
+	ProtocDefaults bool
+
+	// ExplicitSyntax sets the syntax field of every file, including
+	// "proto2" for files that don't say otherwise, for consumers that
+	// expect it to be present.
+	ExplicitSyntax bool
+
+	// Deps are files, besides those being generated, whose extensions
+	// may be used as custom options. For GenerateFile, these are usually
+	// the file's imports, and theirs.
+	Deps []*ast.File
+}
+
+// GenerateWithOptions is like Generate, but configured by opts.
+func GenerateWithOptions(fs *ast.FileSet, opts Options) (*pb.FileDescriptorSet, error) {
+	g := newGenerator(fs.Files, opts)
 	fds := new(pb.FileDescriptorSet)
 	for _, f := range fs.Files {
-		fdp, err := genFile(f)
+		fdp, err := g.genFile(f)
 		if err != nil {
 			return nil, err
 		}
@@ -26,7 +57,25 @@ func Generate(fs *ast.FileSet) (*pb.FileDescriptorSet, error) {
 	return fds, nil
 }
 
-func genFile(f *ast.File) (*pb.FileDescriptorProto, error) {
+// GenerateFile generates the descriptor of a single file, configured by opts.
+// Custom options in f are interpreted using the extensions declared
+// in f and in opts.Deps; others are left uninterpreted.
+func GenerateFile(f *ast.File, opts Options) (*pb.FileDescriptorProto, error) {
+	return newGenerator([]*ast.File{f}, opts).genFile(f)
+}
+
+func newGenerator(files []*ast.File, opts Options) *generator {
+	g := &generator{exts: make(map[string]*ast.Field), opts: opts}
+	for _, f := range files {
+		g.indexExtensions(f.Extensions, f.Messages)
+	}
+	for _, f := range opts.Deps {
+		g.indexExtensions(f.Extensions, f.Messages)
+	}
+	return g
+}
+
+func (g *generator) genFile(f *ast.File) (*pb.FileDescriptorProto, error) {
 	fdp := &pb.FileDescriptorProto{
 		Name:    maybeString(f.Name),
 		Package: maybeString(strings.Join(f.Package, ".")),
@@ -38,78 +87,66 @@ func genFile(f *ast.File) (*pb.FileDescriptorProto, error) {
 		fdp.PublicDependency = append(fdp.PublicDependency, int32(i))
 	}
 	sort.Sort(int32Slice(fdp.PublicDependency))
+	for _, i := range f.WeakImports {
+		fdp.WeakDependency = append(fdp.WeakDependency, int32(i))
+	}
+	sort.Sort(int32Slice(fdp.WeakDependency))
 	for _, m := range f.Messages {
-		dp, err := genMessage(m)
+		dp, err := g.genMessage(m)
 		if err != nil {
 			return nil, err
 		}
 		fdp.MessageType = append(fdp.MessageType, dp)
 	}
 	for _, enum := range f.Enums {
-		edp, err := genEnum(enum)
+		edp, err := g.genEnum(enum)
 		if err != nil {
 			return nil, err
 		}
 		fdp.EnumType = append(fdp.EnumType, edp)
 	}
 	for _, srv := range f.Services {
-		sdp, err := genService(srv)
+		sdp, err := g.genService(srv)
 		if err != nil {
 			return nil, err
 		}
 		fdp.Service = append(fdp.Service, sdp)
 	}
 	for _, ext := range f.Extensions {
-		fdps, err := genExtension(ext)
+		fdps, err := g.genExtension(ext)
 		if err != nil {
 			return nil, err
 		}
 		fdp.Extension = append(fdp.Extension, fdps...)
 	}
-	for _, opt := range f.Options {
-		if fdp.Options == nil {
-			fdp.Options = new(pb.FileOptions)
-		}
-		// TODO: interpret common options
-		uo := new(pb.UninterpretedOption)
-		for _, part := range strings.Split(opt[0], ".") {
-			// TODO: support IsExtension
-			uo.Name = append(uo.Name, &pb.UninterpretedOption_NamePart{
-				NamePart:    proto.String(part),
-				IsExtension: proto.Bool(false),
-			})
-			// TODO: need to handle more types
-			if strings.HasPrefix(opt[1], `"`) {
-				// TODO: doesn't handle single quote strings, etc.
-				unq, err := strconv.Unquote(opt[1])
-				if err != nil {
-					return nil, err
-				}
-				uo.StringValue = []byte(unq)
-			} else {
-				uo.IdentifierValue = proto.String(opt[1])
-			}
+	if len(f.Options) > 0 {
+		fdp.Options = new(pb.FileOptions)
+		if err := g.setOptions(fdp.Options, scopeName(f), f.Options); err != nil {
+			return nil, err
 		}
-		fdp.Options.UninterpretedOption = append(fdp.Options.UninterpretedOption, uo)
 	}
-	// TODO: SourceCodeInfo
-	switch f.Syntax {
-	case "proto2", "":
-		// "proto2" is considered the default; don't set anything.
-	default:
+	if g.opts.SourceInfo && f.Lines != nil {
+		fdp.SourceCodeInfo = sourceCodeInfo(f)
+	}
+	switch {
+	case f.Syntax != "" && f.Syntax != "proto2":
 		fdp.Syntax = proto.String(f.Syntax)
+	case g.opts.ExplicitSyntax:
+		fdp.Syntax = proto.String("proto2")
+	default:
+		// "proto2" is considered the default; don't set anything.
 	}
 
 	return fdp, nil
 }
 
-func genMessage(m *ast.Message) (*pb.DescriptorProto, error) {
+func (g *generator) genMessage(m *ast.Message) (*pb.DescriptorProto, error) {
 	dp := &pb.DescriptorProto{
 		Name: proto.String(m.Name),
 	}
 	var extraNested []*pb.DescriptorProto
 	for _, f := range m.Fields {
-		fdp, xdp, err := genField(f)
+		fdp, xdp, err := g.genField(f)
 		if err != nil {
 			return nil, err
 		}
@@ -119,14 +156,14 @@ func genMessage(m *ast.Message) (*pb.DescriptorProto, error) {
 		}
 	}
 	for _, ext := range m.Extensions {
-		fdps, err := genExtension(ext)
+		fdps, err := g.genExtension(ext)
 		if err != nil {
 			return nil, err
 		}
 		dp.Extension = append(dp.Extension, fdps...)
 	}
 	for _, nm := range m.Messages {
-		ndp, err := genMessage(nm)
+		ndp, err := g.genMessage(nm)
 		if err != nil {
 			return nil, err
 		}
@@ -136,7 +173,7 @@ func genMessage(m *ast.Message) (*pb.DescriptorProto, error) {
 	// at the end so they don't disrupt message indexes.
 	dp.NestedType = append(dp.NestedType, extraNested...)
 	for _, ne := range m.Enums {
-		edp, err := genEnum(ne)
+		edp, err := g.genEnum(ne)
 		if err != nil {
 			return nil, err
 		}
@@ -149,15 +186,62 @@ func genMessage(m *ast.Message) (*pb.DescriptorProto, error) {
 			End:   proto.Int32(int32(r[1] + 1)),
 		})
 	}
+	for _, r := range m.ReservedRanges {
+		// DescriptorProto.ReservedRange also uses a half-open interval.
+		dp.ReservedRange = append(dp.ReservedRange, &pb.DescriptorProto_ReservedRange{
+			Start: proto.Int32(int32(r[0])),
+			End:   proto.Int32(int32(r[1] + 1)),
+		})
+	}
+	dp.ReservedName = append(dp.ReservedName, m.ReservedNames...)
+	if len(m.Options) > 0 {
+		dp.Options = new(pb.MessageOptions)
+		if err := g.setOptions(dp.Options, scopeName(m), m.Options); err != nil {
+			return nil, fmt.Errorf("message %s: %v", m.Name, err)
+		}
+	}
 	for _, oo := range m.Oneofs {
-		dp.OneofDecl = append(dp.OneofDecl, &pb.OneofDescriptorProto{
+		odp := &pb.OneofDescriptorProto{
 			Name: proto.String(oo.Name),
-		})
+		}
+		if len(oo.Options) > 0 {
+			odp.Options = new(pb.OneofOptions)
+			if err := g.setOptions(odp.Options, scopeName(m), oo.Options); err != nil {
+				return nil, err
+			}
+		}
+		dp.OneofDecl = append(dp.OneofDecl, odp)
+	}
+	// Each proto3 optional field is in a synthetic oneof of its own.
+	// As in protoc, these come after the real oneofs, and are named after
+	// their fields, with a leading "_", and as many leading "X"s as are
+	// needed to be distinct from the other fields and oneofs.
+	names := make(map[string]bool)
+	for _, fdp := range dp.Field {
+		names[fdp.GetName()] = true
+	}
+	for _, odp := range dp.OneofDecl {
+		names[odp.GetName()] = true
+	}
+	for _, fdp := range dp.Field {
+		if !fdp.GetProto3Optional() {
+			continue
+		}
+		name := fdp.GetName()
+		if !strings.HasPrefix(name, "_") {
+			name = "_" + name
+		}
+		for names[name] {
+			name = "X" + name
+		}
+		names[name] = true
+		fdp.OneofIndex = proto.Int32(int32(len(dp.OneofDecl)))
+		dp.OneofDecl = append(dp.OneofDecl, &pb.OneofDescriptorProto{Name: proto.String(name)})
 	}
 	return dp, nil
 }
 
-func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, error) {
+func (g *generator) genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, error) {
 	fdp := &pb.FieldDescriptorProto{
 		Name:   proto.String(f.Name),
 		Number: proto.Int32(int32(f.Tag)),
@@ -171,29 +255,15 @@ func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, erro
 		// default is optional
 		fdp.Label = pb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
 	}
+	if f.Optional && f.File().Syntax == "proto3" {
+		fdp.Proto3Optional = proto.Bool(true)
+	}
 	if f.KeyTypeName != "" {
-		mname := camelCase(f.Name) + "Entry"
-		vmsg := &ast.Message{
-			Name: mname,
-			Fields: []*ast.Field{
-				{
-					TypeName: f.KeyTypeName,
-					Type:     f.KeyType,
-					Name:     "key",
-					Tag:      1,
-				},
-				{
-					TypeName: f.TypeName,
-					Type:     f.Type,
-					Name:     "value",
-					Tag:      2,
-				},
-			},
-			Up: f.Up,
+		if f.HasPacked {
+			return nil, nil, packedError(f)
 		}
-		vmsg.Fields[0].Up = vmsg
-		vmsg.Fields[1].Up = vmsg
-		xdp, err := genMessage(vmsg)
+		vmsg := mapEntry(f)
+		xdp, err := g.genMessage(vmsg)
 		if err != nil {
 			return nil, nil, fmt.Errorf("internal error: %v", err)
 		}
@@ -202,6 +272,7 @@ func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, erro
 		}
 		fdp.Type = pb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
 		fdp.TypeName = proto.String(qualifiedName(vmsg))
+		fdp.JsonName = proto.String(jsonName(f, f.Name))
 		return fdp, xdp, nil
 	}
 	switch t := f.Type.(type) {
@@ -217,7 +288,7 @@ func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, erro
 		} else {
 			fdp.Type = pb.FieldDescriptorProto_TYPE_GROUP.Enum()
 			// The field name is lowercased by protoc.
-			*fdp.Name = strings.ToLower(*fdp.Name)
+			*fdp.Name = GroupFieldName(*fdp.Name)
 		}
 		fdp.TypeName = proto.String(qualifiedName(t))
 	case *ast.Enum:
@@ -230,7 +301,37 @@ func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, erro
 		fdp.Extendee = proto.String(qualifiedName(ext.ExtendeeType))
 	}
 	if f.HasDefault {
-		fdp.DefaultValue = proto.String(f.Default)
+		v := f.Default
+		if f.Type == ast.Bytes {
+			v = cEscape(v)
+		}
+		if g.opts.ProtocDefaults {
+			v = protocDefault(fdp.GetType(), v)
+		}
+		fdp.DefaultValue = proto.String(v)
+	}
+	fdp.JsonName = proto.String(jsonName(f, fdp.GetName()))
+	if len(f.Options) > 0 {
+		fdp.Options = new(pb.FieldOptions)
+		if err := g.setOptions(fdp.Options, scopeName(f.Up), f.Options); err != nil {
+			return nil, nil, fmt.Errorf("field %s: %v", f.Name, err)
+		}
+	}
+	// Like protoc, only set packed if it is written; in proto3,
+	// repeated scalar fields are packed by default without it.
+	if f.HasPacked {
+		switch fdp.GetType() {
+		case pb.FieldDescriptorProto_TYPE_STRING, pb.FieldDescriptorProto_TYPE_BYTES,
+			pb.FieldDescriptorProto_TYPE_MESSAGE, pb.FieldDescriptorProto_TYPE_GROUP:
+			return nil, nil, packedError(f)
+		}
+		if !f.Repeated {
+			return nil, nil, packedError(f)
+		}
+		if fdp.Options == nil {
+			fdp.Options = new(pb.FieldOptions)
+		}
+		fdp.Options.Packed = proto.Bool(f.Packed)
 	}
 	if f.Oneof != nil {
 		n := 0
@@ -246,34 +347,91 @@ func genField(f *ast.Field) (*pb.FieldDescriptorProto, *pb.DescriptorProto, erro
 	return fdp, nil, nil
 }
 
-func genEnum(enum *ast.Enum) (*pb.EnumDescriptorProto, error) {
+// mapEntry returns the message synthesized for the map field f.
+func mapEntry(f *ast.Field) *ast.Message {
+	vmsg := &ast.Message{
+		Name: MapEntryName(f.Name),
+		Fields: []*ast.Field{
+			{
+				TypeName: f.KeyTypeName,
+				Type:     f.KeyType,
+				Name:     "key",
+				Tag:      1,
+			},
+			{
+				TypeName: f.TypeName,
+				Type:     f.Type,
+				Name:     "value",
+				Tag:      2,
+			},
+		},
+		Up: f.Up,
+	}
+	vmsg.Fields[0].Up = vmsg
+	vmsg.Fields[1].Up = vmsg
+	return vmsg
+}
+
+func packedError(f *ast.Field) error {
+	return fmt.Errorf("field %s: [packed = %t] can only be specified for repeated primitive fields", f.Name, f.Packed)
+}
+
+func (g *generator) genEnum(enum *ast.Enum) (*pb.EnumDescriptorProto, error) {
 	edp := &pb.EnumDescriptorProto{
 		Name: proto.String(enum.Name),
 	}
 	for _, ev := range enum.Values {
-		edp.Value = append(edp.Value, &pb.EnumValueDescriptorProto{
+		evdp := &pb.EnumValueDescriptorProto{
 			Name:   proto.String(ev.Name),
 			Number: proto.Int32(ev.Number),
+		}
+		if len(ev.Options) > 0 {
+			evdp.Options = new(pb.EnumValueOptions)
+			if err := g.setOptions(evdp.Options, scopeName(enum.Up), ev.Options); err != nil {
+				return nil, fmt.Errorf("enum value %s: %v", ev.Name, err)
+			}
+		}
+		edp.Value = append(edp.Value, evdp)
+	}
+	if len(enum.Options) > 0 {
+		edp.Options = new(pb.EnumOptions)
+		if err := g.setOptions(edp.Options, scopeName(enum.Up), enum.Options); err != nil {
+			return nil, fmt.Errorf("enum %s: %v", enum.Name, err)
+		}
+	}
+	for _, r := range enum.ReservedRanges {
+		// Unlike DescriptorProto.ReservedRange, this is inclusive at both ends,
+		// so that it can include the largest enum value.
+		edp.ReservedRange = append(edp.ReservedRange, &pb.EnumDescriptorProto_EnumReservedRange{
+			Start: proto.Int32(int32(r[0])),
+			End:   proto.Int32(int32(r[1])),
 		})
 	}
+	edp.ReservedName = append(edp.ReservedName, enum.ReservedNames...)
 	return edp, nil
 }
 
-func genService(srv *ast.Service) (*pb.ServiceDescriptorProto, error) {
+func (g *generator) genService(srv *ast.Service) (*pb.ServiceDescriptorProto, error) {
 	sdp := &pb.ServiceDescriptorProto{
 		Name: proto.String(srv.Name),
 	}
 	for _, mth := range srv.Methods {
-		mdp, err := genMethod(mth)
+		mdp, err := g.genMethod(mth)
 		if err != nil {
 			return nil, err
 		}
 		sdp.Method = append(sdp.Method, mdp)
 	}
+	if len(srv.Options) > 0 {
+		sdp.Options = new(pb.ServiceOptions)
+		if err := g.setOptions(sdp.Options, scopeName(srv), srv.Options); err != nil {
+			return nil, fmt.Errorf("service %s: %v", srv.Name, err)
+		}
+	}
 	return sdp, nil
 }
 
-func genMethod(mth *ast.Method) (*pb.MethodDescriptorProto, error) {
+func (g *generator) genMethod(mth *ast.Method) (*pb.MethodDescriptorProto, error) {
 	mdp := &pb.MethodDescriptorProto{
 		Name:       proto.String(mth.Name),
 		InputType:  proto.String(qualifiedName(mth.InType)),
@@ -285,14 +443,20 @@ func genMethod(mth *ast.Method) (*pb.MethodDescriptorProto, error) {
 	if mth.ServerStreaming {
 		mdp.ServerStreaming = proto.Bool(true)
 	}
+	if len(mth.Options) > 0 {
+		mdp.Options = new(pb.MethodOptions)
+		if err := g.setOptions(mdp.Options, scopeName(mth.Up), mth.Options); err != nil {
+			return nil, fmt.Errorf("method %s: %v", mth.Name, err)
+		}
+	}
 	return mdp, nil
 }
 
-func genExtension(ext *ast.Extension) ([]*pb.FieldDescriptorProto, error) {
+func (g *generator) genExtension(ext *ast.Extension) ([]*pb.FieldDescriptorProto, error) {
 	var fdps []*pb.FieldDescriptorProto
 	for _, f := range ext.Fields {
 		// TODO: It should be impossible to get a map field?
-		fdp, _, err := genField(f)
+		fdp, _, err := g.genField(f)
 		if err != nil {
 			return nil, err
 		}
@@ -301,6 +465,145 @@ func genExtension(ext *ast.Extension) ([]*pb.FieldDescriptorProto, error) {
 	return fdps, nil
 }
 
+// cEscape escapes a bytes default value as protoc does.
+func cEscape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '"', '\'', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&buf, `\%03o`, c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// protocDefault normalizes v, a default value of a field of type t,
+// as protoc does. Values that aren't numbers are returned unchanged.
+func protocDefault(t pb.FieldDescriptorProto_Type, v string) string {
+	switch t {
+	case pb.FieldDescriptorProto_TYPE_INT32, pb.FieldDescriptorProto_TYPE_INT64,
+		pb.FieldDescriptorProto_TYPE_SINT32, pb.FieldDescriptorProto_TYPE_SINT64,
+		pb.FieldDescriptorProto_TYPE_SFIXED32, pb.FieldDescriptorProto_TYPE_SFIXED64:
+		if n, err := strconv.ParseInt(v, 0, 64); err == nil {
+			return strconv.FormatInt(n, 10)
+		}
+	case pb.FieldDescriptorProto_TYPE_UINT32, pb.FieldDescriptorProto_TYPE_UINT64,
+		pb.FieldDescriptorProto_TYPE_FIXED32, pb.FieldDescriptorProto_TYPE_FIXED64:
+		if n, err := strconv.ParseUint(v, 0, 64); err == nil {
+			return strconv.FormatUint(n, 10)
+		}
+	case pb.FieldDescriptorProto_TYPE_FLOAT, pb.FieldDescriptorProto_TYPE_DOUBLE:
+		// protoc writes "inf" and "nan" as they are, with any sign.
+		if strings.HasSuffix(v, "inf") || strings.HasSuffix(v, "nan") {
+			return v
+		}
+		// An integer is parsed as for integer fields (so "010" is 8 and
+		// "0x10" is 16), and anything else as a decimal floating-point number.
+		abs := strings.TrimPrefix(v, "-")
+		var f float64
+		if n, err := strconv.ParseUint(abs, 0, 64); err == nil {
+			f = float64(n)
+		} else if f, err = strconv.ParseFloat(abs, 64); err != nil {
+			return v
+		}
+		if abs != v {
+			f = -f
+		}
+		// This is protoc's SimpleDtoa; even float defaults are parsed as doubles.
+		s := strconv.FormatFloat(f, 'g', 15, 64)
+		if g, _ := strconv.ParseFloat(s, 64); g != f {
+			s = strconv.FormatFloat(f, 'g', 17, 64)
+		}
+		return s
+	}
+	return v
+}
+
+// uninterpretedOption returns an UninterpretedOption for a key/value pair
+// as parsed from the source, such as {"(foo.bar).baz", `"x"`}.
+func uninterpretedOption(opt [2]string) (*pb.UninterpretedOption, error) {
+	uo := new(pb.UninterpretedOption)
+	name := opt[0]
+	for name != "" {
+		var part string
+		ext := strings.HasPrefix(name, "(")
+		if ext {
+			i := strings.Index(name, ")")
+			if i < 0 {
+				return nil, fmt.Errorf("bad option name %q", opt[0])
+			}
+			part, name = name[1:i], name[i+1:]
+		} else {
+			i := strings.IndexAny(name, ".(")
+			if i < 0 {
+				i = len(name)
+			}
+			part, name = name[:i], name[i:]
+		}
+		name = strings.TrimPrefix(name, ".")
+		uo.Name = append(uo.Name, &pb.UninterpretedOption_NamePart{
+			NamePart:    proto.String(part),
+			IsExtension: proto.Bool(ext),
+		})
+	}
+	v := opt[1]
+	switch {
+	case strings.HasPrefix(v, `"`) || strings.HasPrefix(v, "'"):
+		unq, err := ast.Unquote(v)
+		if err != nil {
+			return nil, err
+		}
+		uo.StringValue = []byte(unq)
+	case strings.HasPrefix(v, "{"):
+		// A message literal; protoc records it without the braces.
+		agg := strings.TrimSuffix(strings.TrimPrefix(v, "{"), "}")
+		uo.AggregateValue = proto.String(strings.TrimSpace(agg))
+	case isNumber(v):
+		isFloat := !strings.ContainsAny(v, "xX") && strings.ContainsAny(v, ".eE")
+		if n, err := strconv.ParseUint(v, 0, 64); err == nil && !isFloat {
+			uo.PositiveIntValue = proto.Uint64(n)
+		} else if n, err := strconv.ParseInt(v, 0, 64); err == nil && !isFloat && strings.HasPrefix(v, "-") {
+			uo.NegativeIntValue = proto.Int64(n)
+		} else if x, err := strconv.ParseFloat(v, 64); err == nil && isFloat {
+			uo.DoubleValue = proto.Float64(x)
+		} else {
+			return nil, fmt.Errorf("bad number %q for option %s", v, opt[0])
+		}
+	default:
+		// An identifier; "-inf" and "-nan" are recorded as doubles,
+		// but unsigned "inf" and "nan" are identifiers, as in protoc.
+		if v == "-inf" || v == "-nan" {
+			x, _ := strconv.ParseFloat(v, 64)
+			uo.DoubleValue = proto.Float64(x)
+		} else {
+			uo.IdentifierValue = proto.String(v)
+		}
+	}
+	return uo, nil
+}
+
+// isNumber reports whether s, an option value, is a numeric literal.
+func isNumber(s string) bool {
+	s = strings.TrimLeft(s, "+-")
+	if strings.HasPrefix(s, ".") {
+		s = s[1:]
+	}
+	return s != "" && '0' <= s[0] && s[0] <= '9'
+}
+
 // qualifiedName returns the fully-qualified name of x,
 // which must be either *ast.Message or *ast.Enum.
 func qualifiedName(x interface{}) string {
@@ -365,12 +668,3 @@ type int32Slice []int32
 func (s int32Slice) Len() int           { return len(s) }
 func (s int32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s int32Slice) Less(i, j int) bool { return s[i] < s[j] }
-
-// camelCase turns foo_bar into FooBar.
-func camelCase(s string) string {
-	words := strings.Split(s, "_")
-	for i, word := range words {
-		words[i] = strings.Title(word)
-	}
-	return strings.Join(words, "")
-}
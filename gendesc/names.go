@@ -0,0 +1,71 @@
+package gendesc
+
+import "github.com/dsymonds/gotoc/ast"
+
+// These follow protoc's algorithms exactly, character for character,
+// since the names they produce end up in descriptors and generated code.
+// Only ASCII letters change case; everything else is copied as-is.
+
+// JSONName returns the default json_name for a field:
+// underscores are dropped, and the character after each is upper-cased.
+// For example, "foo_bar" becomes "fooBar", and "_foo" becomes "Foo".
+func JSONName(fieldName string) string {
+	b := make([]byte, 0, len(fieldName))
+	capNext := false
+	for i := 0; i < len(fieldName); i++ {
+		c := fieldName[i]
+		switch {
+		case c == '_':
+			capNext = true
+		case capNext:
+			b = append(b, toUpper(c))
+			capNext = false
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// jsonName returns the json_name of f, whose descriptor has the given name.
+// Like protoc, it is set for every field, using the default if f has no option.
+func jsonName(f *ast.Field, name string) string {
+	if f.JSONName != "" {
+		return f.JSONName
+	}
+	return JSONName(name)
+}
+
+// MapEntryName returns the name of the message synthesized for a map field:
+// the field name in CamelCase, with "Entry" appended.
+// For example, "foo_bar" becomes "FooBarEntry".
+func MapEntryName(fieldName string) string {
+	b := make([]byte, 0, len(fieldName)+len("Entry"))
+	capNext := true
+	for i := 0; i < len(fieldName); i++ {
+		c := fieldName[i]
+		switch {
+		case c == '_':
+			capNext = true
+		case capNext:
+			b = append(b, toUpper(c))
+			capNext = false
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(append(b, "Entry"...))
+}
+
+// GroupFieldName returns the name of the field declared by a group,
+// which is the group's name lower-cased. It is the same as ast.GroupFieldName.
+func GroupFieldName(groupName string) string {
+	return ast.GroupFieldName(groupName)
+}
+
+func toUpper(c byte) byte {
+	if 'a' <= c && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
@@ -0,0 +1,56 @@
+package gendesc
+
+import "testing"
+
+func TestJSONName(t *testing.T) {
+	for in, want := range map[string]string{
+		"foo":         "foo",
+		"foo_bar":     "fooBar",
+		"foo_bar_baz": "fooBarBaz",
+		"_foo":        "Foo",
+		"foo__bar":    "fooBar",
+		"foo_1bar":    "foo1bar",
+		"foo_bar_":    "fooBar",
+		"Foo_bar":     "FooBar",
+		"fooBar":      "fooBar",
+	} {
+		if got := JSONName(in); got != want {
+			t.Errorf("JSONName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMapEntryName(t *testing.T) {
+	for in, want := range map[string]string{
+		"foo":          "FooEntry",
+		"foo_bar":      "FooBarEntry",
+		"_foo":         "FooEntry",
+		"foo__bar":     "FooBarEntry",
+		"foo_1bar":     "Foo1barEntry",
+		"foo1_bar":     "Foo1BarEntry",
+		"fooBar":       "FooBarEntry",
+		"FOO_BAR":      "FOOBAREntry",
+		"foo_bar_":     "FooBarEntry",
+		"x_y_z_123":    "XYZ123Entry",
+		"foo_bar2_map": "FooBar2MapEntry",
+		"__foo":        "FooEntry",
+		"foo_2":        "Foo2Entry",
+		"_":            "Entry",
+	} {
+		if got := MapEntryName(in); got != want {
+			t.Errorf("MapEntryName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestGroupFieldName(t *testing.T) {
+	for in, want := range map[string]string{
+		"Result":     "result",
+		"SearchData": "searchdata",
+		"My_Group2":  "my_group2",
+	} {
+		if got := GroupFieldName(in); got != want {
+			t.Errorf("GroupFieldName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
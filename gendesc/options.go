@@ -0,0 +1,290 @@
+package gendesc
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// This file interprets options, as protoc does: the standard options
+// declared in descriptor.proto, such as java_package or deprecated,
+// are set as ordinary fields of the options messages, and custom options
+// are encoded as extensions of them. Other options are recorded as uninterpreted.
+//
+// The standard options are found by reflection on the generated Go types
+// for descriptor.proto, so an option too new for those types is also
+// recorded as uninterpreted rather than rejected.
+
+// An optionEnum is an enum used by standard options.
+type optionEnum struct {
+	name   string // proto full name
+	values map[string]int32
+}
+
+// optionEnums maps the Go types of the enums used by standard options
+// to their proto names and values.
+var optionEnums = map[reflect.Type]optionEnum{
+	reflect.TypeOf(pb.FileOptions_SPEED):                 {"google.protobuf.FileOptions.OptimizeMode", pb.FileOptions_OptimizeMode_value},
+	reflect.TypeOf(pb.FieldOptions_STRING):               {"google.protobuf.FieldOptions.CType", pb.FieldOptions_CType_value},
+	reflect.TypeOf(pb.FieldOptions_JS_NORMAL):            {"google.protobuf.FieldOptions.JSType", pb.FieldOptions_JSType_value},
+	reflect.TypeOf(pb.MethodOptions_IDEMPOTENCY_UNKNOWN): {"google.protobuf.MethodOptions.IdempotencyLevel", pb.MethodOptions_IdempotencyLevel_value},
+}
+
+// A generator holds what is needed to generate the descriptors of a FileSet.
+type generator struct {
+	exts map[string]*ast.Field // extension fields, by full name with a leading dot
+	opts Options
+}
+
+// indexExtensions records the extension fields declared in exts and msgs.
+func (g *generator) indexExtensions(exts []*ast.Extension, msgs []*ast.Message) {
+	for _, ext := range exts {
+		scope := scopeName(ext)
+		for _, f := range ext.Fields {
+			name := f.Name
+			if m, ok := f.Type.(*ast.Message); ok && m.Group {
+				name = GroupFieldName(name)
+			}
+			g.exts[scope+"."+name] = f
+		}
+	}
+	for _, m := range msgs {
+		g.indexExtensions(m.Extensions, m.Messages)
+	}
+}
+
+// lookupExtension finds the extension of the message named extendee
+// that is called name when written in scope, as for scopeName.
+// It returns the extension's full name and field, or nil if there is none.
+func (g *generator) lookupExtension(scope, name, extendee string) (string, *ast.Field) {
+	var candidates []string
+	if strings.HasPrefix(name, ".") {
+		candidates = []string{name}
+	} else {
+		for s := scope; ; s = s[:strings.LastIndex(s, ".")] {
+			candidates = append(candidates, s+"."+name)
+			if s == "" {
+				break
+			}
+		}
+	}
+	for _, c := range candidates {
+		f := g.exts[c]
+		if f == nil {
+			continue
+		}
+		if ext := f.Up.(*ast.Extension); ext.ExtendeeType != nil && qualifiedName(ext.ExtendeeType) == extendee {
+			return c, f
+		}
+	}
+	return "", nil
+}
+
+// scopeName returns the full name, with a leading dot, of the scope that
+// option names written in x are resolved in. x is an *ast.File, *ast.Message,
+// *ast.Extension or *ast.Service.
+func scopeName(x interface{}) string {
+	switch x := x.(type) {
+	case *ast.File:
+		if len(x.Package) == 0 {
+			return ""
+		}
+		return "." + strings.Join(x.Package, ".")
+	case *ast.Message:
+		return qualifiedName(x)
+	case *ast.Extension:
+		return scopeName(x.Up)
+	case *ast.Service:
+		return scopeName(x.Up) + "." + x.Name
+	}
+	return ""
+}
+
+// setOptions records opts, key/value pairs as parsed from the source,
+// in msg, which must be a pointer to one of the descriptor options messages
+// (e.g. *pb.FileOptions). Custom option names are resolved in scope,
+// as for scopeName.
+//
+// Custom options that resolve to extensions of msg are encoded as extensions
+// of it. Options that are neither standard nor resolvable custom options
+// are recorded as uninterpreted.
+func (g *generator) setOptions(msg proto.Message, scope string, opts [][2]string) error {
+	v := reflect.ValueOf(msg).Elem()
+	extendee := ".google.protobuf." + v.Type().Name()
+	var nums []int32
+	exts := make(map[int32][]byte)
+	set := make(map[string]bool) // custom options already set
+	for _, opt := range opts {
+		ok, err := interpretOption(v, opt)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		co, err := g.customOption(extendee, scope, opt)
+		if err != nil {
+			return err
+		}
+		if co != nil {
+			if set[co.name] && !co.repeated {
+				return fmt.Errorf("option %q was already set", opt[0])
+			}
+			set[co.name] = true
+			if _, ok := exts[co.num]; !ok {
+				nums = append(nums, co.num)
+			}
+			// Repeated occurrences of a field concatenate (or merge, for messages),
+			// so options setting parts of the same extension can share it.
+			exts[co.num] = append(exts[co.num], co.enc...)
+			continue
+		}
+		uo, err := uninterpretedOption(opt)
+		if err != nil {
+			return err
+		}
+		uos := v.FieldByName("UninterpretedOption")
+		uos.Set(reflect.Append(uos, reflect.ValueOf(uo)))
+	}
+	for _, n := range nums {
+		proto.SetRawExtension(msg, n, exts[n])
+	}
+	return nil
+}
+
+// interpretOption sets the field of v, an options message, that is named by opt.
+// It reports whether opt names a standard option.
+func interpretOption(v reflect.Value, opt [2]string) (bool, error) {
+	name, value := opt[0], opt[1]
+	if strings.ContainsAny(name, ".(") {
+		// A custom option, or a field of a message-valued option.
+		return false, nil
+	}
+	if name == "uninterpreted_option" {
+		return false, fmt.Errorf("option must not use reserved name %q", name)
+	}
+	var f reflect.Value
+	var isEnum bool
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if protoName(t.Field(i)) == name {
+			f = v.Field(i)
+			isEnum = protoEnum(t.Field(i)) != ""
+			break
+		}
+	}
+	if !f.IsValid() || f.Kind() != reflect.Ptr {
+		return false, nil
+	}
+	if !f.IsNil() {
+		return false, fmt.Errorf("option %q was already set", name)
+	}
+
+	x := reflect.New(f.Type().Elem())
+	switch e := x.Elem(); e.Kind() {
+	case reflect.Bool:
+		if value != "true" && value != "false" {
+			return false, fmt.Errorf("value must be \"true\" or \"false\" for boolean option %q", name)
+		}
+		e.SetBool(value == "true")
+	case reflect.String:
+		if !strings.HasPrefix(value, `"`) && !strings.HasPrefix(value, "'") {
+			return false, fmt.Errorf("value must be quoted string for string option %q", name)
+		}
+		s, err := ast.Unquote(value)
+		if err != nil {
+			return false, err
+		}
+		e.SetString(s)
+	case reflect.Int32, reflect.Int64:
+		if enum, ok := optionEnums[e.Type()]; ok {
+			n, ok := enum.values[value]
+			if !ok {
+				if !isIdentifier(value) {
+					return false, fmt.Errorf("value must be identifier for enum-valued option %q", name)
+				}
+				return false, fmt.Errorf("enum type %q has no value named %q for option %q", enum.name, value, name)
+			}
+			e.SetInt(int64(n))
+			break
+		}
+		if isEnum {
+			// An enum we don't know the values of.
+			return false, nil
+		}
+		n, err := strconv.ParseInt(value, 0, e.Type().Bits())
+		if err != nil || !isNumber(value) {
+			return false, fmt.Errorf("value must be integer in range for %s option %q", e.Kind(), name)
+		}
+		e.SetInt(n)
+	case reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 0, e.Type().Bits())
+		if err != nil || !isNumber(value) {
+			return false, fmt.Errorf("value must be integer in range for %s option %q", e.Kind(), name)
+		}
+		e.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		var fv float64
+		switch value {
+		case "inf":
+			fv = math.Inf(1)
+		case "-inf":
+			fv = math.Inf(-1)
+		case "nan", "-nan":
+			fv = math.NaN()
+		default:
+			var err error
+			fv, err = strconv.ParseFloat(value, 64)
+			if err != nil || !isNumber(value) {
+				return false, fmt.Errorf("value must be number for %s option %q", e.Kind(), name)
+			}
+		}
+		e.SetFloat(fv)
+	default:
+		// e.g. a message-valued option.
+		return false, nil
+	}
+	f.Set(x)
+	return true, nil
+}
+
+// protoName returns the proto field name of a generated struct field.
+func protoName(sf reflect.StructField) string {
+	return tagValue(sf, "name=")
+}
+
+// protoEnum returns the enum type named in the tag of a generated struct field,
+// or "" if it is not an enum. The name is in Go form, such as
+// "google.protobuf.FileOptions_OptimizeMode", so it is only fit for
+// telling whether a field is an enum; optionEnums has the proto names.
+func protoEnum(sf reflect.StructField) string {
+	return tagValue(sf, "enum=")
+}
+
+func tagValue(sf reflect.StructField, prefix string) string {
+	for _, part := range strings.Split(sf.Tag.Get("protobuf"), ",") {
+		if strings.HasPrefix(part, prefix) {
+			return part[len(prefix):]
+		}
+	}
+	return ""
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || c == '_' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
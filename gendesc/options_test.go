@@ -0,0 +1,130 @@
+package gendesc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dsymonds/gotoc/ast"
+)
+
+// customOptionsGenerator returns a generator that knows these extensions,
+// as if declared in a file with "package test;":
+//
+//	message Rule {
+//	  optional int32 min = 1;
+//	  repeated string in = 2;
+//	  optional Rule sub = 3;
+//	  optional group Extra = 4 { optional bool ok = 5; }
+//	  map<string, int32> counts = 6;
+//	}
+//	enum Kind { ZERO = 0; NEG = -1; }
+//	extend google.protobuf.FieldOptions {
+//	  optional Rule rule = 5000;
+//	  optional sint32 delta = 5001;
+//	  optional Kind kind = 5002;
+//	  repeated fixed32 ids = 5003;
+//	  optional double ratio = 5004;
+//	}
+func customOptionsGenerator() *generator {
+	fieldOptions := &ast.Message{
+		Name: "FieldOptions",
+		Up:   &ast.File{Package: []string{"google", "protobuf"}},
+	}
+	f := &ast.File{Package: []string{"test"}}
+	rule := &ast.Message{Name: "Rule", Up: f}
+	extra := &ast.Message{Name: "Extra", Group: true, Up: rule}
+	extra.Fields = []*ast.Field{{Name: "ok", Tag: 5, Type: ast.Bool, Up: extra}}
+	rule.Messages = []*ast.Message{extra}
+	rule.Fields = []*ast.Field{
+		{Name: "min", Tag: 1, Type: ast.Int32, Up: rule},
+		{Name: "in", Tag: 2, Type: ast.String, Repeated: true, Up: rule},
+		{Name: "sub", Tag: 3, Type: rule, Up: rule},
+		{Name: "Extra", Tag: 4, Type: extra, Up: rule},
+		{Name: "counts", Tag: 6, Type: ast.Int32, KeyTypeName: "string", KeyType: ast.String, Repeated: true, Up: rule},
+	}
+	kind := &ast.Enum{Name: "Kind", Up: f}
+	kind.Values = []*ast.EnumValue{{Name: "ZERO", Number: 0, Up: kind}, {Name: "NEG", Number: -1, Up: kind}}
+	ext := &ast.Extension{ExtendeeType: fieldOptions, Up: f}
+	ext.Fields = []*ast.Field{
+		{Name: "rule", Tag: 5000, Type: rule, Up: ext},
+		{Name: "delta", Tag: 5001, Type: ast.Sint32, Up: ext},
+		{Name: "kind", Tag: 5002, Type: kind, Up: ext},
+		{Name: "ids", Tag: 5003, Type: ast.Fixed32, Repeated: true, Up: ext},
+		{Name: "ratio", Tag: 5004, Type: ast.Double, Up: ext},
+	}
+	f.Messages = []*ast.Message{rule}
+	f.Enums = []*ast.Enum{kind}
+	f.Extensions = []*ast.Extension{ext}
+
+	g := &generator{exts: make(map[string]*ast.Field)}
+	g.indexExtensions(f.Extensions, f.Messages)
+	return g
+}
+
+func TestCustomOptions(t *testing.T) {
+	g := customOptionsGenerator()
+	tests := []struct {
+		scope, name, value string
+		want               []byte
+	}{
+		// The key of field 5000 with wire type 2 is c2 b8 02.
+		{".test", "(rule)", `{ min : 7 }`, []byte{0xc2, 0xb8, 0x02, 2, 0x08, 7}},
+		{"", "(test.rule)", `{ min : 7 }`, []byte{0xc2, 0xb8, 0x02, 2, 0x08, 7}},
+		{".other", "(.test.rule).min", `-1`, append([]byte{0xc2, 0xb8, 0x02, 11, 0x08}, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)},
+		{".test.Rule", "(rule).sub.min", `1`, []byte{0xc2, 0xb8, 0x02, 4, 0x1a, 2, 0x08, 1}},
+		{".test", "(rule)", `{ in : [ "a" , "b" ] Extra { ok : true } }`, []byte{0xc2, 0xb8, 0x02, 10, 0x12, 1, 'a', 0x12, 1, 'b', 0x23, 0x28, 1, 0x24}},
+		{".test", "(rule).extra.ok", `false`, []byte{0xc2, 0xb8, 0x02, 4, 0x23, 0x28, 0, 0x24}},
+		{".test", "(rule)", `{ counts { key : "x" value : 3 } }`, []byte{0xc2, 0xb8, 0x02, 7, 0x32, 5, 0x0a, 1, 'x', 0x10, 3}},
+		{".test", "(delta)", `-2`, []byte{0xc8, 0xb8, 0x02, 3}},
+		{".test", "(kind)", `NEG`, append([]byte{0xd0, 0xb8, 0x02}, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)},
+		{".test", "(ids)", `0x01020304`, []byte{0xdd, 0xb8, 0x02, 4, 3, 2, 1}},
+		{".test", "(ratio)", `-inf`, []byte{0xe1, 0xb8, 0x02, 0, 0, 0, 0, 0, 0, 0xf0, 0xff}},
+	}
+	for _, test := range tests {
+		co, err := g.customOption(".google.protobuf.FieldOptions", test.scope, [2]string{test.name, test.value})
+		if err != nil {
+			t.Errorf("%s = %s: %v", test.name, test.value, err)
+			continue
+		}
+		if co == nil {
+			t.Errorf("%s = %s: not resolved", test.name, test.value)
+			continue
+		}
+		if !bytes.Equal(co.enc, test.want) {
+			t.Errorf("%s = %s encoded as % x, want % x", test.name, test.value, co.enc, test.want)
+		}
+	}
+}
+
+func TestBadCustomOptions(t *testing.T) {
+	g := customOptionsGenerator()
+	tests := []struct {
+		name, value, err string
+	}{
+		{"(delta)", `"x"`, `option "(delta)": value must be integer in range for sint32 field`},
+		{"(delta)", `2147483648`, `option "(delta)": value must be integer in range for sint32 field`},
+		{"(kind)", `ONE`, `option "(kind)": enum type .test.Kind has no value named "ONE"`},
+		{"(rule).max", `1`, `option "(rule).max": "max" is not a field or extension of message .test.Rule`},
+		{"(delta).x", `1`, `option "(delta).x" is an atomic type, not a message`},
+		{"(rule)", `{ min : "x" }`, `bad aggregate value for option "(rule)": field min: value must be integer in range for int32 field`},
+		{"(rule)", `{ min : 1`, `bad aggregate value for option "(rule)": expected "}", found end of input`},
+		{"(rule)", `7`, `option "(rule)": value must be aggregate for message-valued field`},
+	}
+	for _, test := range tests {
+		_, err := g.customOption(".google.protobuf.FieldOptions", ".test", [2]string{test.name, test.value})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("%s = %s: got error %q, want %q", test.name, test.value, got, test.err)
+		}
+	}
+
+	// Extensions of other messages, and unknown names, are left uninterpreted.
+	for _, name := range []string{"(rule)", "(nonexistent)"} {
+		if co, err := g.customOption(".google.protobuf.FileOptions", ".test", [2]string{name, "1"}); co != nil || err != nil {
+			t.Errorf("%s on FileOptions = %v, %v; want nil, nil", name, co, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package gendesc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/dsymonds/gotoc/options"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// StripSourceRetention removes from fds the values of options that are only
+// retained in source, which are those set using an extension declared with
+// [retention = RETENTION_SOURCE]. This is what protoc does to descriptors
+// before handing them to plugins or writing them out.
+//
+// Options set as extensions are matched by extendee and field number.
+// Uninterpreted option names are matched to the extensions declared anywhere
+// in fds by full name, or by a suffix of the full name, since they are not
+// resolved in the scope they were written in.
+func StripSourceRetention(fds *pb.FileDescriptorSet) {
+	s := &stripper{
+		exts: make(map[string]bool),
+		nums: make(map[string][]int32),
+	}
+	for _, fd := range fds.File {
+		prefix := ""
+		if fd.GetPackage() != "" {
+			prefix = "." + fd.GetPackage()
+		}
+		s.findExtensions(prefix, fd.Extension, fd.MessageType)
+	}
+	if len(s.exts) == 0 {
+		return
+	}
+	for _, fd := range fds.File {
+		s.stripOptions(fd.Options)
+		s.stripFields(fd.Extension)
+		s.stripMessages(fd.MessageType)
+		s.stripEnums(fd.EnumType)
+		for _, srv := range fd.Service {
+			s.stripOptions(srv.Options)
+			for _, mth := range srv.Method {
+				s.stripOptions(mth.Options)
+			}
+		}
+	}
+}
+
+type stripper struct {
+	exts map[string]bool    // full names of source-retained extensions, with a leading dot
+	nums map[string][]int32 // field numbers of source-retained extensions, by extendee
+}
+
+func (s *stripper) findExtensions(prefix string, exts []*pb.FieldDescriptorProto, msgs []*pb.DescriptorProto) {
+	for _, ext := range exts {
+		if ext.Options == nil {
+			continue
+		}
+		if v, ok := options.Get(ext.Options, "retention"); ok && fmt.Sprint(v) == "RETENTION_SOURCE" {
+			s.exts[prefix+"."+ext.GetName()] = true
+			s.nums[ext.GetExtendee()] = append(s.nums[ext.GetExtendee()], ext.GetNumber())
+		}
+	}
+	for _, msg := range msgs {
+		name := prefix + "." + msg.GetName()
+		s.findExtensions(name, msg.Extension, msg.NestedType)
+	}
+}
+
+// retained reports whether an option should be kept.
+func (s *stripper) retained(uo *pb.UninterpretedOption) bool {
+	if len(uo.Name) == 0 || !uo.Name[0].GetIsExtension() {
+		return true
+	}
+	name := uo.Name[0].GetNamePart()
+	if strings.HasPrefix(name, ".") {
+		return !s.exts[name]
+	}
+	for ext := range s.exts {
+		if strings.HasSuffix(ext, "."+name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *stripper) strip(uos []*pb.UninterpretedOption) []*pb.UninterpretedOption {
+	var kept []*pb.UninterpretedOption
+	for _, uo := range uos {
+		if s.retained(uo) {
+			kept = append(kept, uo)
+		}
+	}
+	return kept
+}
+
+// stripOptions strips opts, which is a pointer to one of the descriptor options messages.
+func (s *stripper) stripOptions(opts proto.Message) {
+	v := reflect.ValueOf(opts)
+	if v.IsNil() {
+		return
+	}
+	for _, n := range s.nums[".google.protobuf."+v.Elem().Type().Name()] {
+		proto.ClearExtension(opts, &proto.ExtensionDesc{ExtendedType: opts, Field: n})
+	}
+	uos := v.Elem().FieldByName("UninterpretedOption")
+	uos.Set(reflect.ValueOf(s.strip(uos.Interface().([]*pb.UninterpretedOption))))
+}
+
+func (s *stripper) stripFields(fields []*pb.FieldDescriptorProto) {
+	for _, f := range fields {
+		s.stripOptions(f.Options)
+	}
+}
+
+func (s *stripper) stripMessages(msgs []*pb.DescriptorProto) {
+	for _, msg := range msgs {
+		s.stripOptions(msg.Options)
+		s.stripFields(msg.Field)
+		s.stripFields(msg.Extension)
+		for _, oo := range msg.OneofDecl {
+			s.stripOptions(oo.Options)
+		}
+		s.stripMessages(msg.NestedType)
+		s.stripEnums(msg.EnumType)
+	}
+}
+
+func (s *stripper) stripEnums(enums []*pb.EnumDescriptorProto) {
+	for _, enum := range enums {
+		s.stripOptions(enum.Options)
+		for _, v := range enum.Value {
+			s.stripOptions(v.Options)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package gendesc
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/dsymonds/gotoc/ast"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Field numbers in the descriptor protos, for SourceCodeInfo paths.
+const (
+	filePackageNumber     = 2
+	fileDependencyNumber  = 3
+	fileMessageTypeNumber = 4
+	fileEnumTypeNumber    = 5
+	fileServiceNumber     = 6
+	fileExtensionNumber   = 7
+	fileOptionsNumber     = 8
+	fileSyntaxNumber      = 12
+
+	messageFieldNumber      = 2
+	messageNestedTypeNumber = 3
+	messageEnumTypeNumber   = 4
+	messageExtensionNumber  = 6
+	messageOneofDeclNumber  = 8
+
+	enumValueNumber     = 2
+	serviceMethodNumber = 2
+)
+
+// AddSourceCodeInfo sets the SourceCodeInfo of each file in fds that was
+// generated from a file in fs parsed from source. Files are matched by name.
+//
+// There is a location for the file, its syntax and package statements,
+// each import and option statement, and each message, field, oneof,
+// extend block, enum, enum value, service and method; unlike protoc,
+// there are none for the parts of a declaration such as its name or number,
+// and an option statement has only the path of the options field.
+// Comments are attached as protoc does, with each line of a comment
+// ending in "\n" and starting with a space unless it is blank.
+func AddSourceCodeInfo(fs *ast.FileSet, fds *pb.FileDescriptorSet) {
+	files := make(map[string]*ast.File)
+	for _, f := range fs.Files {
+		files[f.Name] = f
+	}
+	for _, fd := range fds.File {
+		if f := files[fd.GetName()]; f != nil && f.Lines != nil {
+			fd.SourceCodeInfo = sourceCodeInfo(f)
+		}
+	}
+}
+
+// decl is a declaration that has a location.
+type decl interface {
+	ast.Node
+	End() ast.Position
+}
+
+type location struct {
+	path []int32
+	n    decl // nil for the file
+	up   decl // the enclosing declaration, or nil at the top level
+}
+
+type locator struct {
+	locs []*location
+}
+
+func (lr *locator) add(path []int32, n, up decl) {
+	// Copy path, since callers reuse its backing array.
+	p := make([]int32, len(path))
+	copy(p, path)
+	lr.locs = append(lr.locs, &location{path: p, n: n, up: up})
+}
+
+func sourceCodeInfo(f *ast.File) *pb.SourceCodeInfo {
+	lr := new(locator)
+	lr.add(nil, nil, nil)
+	if f.SyntaxStatement != nil {
+		lr.add([]int32{fileSyntaxNumber}, f.SyntaxStatement, nil)
+	}
+	if f.PackageStatement != nil {
+		lr.add([]int32{filePackageNumber}, f.PackageStatement, nil)
+	}
+	for i, stmt := range f.ImportStatements {
+		lr.add([]int32{fileDependencyNumber, int32(i)}, stmt, nil)
+	}
+	for _, stmt := range f.OptionStatements {
+		lr.add([]int32{fileOptionsNumber}, stmt, nil)
+	}
+	for i, m := range f.Messages {
+		lr.message([]int32{fileMessageTypeNumber, int32(i)}, m, nil)
+	}
+	for i, enum := range f.Enums {
+		lr.enum([]int32{fileEnumTypeNumber, int32(i)}, enum, nil)
+	}
+	for i, srv := range f.Services {
+		path := []int32{fileServiceNumber, int32(i)}
+		lr.add(path, srv, nil)
+		for j, mth := range srv.Methods {
+			lr.add(append(path, serviceMethodNumber, int32(j)), mth, srv)
+		}
+	}
+	lr.extensions([]int32{fileExtensionNumber}, f.Extensions, nil)
+
+	// Locations are in source order, with enclosing declarations first.
+	locs := lr.locs[1:]
+	sort.SliceStable(locs, func(i, j int) bool { return locs[i].n.Pos().Before(locs[j].n.Pos()) })
+
+	sci := new(pb.SourceCodeInfo)
+	for _, loc := range lr.locs {
+		sci.Location = append(sci.Location, lr.location(f, loc))
+	}
+	return sci
+}
+
+func (lr *locator) message(path []int32, m *ast.Message, up decl) {
+	lr.add(path, m, up)
+	for i, f := range m.Fields {
+		fup := decl(m)
+		if f.Oneof != nil {
+			fup = f.Oneof
+		}
+		lr.add(append(path, messageFieldNumber, int32(i)), f, fup)
+	}
+	for i, nm := range m.Messages {
+		lr.message(append(path, messageNestedTypeNumber, int32(i)), nm, m)
+	}
+	for i, ne := range m.Enums {
+		lr.enum(append(path, messageEnumTypeNumber, int32(i)), ne, m)
+	}
+	lr.extensions(append(path, messageExtensionNumber), m.Extensions, m)
+	for i, oo := range m.Oneofs {
+		lr.add(append(path, messageOneofDeclNumber, int32(i)), oo, m)
+	}
+}
+
+func (lr *locator) enum(path []int32, enum *ast.Enum, up decl) {
+	lr.add(path, enum, up)
+	for i, ev := range enum.Values {
+		lr.add(append(path, enumValueNumber, int32(i)), ev, enum)
+	}
+}
+
+// extensions adds the locations of extend blocks and their fields.
+// path is that of the extension field of the enclosing descriptor;
+// as in protoc, each extend block has that path, and its fields are
+// numbered across all the blocks.
+func (lr *locator) extensions(path []int32, exts []*ast.Extension, up decl) {
+	i := 0
+	for _, ext := range exts {
+		lr.add(path, ext, up)
+		for _, f := range ext.Fields {
+			lr.add(append(path, int32(i)), f, ext)
+			i++
+		}
+	}
+}
+
+func (lr *locator) location(f *ast.File, loc *location) *pb.SourceCodeInfo_Location {
+	pl := &pb.SourceCodeInfo_Location{Path: loc.path}
+	if loc.n == nil {
+		// The file spans from its first statement to the end of its last.
+		// Locations are sorted, so the first is that of the first statement.
+		start, end := ast.Position{Line: 1}, ast.Position{}
+		if len(lr.locs) > 1 {
+			start = lr.locs[1].n.Pos()
+		}
+		for _, l := range lr.locs[1:] {
+			if l.up == nil && end.Before(l.n.End()) {
+				end = l.n.End()
+			}
+		}
+		pl.Span = span(f, start, end)
+		return pl
+	}
+	pl.Span = span(f, loc.n.Pos(), loc.n.End())
+
+	// Comments that start on the line where the previous declaration
+	// (or the enclosing one) ends belong to it, not to this one.
+	bound := lr.bound(loc)
+	lead := ast.LeadingComment(loc.n)
+	if lead != nil && lead.Start.Line > bound.Line {
+		pl.LeadingComments = commentText(lead)
+	} else {
+		lead = nil
+	}
+	if c := ast.InlineComment(loc.n); c != nil && loc.n.Pos().Before(c.Start) {
+		pl.TrailingComments = commentText(c)
+	}
+	for _, c := range f.Comments {
+		if c == lead || bound.IsValid() && (!bound.Before(c.Start) || c.Start.Line <= bound.Line) {
+			continue
+		}
+		if c.End.Line >= loc.n.Pos().Line {
+			break
+		}
+		if lead == nil || c.End.Before(lead.Start) {
+			pl.LeadingDetachedComments = append(pl.LeadingDetachedComments, *commentText(c))
+		}
+	}
+	return pl
+}
+
+// bound returns the position after which comments may be attached to
+// the declaration at loc: the end of the last statement before it,
+// or the start of the declaration that encloses it. It is the zero
+// Position if there is neither, so that comments from the start of
+// the file may be attached.
+func (lr *locator) bound(loc *location) ast.Position {
+	var bound ast.Position
+	if loc.up != nil {
+		bound = loc.up.Pos()
+	}
+	for _, l := range lr.locs[1:] {
+		if end := l.n.End(); bound.Before(end) && !loc.n.Pos().Before(end) {
+			bound = end
+		}
+	}
+	return bound
+}
+
+// span returns the span of source from start to end, as protoc gives it:
+// 0-based start line, start column, end line (if different) and end column.
+func span(f *ast.File, start, end ast.Position) []int32 {
+	sl, sc := start.Line-1, f.Lines.Column(start.Offset)
+	el, ec := sl, sc
+	if end.IsValid() {
+		el, ec = end.Line-1, f.Lines.Column(end.Offset)
+	}
+	if sl == el {
+		return []int32{int32(sl), int32(sc), int32(ec)}
+	}
+	return []int32{int32(sl), int32(sc), int32(el), int32(ec)}
+}
+
+// commentText formats c as protoc does in SourceCodeInfo.
+func commentText(c *ast.Comment) *string {
+	var buf strings.Builder
+	for _, line := range c.Text {
+		if line != "" {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	s := buf.String()
+	return &s
+}
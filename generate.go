@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dsymonds/gotoc/parser"
+)
+
+// directivePrefix starts a line in a .proto file that declares a compilation of it.
+// The rest of the line holds gotoc flags, separated by spaces, e.g.
+//
+//	//gotoc:generate --plugin=openapi
+const directivePrefix = "//gotoc:generate"
+
+type directive struct {
+	file string   // slash-separated, relative to the workspace root
+	args []string // gotoc flags
+}
+
+// generate finds the //gotoc:generate directives in the .proto files under
+// each of dirs (by default, the current directory), and runs the compilations
+// they declare, with a file's compilations run after those of the files it imports.
+// Each compilation is run in the directory being walked, so that file
+// names are relative to it.
+func generate(dirs []string) {
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fatalf("Failed finding gotoc binary: %v", err)
+	}
+	for _, dir := range dirs {
+		ds, err := findDirectives(dir)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		for _, d := range ds {
+			args := append(append([]string(nil), d.args...), d.file)
+			fmt.Fprintf(os.Stderr, "gotoc %s\n", strings.Join(args, " "))
+			cmd := exec.Command(self, args...)
+			cmd.Dir = dir
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				fatalf("%s: %v", filepath.Join(dir, d.file), err)
+			}
+		}
+	}
+}
+
+// findDirectives returns the directives in the .proto files under root,
+// in dependency order. Directories starting with "." or "_",
+// and those named "testdata", are skipped.
+func findDirectives(root string) ([]directive, error) {
+	var files []string
+	byFile := make(map[string][]directive)
+	imports := make(map[string][]string)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := fi.Name()
+		if fi.IsDir() {
+			if path != root && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(name, ".proto") {
+			return nil
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		// Files without directives are parsed too, since the order
+		// depends on imports through them. If one can't be parsed,
+		// it is left to the compilations that import it to report.
+		ds := parseDirectives(rel, src)
+		f, err := parser.ParseFile(rel, src)
+		if err != nil {
+			if len(ds) == 0 {
+				return nil
+			}
+			return err
+		}
+		files = append(files, rel)
+		if len(ds) > 0 {
+			byFile[rel] = ds
+		}
+		imports[rel] = f.Imports
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Order files so each comes after any file it (transitively) imports,
+	// following imports through files without directives as well.
+	sort.Strings(files)
+	var ds []directive
+	state := make(map[string]int) // 1 = visiting, 2 = done
+	var visit func(file string) error
+	visit = func(file string) error {
+		switch state[file] {
+		case 1:
+			return fmt.Errorf("import cycle involving %s", file)
+		case 2:
+			return nil
+		}
+		state[file] = 1
+		for _, imp := range imports[file] {
+			if _, ok := imports[imp]; ok {
+				if err := visit(imp); err != nil {
+					return err
+				}
+			}
+		}
+		state[file] = 2
+		ds = append(ds, byFile[file]...)
+		return nil
+	}
+	for _, file := range files {
+		if err := visit(file); err != nil {
+			return nil, err
+		}
+	}
+	return ds, nil
+}
+
+func parseDirectives(file string, src []byte) []directive {
+	var ds []directive
+	s := bufio.NewScanner(bytes.NewReader(src))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, directivePrefix) {
+			continue
+		}
+		rest := line[len(directivePrefix):]
+		if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+			continue // e.g. //gotoc:generated
+		}
+		ds = append(ds, directive{file: file, args: strings.Fields(rest)})
+	}
+	return ds
+}
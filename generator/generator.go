@@ -0,0 +1,156 @@
+/*
+Package generator runs code generators, either in-process or as
+protoc-compatible plugin subprocesses.
+
+Programs built on gotoc may compile their own generators in by calling
+Register, typically from an init function. Run uses a registered generator
+in preference to looking for a plugin binary of the same name.
+*/
+package generator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+)
+
+// A Generator produces output files for a code generation request,
+// in the same way as a protoc plugin.
+type Generator interface {
+	Generate(req *plugin.CodeGeneratorRequest) (*plugin.CodeGeneratorResponse, error)
+}
+
+// GeneratorFunc adapts an ordinary function to the Generator interface.
+type GeneratorFunc func(req *plugin.CodeGeneratorRequest) (*plugin.CodeGeneratorResponse, error)
+
+func (f GeneratorFunc) Generate(req *plugin.CodeGeneratorRequest) (*plugin.CodeGeneratorResponse, error) {
+	return f(req)
+}
+
+var (
+	mu         sync.Mutex
+	generators = make(map[string]Generator)
+)
+
+// Register makes a generator available under the given name.
+// It panics if the name is already registered.
+func Register(name string, g Generator) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := generators[name]; dup {
+		panic("generator: Register called twice for " + name)
+	}
+	generators[name] = g
+}
+
+// Lookup returns the generator registered under the given name, or nil.
+func Lookup(name string) Generator {
+	mu.Lock()
+	defer mu.Unlock()
+	return generators[name]
+}
+
+// Names returns the sorted names of all registered generators.
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var names []string
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run runs the named generator. If no generator is registered under that name,
+// name is taken to be a plugin binary, which is run as a subprocess.
+func Run(name string, req *plugin.CodeGeneratorRequest) (*plugin.CodeGeneratorResponse, error) {
+	return RunContext(context.Background(), name, req, nil)
+}
+
+// PluginOptions control how a plugin subprocess is run.
+type PluginOptions struct {
+	// Env is the environment of the plugin, as for exec.Cmd.
+	// If nil, the plugin inherits the environment of this process.
+	Env []string
+
+	// Dir is the working directory of the plugin.
+	// If empty, it is the working directory of this process.
+	Dir string
+
+	// Stderr receives the standard error of the plugin.
+	// If nil, it is os.Stderr.
+	Stderr io.Writer
+}
+
+// RunContext is like Run, but a plugin subprocess is killed if ctx is done
+// before it finishes, and is run according to opts, which may be nil.
+// Registered generators are not affected by ctx or opts.
+func RunContext(ctx context.Context, name string, req *plugin.CodeGeneratorRequest, opts *PluginOptions) (*plugin.CodeGeneratorResponse, error) {
+	if g := Lookup(name); g != nil {
+		return g.Generate(req)
+	}
+	if opts == nil {
+		opts = new(PluginOptions)
+	}
+	return runPlugin(ctx, name, req, opts)
+}
+
+func runPlugin(ctx context.Context, binary string, req *plugin.CodeGeneratorRequest, opts *PluginOptions) (*plugin.CodeGeneratorResponse, error) {
+	buf, err := proto.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed marshaling CG request: %v", err)
+	}
+
+	// Find plugin.
+	pluginPath, err := findPlugin(binary)
+	if err != nil {
+		return nil, fmt.Errorf("failed finding plugin binary %q: %v", binary, err)
+	}
+
+	// Run the plugin subprocess.
+	cmd := exec.CommandContext(ctx, pluginPath)
+	cmd.Stdin = bytes.NewBuffer(buf)
+	cmd.Stderr = os.Stderr
+	if opts.Stderr != nil {
+		cmd.Stderr = opts.Stderr
+	}
+	cmd.Env = opts.Env
+	cmd.Dir = opts.Dir
+	buf, err = cmd.Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("failed running plugin: %v", ctx.Err())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed running plugin: %v", err)
+	}
+
+	// Parse the response.
+	resp := new(plugin.CodeGeneratorResponse)
+	if err = proto.Unmarshal(buf, resp); err != nil {
+		return nil, fmt.Errorf("failed unmarshaling CG response: %v", err)
+	}
+	return resp, nil
+}
+
+// findPlugin returns the absolute path of a plugin binary.
+// A bare name is looked up in the directories in $PATH (%PATH% on Windows);
+// a name with a directory part is taken to be a path to the binary,
+// relative to the current directory unless it is absolute.
+// On Windows, extensions such as ".exe" are tried too, as for commands.
+func findPlugin(binary string) (string, error) {
+	p, err := exec.LookPath(binary)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(p)
+}
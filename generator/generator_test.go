@@ -0,0 +1,94 @@
+package generator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+)
+
+func TestRegisteredGenerator(t *testing.T) {
+	Register("test-echo", GeneratorFunc(func(req *plugin.CodeGeneratorRequest) (*plugin.CodeGeneratorResponse, error) {
+		resp := new(plugin.CodeGeneratorResponse)
+		for _, name := range req.FileToGenerate {
+			resp.File = append(resp.File, &plugin.CodeGeneratorResponse_File{
+				Name:    proto.String(name + ".txt"),
+				Content: proto.String(req.GetParameter()),
+			})
+		}
+		return resp, nil
+	}))
+
+	if Lookup("test-echo") == nil {
+		t.Fatalf("Lookup did not find a registered generator")
+	}
+	resp, err := Run("test-echo", &plugin.CodeGeneratorRequest{
+		FileToGenerate: []string{"a.proto", "b.proto"},
+		Parameter:      proto.String("hello"),
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(resp.File) != 2 || resp.File[1].GetName() != "b.proto.txt" || resp.File[1].GetContent() != "hello" {
+		t.Errorf("Run returned %v", resp)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering a duplicate generator did not panic")
+		}
+	}()
+	Register("test-echo", GeneratorFunc(nil))
+}
+
+func TestMissingPlugin(t *testing.T) {
+	if _, err := Run("protoc-gen-does-not-exist", new(plugin.CodeGeneratorRequest)); err == nil {
+		t.Errorf("Run succeeded with a nonexistent plugin")
+	}
+}
+
+func TestFindPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotoc-generator-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "protoc-gen-test"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	want := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(want, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", os.TempDir()+string(filepath.ListSeparator)+dir)
+	if got, err := findPlugin("protoc-gen-test"); err != nil || got != want {
+		t.Errorf("findPlugin in PATH = %q, %v; want %q", got, err, want)
+	}
+
+	// A relative path is relative to the current directory, not in PATH.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, want)
+	if err != nil {
+		t.Skipf("No relative path to the test plugin: %v", err)
+	}
+	if filepath.Dir(rel) == "." {
+		rel = "." + string(filepath.Separator) + rel
+	}
+	if got, err := findPlugin(rel); err != nil || got != want {
+		t.Errorf("findPlugin(%q) = %q, %v; want %q", rel, got, err, want)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Package goembed generates Go source files that embed compiled descriptors,
+so that programs can load their schemas at runtime without external files.
+*/
+package goembed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"go/format"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Options controls the generated source.
+type Options struct {
+	// Package is the Go package name of the generated file.
+	Package string
+
+	// Var is the name of the []byte variable holding the serialized
+	// FileDescriptorSet. If empty, "FileDescriptorSet" is used.
+	Var string
+
+	// Register controls whether the generated file includes an init function
+	// that registers each file descriptor with the proto package.
+	Register bool
+}
+
+// Generate returns the source of a Go file embedding fds.
+func Generate(fds *pb.FileDescriptorSet, opts Options) ([]byte, error) {
+	if opts.Package == "" {
+		return nil, fmt.Errorf("no Go package name given")
+	}
+	name := opts.Var
+	if name == "" {
+		name = "FileDescriptorSet"
+	}
+	raw, err := proto.Marshal(fds)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, fd := range fds.File {
+		files = append(files, fd.GetName())
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by gotoc. DO NOT EDIT.\n")
+	fmt.Fprintf(&buf, "// Source: %s\n\n", strings.Join(files, ", "))
+	fmt.Fprintf(&buf, "package %s\n\n", opts.Package)
+	if opts.Register {
+		fmt.Fprintf(&buf, "import %q\n\n", "github.com/golang/protobuf/proto")
+	}
+	fmt.Fprintf(&buf, "// %s is the serialized FileDescriptorSet for %s.\n", name, strings.Join(files, ", "))
+	fmt.Fprintf(&buf, "var %s = ", name)
+	writeBytes(&buf, raw)
+	fmt.Fprintf(&buf, "\n")
+
+	if opts.Register {
+		// proto.RegisterFile wants each FileDescriptorProto gzipped.
+		fmt.Fprintf(&buf, "\nfunc init() {\n")
+		for _, fd := range fds.File {
+			raw, err := proto.Marshal(fd)
+			if err != nil {
+				return nil, err
+			}
+			// The gzip header is left without a name or modification time,
+			// so the output is reproducible.
+			var gz bytes.Buffer
+			w, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+			w.Write(raw)
+			w.Close()
+			fmt.Fprintf(&buf, "proto.RegisterFile(%q, ", fd.GetName())
+			writeBytes(&buf, gz.Bytes())
+			fmt.Fprintf(&buf, ")\n")
+		}
+		fmt.Fprintf(&buf, "}\n")
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("internal error: bad generated source: %v", err)
+	}
+	return src, nil
+}
+
+// writeBytes writes a []byte literal holding b.
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	fmt.Fprintf(buf, "[]byte{\n")
+	for len(b) > 0 {
+		n := 16
+		if n > len(b) {
+			n = len(b)
+		}
+		for _, c := range b[:n] {
+			fmt.Fprintf(buf, "0x%02x,", c)
+		}
+		fmt.Fprintf(buf, "\n")
+		b = b[n:]
+	}
+	fmt.Fprintf(buf, "}")
+}
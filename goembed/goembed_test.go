@@ -0,0 +1,54 @@
+package goembed
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+func TestGenerate(t *testing.T) {
+	fds := &pb.FileDescriptorSet{
+		File: []*pb.FileDescriptorProto{
+			{Name: proto.String("a.proto"), Package: proto.String("a")},
+			{Name: proto.String("b.proto"), Dependency: []string{"a.proto"}},
+		},
+	}
+	for _, opts := range []Options{
+		{Package: "schemas"},
+		{Package: "schemas", Var: "Schema", Register: true},
+	} {
+		src, err := Generate(fds, opts)
+		if err != nil {
+			t.Errorf("Generate(%+v): %v", opts, err)
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), "x.go", src, 0)
+		if err != nil {
+			t.Errorf("Generate(%+v) produced bad source: %v\n%s", opts, err, src)
+			continue
+		}
+		if f.Name.Name != opts.Package {
+			t.Errorf("Generate(%+v) produced package %q", opts, f.Name.Name)
+		}
+		name := opts.Var
+		if name == "" {
+			name = "FileDescriptorSet"
+		}
+		if f.Scope.Lookup(name) == nil {
+			t.Errorf("Generate(%+v) did not declare %s:\n%s", opts, name, src)
+		}
+		if got := strings.Contains(string(src), "proto.RegisterFile"); got != opts.Register {
+			t.Errorf("Generate(%+v): registration present = %v, want %v", opts, got, opts.Register)
+		}
+	}
+}
+
+func TestGenerateNoPackage(t *testing.T) {
+	if _, err := Generate(new(pb.FileDescriptorSet), Options{}); err == nil {
+		t.Errorf("Generate succeeded without a package name")
+	}
+}
@@ -0,0 +1,370 @@
+/*
+Package gostruct drafts protocol buffer messages from Go struct definitions.
+
+It is meant as a starting point when moving a hand-written JSON API to
+protocol buffers: each exported struct type becomes a message, with field
+names taken from json tags and types inferred from the Go types.
+A json tag name that isn't a valid proto field name (e.g. "first-name")
+is made into one, and kept as the field's json_name; if that makes two
+fields in a message have the same name, the later one is numbered to
+make it unique (e.g. "first_name_2").
+The result usually needs refinement by hand.
+
+The Go package is loaded with go/build, so files excluded by build
+constraints are ignored, and type-checked with go/types, so a field of
+a named type such as "type ID string" gets the proto type for the type
+it is defined as. Struct types defined in other packages have no message
+to refer to, so their fields are skipped unless they are one of the few
+well-known types handled specially.
+*/
+package gostruct
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	past "github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/gendesc"
+)
+
+// scalars maps Go basic types to proto scalar types.
+var scalars = map[types.BasicKind]string{
+	types.Bool:    "bool",
+	types.String:  "string",
+	types.Int:     "int64",
+	types.Int8:    "int32",
+	types.Int16:   "int32",
+	types.Int32:   "int32", // and rune
+	types.Int64:   "int64",
+	types.Uint:    "uint64",
+	types.Uint8:   "uint32", // and byte
+	types.Uint16:  "uint32",
+	types.Uint32:  "uint32",
+	types.Uint64:  "uint64",
+	types.Float32: "float",
+	types.Float64: "double",
+}
+
+// wellKnown maps qualified Go types to well-known proto types,
+// and the file that must be imported to use each.
+var wellKnown = map[string][2]string{
+	"time.Time":     {"google.protobuf.Timestamp", "google/protobuf/timestamp.proto"},
+	"time.Duration": {"google.protobuf.Duration", "google/protobuf/duration.proto"},
+}
+
+// Warnings are written here for struct fields that can't be converted.
+var Warnings io.Writer = os.Stderr
+
+// File loads the Go package in dir (ignoring tests) and returns a proto3
+// file with a message for each exported struct type, in the package named
+// after the Go package. Struct fields whose types have no obvious proto
+// equivalent are skipped, with a warning written to Warnings.
+func File(dir string) (*past.File, error) {
+	bp, err := build.ImportDir(dir, 0)
+	if _, ok := err.(*build.NoGoError); ok {
+		return nil, fmt.Errorf("no Go package in %s", dir)
+	} else if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range append(bp.GoFiles, bp.CgoFiles...) {
+		f, err := parser.ParseFile(fset, filepath.Join(bp.Dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	// Carry on despite type errors, such as imports that can't be found;
+	// fields with types that couldn't be worked out are skipped.
+	conf := &types.Config{
+		Importer:    importer.ForCompiler(fset, "source", nil),
+		FakeImportC: true,
+		Error:       func(error) {},
+	}
+	pkg, _ := conf.Check(bp.ImportPath, fset, files, nil)
+
+	// Find the struct types, in source order.
+	var structs []*types.TypeName
+	isMessage := make(map[*types.TypeName]bool)
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				tn, ok := pkg.Scope().Lookup(spec.(*ast.TypeSpec).Name.Name).(*types.TypeName)
+				if !ok || !tn.Exported() || tn.IsAlias() {
+					continue
+				}
+				if _, ok := tn.Type().Underlying().(*types.Struct); ok {
+					structs = append(structs, tn)
+					isMessage[tn] = true
+				}
+			}
+		}
+	}
+
+	c := &converter{
+		fset:     fset,
+		pkg:      pkg,
+		messages: isMessage,
+		file: &past.File{
+			Name:    bp.Name + ".proto",
+			Syntax:  "proto3",
+			Package: []string{bp.Name},
+		},
+		imports: make(map[string]bool),
+	}
+	for _, tn := range structs {
+		c.file.Messages = append(c.file.Messages, c.message(tn))
+	}
+	for imp := range c.imports {
+		c.file.Imports = append(c.file.Imports, imp)
+	}
+	sort.Strings(c.file.Imports)
+	return c.file, nil
+}
+
+type converter struct {
+	fset     *token.FileSet
+	pkg      *types.Package
+	messages map[*types.TypeName]bool // exported struct types in the package
+	file     *past.File
+	imports  map[string]bool
+}
+
+func (c *converter) message(tn *types.TypeName) *past.Message {
+	msg := &past.Message{
+		Name: tn.Name(),
+		Up:   c.file,
+	}
+	st := tn.Type().Underlying().(*types.Struct)
+	used := make(map[int]bool)
+	names := make(map[string]bool)
+	var untagged []*past.Field
+	for i := 0; i < st.NumFields(); i++ {
+		v := st.Field(i)
+		if v.Anonymous() {
+			c.warnf(v.Pos(), "skipping embedded field of type %s", c.typeString(v.Type()))
+			continue
+		}
+		if !v.Exported() {
+			continue
+		}
+		f := c.field(msg, v, reflect.StructTag(st.Tag(i)))
+		if f == nil {
+			continue
+		}
+		if names[f.Name] {
+			// Keep the JSON name it would have had.
+			base, jsonName := f.Name, f.JSONName
+			if jsonName == "" {
+				jsonName = gendesc.JSONName(base)
+			}
+			for n := 2; names[f.Name]; n++ {
+				f.Name = fmt.Sprintf("%s_%d", base, n)
+			}
+			f.JSONName = jsonName
+			c.warnf(v.Pos(), "field %s renamed to %s, since %s is already used", v.Name(), f.Name, base)
+		}
+		names[f.Name] = true
+		msg.Fields = append(msg.Fields, f)
+		if f.Tag > 0 {
+			used[f.Tag] = true
+		} else {
+			untagged = append(untagged, f)
+		}
+	}
+	// Number the fields without explicit numbers in order,
+	// avoiding those taken by fields with them.
+	next := 1
+	for _, f := range untagged {
+		for used[next] {
+			next++
+		}
+		f.Tag = next
+		used[next] = true
+	}
+	return msg
+}
+
+// field returns the proto field for a Go struct field,
+// or nil if it should be skipped.
+func (c *converter) field(msg *past.Message, v *types.Var, tag reflect.StructTag) *past.Field {
+	f := &past.Field{
+		Name: snakeCase(v.Name()),
+		Up:   msg,
+	}
+	if js, ok := tag.Lookup("json"); ok {
+		name := strings.Split(js, ",")[0]
+		if name == "-" {
+			return nil
+		}
+		if name != "" {
+			f.Name = fieldName(name)
+			if gendesc.JSONName(f.Name) != name {
+				f.JSONName = name
+			}
+		}
+	}
+	// A protobuf tag, as written by protoc-gen-go, gives the field number.
+	if pt, ok := tag.Lookup("protobuf"); ok {
+		parts := strings.Split(pt, ",")
+		if len(parts) > 1 {
+			if n, err := strconv.Atoi(parts[1]); err == nil {
+				f.Tag = n
+			}
+		}
+	}
+
+	// []byte is bytes, not repeated uint32.
+	typ := c.underlying(v.Type())
+	if st, ok := typ.(*types.Slice); ok && !isBytes(st) {
+		f.Repeated = true
+		typ = c.underlying(st.Elem())
+	}
+	if mt, ok := typ.(*types.Map); ok {
+		key := c.typeName(mt.Key())
+		switch key {
+		case "", "double", "float", "bytes":
+			c.warnf(v.Pos(), "skipping field %s: unsupported map key type %s", v.Name(), c.typeString(mt.Key()))
+			return nil
+		}
+		if f.Repeated {
+			c.warnf(v.Pos(), "skipping field %s: slices of maps are not supported", v.Name())
+			return nil
+		}
+		if st, ok := c.underlying(mt.Elem()).(*types.Slice); ok && !isBytes(st) {
+			c.warnf(v.Pos(), "skipping field %s: maps of slices are not supported", v.Name())
+			return nil
+		}
+		f.KeyTypeName = key
+		f.Repeated = true // as the parser does for map fields
+		typ = mt.Elem()
+	}
+	f.TypeName = c.typeName(typ)
+	if f.TypeName == "" {
+		c.warnf(v.Pos(), "skipping field %s: unsupported type %s", v.Name(), c.typeString(v.Type()))
+		return nil
+	}
+	return f
+}
+
+// underlying returns the type that t is defined as, unless t is one of
+// the types that has a proto equivalent of its own: a message or
+// a well-known type.
+func (c *converter) underlying(t types.Type) types.Type {
+	if n, ok := t.(*types.Named); ok && !c.messages[n.Obj()] && !isWellKnown(n) {
+		return n.Underlying()
+	}
+	return t
+}
+
+// typeName returns the proto type for a Go type, or "" if there isn't one.
+func (c *converter) typeName(typ types.Type) string {
+	switch t := c.underlying(typ).(type) {
+	case *types.Pointer:
+		return c.typeName(t.Elem())
+	case *types.Basic:
+		return scalars[t.Kind()]
+	case *types.Named:
+		if wk, ok := wellKnown[qualifiedName(t)]; ok {
+			c.imports[wk[1]] = true
+			return wk[0]
+		}
+		return t.Obj().Name()
+	case *types.Slice:
+		if isBytes(t) {
+			return "bytes"
+		}
+	}
+	return ""
+}
+
+func isBytes(st *types.Slice) bool {
+	b, ok := st.Elem().Underlying().(*types.Basic)
+	return ok && b.Kind() == types.Uint8
+}
+
+func isWellKnown(n *types.Named) bool {
+	_, ok := wellKnown[qualifiedName(n)]
+	return ok
+}
+
+// qualifiedName returns the name of a named type qualified by its
+// package's path, as in wellKnown.
+func qualifiedName(n *types.Named) string {
+	if n.Obj().Pkg() == nil {
+		return n.Obj().Name() // e.g. error
+	}
+	return n.Obj().Pkg().Path() + "." + n.Obj().Name()
+}
+
+// typeString returns a Go type as it would be written in the package, for messages.
+func (c *converter) typeString(t types.Type) string {
+	return types.TypeString(t, types.RelativeTo(c.pkg))
+}
+
+func (c *converter) warnf(pos token.Pos, format string, args ...interface{}) {
+	fmt.Fprintf(Warnings, "%v: %s\n", c.fset.Position(pos), fmt.Sprintf(format, args...))
+}
+
+// fieldName makes a valid proto field name from a json tag name,
+// replacing each run of characters that can't be in a name with "_"
+// (e.g. "first-name" becomes "first_name", and "@type" becomes "type").
+func fieldName(s string) string {
+	var b strings.Builder
+	sep := false
+	for _, c := range s {
+		if c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_') {
+			if sep && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+			sep = false
+		} else {
+			sep = true
+		}
+	}
+	name := b.String()
+	if name == "" {
+		return "field"
+	}
+	if unicode.IsDigit(rune(name[0])) {
+		return "field_" + name
+	}
+	return name
+}
+
+// snakeCase converts a Go identifier to a proto field name,
+// keeping initialisms together (e.g. "UserID" becomes "user_id").
+func snakeCase(s string) string {
+	r := []rune(s)
+	var b strings.Builder
+	for i, c := range r {
+		if unicode.IsUpper(c) {
+			if i > 0 && (unicode.IsLower(r[i-1]) || (i+1 < len(r) && unicode.IsLower(r[i+1]) && unicode.IsUpper(r[i-1]))) {
+				b.WriteByte('_')
+			}
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
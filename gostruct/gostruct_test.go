@@ -0,0 +1,157 @@
+package gostruct
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dsymonds/gotoc/printer"
+)
+
+const goSrc = `package api
+
+import "time"
+
+type User struct {
+	ID        int64             ` + "`json:\"id\"`" + `
+	Name      string            ` + "`json:\"name,omitempty\"`" + `
+	Email     *string
+	Tags      []string          ` + "`json:\"tags\"`" + `
+	Avatar    []byte            ` + "`json:\"avatar\"`" + `
+	Score     float64           ` + "`json:\"score\" protobuf:\"fixed64,9,opt,name=score\"`" + `
+	Created   time.Time         ` + "`json:\"created\"`" + `
+	Labels    map[string]string ` + "`json:\"labels\"`" + `
+	Friends   []*User           ` + "`json:\"friends\"`" + `
+	Password  string            ` + "`json:\"-\"`" + `
+	Callback  func()
+	UserAgent string
+	FirstName string            ` + "`json:\"first-name\"`" + `
+	Type      string            ` + "`json:\"@type\"`" + `
+	CamelCase string            ` + "`json:\"camelCase\"`" + `
+	Kind      Kind              ` + "`json:\"kind\"`" + `
+	Aliases   Names             ` + "`json:\"aliases\"`" + `
+	Other     string            ` + "`json:\"first_name\"`" + `
+	internal  int
+}
+
+type Kind string
+
+type Names []string
+
+type unexported struct {
+	X int
+}
+`
+
+const goTest = `package api
+
+type Ignored struct {
+	X int
+}
+`
+
+// A file excluded by build constraints, in another package.
+const goIgnored = `//go:build ignore
+
+package main
+
+type AlsoIgnored struct {
+	X int
+}
+`
+
+const want = `syntax = "proto3";
+
+package api;
+
+import "google/protobuf/timestamp.proto";
+
+message User {
+  int64 id = 1;
+  string name = 2;
+  string email = 3;
+  repeated string tags = 4;
+  bytes avatar = 5;
+  double score = 9;
+  google.protobuf.Timestamp created = 6;
+  map<string, string> labels = 7;
+  repeated User friends = 8;
+  string user_agent = 10;
+  string first_name = 11 [json_name = "first-name"];
+  string type = 12 [json_name = "@type"];
+  string camelCase = 13;
+  string kind = 14;
+  repeated string aliases = 15;
+  string first_name_2 = 16 [json_name = "first_name"];
+}
+`
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gostruct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "api.go"), []byte(goSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "api_test.go"), []byte(goTest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "gen.go"), []byte(goIgnored), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings bytes.Buffer
+	Warnings = &warnings
+	defer func() { Warnings = os.Stderr }()
+
+	f, err := File(dir)
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	if got := string(printer.Format(f)); got != want {
+		t.Errorf("Wrong output.\nGot:\n%s\nWant:\n%s", got, want)
+	}
+	if w := warnings.String(); !strings.Contains(w, "skipping field Callback") {
+		t.Errorf("Missing warning about Callback; got %q", w)
+	}
+	if w := warnings.String(); !strings.Contains(w, "field Other renamed to first_name_2") {
+		t.Errorf("Missing warning about Other; got %q", w)
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"name", "name"},
+		{"first-name", "first_name"},
+		{"@type", "type"},
+		{"a.b--c", "a_b_c"},
+		{"2fa", "field_2fa"},
+		{"héllo", "h_llo"},
+		{"$", "field"},
+	}
+	for _, tc := range tests {
+		if got := fieldName(tc.in); got != tc.out {
+			t.Errorf("fieldName(%q) = %q, want %q", tc.in, got, tc.out)
+		}
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"Name", "name"},
+		{"UserID", "user_id"},
+		{"HTTPServer", "http_server"},
+		{"CreatedAt", "created_at"},
+		{"X", "x"},
+	}
+	for _, tc := range tests {
+		if got := snakeCase(tc.in); got != tc.out {
+			t.Errorf("snakeCase(%q) = %q, want %q", tc.in, got, tc.out)
+		}
+	}
+}
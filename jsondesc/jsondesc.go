@@ -0,0 +1,127 @@
+/*
+Package jsondesc loads descriptors encoded as JSON, as exported by
+several schema registries, so they can take part in a compilation
+alongside .proto sources.
+
+A JSON input holds either a single FileDescriptorProto or a
+FileDescriptorSet, in the proto3 JSON encoding.
+*/
+package jsondesc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/descast"
+)
+
+// IsJSON reports whether filename names a JSON-encoded descriptor input.
+func IsJSON(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".json")
+}
+
+// Decode parses JSON holding a FileDescriptorSet or a FileDescriptorProto,
+// and returns its files. For a set, it also returns the names of its root
+// files: those not imported by any other file in the set. A single file
+// is its own root.
+func Decode(data []byte) (files []*pb.FileDescriptorProto, roots []string, err error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil, nil, err
+	}
+	if _, ok := top["file"]; !ok {
+		fd := new(pb.FileDescriptorProto)
+		if err := jsonpb.Unmarshal(bytes.NewReader(data), fd); err != nil {
+			return nil, nil, fmt.Errorf("bad FileDescriptorProto: %v", err)
+		}
+		return []*pb.FileDescriptorProto{fd}, []string{fd.GetName()}, nil
+	}
+
+	fds := new(pb.FileDescriptorSet)
+	if err := jsonpb.Unmarshal(bytes.NewReader(data), fds); err != nil {
+		return nil, nil, fmt.Errorf("bad FileDescriptorSet: %v", err)
+	}
+	imported := make(map[string]bool)
+	for _, fd := range fds.File {
+		for _, dep := range fd.Dependency {
+			imported[dep] = true
+		}
+	}
+	for _, fd := range fds.File {
+		if !imported[fd.GetName()] {
+			roots = append(roots, fd.GetName())
+		}
+	}
+	return fds.File, roots, nil
+}
+
+// Load reads the named JSON files and converts their contents to ASTs.
+// It returns the converted files keyed by name, along with any files
+// that parse supplied, and the names of the inputs' root files in order.
+//
+// Files imported by the JSON files but not contained in them are passed to
+// parse, which should return them (and their own imports) with their types
+// resolved, for example by parsing them from .proto sources.
+func Load(filenames []string, parse func(names []string) ([]*ast.File, error)) (map[string]*ast.File, []string, error) {
+	var fdps []*pb.FileDescriptorProto
+	var roots []string
+	have := make(map[string]bool)
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		files, r, err := Decode(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		for _, fd := range files {
+			if have[fd.GetName()] {
+				// The same file may be in several exported sets.
+				continue
+			}
+			have[fd.GetName()] = true
+			fdps = append(fdps, fd)
+		}
+		roots = append(roots, r...)
+	}
+
+	var missing []string
+	seen := make(map[string]bool)
+	for _, fd := range fdps {
+		for _, dep := range fd.Dependency {
+			if !have[dep] && !seen[dep] {
+				seen[dep] = true
+				missing = append(missing, dep)
+			}
+		}
+	}
+	var deps []*ast.File
+	if len(missing) > 0 {
+		var err error
+		if deps, err = parse(missing); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	files, err := descast.Files(fdps, deps)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := make(map[string]*ast.File)
+	for _, f := range deps {
+		m[f.Name] = f
+	}
+	for _, f := range files {
+		m[f.Name] = f
+	}
+	return m, roots, nil
+}
@@ -0,0 +1,135 @@
+package jsondesc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/parser"
+)
+
+const fileJSON = `{
+  "name": "a.proto",
+  "package": "a",
+  "messageType": [{
+    "name": "A",
+    "field": [{"name": "x", "number": 1, "label": "LABEL_OPTIONAL", "type": "TYPE_INT32", "jsonName": "x"}]
+  }]
+}`
+
+// setJSON holds b.proto, which imports a.proto from the same set
+// and dep.proto from elsewhere.
+const setJSON = `{
+  "file": [
+    {
+      "name": "a.proto",
+      "package": "a",
+      "messageType": [{"name": "A"}]
+    },
+    {
+      "name": "b.proto",
+      "package": "b",
+      "dependency": ["a.proto", "dep.proto"],
+      "messageType": [{
+        "name": "B",
+        "field": [
+          {"name": "a", "number": 1, "label": "LABEL_OPTIONAL", "type": "TYPE_MESSAGE", "typeName": ".a.A"},
+          {"name": "d", "number": 2, "label": "LABEL_REPEATED", "type": "TYPE_MESSAGE", "typeName": ".dep.D"}
+        ]
+      }]
+    }
+  ]
+}`
+
+func TestDecodeFile(t *testing.T) {
+	files, roots, err := Decode([]byte(fileJSON))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(files) != 1 || files[0].GetName() != "a.proto" {
+		t.Fatalf("Decode returned %v, want a.proto", files)
+	}
+	if f := files[0].MessageType[0].Field[0]; f.GetName() != "x" || f.GetNumber() != 1 {
+		t.Errorf("Wrong field: %v", f)
+	}
+	if !reflect.DeepEqual(roots, []string{"a.proto"}) {
+		t.Errorf("roots = %q, want [a.proto]", roots)
+	}
+}
+
+func TestDecodeSet(t *testing.T) {
+	files, roots, err := Decode([]byte(setJSON))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Decode returned %d files, want 2", len(files))
+	}
+	if !reflect.DeepEqual(roots, []string{"b.proto"}) {
+		t.Errorf("roots = %q, want [b.proto]", roots)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsondesc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("set.json", setJSON)
+	write("dep.proto", "syntax = \"proto2\";\npackage dep;\nmessage D {}\n")
+
+	var asked []string
+	files, roots, err := Load([]string{filepath.Join(dir, "set.json")}, func(names []string) ([]*ast.File, error) {
+		asked = names
+		fs, err := parser.ParseFiles(names, []string{dir})
+		if err != nil {
+			return nil, err
+		}
+		return fs.Files, nil
+	})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(asked, []string{"dep.proto"}) {
+		t.Errorf("Load asked for %q, want [dep.proto]", asked)
+	}
+	if !reflect.DeepEqual(roots, []string{"b.proto"}) {
+		t.Errorf("roots = %q, want [b.proto]", roots)
+	}
+	for _, name := range []string{"a.proto", "b.proto", "dep.proto"} {
+		if files[name] == nil {
+			t.Errorf("Load didn't return %s", name)
+		}
+	}
+
+	// b.proto's fields should refer to the types in the other files.
+	b := files["b.proto"].Messages[0]
+	if b.Fields[0].Type != files["a.proto"].Messages[0] {
+		t.Errorf("Field a has type %v, want a.A", b.Fields[0].Type)
+	}
+	if b.Fields[1].Type != files["dep.proto"].Messages[0] {
+		t.Errorf("Field d has type %v, want dep.D", b.Fields[1].Type)
+	}
+}
+
+func TestIsJSON(t *testing.T) {
+	for name, want := range map[string]bool{
+		"foo.json":     true,
+		"dir/foo.JSON": true,
+		"foo.proto":    false,
+		"json":         false,
+	} {
+		if got := IsJSON(name); got != want {
+			t.Errorf("IsJSON(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
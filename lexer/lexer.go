@@ -0,0 +1,249 @@
+/*
+Package lexer splits .proto source into tokens.
+
+The token stream includes comments, so it is suitable for tools such as
+formatters and syntax highlighters as well as for package parser.
+Whitespace is skipped.
+
+Fully-qualified names such as ".foo.Bar" are scanned as single identifiers,
+and a sign is part of the number or identifier that directly follows it
+(e.g. "-1" or "-inf"); a sign on its own is a symbol.
+*/
+package lexer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dsymonds/gotoc/ast"
+)
+
+// Kind is the kind of a token.
+type Kind int
+
+const (
+	Ident   Kind = iota // e.g. foo, .foo.Bar, -inf
+	Int                 // e.g. 7, -0x1F, 017
+	Float               // e.g. 1.5, -2e-3, .5
+	String              // e.g. "foo", 'bar'
+	Symbol              // e.g. ;, {, -
+	Comment             // e.g. // foo, /* bar */
+)
+
+var kindNames = map[Kind]string{
+	Ident:   "identifier",
+	Int:     "integer",
+	Float:   "float",
+	String:  "string",
+	Symbol:  "symbol",
+	Comment: "comment",
+}
+
+func (k Kind) String() string {
+	if s, ok := kindNames[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Token is a single token of the input.
+type Token struct {
+	Kind  Kind
+	Value string // as written in the source, including any quotes or comment markers
+
+	Pos ast.Position // position of the token's first byte
+	End ast.Position // position just after the token's last byte
+}
+
+// Error is a problem found while scanning.
+type Error struct {
+	Pos ast.Position
+	Msg string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("line %d: %s", e.Pos.Line, e.Msg) }
+
+// Scanner produces the tokens of some source.
+// A copy of a Scanner scans independently of the original,
+// so copying one is a way to look ahead.
+type Scanner struct {
+	src       string
+	off, line int
+}
+
+// New returns a Scanner for src. A leading UTF-8 byte order mark is skipped.
+func New(src string) *Scanner {
+	s := &Scanner{src: src, line: 1}
+	if strings.HasPrefix(src, "\uFEFF") {
+		s.off = 3
+	}
+	return s
+}
+
+// Pos returns the position just after the last token scanned,
+// or the end of the input once Scan has returned io.EOF.
+func (s *Scanner) Pos() ast.Position {
+	return ast.Position{Line: s.line, Offset: s.off}
+}
+
+// Scan returns the next token. At the end of the input it returns io.EOF.
+// Other errors are of type *Error.
+func (s *Scanner) Scan() (Token, error) {
+	s.skipWhitespace()
+	if s.off >= len(s.src) {
+		return Token{}, io.EOF
+	}
+	start := s.Pos()
+	kind, n, err := s.scan(s.src[s.off:])
+	if err != nil {
+		err.Pos = start
+		if n > 0 {
+			// The problem is within the token.
+			err.Pos.Offset += n
+			err.Pos.Line += strings.Count(s.src[s.off:s.off+n], "\n")
+		}
+		return Token{}, err
+	}
+	tok := Token{
+		Kind:  kind,
+		Value: s.src[s.off : s.off+n],
+		Pos:   start,
+	}
+	s.off += n
+	s.line += strings.Count(tok.Value, "\n")
+	tok.End = s.Pos()
+	return tok, nil
+}
+
+func (s *Scanner) skipWhitespace() {
+	for s.off < len(s.src) && isWhitespace(s.src[s.off]) {
+		if s.src[s.off] == '\n' {
+			s.line++
+		}
+		s.off++
+	}
+}
+
+// scan scans the token at the start of src, and returns its kind and length.
+// If there's an error, n is the offset of the problem within the token.
+func (s *Scanner) scan(src string) (kind Kind, n int, err *Error) {
+	c := src[0]
+	switch {
+	case strings.HasPrefix(src, "//"):
+		n := strings.IndexByte(src, '\n')
+		if n < 0 {
+			n = len(src)
+		} else if n > 0 && src[n-1] == '\r' {
+			// The "\r" of a "\r\n" line ending isn't part of the comment.
+			n--
+		}
+		return Comment, n, nil
+	case strings.HasPrefix(src, "/*"):
+		// Block comments don't nest; the first "*/" ends it.
+		n := strings.Index(src[2:], "*/")
+		if n < 0 {
+			return 0, 0, &Error{Msg: "encountered EOF inside block comment"}
+		}
+		return Comment, n + 4, nil
+	case strings.IndexByte(";{}=[],<>():", c) >= 0:
+		return Symbol, 1, nil
+	case c == '"' || c == '\'':
+		i := 1
+		for i < len(src) && src[i] != c {
+			if src[i] == '\\' && i+1 < len(src) {
+				// skip escaped character
+				i++
+			}
+			i++
+		}
+		if i >= len(src) {
+			return 0, 0, &Error{Msg: "encountered EOF inside string"}
+		}
+		i++
+		if _, err := ast.Unquote(src[:i]); err != nil {
+			// Report the problem where it is, such as at an invalid escape.
+			return 0, err.(*ast.UnquoteError).Offset, &Error{Msg: fmt.Sprintf("invalid quoted string [%s]: %v", src[:i], err)}
+		}
+		return String, i, nil
+	}
+
+	// A sign is part of a following number or identifier
+	// (e.g. "-inf" or an enum value name), and is otherwise a symbol.
+	i := 0
+	if c == '-' || c == '+' {
+		i++
+	}
+	switch {
+	case i < len(src) && (isDigit(src[i]) || src[i] == '.' && i+1 < len(src) && isDigit(src[i+1])):
+		i, kind = scanNumber(src, i)
+		if i < len(src) && isIdentChar(src[i]) {
+			return 0, i, &Error{Msg: "need space between number and identifier"}
+		}
+		return kind, i, nil
+	case i < len(src) && (isIdentChar(src[i]) || src[i] == '.'):
+		for i < len(src) && (isIdentChar(src[i]) || src[i] == '.') {
+			i++
+		}
+		return Ident, i, nil
+	case i == 1:
+		return Symbol, 1, nil
+	case c >= utf8.RuneSelf:
+		r, _ := utf8.DecodeRuneInString(src)
+		return 0, 0, &Error{Msg: fmt.Sprintf("non-ASCII character %q is only allowed in strings and comments", r)}
+	}
+	return 0, 0, &Error{Msg: fmt.Sprintf("unexpected byte 0x%02x (%q)", c, src[:1])}
+}
+
+// scanNumber scans the numeric literal in s that starts at i,
+// after any sign, and returns the index just past it and its kind.
+func scanNumber(s string, i int) (int, Kind) {
+	if i+1 < len(s) && s[i] == '0' && (s[i+1] == 'x' || s[i+1] == 'X') {
+		i += 2
+		for i < len(s) && isHexDigit(s[i]) {
+			i++
+		}
+		return i, Int
+	}
+	kind := Int
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	if i < len(s) && s[i] == '.' {
+		kind = Float
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '-' || s[j] == '+') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			kind = Float
+			for i = j; i < len(s) && isDigit(s[i]); i++ {
+			}
+		}
+	}
+	return i, kind
+}
+
+func isWhitespace(c byte) bool {
+	// TODO: do more accurately
+	return unicode.IsSpace(rune(c))
+}
+
+// Identifiers are matched by [_A-Za-z0-9], along with dots between their parts.
+func isIdentChar(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || isDigit(c) || c == '_'
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
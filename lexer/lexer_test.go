@@ -0,0 +1,129 @@
+package lexer
+
+import (
+	"io"
+	"testing"
+
+	"github.com/dsymonds/gotoc/ast"
+)
+
+func pos(line, offset int) ast.Position { return ast.Position{Line: line, Offset: offset} }
+
+func TestKinds(t *testing.T) {
+	const input = `foo=-1 .foo.Bar -inf 1.5e3 -.5 2E-3 0x1F 017 "s" 'q' - ; 3.`
+	want := []struct {
+		value string
+		kind  Kind
+	}{
+		{"foo", Ident},
+		{"=", Symbol},
+		{"-1", Int},
+		{".foo.Bar", Ident},
+		{"-inf", Ident},
+		{"1.5e3", Float},
+		{"-.5", Float},
+		{"2E-3", Float},
+		{"0x1F", Int},
+		{"017", Int},
+		{`"s"`, String},
+		{`'q'`, String},
+		{"-", Symbol},
+		{";", Symbol},
+		{"3.", Float},
+	}
+	s := New(input)
+	for i, w := range want {
+		tok, err := s.Scan()
+		if err != nil {
+			t.Fatalf("Token %d: %v", i, err)
+		}
+		if tok.Value != w.value || tok.Kind != w.kind {
+			t.Errorf("Token %d is %q (%v), want %q (%v)", i, tok.Value, tok.Kind, w.value, w.kind)
+		}
+	}
+	if tok, err := s.Scan(); err != io.EOF {
+		t.Errorf("Got %q, %v after the last token, want EOF", tok.Value, err)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	const input = "\uFEFFsyntax = // foo\n  \"proto2\"; /* a\n b */ x"
+	want := []Token{
+		{Ident, "syntax", pos(1, 3), pos(1, 9)},
+		{Symbol, "=", pos(1, 10), pos(1, 11)},
+		{Comment, "// foo", pos(1, 12), pos(1, 18)},
+		{String, `"proto2"`, pos(2, 21), pos(2, 29)},
+		{Symbol, ";", pos(2, 29), pos(2, 30)},
+		{Comment, "/* a\n b */", pos(2, 31), pos(3, 41)},
+		{Ident, "x", pos(3, 42), pos(3, 43)},
+	}
+	s := New(input)
+	for i, w := range want {
+		tok, err := s.Scan()
+		if err != nil {
+			t.Fatalf("Token %d: %v", i, err)
+		}
+		if tok != w {
+			t.Errorf("Token %d is %+v, want %+v", i, tok, w)
+		}
+	}
+	if _, err := s.Scan(); err != io.EOF {
+		t.Errorf("Got %v after the last token, want EOF", err)
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	const input = "a // foo\r\n/* x\r\n */\r\nb"
+	want := []Token{
+		{Ident, "a", pos(1, 0), pos(1, 1)},
+		{Comment, "// foo", pos(1, 2), pos(1, 8)},
+		{Comment, "/* x\r\n */", pos(2, 10), pos(3, 19)},
+		{Ident, "b", pos(4, 21), pos(4, 22)},
+	}
+	s := New(input)
+	for i, w := range want {
+		tok, err := s.Scan()
+		if err != nil {
+			t.Fatalf("Token %d: %v", i, err)
+		}
+		if tok != w {
+			t.Errorf("Token %d is %+v, want %+v", i, tok, w)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   ast.Position
+	}{
+		{"123abc", pos(1, 3)},
+		{"1e", pos(1, 1)},
+		{"0x1G", pos(1, 3)},
+		{"a\n/* foo", pos(2, 2)},
+		{`"foo`, pos(1, 0)},
+		{`'\z'`, pos(1, 1)},
+		{`x = "ab\q";`, pos(1, 7)},
+		{`"\xg"`, pos(1, 1)},
+		{`"\u12"`, pos(1, 1)},
+		{"\"a\nb\"", pos(1, 2)},
+		{"a\n'\\\n'", pos(2, 3)},
+		{"é", pos(1, 0)},
+		{"#", pos(1, 0)},
+	}
+	for _, test := range tests {
+		s := New(test.input)
+		var err error
+		for err == nil {
+			_, err = s.Scan()
+		}
+		le, ok := err.(*Error)
+		if !ok {
+			t.Errorf("Scanning %q gave %v, want an *Error", test.input, err)
+			continue
+		}
+		if le.Pos != test.pos {
+			t.Errorf("Scanning %q gave an error at %+v, want %+v", test.input, le.Pos, test.pos)
+		}
+	}
+}
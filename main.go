@@ -10,16 +10,36 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
 
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/descdiff"
+	"github.com/dsymonds/gotoc/fdsio"
+	"github.com/dsymonds/gotoc/fingerprint"
+	"github.com/dsymonds/gotoc/fix"
 	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/dsymonds/gotoc/generator"
+	"github.com/dsymonds/gotoc/goembed"
+	"github.com/dsymonds/gotoc/gostruct"
+	"github.com/dsymonds/gotoc/jsondesc"
+	"github.com/dsymonds/gotoc/manifest"
+	"github.com/dsymonds/gotoc/minify"
+	_ "github.com/dsymonds/gotoc/openapi" // registers the "openapi" generator
 	"github.com/dsymonds/gotoc/parser"
+	"github.com/dsymonds/gotoc/printer"
+	"github.com/dsymonds/gotoc/reflection"
+	"github.com/dsymonds/gotoc/remote"
+	"github.com/dsymonds/gotoc/server"
+	"github.com/dsymonds/gotoc/wkt"
 )
 
 var (
@@ -27,105 +47,776 @@ var (
 	helpShort = flag.Bool("h", false, "Show usage text (same as --help).")
 	helpLong  = flag.Bool("help", false, "Show usage text (same as -h).")
 
-	importPath     = flag.String("import_path", ".", "Comma-separated list of paths to search for imports.")
-	pluginBinary   = flag.String("plugin", "protoc-gen-go", "The code generator plugin to use.")
 	descriptorOnly = flag.Bool("descriptor_only", false, "Whether to print out only the FileDescriptorSet.")
-	params         = flag.String("params", "", "Parameters to pass to the code generator plugin (plugin-specific format).")
+	descriptorSet  = flag.String("descriptor_set_out", "", "If set, write the FileDescriptorSet in binary form to this file (e.g. as a baseline for the verify subcommand), instead of running a plugin.")
+	params         = flag.String("params", "", "Parameters to pass to the code generators named by --plugin (plugin-specific format).")
+	outDir         = flag.String("out_dir", "", "The directory under which to write the files of the code generators named by --plugin; by default, the current directory.")
+	manifestFile   = flag.String("manifest", "", "If set, a file recording the hashes of generated outputs; unchanged outputs are not rewritten.")
+	incremental    = flag.Bool("incremental", false, "Whether to skip running the code generators when --manifest shows its inputs and outputs are unchanged.")
+	minifyOutput   = flag.Bool("minify", false, "Whether to strip comments, default json_names and other inessentials from the descriptors written by --descriptor_only, --descriptor_set_out and --embed_out.")
+	retainSource   = flag.Bool("retain_source_options", false, "Whether to keep options with source retention in the generated descriptors.")
+	explicitSyntax = flag.Bool("explicit_syntax", false, "Whether to set the syntax of every file descriptor, including \"proto2\" ones, where it is usually left unset.")
+	protocDefaults = flag.Bool("protoc_defaults", false, "Whether to normalize numeric default values as protoc does (e.g. 0x10 becomes 16), instead of keeping them as written.")
+	includeImports = flag.Bool("include_imports", false, "Whether the descriptors written by --descriptor_only, --descriptor_set_out and --embed_out should include all the imports of the named files, not just the named files.")
+	sourceInfo     = flag.Bool("include_source_info", false, "Whether to include source code info (spans and comments) in the descriptors written by --descriptor_only, --descriptor_set_out and --embed_out.")
+	missingSyntax  = flag.String("missing_syntax", "allow", "What to do about files with no syntax statement: allow, warn or error.")
+
+	embedOut      = flag.String("embed_out", "", "If set, write a Go file in this package that embeds the FileDescriptorSet, instead of running a plugin.")
+	embedFile     = flag.String("embed_file", "descriptor_set.go", "The file written by --embed_out.")
+	embedVar      = flag.String("embed_var", "FileDescriptorSet", "The name of the variable written by --embed_out.")
+	embedRegister = flag.Bool("embed_register", false, "Whether the file written by --embed_out should register its descriptors with the proto package.")
+
+	reflectionImport = flag.String("reflection_import", "", "Address (host:port) of a gRPC reflection service from which to fetch imports not found locally.")
+	remoteImport     = flag.String("remote_import", "", "Comma-separated list of HTTPS base URLs from which to fetch imports not found locally.")
+	remotePins       = flag.String("remote_pins", "", "File of SHA-256 hashes (in sha256sum format) that remote imports must match.")
+	builtinWKT       = flag.Bool("builtin_wkt", true, "Whether to supply google/protobuf/*.proto files from copies built into gotoc when they are not found in the import path.")
+	wktOverride      = flag.String("wkt_override", "", "Directory, or FileDescriptorSet file, whose google/protobuf/*.proto files take precedence over any other copies.")
+	remoteCache      = flag.String("remote_cache", defaultRemoteCache(), "Directory in which to cache pinned remote imports.")
+
+	baseline = flag.String("baseline", "", "The FileDescriptorSet file that the verify subcommand compares against.")
+
+	httpAddr      = flag.String("http", ":8080", "The address on which the server subcommand listens.")
+	serverPlugins = flag.String("server_plugins", "", "Comma-separated list of plugin binaries that clients of the server subcommand may run.")
 )
 
-func fullPath(binary string, paths []string) string {
-	if strings.Index(binary, "/") >= 0 {
-		// path with path component
-		return binary
+// importPaths are the paths to search for imports, in the order given by
+// --import_path, -I and --proto_path. If there are none, "." is searched.
+var importPaths []string
+
+// plugins are the values of --plugin, in order.
+var plugins []string
+
+func init() {
+	flag.Var(listFlag{&importPaths, ","}, "import_path", "Comma-separated list of paths (directories, or zip or tar archives) to search for imports. May be repeated, and mixed with -I. (default \".\")")
+	flag.Var(listFlag{&importPaths, string(filepath.ListSeparator)}, "I", "A path to search for imports, as for protoc; may be repeated, and may be a list separated by \""+string(filepath.ListSeparator)+"\". Same as --proto_path.")
+	flag.Var(listFlag{&importPaths, string(filepath.ListSeparator)}, "proto_path", "Same as -I.")
+	flag.Var(listFlag{&plugins, ","}, "plugin", "A code generator to run, either one compiled in or a plugin binary, writing files to the current directory; may be repeated. As in protoc, protoc-gen-NAME=PATH instead sets the plugin binary used by --NAME_out. (default protoc-gen-go, unless --NAME_out is given)")
+}
+
+// listFlag is a flag.Value that appends to a list each time it is set.
+type listFlag struct {
+	list *[]string
+	sep  string // separator of elements within one value
+}
+
+func (lf listFlag) String() string {
+	if lf.list == nil {
+		return ""
 	}
-	for _, p := range paths {
-		full := path.Join(p, binary)
-		fi, err := os.Stat(full)
-		if err == nil && !fi.IsDir() {
-			return full
+	return strings.Join(*lf.list, lf.sep)
+}
+
+func (lf listFlag) Set(s string) error {
+	*lf.list = append(*lf.list, strings.Split(s, lf.sep)...)
+	return nil
+}
+
+// An output is a code generator to run, and where to put what it generates.
+type output struct {
+	name      string // NAME of --NAME_out, if that is where it came from
+	generator string // compiled-in generator or plugin binary, as for --plugin
+	param     string // parameter to pass to the generator
+	dir       string // directory under which to write files; "" for the current one
+}
+
+// protocArgs handles the arguments that gotoc accepts for compatibility
+// with protoc, but that the flag package cannot parse. It rewrites "-Ipath"
+// as "-I=path", and removes --NAME_out=[PARAMS:]DIR and --NAME_opt=PARAMS,
+// returning the outputs that they describe. Their generators are set by
+// resolveOutputs, once the flags have been parsed.
+//
+// As in protoc, the parameters of --NAME_opt are added to those of
+// --NAME_out, separated by commas.
+func protocArgs(args []string) ([]string, []*output) {
+	var rest []string
+	var outs []*output
+	byName := make(map[string]*output)
+	opts := make(map[string][]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if strings.HasPrefix(arg, "-I") && len(arg) > 2 && arg[2] != '=' {
+			arg = "-I=" + arg[2:]
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		value := ""
+		j := strings.Index(name, "=")
+		if j >= 0 {
+			name, value = name[:j], name[j+1:]
 		}
+		isOut, isOpt := strings.HasSuffix(name, "_out"), strings.HasSuffix(name, "_opt")
+		if !strings.HasPrefix(arg, "-") || !(isOut || isOpt) || flag.Lookup(name) != nil {
+			rest = append(rest, arg)
+			continue
+		}
+		if j < 0 {
+			// The value is the next argument, as in "--go_out dir".
+			if i+1 == len(args) {
+				fatalf("Missing value for %s", arg)
+			}
+			i++
+			value = args[i]
+		}
+		gen := name[:len(name)-len("_out")]
+		if isOpt {
+			opts[gen] = append(opts[gen], value)
+			continue
+		}
+		if byName[gen] != nil {
+			fatalf("%s was given more than once", arg)
+		}
+		out := &output{name: gen, dir: value}
+		if k := strings.Index(value, ":"); k >= 0 {
+			out.param, out.dir = value[:k], value[k+1:]
+		}
+		byName[gen] = out
+		outs = append(outs, out)
 	}
-	return ""
+	for gen, o := range opts {
+		out := byName[gen]
+		if out == nil {
+			fatalf("--%s_opt was given without --%s_out", gen, gen)
+		}
+		if out.param != "" {
+			o = append([]string{out.param}, o...)
+		}
+		out.param = strings.Join(o, ",")
+	}
+	return rest, outs
+}
+
+// resolveOutputs sets the generators of outs, from --NAME_out flags,
+// and adds an output for each generator named by --plugin.
+//
+// As in protoc, the generator for --NAME_out is the plugin binary given by
+// --plugin=protoc-gen-NAME=PATH if there is one. Otherwise it is the
+// compiled-in generator NAME, or failing that the plugin protoc-gen-NAME.
+// With no outputs at all, protoc-gen-go is run.
+func resolveOutputs(outs []*output) []*output {
+	paths := make(map[string]string)
+	var gens []string
+	for _, p := range plugins {
+		if i := strings.Index(p, "="); i >= 0 {
+			paths[p[:i]] = p[i+1:]
+		} else {
+			gens = append(gens, p)
+		}
+	}
+	for _, out := range outs {
+		switch bin, ok := paths["protoc-gen-"+out.name]; {
+		case ok:
+			out.generator = bin
+		case generator.Lookup(out.name) != nil:
+			out.generator = out.name
+		default:
+			out.generator = "protoc-gen-" + out.name
+		}
+	}
+	if len(gens) == 0 && len(outs) == 0 {
+		gens = []string{"protoc-gen-go"}
+	}
+	for _, g := range gens {
+		outs = append(outs, &output{generator: g, param: *params, dir: *outDir})
+	}
+	return outs
+}
+
+func defaultRemoteCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gotoc", "remote")
+}
+
+// commands are the subcommands, named by the first argument.
+// Each is passed the arguments remaining after flags are parsed.
+var commands = map[string]func(args []string){
+	"explain-imports": explainImports,
+	"fingerprint":     printFingerprints,
+	"fix":             fixFiles,
+	"from-go":         fromGo,
+	"generate":        generate,
+	"plugin":          runPlugin,
+	"server":          serve,
+	"verify":          verify,
 }
 
 func main() {
 	flag.Usage = usage
-	flag.Parse()
+	if isPlugin() {
+		runPlugin(nil)
+		return
+	}
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			args, outs := protocArgs(os.Args[2:])
+			if len(outs) > 0 {
+				fatalf("The %s subcommand does not run code generators", os.Args[1])
+			}
+			flag.CommandLine.Parse(args)
+			if *helpShort || *helpLong {
+				flag.Usage()
+				os.Exit(1)
+			}
+			cmd(flag.Args())
+			return
+		}
+	}
+	args, outs := protocArgs(os.Args[1:])
+	flag.CommandLine.Parse(args)
 	if *helpShort || *helpLong || flag.NArg() == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	fs, err := parser.ParseFiles(flag.Args(), strings.Split(*importPath, ","))
-	if err != nil {
-		fatalf("%v", err)
-	}
-	fds, err := gendesc.Generate(fs)
+	fs, filenames := parseFiles(flag.Args())
+	fds, err := gendesc.GenerateWithOptions(fs, gendesc.Options{
+		// Plugins always get source info, as from protoc.
+		SourceInfo:     *sourceInfo || !writesDescriptors(),
+		ProtocDefaults: *protocDefaults,
+		ExplicitSyntax: *explicitSyntax,
+	})
 	if err != nil {
 		fatalf("Failed generating descriptors: %v", err)
 	}
+	if !*retainSource {
+		gendesc.StripSourceRetention(fds)
+	}
+	if !*includeImports && writesDescriptors() {
+		fds.File = namedFiles(fds.File, filenames)
+	}
 
+	if *minifyOutput && writesDescriptors() {
+		minify.Minify(fds)
+	}
 	if *descriptorOnly {
 		proto.MarshalText(os.Stdout, fds)
 		os.Exit(0)
 	}
+	if *descriptorSet != "" {
+		b, err := proto.Marshal(fds)
+		if err != nil {
+			fatalf("Failed encoding descriptors: %v", err)
+		}
+		if err := ioutil.WriteFile(*descriptorSet, b, 0644); err != nil {
+			fatalf("Failed writing output file: %v", err)
+		}
+		os.Exit(0)
+	}
+	if *embedOut != "" {
+		src, err := goembed.Generate(fds, goembed.Options{
+			Package:  *embedOut,
+			Var:      *embedVar,
+			Register: *embedRegister,
+		})
+		if err != nil {
+			fatalf("Failed generating embedded descriptors: %v", err)
+		}
+		if err := ioutil.WriteFile(*embedFile, src, 0644); err != nil {
+			fatalf("Failed writing output file: %v", err)
+		}
+		os.Exit(0)
+	}
 
 	//fmt.Println("-----")
 	//proto.MarshalText(os.Stdout, fds)
 	//fmt.Println("-----")
 
-	// Prepare request.
-	cgRequest := &plugin.CodeGeneratorRequest{
-		FileToGenerate: flag.Args(),
-		ProtoFile:      fds.File,
+	// Prepare requests. Each generator gets the same descriptors.
+	outs = resolveOutputs(outs)
+	reqs := make([]*plugin.CodeGeneratorRequest, len(outs))
+	for i, out := range outs {
+		reqs[i] = &plugin.CodeGeneratorRequest{
+			FileToGenerate: filenames,
+			ProtoFile:      fds.File,
+		}
+		if out.param != "" {
+			reqs[i].Parameter = proto.String(out.param)
+		}
+	}
+	var mf *manifest.Manifest
+	var inputs string
+	if *manifestFile != "" {
+		if mf, err = manifest.Load(*manifestFile); err != nil {
+			fatalf("Failed loading manifest: %v", err)
+		}
+		var in bytes.Buffer
+		for i, out := range outs {
+			raw, err := proto.Marshal(reqs[i])
+			if err != nil {
+				fatalf("Failed encoding CG request: %v", err)
+			}
+			fmt.Fprintf(&in, "%s\x00%s\x00%s\n", out.generator, out.dir, manifest.Hash(raw))
+		}
+		inputs = manifest.Hash(in.Bytes())
+		if *incremental && mf.UpToDate(inputs) {
+			os.Exit(0)
+		}
+	}
+
+	// Run the generators in order, collecting their files.
+	gen := &generatedFiles{content: make(map[string][]byte)}
+	for i, out := range outs {
+		cgResponse, err := generator.Run(out.generator, reqs[i])
+		if err != nil {
+			fatalf("%v", err)
+		}
+		// As in protoc, an error reported by a generator is fatal,
+		// and nothing is written.
+		if cgResponse.Error != nil {
+			fatalf("--%s_out: %s", out.name, cgResponse.GetError())
+		}
+		if err := gen.add(out, cgResponse); err != nil {
+			fatalf("Bad CG response from %s: %v", out.generator, err)
+		}
+	}
+	outputs := make(map[string]string)
+	for _, name := range gen.names {
+		content := gen.content[name]
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			fatalf("Failed creating output directory: %v", err)
+		}
+		if _, err := manifest.WriteFile(name, content); err != nil {
+			fatalf("Failed writing output file: %v", err)
+		}
+		outputs[name] = manifest.Hash(content)
+	}
+	if mf != nil {
+		mf.Inputs, mf.Outputs = inputs, outputs
+		if err := mf.Save(*manifestFile); err != nil {
+			fatalf("Failed writing manifest: %v", err)
+		}
+	}
+}
+
+// printFingerprints prints the fingerprint of every message, enum and service
+// defined in the named files, sorted by name.
+func printFingerprints(filenames []string) {
+	if len(filenames) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	fs, names := parseFiles(filenames)
+	fds, err := gendesc.Generate(fs)
+	if err != nil {
+		fatalf("Failed generating descriptors: %v", err)
+	}
+	fps := fingerprint.Compute(fds)
+
+	// Only report on the named files, not their imports.
+	var lines []string
+	for _, fd := range namedFiles(fds.File, names) {
+		prefix := ""
+		if fd.GetPackage() != "" {
+			prefix = fd.GetPackage() + "."
+		}
+		for _, name := range typeNames(prefix, fd.MessageType, fd.EnumType) {
+			lines = append(lines, name+" "+fps[name])
+		}
+		for _, srv := range fd.Service {
+			name := prefix + srv.GetName()
+			lines = append(lines, name+" "+fps[name])
+		}
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+// writesDescriptors reports whether the flags ask for the descriptors
+// to be written out, instead of being given to code generators.
+func writesDescriptors() bool {
+	return *descriptorOnly || *descriptorSet != "" || *embedOut != ""
+}
+
+// typeNames returns the fully-qualified names of msgs and enums and the types nested in them.
+func typeNames(prefix string, msgs []*pb.DescriptorProto, enums []*pb.EnumDescriptorProto) []string {
+	var names []string
+	for _, msg := range msgs {
+		name := prefix + msg.GetName()
+		names = append(names, name)
+		names = append(names, typeNames(name+".", msg.NestedType, msg.EnumType)...)
+	}
+	for _, enum := range enums {
+		names = append(names, prefix+enum.GetName())
+	}
+	return names
+}
+
+// generatedFiles holds the files produced by code generators until they are written.
+type generatedFiles struct {
+	names   []string          // paths, in the order they were first generated
+	content map[string][]byte // by path
+}
+
+// add adds the files in resp, which was produced for out.
+// As the plugin protocol specifies, a file with no name continues
+// the file before it, and a file with an insertion point is inserted
+// into a file generated earlier, by this generator or another.
+func (gf *generatedFiles) add(out *output, resp *plugin.CodeGeneratorResponse) error {
+	var files []*plugin.CodeGeneratorResponse_File
+	for _, f := range resp.File {
+		if f.Name == nil {
+			if len(files) == 0 {
+				return fmt.Errorf("the first file has no name")
+			}
+			prev := files[len(files)-1]
+			prev.Content = proto.String(prev.GetContent() + f.GetContent())
+			continue
+		}
+		files = append(files, &plugin.CodeGeneratorResponse_File{
+			Name:           f.Name,
+			InsertionPoint: f.InsertionPoint,
+			Content:        proto.String(f.GetContent()),
+		})
+	}
+	for _, f := range files {
+		name, err := outputPath(out.dir, f.GetName())
+		if err != nil {
+			return err
+		}
+		if f.GetInsertionPoint() != "" {
+			if err := gf.insert(name, f.GetInsertionPoint(), f.GetContent()); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := gf.content[name]; ok {
+			return fmt.Errorf("%s: tried to write the same file twice", name)
+		}
+		gf.names = append(gf.names, name)
+		gf.content[name] = []byte(f.GetContent())
+	}
+	return nil
+}
+
+// insert inserts content into the file at path name, above the line
+// holding the marker of the named insertion point. As in protoc,
+// each line of content is indented as much as the marker's line.
+func (gf *generatedFiles) insert(name, point, content string) error {
+	old, ok := gf.content[name]
+	if !ok {
+		return fmt.Errorf("%s: tried to insert into a file that was not generated", name)
 	}
-	if *params != "" {
-		cgRequest.Parameter = params
+	i := bytes.Index(old, []byte("@@protoc_insertion_point("+point+")"))
+	if i < 0 {
+		return fmt.Errorf("%s: insertion point %q not found", name, point)
 	}
-	buf, err := proto.Marshal(cgRequest)
+	start := bytes.LastIndexByte(old[:i], '\n') + 1
+	line := old[start:i]
+	indent := line[:len(line)-len(bytes.TrimLeft(line, " \t"))]
+
+	var buf bytes.Buffer
+	buf.Write(old[:start])
+	for _, l := range strings.SplitAfter(content, "\n") {
+		if l == "" {
+			continue
+		}
+		if l != "\n" {
+			buf.Write(indent)
+		}
+		buf.WriteString(l)
+	}
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		buf.WriteByte('\n')
+	}
+	buf.Write(old[start:])
+	gf.content[name] = buf.Bytes()
+	return nil
+}
+
+// outputPath returns where to write the generated file called name,
+// which is slash-separated and relative to dir.
+func outputPath(dir, name string) (string, error) {
+	clean := path.Clean(name)
+	if name == "" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("file name %q is not within the output directory", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// namedFiles returns the descriptors in fds of the files with the given names,
+// keeping their order.
+func namedFiles(fds []*pb.FileDescriptorProto, names []string) []*pb.FileDescriptorProto {
+	named := make(map[string]bool)
+	for _, name := range names {
+		named[name] = true
+	}
+	var files []*pb.FileDescriptorProto
+	for _, fd := range fds {
+		if named[fd.GetName()] {
+			files = append(files, fd)
+		}
+	}
+	return files
+}
+
+// fixFiles applies mechanical fixes to the named files, rewriting those
+// that change, and prints a summary of the changes.
+func fixFiles(filenames []string) {
+	if len(filenames) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	for _, filename := range filenames {
+		if jsondesc.IsJSON(filename) {
+			fatalf("Cannot fix %s: only .proto sources can be fixed", filename)
+		}
+	}
+	fs, names := parseFiles(filenames)
+	files := make(map[string]*ast.File)
+	for _, f := range fs.Files {
+		files[f.Name] = f
+	}
+
+	total, changed := 0, 0
+	for i, filename := range filenames {
+		f := files[names[i]]
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fatalf("Failed reading %s: %v", filename, err)
+		}
+		changes := fix.File(fs, f, src)
+		if len(changes) == 0 {
+			continue
+		}
+		if err := ioutil.WriteFile(filename, printer.Format(f), 0644); err != nil {
+			fatalf("Failed writing %s: %v", filename, err)
+		}
+		for _, c := range changes {
+			if c.Line > 0 {
+				fmt.Printf("%s:%d: %s\n", filename, c.Line, c.Message)
+			} else {
+				fmt.Printf("%s: %s\n", filename, c.Message)
+			}
+		}
+		total += len(changes)
+		changed++
+	}
+	fmt.Printf("%d change(s) in %d file(s)\n", total, changed)
+}
+
+// fromGo prints a draft .proto file with a message for each exported
+// struct type in the Go package in the named directory.
+func fromGo(args []string) {
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	f, err := gostruct.File(args[0])
 	if err != nil {
-		fatalf("Failed marshaling CG request: %v", err)
+		fatalf("Failed reading Go package: %v", err)
 	}
+	if err := printer.Fprint(os.Stdout, f); err != nil {
+		fatalf("Failed writing output: %v", err)
+	}
+}
 
-	// Find plugin.
-	pluginPath := fullPath(*pluginBinary, strings.Split(os.Getenv("PATH"), ":"))
-	if pluginPath == "" {
-		fatalf("Failed finding plugin binary %q", *pluginBinary)
+// verify compiles the named files and checks that the result matches the
+// baseline descriptor set, exiting with a diff if it does not.
+// The descriptors are generated as for --descriptor_set_out with the same
+// flags, so only the named files are compared unless --include_imports is set.
+func verify(filenames []string) {
+	if len(filenames) == 0 || *baseline == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	fs, names := parseFiles(filenames)
+	got, err := gendesc.GenerateWithOptions(fs, gendesc.Options{
+		SourceInfo:     *sourceInfo,
+		ProtocDefaults: *protocDefaults,
+		ExplicitSyntax: *explicitSyntax,
+	})
+	if err != nil {
+		fatalf("Failed generating descriptors: %v", err)
+	}
+	if !*retainSource {
+		gendesc.StripSourceRetention(got)
+	}
+	if !*includeImports {
+		got.File = namedFiles(got.File, names)
+	}
+	if *minifyOutput {
+		minify.Minify(got)
 	}
 
-	// Run the plugin subprocess.
-	cmd := &exec.Cmd{
-		Path:   pluginPath,
-		Stdin:  bytes.NewBuffer(buf),
-		Stderr: os.Stderr,
+	// The baseline may be large, so read it a file at a time.
+	f, err := os.Open(*baseline)
+	if err != nil {
+		fatalf("Failed reading baseline: %v", err)
 	}
-	buf, err = cmd.Output()
+	defer f.Close()
+	r := fdsio.NewReader(f)
+	diff, err := descdiff.Stream(func() (*pb.FileDescriptorProto, error) {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		fd, err := e.Decode()
+		if err == nil && *minifyOutput {
+			minify.Minify(&pb.FileDescriptorSet{File: []*pb.FileDescriptorProto{fd}})
+		}
+		return fd, err
+	}, got)
 	if err != nil {
-		fatalf("Failed running plugin: %v", err)
+		fatalf("Failed parsing baseline %s: %v", *baseline, err)
+	}
+	if diff != "" {
+		fatalf("Descriptors differ from %s (- baseline, + current):\n%s", *baseline, diff)
+	}
+}
+
+// serve runs an HTTP server that compiles .proto sources sent to it.
+func serve(args []string) {
+	if len(args) != 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	s := new(server.Server)
+	if *serverPlugins != "" {
+		s.Plugins = strings.Split(*serverPlugins, ",")
 	}
+	fatalf("%v", http.ListenAndServe(*httpAddr, s))
+}
 
-	// Parse the response.
-	cgResponse := new(plugin.CodeGeneratorResponse)
-	if err = proto.Unmarshal(buf, cgResponse); err != nil {
-		fatalf("Failed unmarshaling CG response: %v", err)
+// parseFiles parses the named files and their imports,
+// locating files as directed by the flags.
+// It also returns the canonical names of the named files.
+// Files ending in .json hold JSON-encoded descriptors (see package jsondesc);
+// the names returned for these are those of their root files.
+func parseFiles(filenames []string) (*ast.FileSet, []string) {
+	var fallbacks []func(string) (*ast.File, error)
+	if *builtinWKT {
+		fallbacks = append(fallbacks, wkt.Import)
+	}
+	if *reflectionImport != "" {
+		imp := reflection.NewImporter(*reflectionImport)
+		defer imp.Close()
+		fallbacks = append(fallbacks, imp.Import)
+	}
+	if *remoteImport != "" {
+		imp, err := remote.NewImporter(strings.Split(*remoteImport, ","))
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if *remotePins != "" {
+			if imp.Pins, err = remote.LoadPins(*remotePins); err != nil {
+				fatalf("Failed loading pins: %v", err)
+			}
+		}
+		imp.CacheDir = *remoteCache
+		fallbacks = append(fallbacks, imp.Import)
 	}
 
-	// TODO: check cgResponse.Error
+	var override func(string) (*ast.File, error)
+	if *wktOverride != "" {
+		o, err := wkt.LoadOverrides(*wktOverride)
+		if err != nil {
+			fatalf("Failed loading well-known type overrides: %v", err)
+		}
+		override = o.Import
+	}
 
-	for _, f := range cgResponse.File {
-		// TODO: If f.Name is nil, the content should be appended to the previous file.
-		if f.Name == nil || f.Content == nil {
-			fatalf("Malformed CG response")
+	paths := importPaths
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	config := &parser.Config{
+		ImportPaths: paths,
+		Override:    override,
+		Fallback:    chainFallbacks(fallbacks),
+	}
+	switch *missingSyntax {
+	case "allow":
+		config.MissingSyntax = parser.SyntaxOptional
+	case "warn":
+		config.MissingSyntax = parser.SyntaxWarn
+	case "error":
+		config.MissingSyntax = parser.SyntaxRequired
+	default:
+		fatalf("Bad --missing_syntax value %q; want allow, warn or error", *missingSyntax)
+	}
+	var names, jsonInputs []string
+	for _, filename := range filenames {
+		if jsondesc.IsJSON(filename) {
+			jsonInputs = append(jsonInputs, filename)
+			continue
 		}
-		if err := ioutil.WriteFile(*f.Name, []byte(*f.Content), 0644); err != nil {
-			fatalf("Failed writing output file: %v", err)
+		name, err := config.CanonicalName(filename)
+		if err != nil {
+			fatalf("%v", err)
 		}
+		names = append(names, name)
+	}
+	if len(jsonInputs) > 0 {
+		// JSON-encoded descriptors are converted up front, and their files
+		// are supplied in preference to any other copies except overrides.
+		files, roots, err := jsondesc.Load(jsonInputs, func(deps []string) ([]*ast.File, error) {
+			fs, err := config.ParseFiles(deps)
+			if err != nil {
+				return nil, err
+			}
+			return fs.Files, nil
+		})
+		if err != nil {
+			fatalf("Failed loading JSON descriptors: %v", err)
+		}
+		config.Override = func(filename string) (*ast.File, error) {
+			if override != nil {
+				if f, err := override(filename); err != nil || f != nil {
+					return f, err
+				}
+			}
+			return files[filename], nil
+		}
+		names = append(names, roots...)
+	}
+	fs, err := config.ParseFiles(names)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	return fs, names
+}
+
+// chainFallbacks returns a fallback that tries each of fallbacks in turn.
+func chainFallbacks(fallbacks []func(string) (*ast.File, error)) func(string) (*ast.File, error) {
+	if len(fallbacks) == 0 {
+		return nil
+	}
+	return func(filename string) (*ast.File, error) {
+		for _, fb := range fallbacks {
+			f, err := fb(filename)
+			if err != nil || f != nil {
+				return f, err
+			}
+		}
+		return nil, nil
 	}
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage:  %s [options] <foo.proto> ...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage:  %s [options] <foo.proto|foo.json> ...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "        %s explain-imports [options] <foo.proto> ...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "        %s fingerprint [options] <foo.proto> ...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "        %s fix [options] <foo.proto> ...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "        %s from-go <dir>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "        %s generate [<dir> ...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "        %s plugin < request (or invoke as %s)\n", os.Args[0], pluginName)
+	fmt.Fprintf(os.Stderr, "        %s server [--http=<addr>] [--server_plugins=<plugin>,...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "        %s verify --baseline=<schema.fds> [options] <foo.proto> ...\n", os.Args[0])
 	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "  --NAME_out=[PARAMS:]DIR\n")
+	fmt.Fprintf(os.Stderr, "    \tAs in protoc, run the generator NAME (or plugin protoc-gen-NAME) with PARAMS, writing files to DIR; may be given for several generators.\n")
+	fmt.Fprintf(os.Stderr, "  --NAME_opt=PARAMS\n")
+	fmt.Fprintf(os.Stderr, "    \tMore parameters for the generator of --NAME_out.\n")
+	if names := generator.Names(); len(names) > 0 {
+		fmt.Fprintf(os.Stderr, "Compiled-in generators: %s\n", strings.Join(names, ", "))
+	}
 }
 
 func fatalf(format string, args ...interface{}) {
@@ -0,0 +1,86 @@
+/*
+Package manifest records the outputs produced from a set of inputs,
+so that unchanged outputs need not be regenerated or rewritten.
+*/
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Manifest maps the hash of a generator's inputs to the hashes of its outputs.
+type Manifest struct {
+	// Inputs is the hash of everything the outputs were generated from.
+	Inputs string `json:"inputs"`
+
+	// Outputs maps output filenames to the hash of their content.
+	Outputs map[string]string `json:"outputs"`
+}
+
+// Load reads a manifest. A missing file yields an empty manifest.
+func Load(filename string) (*Manifest, error) {
+	m := &Manifest{Outputs: make(map[string]string)}
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, fmt.Errorf("bad manifest %s: %v", filename, err)
+	}
+	if m.Outputs == nil {
+		m.Outputs = make(map[string]string)
+	}
+	return m, nil
+}
+
+// Save writes the manifest, unless it is unchanged on disk.
+func (m *Manifest) Save(filename string) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = WriteFile(filename, append(buf, '\n'))
+	return err
+}
+
+// UpToDate reports whether the manifest was recorded for the given inputs,
+// and every output it lists still exists with the recorded content.
+func (m *Manifest) UpToDate(inputs string) bool {
+	if m.Inputs == "" || m.Inputs != inputs {
+		return false
+	}
+	for name, h := range m.Outputs {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil || Hash(buf) != h {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash returns the hex-encoded SHA-256 hash of b.
+func Hash(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// WriteFile writes content to filename, unless the file already holds
+// exactly that content, so that its modification time is left alone.
+// It reports whether the file was written.
+func WriteFile(filename string, content []byte) (bool, error) {
+	if old, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(old, content) {
+		return false, nil
+	}
+	if err := ioutil.WriteFile(filename, content, 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,65 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotoc-manifest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "foo.pb.go")
+	mfile := filepath.Join(dir, "manifest.json")
+
+	m, err := Load(mfile)
+	if err != nil {
+		t.Fatalf("Load of missing manifest: %v", err)
+	}
+	if m.UpToDate("in1") {
+		t.Errorf("Empty manifest is up to date")
+	}
+
+	if wrote, err := WriteFile(out, []byte("package foo\n")); err != nil || !wrote {
+		t.Fatalf("WriteFile = %v, %v; want true, nil", wrote, err)
+	}
+	m.Inputs = "in1"
+	m.Outputs[out] = Hash([]byte("package foo\n"))
+	if err := m.Save(mfile); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// Rewriting the same content should leave the file alone.
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(out, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if wrote, err := WriteFile(out, []byte("package foo\n")); err != nil || wrote {
+		t.Errorf("WriteFile of unchanged content = %v, %v; want false, nil", wrote, err)
+	}
+	if fi, err := os.Stat(out); err != nil || !fi.ModTime().Equal(old) {
+		t.Errorf("WriteFile of unchanged content changed the modification time")
+	}
+
+	m, err = Load(mfile)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !m.UpToDate("in1") {
+		t.Errorf("Manifest is not up to date for the same inputs")
+	}
+	if m.UpToDate("in2") {
+		t.Errorf("Manifest is up to date for different inputs")
+	}
+	if err := ioutil.WriteFile(out, []byte("// edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if m.UpToDate("in1") {
+		t.Errorf("Manifest is up to date after an output was modified")
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Package minify strips descriptors down to what is needed at runtime,
+for embedding schemas in binaries or sending them over the network.
+*/
+package minify
+
+import (
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"github.com/dsymonds/gotoc/gendesc"
+)
+
+// Minify removes from fds, in place:
+//   - source code info, including comments;
+//   - json_name values that are the default for their field name;
+//   - options with source retention;
+//   - options messages left empty by the above.
+//
+// A json_name that differs from the default is kept, since it changes
+// the JSON encoding of the field.
+func Minify(fds *pb.FileDescriptorSet) {
+	gendesc.StripSourceRetention(fds)
+	for _, fd := range fds.File {
+		fd.SourceCodeInfo = nil
+		if isEmpty(fd.Options) {
+			fd.Options = nil
+		}
+		minifyFields(fd.Extension)
+		minifyMessages(fd.MessageType)
+		minifyEnums(fd.EnumType)
+		for _, srv := range fd.Service {
+			if isEmpty(srv.Options) {
+				srv.Options = nil
+			}
+			for _, mth := range srv.Method {
+				if isEmpty(mth.Options) {
+					mth.Options = nil
+				}
+			}
+		}
+	}
+}
+
+// Marshal minifies a copy of fds and returns its serialized form.
+func Marshal(fds *pb.FileDescriptorSet) ([]byte, error) {
+	fds = proto.Clone(fds).(*pb.FileDescriptorSet)
+	Minify(fds)
+	return proto.Marshal(fds)
+}
+
+func minifyMessages(msgs []*pb.DescriptorProto) {
+	for _, msg := range msgs {
+		if isEmpty(msg.Options) {
+			msg.Options = nil
+		}
+		minifyFields(msg.Field)
+		minifyFields(msg.Extension)
+		for _, oo := range msg.OneofDecl {
+			if isEmpty(oo.Options) {
+				oo.Options = nil
+			}
+		}
+		minifyMessages(msg.NestedType)
+		minifyEnums(msg.EnumType)
+	}
+}
+
+func minifyFields(fields []*pb.FieldDescriptorProto) {
+	for _, f := range fields {
+		if f.JsonName != nil && f.GetJsonName() == gendesc.JSONName(f.GetName()) {
+			f.JsonName = nil
+		}
+		if isEmpty(f.Options) {
+			f.Options = nil
+		}
+	}
+}
+
+func minifyEnums(enums []*pb.EnumDescriptorProto) {
+	for _, enum := range enums {
+		if isEmpty(enum.Options) {
+			enum.Options = nil
+		}
+		for _, v := range enum.Value {
+			if isEmpty(v.Options) {
+				v.Options = nil
+			}
+		}
+	}
+}
+
+// isEmpty reports whether m, a pointer to an options message, has nothing set.
+// It reports false for a nil pointer, so the caller need not clear it again.
+func isEmpty(m proto.Message) bool {
+	v := reflect.ValueOf(m)
+	if v.IsNil() {
+		return false
+	}
+	return proto.Equal(m, reflect.New(v.Type().Elem()).Interface().(proto.Message))
+}
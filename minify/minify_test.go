@@ -0,0 +1,75 @@
+package minify
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+const input = `
+file: <
+  name: "a.proto"
+  package: "a"
+  message_type: <
+    name: "M"
+    field: < name: "foo_bar" number: 1 label: LABEL_OPTIONAL type: TYPE_INT32 json_name: "fooBar" >
+    field: < name: "baz" number: 2 label: LABEL_OPTIONAL type: TYPE_INT32 json_name: "BAZ"
+      options: <
+        uninterpreted_option: < name: < name_part: "note" is_extension: true > string_value: "internal" >
+      >
+    >
+    options: < >
+  >
+  extension: <
+    name: "note" number: 100 label: LABEL_OPTIONAL type: TYPE_STRING extendee: ".a.M"
+    options: <
+      uninterpreted_option: < name: < name_part: "retention" is_extension: false > identifier_value: "RETENTION_SOURCE" >
+    >
+  >
+  source_code_info: <
+    location: < path: 4 path: 0 span: 1 span: 0 span: 10 leading_comments: " A message.\n" >
+  >
+>
+`
+
+const want = `
+file: <
+  name: "a.proto"
+  package: "a"
+  message_type: <
+    name: "M"
+    field: < name: "foo_bar" number: 1 label: LABEL_OPTIONAL type: TYPE_INT32 >
+    field: < name: "baz" number: 2 label: LABEL_OPTIONAL type: TYPE_INT32 json_name: "BAZ" >
+  >
+  extension: <
+    name: "note" number: 100 label: LABEL_OPTIONAL type: TYPE_STRING extendee: ".a.M"
+    options: <
+      uninterpreted_option: < name: < name_part: "retention" is_extension: false > identifier_value: "RETENTION_SOURCE" >
+    >
+  >
+>
+`
+
+func TestMinify(t *testing.T) {
+	fds, wantFDS := new(pb.FileDescriptorSet), new(pb.FileDescriptorSet)
+	if err := proto.UnmarshalText(input, fds); err != nil {
+		t.Fatalf("Bad input: %v", err)
+	}
+	if err := proto.UnmarshalText(want, wantFDS); err != nil {
+		t.Fatalf("Bad want: %v", err)
+	}
+
+	orig := proto.Clone(fds)
+	if _, err := Marshal(fds); err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !proto.Equal(fds, orig) {
+		t.Errorf("Marshal modified its argument")
+	}
+
+	Minify(fds)
+	if !proto.Equal(fds, wantFDS) {
+		t.Errorf("Minify produced\n%v\nwant\n%v", proto.MarshalTextString(fds), proto.MarshalTextString(wantFDS))
+	}
+}
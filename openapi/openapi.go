@@ -0,0 +1,418 @@
+/*
+Package openapi is a code generator that produces an OpenAPI v3 document
+describing the services in each file it is asked to generate.
+
+HTTP bindings are taken from google.api.http method options where present,
+whether they are uninterpreted or stored as extensions; for the latter,
+google/api/annotations.proto must be among the request's files.
+Other methods are described as gRPC-style POST requests to /package.Service/Method.
+Comments on services and methods (from SourceCodeInfo) become descriptions.
+
+The generator is registered with package generator as "openapi".
+*/
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/dsymonds/gotoc/generator"
+	"github.com/dsymonds/gotoc/options"
+)
+
+func init() {
+	generator.Register("openapi", generator.GeneratorFunc(Generate))
+}
+
+// Generate produces a .openapi.json file for each file to generate
+// that defines at least one service.
+func Generate(req *plugin.CodeGeneratorRequest) (*plugin.CodeGeneratorResponse, error) {
+	g := &gen{
+		types:   make(map[string]*pb.DescriptorProto),
+		options: options.NewResolver(req.ProtoFile),
+	}
+	byName := make(map[string]*pb.FileDescriptorProto)
+	for _, fd := range req.ProtoFile {
+		byName[fd.GetName()] = fd
+		g.indexTypes(packagePrefix(fd), fd.MessageType, fd.EnumType)
+	}
+
+	resp := new(plugin.CodeGeneratorResponse)
+	for _, name := range req.FileToGenerate {
+		fd, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("no descriptor for %s", name)
+		}
+		if len(fd.Service) == 0 {
+			continue
+		}
+		doc, err := g.document(fd)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		buf, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		resp.File = append(resp.File, &plugin.CodeGeneratorResponse_File{
+			Name:    proto.String(strings.TrimSuffix(name, ".proto") + ".openapi.json"),
+			Content: proto.String(string(buf) + "\n"),
+		})
+	}
+	return resp, nil
+}
+
+// These types are the subset of the OpenAPI v3 object model that is generated.
+
+type document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       info                `json:"info"`
+	Paths      map[string]pathItem `json:"paths"`
+	Components components          `json:"components"`
+}
+
+type info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type pathItem map[string]*operation // HTTP method (lowercase) => operation
+
+type operation struct {
+	OperationID string              `json:"operationId"`
+	Summary     string              `json:"summary,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Tags        []string            `json:"tags,omitempty"`
+	Parameters  []parameter         `json:"parameters,omitempty"`
+	RequestBody *requestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]response `json:"responses"`
+}
+
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]mediaType `json:"content"`
+}
+
+type response struct {
+	Description string               `json:"description"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type components struct {
+	Schemas map[string]*schema `json:"schemas,omitempty"`
+}
+
+type schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	AdditionalProperties *schema            `json:"additionalProperties,omitempty"`
+}
+
+type gen struct {
+	types map[string]*pb.DescriptorProto // fully-qualified message name => descriptor
+	enums map[string]*pb.EnumDescriptorProto
+
+	options *options.Resolver // for custom options stored as extensions
+
+	schemas map[string]*schema // schemas for the document being generated
+}
+
+func packagePrefix(fd *pb.FileDescriptorProto) string {
+	if fd.GetPackage() == "" {
+		return ""
+	}
+	return "." + fd.GetPackage()
+}
+
+func (g *gen) indexTypes(prefix string, msgs []*pb.DescriptorProto, enums []*pb.EnumDescriptorProto) {
+	if g.enums == nil {
+		g.enums = make(map[string]*pb.EnumDescriptorProto)
+	}
+	for _, msg := range msgs {
+		name := prefix + "." + msg.GetName()
+		g.types[name] = msg
+		g.indexTypes(name, msg.NestedType, msg.EnumType)
+	}
+	for _, enum := range enums {
+		g.enums[prefix+"."+enum.GetName()] = enum
+	}
+}
+
+func (g *gen) document(fd *pb.FileDescriptorProto) (*document, error) {
+	g.schemas = make(map[string]*schema)
+	doc := &document{
+		OpenAPI: "3.0.3",
+		Info: info{
+			Title:   fd.GetName(),
+			Version: "version not set",
+		},
+		Paths: make(map[string]pathItem),
+	}
+	comments := commentsByPath(fd)
+	prefix := strings.TrimPrefix(packagePrefix(fd), ".")
+	for si, srv := range fd.Service {
+		srvName := srv.GetName()
+		if prefix != "" {
+			srvName = prefix + "." + srvName
+		}
+		for mi, mth := range srv.Method {
+			method, path, body, err := g.httpRule(mth)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", srvName, mth.GetName(), err)
+			}
+			if method == "" {
+				// No HTTP binding; describe it the way gRPC-over-HTTP would call it.
+				method, path, body = "post", "/"+srvName+"/"+mth.GetName(), "*"
+			}
+			op := &operation{
+				OperationID: srv.GetName() + "_" + mth.GetName(),
+				Tags:        []string{srv.GetName()},
+				Responses: map[string]response{
+					"200": {
+						Description: "A successful response.",
+						Content:     jsonContent(g.ref(mth.GetOutputType())),
+					},
+				},
+			}
+			// Path is 6 (service), then 2 (method) in FileDescriptorProto/ServiceDescriptorProto.
+			if c := comments[pathKey(6, si, 2, mi)]; c != "" {
+				op.Summary, op.Description = splitComment(c)
+			}
+			for _, p := range pathParams.FindAllStringSubmatch(path, -1) {
+				op.Parameters = append(op.Parameters, parameter{
+					Name:     p[1],
+					In:       "path",
+					Required: true,
+					Schema:   &schema{Type: "string"},
+				})
+			}
+			path = pathParams.ReplaceAllString(path, "{$1}")
+			if body != "" {
+				op.RequestBody = &requestBody{
+					Required: true,
+					Content:  jsonContent(g.ref(mth.GetInputType())),
+				}
+			}
+			if doc.Paths[path] == nil {
+				doc.Paths[path] = make(pathItem)
+			}
+			doc.Paths[path][method] = op
+		}
+	}
+	doc.Components.Schemas = g.schemas
+	return doc, nil
+}
+
+// pathParams matches path template variables such as {name} or {name=shelves/*}.
+var pathParams = regexp.MustCompile(`\{([^}=]+)(=[^}]*)?\}`)
+
+var httpMethods = []string{"get", "put", "post", "delete", "patch"}
+
+// httpRule extracts the HTTP binding from a method's google.api.http option.
+// It returns an empty method if there is no such option.
+func (g *gen) httpRule(mth *pb.MethodDescriptorProto) (method, path, body string, err error) {
+	opts := mth.GetOptions()
+	if opts == nil {
+		return "", "", "", nil
+	}
+	// The rule may be written as an aggregate, or field by field.
+	if v, ok := g.options.Get(opts, "(google.api.http)"); ok {
+		agg, ok := v.(options.Aggregate)
+		if !ok {
+			return "", "", "", fmt.Errorf("google.api.http option is not a message literal")
+		}
+		fields := parseAggregate(string(agg))
+		for _, m := range httpMethods {
+			if p, ok := fields[m]; ok {
+				return m, p, fields["body"], nil
+			}
+		}
+		return "", "", "", fmt.Errorf("google.api.http option has no HTTP method")
+	}
+	for _, m := range httpMethods {
+		if v, ok := g.options.Get(opts, "(google.api.http)."+m); ok {
+			path, _ := v.(string)
+			body, _ := g.options.Get(opts, "(google.api.http).body")
+			b, _ := body.(string)
+			return m, path, b, nil
+		}
+	}
+	if options.HasExtension(opts, httpRuleExtension) {
+		// Don't quietly describe the method as a POST.
+		return "", "", "", fmt.Errorf("google.api.http option is set, but its declaration (in google/api/annotations.proto) is not among the request's files")
+	}
+	return "", "", "", nil
+}
+
+// httpRuleExtension is the field number of the google.api.http extension of MethodOptions.
+const httpRuleExtension = 72295728
+
+// aggregateField matches a scalar field in a text format message literal.
+var aggregateField = regexp.MustCompile(`(\w+)\s*:\s*("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|[\w.+-]+)`)
+
+// parseAggregate extracts top-level scalar fields from a message literal.
+// Nested messages (such as additional_bindings) are ignored.
+func parseAggregate(s string) map[string]string {
+	fields := make(map[string]string)
+	depth := 0
+	var quote rune // the open quote character, if inside a string
+	escaped := false
+	var top strings.Builder
+	for _, r := range s {
+		inner := depth > 0
+		switch {
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if r == '\\' {
+				escaped = true
+			} else if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '{' || r == '<':
+			depth++
+			inner = true
+		case r == '}' || r == '>':
+			depth--
+			inner = true
+		}
+		if !inner {
+			top.WriteRune(r)
+		}
+	}
+	for _, m := range aggregateField.FindAllStringSubmatch(top.String(), -1) {
+		v := m[2]
+		if uq, err := ast.Unquote(v); err == nil {
+			v = uq
+		}
+		fields[m[1]] = v
+	}
+	return fields
+}
+
+func jsonContent(s *schema) map[string]mediaType {
+	return map[string]mediaType{"application/json": {Schema: s}}
+}
+
+// ref returns a reference to the schema for the named message or enum,
+// generating it if necessary.
+func (g *gen) ref(typeName string) *schema {
+	name := strings.TrimPrefix(typeName, ".")
+	if _, ok := g.schemas[name]; !ok {
+		g.schemas[name] = nil // break cycles
+		g.schemas[name] = g.typeSchema(typeName)
+	}
+	return &schema{Ref: "#/components/schemas/" + name}
+}
+
+func (g *gen) typeSchema(typeName string) *schema {
+	if enum, ok := g.enums[typeName]; ok {
+		s := &schema{Type: "string"}
+		for _, v := range enum.Value {
+			s.Enum = append(s.Enum, v.GetName())
+		}
+		return s
+	}
+	msg, ok := g.types[typeName]
+	if !ok {
+		return &schema{Type: "object"}
+	}
+	s := &schema{Type: "object", Properties: make(map[string]*schema)}
+	for _, f := range msg.Field {
+		name := f.GetJsonName()
+		if name == "" {
+			name = gendesc.JSONName(f.GetName())
+		}
+		s.Properties[name] = g.fieldSchema(f)
+	}
+	return s
+}
+
+func (g *gen) fieldSchema(f *pb.FieldDescriptorProto) *schema {
+	if f.GetLabel() == pb.FieldDescriptorProto_LABEL_REPEATED {
+		if entry, ok := g.types[f.GetTypeName()]; ok && entry.GetOptions().GetMapEntry() && len(entry.Field) == 2 {
+			return &schema{Type: "object", AdditionalProperties: g.singularSchema(entry.Field[1])}
+		}
+		return &schema{Type: "array", Items: g.singularSchema(f)}
+	}
+	return g.singularSchema(f)
+}
+
+func (g *gen) singularSchema(f *pb.FieldDescriptorProto) *schema {
+	switch f.GetType() {
+	case pb.FieldDescriptorProto_TYPE_MESSAGE, pb.FieldDescriptorProto_TYPE_GROUP, pb.FieldDescriptorProto_TYPE_ENUM:
+		return g.ref(f.GetTypeName())
+	case pb.FieldDescriptorProto_TYPE_DOUBLE:
+		return &schema{Type: "number", Format: "double"}
+	case pb.FieldDescriptorProto_TYPE_FLOAT:
+		return &schema{Type: "number", Format: "float"}
+	case pb.FieldDescriptorProto_TYPE_INT32, pb.FieldDescriptorProto_TYPE_SINT32, pb.FieldDescriptorProto_TYPE_SFIXED32:
+		return &schema{Type: "integer", Format: "int32"}
+	case pb.FieldDescriptorProto_TYPE_UINT32, pb.FieldDescriptorProto_TYPE_FIXED32:
+		return &schema{Type: "integer", Format: "int64"}
+	case pb.FieldDescriptorProto_TYPE_INT64, pb.FieldDescriptorProto_TYPE_SINT64, pb.FieldDescriptorProto_TYPE_SFIXED64,
+		pb.FieldDescriptorProto_TYPE_UINT64, pb.FieldDescriptorProto_TYPE_FIXED64:
+		// The proto3 JSON mapping encodes 64-bit integers as strings.
+		return &schema{Type: "string", Format: "int64"}
+	case pb.FieldDescriptorProto_TYPE_BOOL:
+		return &schema{Type: "boolean"}
+	case pb.FieldDescriptorProto_TYPE_BYTES:
+		return &schema{Type: "string", Format: "byte"}
+	}
+	return &schema{Type: "string"}
+}
+
+func pathKey(path ...int) string {
+	return fmt.Sprint(path)
+}
+
+// commentsByPath returns the leading comments in a file's SourceCodeInfo,
+// keyed by pathKey of their location path.
+func commentsByPath(fd *pb.FileDescriptorProto) map[string]string {
+	comments := make(map[string]string)
+	for _, loc := range fd.GetSourceCodeInfo().GetLocation() {
+		if loc.LeadingComments == nil {
+			continue
+		}
+		path := make([]int, len(loc.Path))
+		for i, p := range loc.Path {
+			path[i] = int(p)
+		}
+		comments[pathKey(path...)] = strings.TrimSpace(loc.GetLeadingComments())
+	}
+	return comments
+}
+
+// splitComment splits a comment into a one-line summary and the remainder.
+func splitComment(c string) (summary, description string) {
+	if i := strings.Index(c, "\n\n"); i >= 0 {
+		return strings.TrimSpace(c[:i]), strings.TrimSpace(c[i+2:])
+	}
+	return c, ""
+}
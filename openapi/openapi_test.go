@@ -0,0 +1,200 @@
+package openapi
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+
+	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/dsymonds/gotoc/parser"
+	"github.com/dsymonds/gotoc/wkt"
+)
+
+const testFile = `
+name: "lib.proto"
+package: "lib"
+message_type: <
+  name: "GetBookRequest"
+  field: < name: "name" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING json_name: "name" >
+>
+message_type: <
+  name: "Book"
+  field: < name: "name" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING json_name: "name" >
+  field: < name: "page_count" number: 2 label: LABEL_OPTIONAL type: TYPE_INT64 json_name: "pageCount" >
+  field: < name: "tags" number: 3 label: LABEL_REPEATED type: TYPE_STRING json_name: "tags" >
+>
+service: <
+  name: "Library"
+  method: <
+    name: "GetBook"
+    input_type: ".lib.GetBookRequest"
+    output_type: ".lib.Book"
+    options: <
+      uninterpreted_option: <
+        name: < name_part: "google.api.http" is_extension: true >
+        aggregate_value: "get: \"/v1/{name=books/*}\""
+      >
+    >
+  >
+  method: <
+    name: "CreateBook"
+    input_type: ".lib.Book"
+    output_type: ".lib.Book"
+  >
+>
+source_code_info: <
+  location: < path: 6 path: 0 path: 2 path: 0 leading_comments: " Gets a book.\n\n Returns NOT_FOUND if there is no such book.\n" >
+>
+`
+
+func TestGenerate(t *testing.T) {
+	fd := new(pb.FileDescriptorProto)
+	if err := proto.UnmarshalText(testFile, fd); err != nil {
+		t.Fatalf("Bad test file: %v", err)
+	}
+	resp, err := Generate(&plugin.CodeGeneratorRequest{
+		FileToGenerate: []string{"lib.proto"},
+		ProtoFile:      []*pb.FileDescriptorProto{fd},
+	})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(resp.File) != 1 || resp.File[0].GetName() != "lib.openapi.json" {
+		t.Fatalf("Generate returned %v, want one file lib.openapi.json", resp.File)
+	}
+	var doc document
+	if err := json.Unmarshal([]byte(resp.File[0].GetContent()), &doc); err != nil {
+		t.Fatalf("Generated bad JSON: %v", err)
+	}
+
+	get := doc.Paths["/v1/{name}"]["get"]
+	if get == nil {
+		t.Fatalf("No GET operation for /v1/{name}; paths are %v", doc.Paths)
+	}
+	if get.Summary != "Gets a book." || get.Description != "Returns NOT_FOUND if there is no such book." {
+		t.Errorf("GetBook summary, description = %q, %q", get.Summary, get.Description)
+	}
+	if len(get.Parameters) != 1 || get.Parameters[0].Name != "name" || get.RequestBody != nil {
+		t.Errorf("GetBook parameters = %+v, body = %+v", get.Parameters, get.RequestBody)
+	}
+	if create := doc.Paths["/lib.Library/CreateBook"]["post"]; create == nil || create.RequestBody == nil {
+		t.Errorf("CreateBook was not bound as a POST with a body; paths are %v", doc.Paths)
+	}
+
+	book := doc.Components.Schemas["lib.Book"]
+	if book == nil {
+		t.Fatalf("No schema for lib.Book")
+	}
+	if p := book.Properties["pageCount"]; p == nil || p.Type != "string" || p.Format != "int64" {
+		t.Errorf("Book.pageCount schema = %+v", p)
+	}
+	if p := book.Properties["tags"]; p == nil || p.Type != "array" || p.Items.Type != "string" {
+		t.Errorf("Book.tags schema = %+v", p)
+	}
+}
+
+// These are cut-down copies of the files from googleapis.
+var googleAPISources = map[string]string{
+	"google/api/http.proto": `
+syntax = "proto3";
+package google.api;
+message HttpRule {
+  string selector = 1;
+  oneof pattern {
+    string get = 2;
+    string put = 3;
+    string post = 4;
+    string delete = 5;
+    string patch = 6;
+  }
+  string body = 7;
+  repeated HttpRule additional_bindings = 11;
+}
+`,
+	"google/api/annotations.proto": `
+syntax = "proto3";
+package google.api;
+import "google/api/http.proto";
+import "google/protobuf/descriptor.proto";
+extend google.protobuf.MethodOptions {
+  HttpRule http = 72295728;
+}
+`,
+	"svc.proto": `
+syntax = "proto3";
+package pkg;
+import "google/api/annotations.proto";
+message Req { string name = 1; }
+service Svc {
+  rpc Get(Req) returns (Req) {
+    option (google.api.http) = { get: "/v1/{name}" };
+  }
+  rpc Update(Req) returns (Req) {
+    option (google.api.http).patch = "/v1/{name}";
+    option (google.api.http).body = "*";
+  }
+}
+`,
+}
+
+// compileSources parses and compiles the named files from sources,
+// and returns the descriptors of them and their imports.
+func compileSources(t *testing.T, sources map[string]string, files ...string) []*pb.FileDescriptorProto {
+	c := &parser.Config{Sources: make(map[string][]byte), Fallback: wkt.Import}
+	for name, src := range sources {
+		c.Sources[name] = []byte(src)
+	}
+	fs, err := c.ParseFiles(files)
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	fds, err := gendesc.Generate(fs)
+	if err != nil {
+		t.Fatalf("Generating descriptors: %v", err)
+	}
+	return fds.File
+}
+
+func TestGenerateImportedHTTPRule(t *testing.T) {
+	resp, err := Generate(&plugin.CodeGeneratorRequest{
+		FileToGenerate: []string{"svc.proto"},
+		ProtoFile:      compileSources(t, googleAPISources, "svc.proto"),
+	})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	var doc document
+	if err := json.Unmarshal([]byte(resp.File[0].GetContent()), &doc); err != nil {
+		t.Fatalf("Generated bad JSON: %v", err)
+	}
+	if doc.Paths["/v1/{name}"]["get"] == nil {
+		t.Errorf("No GET operation for /v1/{name}; paths are %v", doc.Paths)
+	}
+	if patch := doc.Paths["/v1/{name}"]["patch"]; patch == nil || patch.RequestBody == nil {
+		t.Errorf("No PATCH operation with a body for /v1/{name}; paths are %v", doc.Paths)
+	}
+	if _, ok := doc.Paths["/pkg.Svc/Get"]; ok {
+		t.Errorf("Get was bound as a POST to /pkg.Svc/Get")
+	}
+}
+
+func TestGenerateUndeclaredHTTPRule(t *testing.T) {
+	// Without the declaration of google.api.http, the bindings can't be read.
+	var files []*pb.FileDescriptorProto
+	for _, fd := range compileSources(t, googleAPISources, "svc.proto") {
+		if fd.GetName() != "google/api/annotations.proto" {
+			files = append(files, fd)
+		}
+	}
+	_, err := Generate(&plugin.CodeGeneratorRequest{
+		FileToGenerate: []string{"svc.proto"},
+		ProtoFile:      files,
+	})
+	if err == nil || !strings.Contains(err.Error(), "google/api/annotations.proto") {
+		t.Errorf("Generate gave error %v, want one about google/api/annotations.proto", err)
+	}
+}
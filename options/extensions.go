@@ -0,0 +1,430 @@
+package options
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// A Resolver finds the declarations of extensions, so that it can read
+// custom options stored as extension fields of the options messages,
+// which is how protoc and gendesc store the custom options they interpret.
+type Resolver struct {
+	exts  map[string]*pb.FieldDescriptorProto // extensions, by full name without a leading dot
+	types map[string]interface{}              // *pb.DescriptorProto or *pb.EnumDescriptorProto, by full name with a leading dot
+}
+
+// NewResolver returns a Resolver for the extensions and types declared in files,
+// which would usually be all the files of a CodeGeneratorRequest.
+func NewResolver(files []*pb.FileDescriptorProto) *Resolver {
+	r := &Resolver{
+		exts:  make(map[string]*pb.FieldDescriptorProto),
+		types: make(map[string]interface{}),
+	}
+	for _, fd := range files {
+		prefix := ""
+		if fd.GetPackage() != "" {
+			prefix = "." + fd.GetPackage()
+		}
+		r.index(prefix, fd.Extension, fd.MessageType, fd.EnumType)
+	}
+	return r
+}
+
+func (r *Resolver) index(prefix string, exts []*pb.FieldDescriptorProto, msgs []*pb.DescriptorProto, enums []*pb.EnumDescriptorProto) {
+	for _, ext := range exts {
+		r.exts[strings.TrimPrefix(prefix+"."+ext.GetName(), ".")] = ext
+	}
+	for _, msg := range msgs {
+		name := prefix + "." + msg.GetName()
+		r.types[name] = msg
+		r.index(name, msg.Extension, msg.NestedType, msg.EnumType)
+	}
+	for _, enum := range enums {
+		r.types[prefix+"."+enum.GetName()] = enum
+	}
+}
+
+// Get is like the package's Get function, but also finds custom options
+// stored as extension fields. The extension must be named by its full name,
+// such as "(google.api.http)", and be declared in the resolver's files.
+// The values of such options have the same dynamic types as those of
+// uninterpreted options: bools and enum values are Identifiers, and messages
+// are Aggregates. Where a field is set more than once, the last value is used.
+func (r *Resolver) Get(opts proto.Message, name string) (interface{}, bool) {
+	if x, ok := Get(opts, name); ok {
+		return x, true
+	}
+	parts, ok := splitName(name)
+	if !ok || !parts[0].ext {
+		return nil, false
+	}
+	ext := r.exts[parts[0].name]
+	if ext == nil {
+		return nil, false
+	}
+	v := reflect.ValueOf(opts)
+	if v.Kind() != reflect.Ptr || v.IsNil() || ext.GetExtendee() != ".google.protobuf."+v.Elem().Type().Name() {
+		return nil, false
+	}
+	raw, err := proto.GetExtension(opts, &proto.ExtensionDesc{ExtendedType: opts, Field: ext.GetNumber()})
+	if err != nil {
+		return nil, false
+	}
+	b, _ := raw.([]byte)
+	x, err := r.value(b, ext, parts[1:])
+	if err != nil || x == nil {
+		return nil, false
+	}
+	return x, true
+}
+
+// Extensions returns the full names of the extensions set in opts
+// that r has the declarations of, in order of field number.
+func (r *Resolver) Extensions(opts proto.Message) []string {
+	v := reflect.ValueOf(opts)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil
+	}
+	extendee := ".google.protobuf." + v.Elem().Type().Name()
+	var names []string
+	for name, ext := range r.exts {
+		if ext.GetExtendee() == extendee && HasExtension(opts, ext.GetNumber()) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return r.exts[names[i]].GetNumber() < r.exts[names[j]].GetNumber()
+	})
+	return names
+}
+
+// HasExtension reports whether opts has a value for the extension field
+// numbered num, whether or not its declaration is known.
+func HasExtension(opts proto.Message, num int32) bool {
+	raw, err := proto.GetExtension(opts, &proto.ExtensionDesc{ExtendedType: opts, Field: num})
+	b, _ := raw.([]byte)
+	return err == nil && len(b) > 0
+}
+
+// A wireField is a field decoded from the wire format.
+type wireField struct {
+	num      int32
+	wireType int
+	x        uint64 // value of a varint or fixed-width field
+	b        []byte // value of a length-delimited field, or a group's contents
+}
+
+const (
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
+)
+
+var errBadWire = errors.New("bad wire format")
+
+// decodeFields splits b into its fields.
+func decodeFields(b []byte) ([]wireField, error) {
+	var fields []wireField
+	for len(b) > 0 {
+		f, n, err := decodeField(b)
+		if err != nil {
+			return nil, err
+		}
+		if f.wireType == wireEndGroup {
+			return nil, errBadWire
+		}
+		fields = append(fields, f)
+		b = b[n:]
+	}
+	return fields, nil
+}
+
+// decodeField decodes the field at the start of b,
+// and returns it with the number of bytes it takes.
+func decodeField(b []byte) (wireField, int, error) {
+	tag, n := proto.DecodeVarint(b)
+	if n == 0 || tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+		return wireField{}, 0, errBadWire
+	}
+	f := wireField{num: int32(tag >> 3), wireType: int(tag & 7)}
+	switch f.wireType {
+	case wireVarint:
+		x, m := proto.DecodeVarint(b[n:])
+		if m == 0 {
+			return f, 0, errBadWire
+		}
+		f.x = x
+		n += m
+	case wireFixed64:
+		if len(b) < n+8 {
+			return f, 0, errBadWire
+		}
+		for i := 7; i >= 0; i-- {
+			f.x = f.x<<8 | uint64(b[n+i])
+		}
+		n += 8
+	case wireFixed32:
+		if len(b) < n+4 {
+			return f, 0, errBadWire
+		}
+		for i := 3; i >= 0; i-- {
+			f.x = f.x<<8 | uint64(b[n+i])
+		}
+		n += 4
+	case wireBytes:
+		l, m := proto.DecodeVarint(b[n:])
+		if m == 0 || l > uint64(len(b)-n-m) {
+			return f, 0, errBadWire
+		}
+		n += m
+		f.b = b[n : n+int(l)]
+		n += int(l)
+	case wireStartGroup:
+		start := n
+		for {
+			g, m, err := decodeField(b[n:])
+			if err != nil {
+				return f, 0, err
+			}
+			if g.wireType == wireEndGroup {
+				if g.num != f.num {
+					return f, 0, errBadWire
+				}
+				f.b = b[start:n]
+				n += m
+				break
+			}
+			n += m
+		}
+	case wireEndGroup:
+	default:
+		return f, 0, errBadWire
+	}
+	return f, n, nil
+}
+
+// value returns the value of the field fd in the encoded fields b,
+// or of the sub-field of it named by parts. It returns nil if the field is not set.
+func (r *Resolver) value(b []byte, fd *pb.FieldDescriptorProto, parts []namePart) (interface{}, error) {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return nil, err
+	}
+	var set []wireField
+	for _, f := range fields {
+		if f.num == fd.GetNumber() {
+			set = append(set, f)
+		}
+	}
+	if len(set) == 0 {
+		return nil, nil
+	}
+	md, isMsg := r.types[fd.GetTypeName()].(*pb.DescriptorProto)
+	isMsg = isMsg && (fd.GetType() == pb.FieldDescriptorProto_TYPE_MESSAGE || fd.GetType() == pb.FieldDescriptorProto_TYPE_GROUP)
+	if !isMsg {
+		if len(parts) > 0 {
+			return nil, nil
+		}
+		xs, err := r.scalars(fd, set)
+		if err != nil || len(xs) == 0 {
+			return nil, err
+		}
+		return xs[len(xs)-1], nil
+	}
+
+	// The occurrences of a message field are merged, as if concatenated.
+	var msg []byte
+	for _, f := range set {
+		msg = append(msg, f.b...)
+	}
+	if len(parts) == 0 {
+		s, err := r.text(msg, md)
+		return Aggregate(s), err
+	}
+	if parts[0].ext {
+		return nil, nil
+	}
+	for _, sub := range md.Field {
+		if sub.GetName() == parts[0].name {
+			return r.value(msg, sub, parts[1:])
+		}
+	}
+	return nil, nil
+}
+
+// scalars decodes the values of the non-message field fd in set,
+// including packed values.
+func (r *Resolver) scalars(fd *pb.FieldDescriptorProto, set []wireField) ([]interface{}, error) {
+	var xs []interface{}
+	for _, f := range set {
+		if f.wireType != wireBytes || fd.GetType() == pb.FieldDescriptorProto_TYPE_STRING || fd.GetType() == pb.FieldDescriptorProto_TYPE_BYTES {
+			xs = append(xs, r.scalar(fd, f))
+			continue
+		}
+		// Packed values.
+		wt := wireVarint
+		switch fd.GetType() {
+		case pb.FieldDescriptorProto_TYPE_DOUBLE, pb.FieldDescriptorProto_TYPE_FIXED64, pb.FieldDescriptorProto_TYPE_SFIXED64:
+			wt = wireFixed64
+		case pb.FieldDescriptorProto_TYPE_FLOAT, pb.FieldDescriptorProto_TYPE_FIXED32, pb.FieldDescriptorProto_TYPE_SFIXED32:
+			wt = wireFixed32
+		}
+		tag := proto.EncodeVarint(uint64(fd.GetNumber())<<3 | uint64(wt))
+		for b := f.b; len(b) > 0; {
+			// Decode each element as if it were a field of its own.
+			e, n, err := decodeField(append(tag[:len(tag):len(tag)], b...))
+			if err != nil {
+				return nil, err
+			}
+			xs = append(xs, r.scalar(fd, e))
+			b = b[n-len(tag):]
+		}
+	}
+	return xs, nil
+}
+
+// scalar returns the value of f, an occurrence of the non-message field fd.
+func (r *Resolver) scalar(fd *pb.FieldDescriptorProto, f wireField) interface{} {
+	signed := func(n int64) interface{} {
+		if n < 0 {
+			return n
+		}
+		return uint64(n)
+	}
+	switch fd.GetType() {
+	case pb.FieldDescriptorProto_TYPE_STRING, pb.FieldDescriptorProto_TYPE_BYTES:
+		return string(f.b)
+	case pb.FieldDescriptorProto_TYPE_BOOL:
+		return Identifier(strconv.FormatBool(f.x != 0))
+	case pb.FieldDescriptorProto_TYPE_ENUM:
+		if ed, ok := r.types[fd.GetTypeName()].(*pb.EnumDescriptorProto); ok {
+			for _, v := range ed.Value {
+				if v.GetNumber() == int32(f.x) {
+					return Identifier(v.GetName())
+				}
+			}
+		}
+		return signed(int64(int32(f.x)))
+	case pb.FieldDescriptorProto_TYPE_DOUBLE:
+		return math.Float64frombits(f.x)
+	case pb.FieldDescriptorProto_TYPE_FLOAT:
+		return float64(math.Float32frombits(uint32(f.x)))
+	case pb.FieldDescriptorProto_TYPE_INT32:
+		return signed(int64(int32(f.x)))
+	case pb.FieldDescriptorProto_TYPE_INT64:
+		return signed(int64(f.x))
+	case pb.FieldDescriptorProto_TYPE_SINT32, pb.FieldDescriptorProto_TYPE_SINT64:
+		return signed(int64(f.x>>1) ^ -int64(f.x&1))
+	case pb.FieldDescriptorProto_TYPE_SFIXED32:
+		return signed(int64(int32(uint32(f.x))))
+	case pb.FieldDescriptorProto_TYPE_SFIXED64:
+		return signed(int64(f.x))
+	}
+	// UINT32, UINT64, FIXED32, FIXED64.
+	return f.x
+}
+
+// text returns the encoded message b, of type md, in text format,
+// in the form used for Aggregate values.
+func (r *Resolver) text(b []byte, md *pb.DescriptorProto) (string, error) {
+	fields, err := decodeFields(b)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, f := range fields {
+		var fd *pb.FieldDescriptorProto
+		for _, x := range md.Field {
+			if x.GetNumber() == f.num {
+				fd = x
+				break
+			}
+		}
+		if fd == nil {
+			continue // an unknown field
+		}
+		name := fd.GetName()
+		if fd.GetType() == pb.FieldDescriptorProto_TYPE_GROUP {
+			// Groups are named by their type in text format.
+			name = fd.GetTypeName()[strings.LastIndex(fd.GetTypeName(), ".")+1:]
+		}
+		if sub, ok := r.types[fd.GetTypeName()].(*pb.DescriptorProto); ok {
+			s, err := r.text(f.b, sub)
+			if err != nil {
+				return "", err
+			}
+			if s == "" {
+				parts = append(parts, name+" {}")
+			} else {
+				parts = append(parts, name+" { "+s+" }")
+			}
+			continue
+		}
+		xs, err := r.scalars(fd, []wireField{f})
+		if err != nil {
+			return "", err
+		}
+		for _, x := range xs {
+			var v string
+			switch x := x.(type) {
+			case string:
+				v = quote(x)
+			case float64:
+				v = strconv.FormatFloat(x, 'g', -1, 64)
+			default:
+				v = fmtValue(x)
+			}
+			parts = append(parts, name+": "+v)
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+func fmtValue(x interface{}) string {
+	switch x := x.(type) {
+	case Identifier:
+		return string(x)
+	case uint64:
+		return strconv.FormatUint(x, 10)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	}
+	return ""
+}
+
+// quote quotes s as a string in text format, using C escapes.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				b.WriteString(`\` + strconv.FormatUint(uint64(c)>>6, 8) + strconv.FormatUint(uint64(c)>>3&7, 8) + strconv.FormatUint(uint64(c)&7, 8))
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
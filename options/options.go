@@ -0,0 +1,173 @@
+/*
+Package options looks up option values in descriptor options messages.
+
+Options may be interpreted (set as ordinary fields of the options message,
+such as FileOptions.java_package) or uninterpreted (recorded in the
+uninterpreted_option field, as gendesc does for most options).
+Get finds either kind by the name used in the .proto source.
+
+Custom options that have been resolved, as protoc does for all of them and
+gendesc does for those whose declarations it can see, are stored as extension
+fields of the options message instead. Reading those needs the declaration
+of the extension, so Get does not find them; use a Resolver.
+*/
+package options
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Identifier is the value of an uninterpreted option written as an identifier,
+// such as an enum value name or a boolean.
+type Identifier string
+
+// Aggregate is the value of an uninterpreted option written as a message literal,
+// in text format without the surrounding braces.
+type Aggregate string
+
+// Get looks up the option called name in opts, which must be a pointer
+// to one of the descriptor options messages (e.g. *pb.FileOptions).
+// The name is written as in the .proto source: a simple name such as
+// "java_package", or an extension name in parentheses such as
+// "(google.api.http)", optionally followed by sub-field names
+// (e.g. "(my.opt).field").
+//
+// The dynamic type of the returned value is the Go type of the field
+// for interpreted options (e.g. string, bool or pb.FileOptions_OptimizeMode),
+// and for uninterpreted options one of Identifier, uint64, int64, float64,
+// string or Aggregate. Options stored as extension fields are not found;
+// see Resolver.Get.
+func Get(opts proto.Message, name string) (interface{}, bool) {
+	parts, ok := splitName(name)
+	if !ok {
+		return nil, false
+	}
+	v := reflect.ValueOf(opts)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, false
+	}
+	v = v.Elem()
+
+	if len(parts) == 1 && !parts[0].ext {
+		if x, ok := interpreted(v, parts[0].name); ok {
+			return x, true
+		}
+	}
+
+	f := v.FieldByName("UninterpretedOption")
+	if !f.IsValid() {
+		return nil, false
+	}
+	uos, ok := f.Interface().([]*pb.UninterpretedOption)
+	if !ok {
+		return nil, false
+	}
+	for _, uo := range uos {
+		if nameMatches(uo.Name, parts) {
+			return uninterpreted(uo), true
+		}
+	}
+	return nil, false
+}
+
+type namePart struct {
+	name string
+	ext  bool // whether this is an extension name
+}
+
+// splitName splits an option name like "(foo.bar).baz" into its parts.
+func splitName(name string) ([]namePart, bool) {
+	var parts []namePart
+	for name != "" {
+		if name[0] == '(' {
+			i := strings.Index(name, ")")
+			if i < 0 {
+				return nil, false
+			}
+			// Extension names may be written fully-qualified with a leading dot.
+			parts = append(parts, namePart{strings.TrimPrefix(name[1:i], "."), true})
+			name = name[i+1:]
+		} else {
+			i := strings.IndexAny(name, ".(")
+			if i < 0 {
+				i = len(name)
+			}
+			if i == 0 {
+				return nil, false
+			}
+			parts = append(parts, namePart{name[:i], false})
+			name = name[i:]
+		}
+		if name != "" {
+			if name[0] != '.' {
+				return nil, false
+			}
+			name = name[1:]
+		}
+	}
+	return parts, len(parts) > 0
+}
+
+func nameMatches(uoName []*pb.UninterpretedOption_NamePart, parts []namePart) bool {
+	if len(uoName) != len(parts) {
+		return false
+	}
+	for i, np := range uoName {
+		n := np.GetNamePart()
+		if np.GetIsExtension() {
+			n = strings.TrimPrefix(n, ".")
+		}
+		if n != parts[i].name || np.GetIsExtension() != parts[i].ext {
+			return false
+		}
+	}
+	return true
+}
+
+// interpreted returns the value of the set field with the given proto name.
+func interpreted(v reflect.Value, name string) (interface{}, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if protoName(t.Field(i)) != name {
+			continue
+		}
+		f := v.Field(i)
+		if f.Kind() != reflect.Ptr || f.IsNil() {
+			return nil, false
+		}
+		return f.Elem().Interface(), true
+	}
+	return nil, false
+}
+
+// protoName returns the proto field name of a generated struct field.
+func protoName(sf reflect.StructField) string {
+	for _, part := range strings.Split(sf.Tag.Get("protobuf"), ",") {
+		if strings.HasPrefix(part, "name=") {
+			return part[len("name="):]
+		}
+	}
+	return ""
+}
+
+func uninterpreted(uo *pb.UninterpretedOption) interface{} {
+	switch {
+	case uo.IdentifierValue != nil:
+		return Identifier(uo.GetIdentifierValue())
+	case uo.PositiveIntValue != nil:
+		return uo.GetPositiveIntValue()
+	case uo.NegativeIntValue != nil:
+		return uo.GetNegativeIntValue()
+	case uo.DoubleValue != nil:
+		return uo.GetDoubleValue()
+	case uo.StringValue != nil:
+		return string(uo.StringValue)
+	case uo.AggregateValue != nil:
+		return Aggregate(uo.GetAggregateValue())
+	}
+	return nil
+}
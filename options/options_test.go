@@ -0,0 +1,139 @@
+package options
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+func TestGet(t *testing.T) {
+	opts := new(pb.FileOptions)
+	if err := proto.UnmarshalText(`
+	  java_package: "com.example"
+	  optimize_for: CODE_SIZE
+	  uninterpreted_option { name { name_part: "go_package" is_extension: false } string_value: "example" }
+	  uninterpreted_option { name { name_part: "my.flag" is_extension: true } identifier_value: "true" }
+	  uninterpreted_option { name { name_part: ".my.num" is_extension: true } negative_int_value: -3 }
+	  uninterpreted_option {
+	    name { name_part: "google.api.http" is_extension: true }
+	    name { name_part: "get" is_extension: false }
+	    string_value: "/v1/foo"
+	  }
+	  uninterpreted_option { name { name_part: "my.msg" is_extension: true } aggregate_value: "a: 1" }
+	`, opts); err != nil {
+		t.Fatalf("Test failure parsing options: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want interface{} // nil means not found
+	}{
+		{"java_package", "com.example"},
+		{"optimize_for", pb.FileOptions_CODE_SIZE},
+		{"go_package", "example"},
+		{"(my.flag)", Identifier("true")},
+		{"(my.num)", int64(-3)},
+		{"(.my.num)", int64(-3)},
+		{"(google.api.http).get", "/v1/foo"},
+		{"(my.msg)", Aggregate("a: 1")},
+		{"java_outer_classname", nil},
+		{"(google.api.http)", nil},
+		{"my.flag", nil},
+		{"(unterminated", nil},
+	}
+	for _, tt := range tests {
+		got, ok := Get(opts, tt.name)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Get(%q) = %#v, %v; want %#v", tt.name, got, ok, tt.want)
+		}
+	}
+
+	// A message with no uninterpreted_option field has no such options.
+	if got, ok := Get(new(pb.SourceCodeInfo), "(my.flag)"); ok {
+		t.Errorf("Get in SourceCodeInfo = %#v, want not found", got)
+	}
+}
+
+const resolverFile = `
+name: "my.proto"
+package: "my"
+message_type: <
+  name: "Opt"
+  field: < name: "s" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING >
+  field: < name: "n" number: 2 label: LABEL_OPTIONAL type: TYPE_INT32 >
+  field: < name: "e" number: 3 label: LABEL_OPTIONAL type: TYPE_ENUM type_name: ".my.E" >
+  field: < name: "b" number: 4 label: LABEL_OPTIONAL type: TYPE_BOOL >
+  field: < name: "sub" number: 5 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".my.Opt" >
+  field: < name: "xs" number: 6 label: LABEL_REPEATED type: TYPE_INT32 >
+>
+enum_type: <
+  name: "E"
+  value: < name: "ZERO" number: 0 >
+  value: < name: "ONE" number: 1 >
+>
+extension: < name: "opt" number: 50000 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".my.Opt" extendee: ".google.protobuf.MethodOptions" >
+extension: < name: "num" number: 50001 label: LABEL_OPTIONAL type: TYPE_SINT64 extendee: ".google.protobuf.MethodOptions" >
+`
+
+func TestResolver(t *testing.T) {
+	fd := new(pb.FileDescriptorProto)
+	if err := proto.UnmarshalText(resolverFile, fd); err != nil {
+		t.Fatalf("Test failure parsing descriptor: %v", err)
+	}
+	opt := []byte{
+		0x0a, 2, 'h', 'i', // s: "hi"
+		0x10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, // n: -1
+		0x18, 1, // e: ONE
+		0x20, 1, // b: true
+		0x2a, 2, 0x10, 7, // sub { n: 7 }
+		0x32, 2, 3, 4, // xs: [3, 4], packed
+	}
+	var raw []byte
+	raw = append(raw, proto.EncodeVarint(50000<<3|2)...)
+	raw = append(raw, proto.EncodeVarint(uint64(len(opt)))...)
+	raw = append(raw, opt...)
+	// A second occurrence of the option is merged into the first.
+	raw = append(raw, proto.EncodeVarint(50000<<3|2)...)
+	raw = append(raw, 3, 0x0a, 1, 'x')
+	opts := new(pb.MethodOptions)
+	proto.SetRawExtension(opts, 50000, raw)
+	proto.SetRawExtension(opts, 50001, append(proto.EncodeVarint(50001<<3), 3)) // -2
+
+	r := NewResolver([]*pb.FileDescriptorProto{fd})
+	tests := []struct {
+		name string
+		want interface{} // nil means not found
+	}{
+		{"(my.opt)", Aggregate(`s: "hi" n: -1 e: ONE b: true sub { n: 7 } xs: 3 xs: 4 s: "x"`)},
+		{"(my.opt).s", "x"},
+		{"(my.opt).n", int64(-1)},
+		{"(my.opt).e", Identifier("ONE")},
+		{"(my.opt).b", Identifier("true")},
+		{"(my.opt).sub.n", uint64(7)},
+		{"(my.opt).xs", uint64(4)},
+		{"(my.opt).sub.s", nil},
+		{"(my.opt).missing", nil},
+		{"(my.num)", int64(-2)},
+		{"(.my.num)", int64(-2)},
+		{"(my.unknown)", nil},
+		{"deprecated", nil},
+	}
+	for _, tt := range tests {
+		got, ok := r.Get(opts, tt.name)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Get(%q) = %#v, %v; want %#v", tt.name, got, ok, tt.want)
+		}
+	}
+
+	// The extensions don't extend FileOptions.
+	fopts := new(pb.FileOptions)
+	proto.SetRawExtension(fopts, 50001, append(proto.EncodeVarint(50001<<3), 3))
+	if got, ok := r.Get(fopts, "(my.num)"); ok {
+		t.Errorf("Get of (my.num) in FileOptions = %#v, want not found", got)
+	}
+	if !HasExtension(fopts, 50001) || HasExtension(fopts, 50000) {
+		t.Errorf("HasExtension(50001), HasExtension(50000) = %v, %v; want true, false", HasExtension(fopts, 50001), HasExtension(fopts, 50000))
+	}
+}
@@ -0,0 +1,186 @@
+package parser
+
+// This file implements reading imported files from directories, archives
+// and Importers.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// importRoot is a place to search for imported files.
+type importRoot interface {
+	// read returns the contents of the named file,
+	// or nil if the file is not present.
+	read(filename string) ([]byte, error)
+	close() error
+}
+
+type importRoots []importRoot
+
+func openImportRoots(importPaths []string) (importRoots, error) {
+	var roots importRoots
+	for _, impPath := range importPaths {
+		r, err := openImportRoot(impPath)
+		if err != nil {
+			roots.close()
+			return nil, err
+		}
+		roots = append(roots, r)
+	}
+	return roots, nil
+}
+
+// read returns the contents of the named file from the first root that has it,
+// or nil if no root has it.
+func (roots importRoots) read(filename string) ([]byte, error) {
+	for _, r := range roots {
+		buf, err := r.read(filename)
+		if err != nil || buf != nil {
+			return buf, err
+		}
+	}
+	return nil, nil
+}
+
+func (roots importRoots) close() {
+	for _, r := range roots {
+		r.close()
+	}
+}
+
+// importerRoot adapts an Importer to an importRoot.
+type importerRoot struct{ imp Importer }
+
+func (r importerRoot) read(filename string) ([]byte, error) {
+	rc, err := r.imp.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(rc)
+	if err == nil && buf == nil {
+		buf = []byte{} // an empty file
+	}
+	return buf, err
+}
+
+func (r importerRoot) close() error { return nil }
+
+func isArchive(name string) bool {
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func openImportRoot(impPath string) (importRoot, error) {
+	if !isArchive(impPath) {
+		return dirRoot(impPath), nil
+	}
+	if fi, err := os.Stat(impPath); err != nil || fi.IsDir() {
+		// Not an archive after all; treat it like any other directory.
+		return dirRoot(impPath), nil
+	}
+	if strings.HasSuffix(impPath, ".zip") {
+		zr, err := zip.OpenReader(impPath)
+		if err != nil {
+			return nil, fmt.Errorf("opening import archive %s: %v", impPath, err)
+		}
+		return &zipRoot{zr}, nil
+	}
+	return openTarRoot(impPath)
+}
+
+// dirRoot is a directory in the file system.
+type dirRoot string
+
+func (d dirRoot) read(filename string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(string(d), filename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return buf, err
+}
+
+func (d dirRoot) close() error { return nil }
+
+// zipRoot is a zip archive.
+type zipRoot struct {
+	zr *zip.ReadCloser
+}
+
+func (z *zipRoot) read(filename string) ([]byte, error) {
+	for _, zf := range z.zr.File {
+		if path.Clean(zf.Name) != filename {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	return nil, nil
+}
+
+func (z *zipRoot) close() error { return z.zr.Close() }
+
+// tarRoot is a tar archive. Since tar files can only be read sequentially,
+// all the .proto files in it are read up front.
+type tarRoot map[string][]byte
+
+func openTarRoot(impPath string) (tarRoot, error) {
+	f, err := os.Open(impPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening import archive %s: %v", impPath, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if !strings.HasSuffix(impPath, ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("opening import archive %s: %v", impPath, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	t := make(tarRoot)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading import archive %s: %v", impPath, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(hdr.Name, ".proto") {
+			continue
+		}
+		buf, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading import archive %s: %v", impPath, err)
+		}
+		t[path.Clean(hdr.Name)] = buf
+	}
+	return t, nil
+}
+
+func (t tarRoot) read(filename string) ([]byte, error) { return t[filename], nil }
+func (t tarRoot) close() error                         { return nil }
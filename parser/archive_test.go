@@ -0,0 +1,137 @@
+package parser
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var archiveFiles = map[string]string{
+	"top.proto":        "import \"dep/dep.proto\";\nmessage Top { optional Dep dep = 1; }\n",
+	"dep/dep.proto":    "message Dep {}\n",
+	"dep/README.txt":   "not a proto",
+	"unused/foo.proto": "message Unused {}\n",
+}
+
+func writeZip(t *testing.T, w io.Writer) {
+	zw := zip.NewWriter(w)
+	for name, content := range archiveFiles {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTarGz(t *testing.T, w io.Writer) {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for name, content := range archiveFiles {
+		hdr := &tar.Header{Name: "./" + name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveImportPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotoc-archive-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name  string
+		write func(*testing.T, io.Writer)
+	}{
+		{"protos.zip", writeZip},
+		{"protos.tar.gz", writeTarGz},
+	} {
+		archive := filepath.Join(dir, tc.name)
+		f, err := os.Create(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.write(t, f)
+		f.Close()
+
+		fset, err := ParseFiles([]string{"top.proto"}, []string{dir, archive})
+		if err != nil {
+			t.Errorf("%s: ParseFiles: %v", tc.name, err)
+			continue
+		}
+		if n := len(fset.Files); n != 2 {
+			t.Errorf("%s: got %d files, want 2", tc.name, n)
+		}
+	}
+}
+
+func TestImporter(t *testing.T) {
+	var opened []string
+	imp := ImporterFunc(func(filename string) (io.ReadCloser, error) {
+		opened = append(opened, filename)
+		content, ok := archiveFiles[filename]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.NopCloser(strings.NewReader(content)), nil
+	})
+	c := &Config{Importer: imp}
+	fset, err := c.ParseFiles([]string{"top.proto"})
+	if err != nil {
+		t.Fatalf("ParseFiles: %v", err)
+	}
+	if n := len(fset.Files); n != 2 {
+		t.Errorf("Got %d files, want 2", n)
+	}
+	if want := []string{"top.proto", "dep/dep.proto"}; !reflect.DeepEqual(opened, want) {
+		t.Errorf("Opened %q, want %q", opened, want)
+	}
+
+	if _, err := c.ParseFiles([]string{"missing.proto"}); err == nil {
+		t.Errorf("ParseFiles of a missing file succeeded")
+	}
+	broken := ImporterFunc(func(string) (io.ReadCloser, error) { return nil, errors.New("importer broken") })
+	if _, err := (&Config{Importer: broken}).ParseFiles([]string{"top.proto"}); err == nil || err.Error() != "importer broken" {
+		t.Errorf("ParseFiles with a failing Importer gave error %v, want importer broken", err)
+	}
+}
+
+func TestParseFilesContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var opened []string
+	imp := ImporterFunc(func(filename string) (io.ReadCloser, error) {
+		opened = append(opened, filename)
+		cancel() // stop once the first file is read
+		return ioutil.NopCloser(strings.NewReader(archiveFiles[filename])), nil
+	})
+	c := &Config{Importer: imp}
+	if _, err := c.ParseFilesContext(ctx, []string{"top.proto"}); err != context.Canceled {
+		t.Errorf("ParseFilesContext gave error %v, want %v", err, context.Canceled)
+	}
+	if want := []string{"top.proto"}; !reflect.DeepEqual(opened, want) {
+		t.Errorf("Opened %q before stopping, want %q", opened, want)
+	}
+}
@@ -0,0 +1,88 @@
+package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/golang/protobuf/proto"
+)
+
+// writeTree writes a small tree of .proto files that import each other,
+// with content that varies with n, and returns its root directory.
+func writeTree(t *testing.T, n int) string {
+	dir, err := ioutil.TempDir("", "gotoc-concurrent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"common/types.proto": fmt.Sprintf("package common;\nmessage Money%d { optional int64 units = 1; }\nenum Kind { A = %d; }\n", n, n),
+		"api/service.proto": fmt.Sprintf("package api;\nimport \"common/types.proto\";\n"+
+			"message Req { optional common.Money%d m = 1; repeated common.Kind k = 2; map<string, Req> sub = 3; }\n"+
+			"service S%d { rpc Do(Req) returns (Req); }\n", n, n),
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func compileTree(dir string) (string, error) {
+	fs, err := ParseFiles([]string{"api/service.proto"}, []string{dir})
+	if err != nil {
+		return "", err
+	}
+	fds, err := gendesc.Generate(fs)
+	if err != nil {
+		return "", err
+	}
+	return proto.MarshalTextString(fds), nil
+}
+
+// TestConcurrentCompilation compiles many trees in parallel.
+// It is most useful when run with -race.
+func TestConcurrentCompilation(t *testing.T) {
+	const trees, rounds = 8, 10
+	var dirs, want []string
+	for i := 0; i < trees; i++ {
+		dir := writeTree(t, i)
+		defer os.RemoveAll(dir)
+		out, err := compileTree(dir)
+		if err != nil {
+			t.Fatalf("Compiling tree %d: %v", i, err)
+		}
+		dirs, want = append(dirs, dir), append(want, out)
+	}
+
+	var wg sync.WaitGroup
+	errc := make(chan error, trees*rounds)
+	for r := 0; r < rounds; r++ {
+		for i := range dirs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				got, err := compileTree(dirs[i])
+				if err != nil {
+					errc <- fmt.Errorf("tree %d: %v", i, err)
+				} else if got != want[i] {
+					errc <- fmt.Errorf("tree %d: concurrent result differs from sequential result", i)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Error(err)
+	}
+}
@@ -4,16 +4,21 @@ Package parser parses proto files into gotoc's AST representation.
 package parser
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"unicode"
 
 	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/lexer"
 )
 
 const debugging = false
@@ -28,16 +33,154 @@ func debugf(format string, args ...interface{}) {
 // The files should generally consist of one package.
 // Any .proto files that these files import should be discoverable
 // relative to an element of importPaths; if importPaths is empty
-// then the current directory is searched.
+// then the current directory is searched. An element of importPaths
+// may also name a zip or tar archive (optionally gzipped),
+// whose members are searched in the same way.
 func ParseFiles(filenames []string, importPaths []string) (*ast.FileSet, error) {
+	return ParseFilesWithFallback(filenames, importPaths, nil)
+}
+
+// ParseFilesContext is like ParseFiles, but stops early with ctx's error
+// if ctx is cancelled or its deadline passes.
+func ParseFilesContext(ctx context.Context, filenames []string, importPaths []string) (*ast.FileSet, error) {
+	c := &Config{ImportPaths: importPaths}
+	return c.ParseFilesContext(ctx, filenames)
+}
+
+// ParseFilesWithFallback is like ParseFiles, but if a file cannot be found
+// relative to any element of importPaths then fallback is called to supply it.
+// fallback should return a nil *ast.File if it does not know the file either.
+// A file supplied by fallback may come from ParseFile, or may already have
+// its types resolved (e.g. if it was built by package descast);
+// either way, its imports are located in the same way as any other file's.
+func ParseFilesWithFallback(filenames []string, importPaths []string, fallback func(filename string) (*ast.File, error)) (*ast.FileSet, error) {
+	return ParseFilesWithOverride(filenames, importPaths, nil, fallback)
+}
+
+// ParseFilesWithOverride is like ParseFilesWithFallback, but override is
+// consulted for each file before importPaths are searched, so that it may
+// supply particular files in preference to any other copy. Like fallback,
+// override should return a nil *ast.File for files it does not supply.
+// Either of override and fallback may be nil.
+func ParseFilesWithOverride(filenames []string, importPaths []string, override, fallback func(filename string) (*ast.File, error)) (*ast.FileSet, error) {
+	c := &Config{
+		ImportPaths: importPaths,
+		Override:    override,
+		Fallback:    fallback,
+	}
+	return c.ParseFiles(filenames)
+}
+
+// A Config controls how files are located and how their symbols are resolved.
+// The zero Config searches only the current directory for imports.
+type Config struct {
+	// ImportPaths are searched for imports, as for ParseFiles,
+	// unless Importer is set.
+	ImportPaths []string
+
+	// Importer, if non-nil, opens files instead of ImportPaths being searched.
+	Importer Importer
+
+	// Sources, if non-nil, holds the contents of files keyed by name.
+	// A file in Sources is used in preference to any other copy of it,
+	// so files may be compiled without being written to disk.
+	Sources map[string][]byte
+
+	// Override and Fallback supply files before and after ImportPaths
+	// are searched, as for ParseFilesWithOverride. Either may be nil.
+	Override func(filename string) (*ast.File, error)
+	Fallback func(filename string) (*ast.File, error)
+
+	// Symbols, if non-nil, is consulted for type names that are not defined
+	// in any of the files. It is given each fully-qualified name (without a
+	// leading dot) that the type name could refer to, innermost scope first,
+	// and should return an *ast.Message or *ast.Enum, or nil if it does not
+	// know the name. The returned type's Up chain must lead to an *ast.File
+	// whose Package gives the type's full name.
+	Symbols func(fullName string) interface{}
+
+	// MaxDepth limits how deeply messages and groups may be nested.
+	// If it is zero, DefaultMaxDepth is used.
+	MaxDepth int
+
+	// MissingSyntax says what to do about a parsed file that has no
+	// syntax statement. Such a file is proto2 in any case.
+	MissingSyntax SyntaxPolicy
+
+	// Warnings receives warnings, one per line.
+	// If it is nil, warnings are written to os.Stderr.
+	Warnings io.Writer
+}
+
+// A SyntaxPolicy says what to do about a file with no syntax statement.
+type SyntaxPolicy int
+
+const (
+	SyntaxOptional SyntaxPolicy = iota // allow it, as older versions of protoc do
+	SyntaxWarn                         // allow it, with a warning
+	SyntaxRequired                     // report an error
+)
+
+// An Importer opens the files that a compilation needs, so that they may come
+// from somewhere other than the file system (e.g. generated content).
+type Importer interface {
+	// Open opens the named file (e.g. "foo/bar.proto").
+	// If there is no such file, it should return an error
+	// for which os.IsNotExist is true.
+	Open(filename string) (io.ReadCloser, error)
+}
+
+// ImporterFunc adapts a function to an Importer.
+type ImporterFunc func(filename string) (io.ReadCloser, error)
+
+// Open calls f(filename).
+func (f ImporterFunc) Open(filename string) (io.ReadCloser, error) { return f(filename) }
+
+// DefaultMaxDepth is the default limit on the nesting of messages and groups.
+const DefaultMaxDepth = 100
+
+// ParseFiles parses one or more files, and the files they import.
+func (c *Config) ParseFiles(filenames []string) (*ast.FileSet, error) {
+	return c.ParseFilesContext(context.Background(), filenames)
+}
+
+// ParseFilesContext is like ParseFiles, but stops early with ctx's error
+// if ctx is cancelled or its deadline passes. It is checked before each file
+// is read and before symbols are resolved.
+func (c *Config) ParseFilesContext(ctx context.Context, filenames []string) (*ast.FileSet, error) {
+	importPaths, override, fallback := c.ImportPaths, c.Override, c.Fallback
+
 	// Force importPaths to have at least one element.
 	if len(importPaths) == 0 {
 		importPaths = []string{"."}
 	}
 
+	// Refer to the input files by their names relative to an import path,
+	// so descriptors don't depend on where the files are on this machine.
+	filenames = append([]string(nil), filenames...)
+	for i, filename := range filenames {
+		name, err := c.CanonicalName(filename)
+		if err != nil {
+			return nil, err
+		}
+		filenames[i] = name
+	}
+
+	roots := importRoots{importerRoot{c.Importer}}
+	var err error
+	if c.Importer == nil {
+		if roots, err = openImportRoots(importPaths); err != nil {
+			return nil, err
+		}
+	}
+	defer roots.close()
+
 	fset := new(ast.FileSet)
 
-	index := make(map[string]int) // filename => index in fset.Files
+	index := make(map[string]int)         // filename => index in fset.Files
+	importedBy := make(map[string]string) // filename => first file to import it
+	weakOnly := make(map[string]bool)     // filename => whether all imports of it so far are weak
+	missing := make(map[string]bool)      // weakly imported files that weren't found
 
 	for len(filenames) > 0 {
 		filename := filenames[0]
@@ -45,72 +188,273 @@ func ParseFiles(filenames []string, importPaths []string) (*ast.FileSet, error)
 		if _, ok := index[filename]; ok {
 			continue // already parsed this one
 		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
 		f := &ast.File{Name: filename}
 		index[filename] = len(fset.Files)
 		fset.Files = append(fset.Files, f)
 
-		// Read the first existing file relative to an element of importPaths.
-		var buf []byte
-		for _, impPath := range importPaths {
-			b, err := ioutil.ReadFile(filepath.Join(impPath, filename))
-			if err != nil {
-				if os.IsNotExist(err) {
-					continue
-				}
+		var ff *ast.File
+		buf, inSources := c.Sources[filename]
+		if inSources && buf == nil {
+			buf = []byte{} // an empty file
+		}
+		if !inSources && override != nil {
+			if ff, err = override(filename); err != nil {
 				return nil, err
 			}
-			buf = b
-			break
 		}
-		if buf == nil {
-			return nil, fmt.Errorf("file not found: %s", filename)
+		if ff == nil && !inSources {
+			// Read the first existing file relative to an element of importPaths.
+			if buf, err = roots.read(filename); err != nil {
+				return nil, err
+			}
 		}
-
-		p := newParser(filename, string(buf))
-		if pe := p.readFile(f); pe != nil {
-			return nil, pe
+		if ff == nil && buf == nil && fallback != nil {
+			if ff, err = fallback(filename); err != nil {
+				return nil, err
+			}
+		}
+		if ff == nil && buf == nil {
+			if weakOnly[filename] {
+				// As in protoc, a file that is only imported weakly need not exist.
+				fset.Files = fset.Files[:len(fset.Files)-1]
+				missing[filename] = true
+				continue
+			}
+			return nil, c.notFound(filename, importedBy, importPaths)
 		}
-		if p.s != "" {
-			return nil, p.errorf("input was not all consumed")
+		if ff != nil {
+			fset.Files[index[filename]] = ff
+			f = ff
+		} else if err := parseFile(f, buf, c.MaxDepth); err != nil {
+			return nil, err
+		} else if f.Syntax == "" {
+			if err := c.missingSyntax(filename); err != nil {
+				return nil, err
+			}
 		}
 
 		// enqueue unparsed imports
-		for _, imp := range f.Imports {
+		for i, imp := range f.Imports {
+			weak := false
+			for _, j := range f.WeakImports {
+				weak = weak || i == j
+			}
+			if w, ok := weakOnly[imp]; !ok || w {
+				weakOnly[imp] = weak
+			}
+			if missing[imp] && !weak {
+				importedBy[imp] = filename
+				return nil, c.notFound(imp, importedBy, importPaths)
+			}
 			if _, ok := index[imp]; !ok {
 				filenames = append(filenames, imp)
+				if _, ok := importedBy[imp]; !ok {
+					importedBy[imp] = filename
+				}
 			}
 		}
 	}
 
-	if err := resolveSymbols(fset); err != nil {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkImportCycles(fset); err != nil {
+		return nil, err
+	}
+	if err := checkDeclarations(fset); err != nil {
+		return nil, err
+	}
+	if err := resolveSymbols(fset, c.Symbols); err != nil {
 		return nil, err
 	}
 	fset.Sort()
 	return fset, nil
 }
 
+// missingSyntax applies c.MissingSyntax to a file with no syntax statement.
+func (c *Config) missingSyntax(filename string) error {
+	msg := fmt.Sprintf("no syntax specified for %s; please use 'syntax = \"proto2\";' or 'syntax = \"proto3\";'", filename)
+	switch c.MissingSyntax {
+	case SyntaxWarn:
+		w := c.Warnings
+		if w == nil {
+			w = os.Stderr
+		}
+		fmt.Fprintf(w, "warning: %s (defaulted to proto2 syntax)\n", msg)
+	case SyntaxRequired:
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// notFound returns the error for a file that could not be found, saying how it
+// came to be needed (e.g. "a.proto -> b.proto") and where it was looked for.
+func (c *Config) notFound(filename string, importedBy map[string]string, importPaths []string) error {
+	var where []string
+	if c.Importer == nil {
+		where = append(where, "searched import paths "+strings.Join(importPaths, ", "))
+	}
+	if _, ok := importedBy[filename]; ok {
+		chain := []string{filename}
+		for imp, ok := importedBy[filename]; ok; imp, ok = importedBy[imp] {
+			chain = append([]string{imp}, chain...)
+		}
+		where = append([]string{"imported via " + strings.Join(chain, " -> ")}, where...)
+	}
+	if len(where) == 0 {
+		return fmt.Errorf("file not found: %s", filename)
+	}
+	return fmt.Errorf("file not found: %s (%s)", filename, strings.Join(where, "; "))
+}
+
+// checkImportCycles reports the first import cycle among the files in fset,
+// giving the chain of imports that forms it (e.g. "a.proto -> b.proto -> a.proto").
+func checkImportCycles(fset *ast.FileSet) error {
+	files := make(map[string]*ast.File)
+	for _, f := range fset.Files {
+		files[f.Name] = f
+	}
+	done := make(map[string]bool)
+	var chain []string // the files being visited, each importing the next
+	var visit func(name string) error
+	visit = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		for i, n := range chain {
+			if n == name {
+				cycle := append(chain[i:len(chain):len(chain)], name)
+				return fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		chain = append(chain, name)
+		if f := files[name]; f != nil {
+			for _, imp := range f.Imports {
+				if err := visit(imp); err != nil {
+					return err
+				}
+			}
+		}
+		chain = chain[:len(chain)-1]
+		done[name] = true
+		return nil
+	}
+	for _, f := range fset.Files {
+		if err := visit(f.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CanonicalName returns the name by which an input file is known in a compilation.
+// Names that are relative and already clean (e.g. "foo/bar.proto") are taken
+// to be relative to an import path, and are returned unchanged apart from
+// using forward slashes. Other names (e.g. "/src/foo/bar.proto" or
+// "./bar.proto") are taken to be paths on disk, and are made relative to the
+// first import path directory containing them.
+func (c *Config) CanonicalName(filename string) (string, error) {
+	slashed := filepath.ToSlash(filename)
+	if !filepath.IsAbs(filename) && slashed == path.Clean(slashed) && !strings.HasPrefix(slashed, "../") {
+		return slashed, nil
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	importPaths := c.ImportPaths
+	if len(importPaths) == 0 {
+		importPaths = []string{"."}
+	}
+	for _, impPath := range importPaths {
+		if isArchive(impPath) {
+			continue
+		}
+		dir, err := filepath.Abs(impPath)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return filepath.ToSlash(rel), nil
+	}
+	return "", fmt.Errorf("%s is not within any import path", filename)
+}
+
+// ParseFile parses the source of a single file.
+// Its imports are not parsed, and no symbol resolution is done.
+func ParseFile(filename string, src []byte) (*ast.File, error) {
+	f := &ast.File{Name: filename}
+	if err := parseFile(f, src, 0); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Parse is like ParseFile, but reads the source from src.
+func Parse(filename string, src io.Reader) (*ast.File, error) {
+	buf, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFile(filename, buf)
+}
+
+// ParseSource parses the named files and the files they import,
+// taking their contents from sources, which is keyed by file name.
+// Any imports that are not in sources are searched for
+// in the current directory, as for ParseFiles.
+func ParseSource(filenames []string, sources map[string][]byte) (*ast.FileSet, error) {
+	c := &Config{Sources: sources}
+	return c.ParseFiles(filenames)
+}
+
+func parseFile(f *ast.File, src []byte, maxDepth int) error {
+	f.Lines = ast.NewLineTable(string(src))
+	p := newParser(f.Name, string(src))
+	if maxDepth > 0 {
+		p.maxDepth = maxDepth
+	}
+	if pe := p.readFile(f); pe != nil {
+		return pe
+	}
+	if p.cur.err == nil || !p.cur.err.eof {
+		return p.errorf("input was not all consumed")
+	}
+	return validate(f)
+}
+
 type parseError struct {
 	message  string
 	filename string
-	line     int // 1-based line number
-	offset   int // 0-based byte offset from start of input
+	line     int  // 1-based line number
+	offset   int  // 0-based byte offset from start of input
+	eof      bool // whether this reports reaching the end of the input
 }
 
 func (pe *parseError) Error() string {
 	if pe == nil {
 		return "<nil>"
 	}
+	if pe.line == 0 {
+		// No position is known (e.g. for a file built from a descriptor).
+		return fmt.Sprintf("%s: %v", pe.filename, pe.message)
+	}
 	if pe.line == 1 {
 		return fmt.Sprintf("%s:1.%d: %v", pe.filename, pe.offset, pe.message)
 	}
 	return fmt.Sprintf("%s:%d: %v", pe.filename, pe.line, pe.message)
 }
 
-var eof = &parseError{message: "EOF"}
-
 type token struct {
 	value        string
+	kind         lexer.Kind
 	err          *parseError
 	line, offset int
 	unquoted     string // unquoted version of value
@@ -123,28 +467,40 @@ func (t *token) astPosition() ast.Position {
 	}
 }
 
+// astEnd returns the position just after the token.
+func (t *token) astEnd() ast.Position {
+	return ast.Position{
+		Line:   t.line,
+		Offset: t.offset + len(t.value),
+	}
+}
+
 type parser struct {
-	filename     string
-	s            string // remaining input
-	done         bool
-	backed       bool // whether back() was called
-	offset, line int
-	cur          token
+	filename string
+	sc       *lexer.Scanner
+	done     bool
+	backed   bool // whether back() was called
+	cur      token
 
 	comments []comment // accumulated during parse
+
+	depth, maxDepth int // nesting of messages
 }
 
 type comment struct {
-	text         string
-	line, offset int
+	lines              []string
+	line, offset       int
+	endLine, endOffset int  // position of the last "//", or the closing "*/"
+	trailing           bool // whether it follows a token on the same line
+	block              bool // whether it is a /* ... */ comment
 }
 
 func newParser(filename, s string) *parser {
 	return &parser{
 		filename: filename,
-		s:        s,
-		line:     1,
+		sc:       lexer.New(s),
 		cur:      token{line: 1},
+		maxDepth: DefaultMaxDepth,
 	}
 }
 
@@ -152,12 +508,16 @@ func (p *parser) readFile(f *ast.File) *parseError {
 	// Parse top-level things.
 	for !p.done {
 		tok := p.next()
-		if tok.err == eof {
+		if tok.err != nil && tok.err.eof {
 			break
 		} else if tok.err != nil {
 			return tok.err
 		}
 		// TODO: enforce ordering? package, imports, remainder
+		start := tok.astPosition()
+		stmt := func() *ast.Statement {
+			return &ast.Statement{Position: start, EndPosition: p.cur.astEnd(), Up: f}
+		}
 		switch tok.value {
 		case "package":
 			if f.Package != nil {
@@ -189,24 +549,14 @@ func (p *parser) readFile(f *ast.File) *parseError {
 				pkg += tok.value
 			}
 			f.Package = strings.Split(pkg, ".")
+			f.PackageStatement = stmt()
 		case "option":
-			tok := p.next()
-			if tok.err != nil {
-				return tok.err
-			}
-			key := tok.value
-			if err := p.readToken("="); err != nil {
-				return err
-			}
-			tok = p.next()
-			if tok.err != nil {
-				return tok.err
-			}
-			value := tok.value
-			if err := p.readToken(";"); err != nil {
+			opt, err := p.readOption()
+			if err != nil {
 				return err
 			}
-			f.Options = append(f.Options, [2]string{key, value})
+			f.Options = append(f.Options, opt)
+			f.OptionStatements = append(f.OptionStatements, stmt())
 		case "syntax":
 			if f.Syntax != "" {
 				return p.errorf("duplicate syntax statement")
@@ -227,10 +577,14 @@ func (p *parser) readFile(f *ast.File) *parseError {
 			if err := p.readToken(";"); err != nil {
 				return err
 			}
+			f.SyntaxStatement = stmt()
 		case "import":
-			if err := p.readToken("public"); err == nil {
+			switch tok := p.next(); {
+			case tok.err == nil && tok.value == "public":
 				f.PublicImports = append(f.PublicImports, len(f.Imports))
-			} else {
+			case tok.err == nil && tok.value == "weak":
+				f.WeakImports = append(f.WeakImports, len(f.Imports))
+			default:
 				p.back()
 			}
 			tok, err := p.readString()
@@ -241,6 +595,7 @@ func (p *parser) readFile(f *ast.File) *parseError {
 			if err := p.readToken(";"); err != nil {
 				return err
 			}
+			f.ImportStatements = append(f.ImportStatements, stmt())
 		case "message":
 			p.back()
 			msg := new(ast.Message)
@@ -267,12 +622,11 @@ func (p *parser) readFile(f *ast.File) *parseError {
 			srv.Up = f
 		case "extend":
 			p.back()
-			ext := new(ast.Extension)
+			ext := &ast.Extension{Up: f} // p.readField uses Up
 			f.Extensions = append(f.Extensions, ext)
 			if err := p.readExtension(ext); err != nil {
 				return err
 			}
-			ext.Up = f
 		default:
 			return p.errorf("unknown top-level thing %q", tok.value)
 		}
@@ -282,7 +636,9 @@ func (p *parser) readFile(f *ast.File) *parseError {
 	for len(p.comments) > 0 {
 		n := 1
 		for ; n < len(p.comments); n++ {
-			if p.comments[n].line != p.comments[n-1].line+1 {
+			// A comment after a token stands alone, as does a block comment.
+			prev, c := p.comments[n-1], p.comments[n]
+			if c.line != prev.endLine+1 || prev.trailing || c.trailing || prev.block || c.block {
 				break
 			}
 		}
@@ -292,12 +648,12 @@ func (p *parser) readFile(f *ast.File) *parseError {
 				Offset: p.comments[0].offset,
 			},
 			End: ast.Position{
-				Line:   p.comments[n-1].line,
-				Offset: p.comments[n-1].offset,
+				Line:   p.comments[n-1].endLine,
+				Offset: p.comments[n-1].endOffset,
 			},
 		}
 		for _, comm := range p.comments[:n] {
-			c.Text = append(c.Text, comm.text)
+			c.Text = append(c.Text, comm.lines...)
 		}
 		p.comments = p.comments[n:]
 
@@ -354,46 +710,50 @@ func (p *parser) readMessage(msg *ast.Message) *parseError {
 		return err
 	}
 
-	return p.readToken("}")
+	if err := p.readToken("}"); err != nil {
+		return err
+	}
+	msg.EndPosition = p.cur.astEnd()
+	return nil
 }
 
 func (p *parser) readMessageContents(msg *ast.Message) *parseError {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > p.maxDepth {
+		return p.errorf("nesting too deep (more than %d levels)", p.maxDepth)
+	}
+
 	// Parse message fields and other things inside a message.
-	var oneof *ast.Oneof // set while inside a oneof
 	for !p.done {
 		tok := p.next()
 		if tok.err != nil {
 			return tok.err
 		}
-		switch tok.value {
+		stmt := tok.value
+		if messageKeywords[stmt] && p.fieldFollows() {
+			// A field whose type has a keyword's name (e.g. "message m = 1;").
+			stmt = ""
+		}
+		switch stmt {
 		case "extend":
 			// extension
 			p.back()
-			ext := new(ast.Extension)
+			ext := &ast.Extension{Up: msg} // p.readField uses Up
 			msg.Extensions = append(msg.Extensions, ext)
 			if err := p.readExtension(ext); err != nil {
 				return err
 			}
-			ext.Up = msg
 		case "oneof":
-			// oneof
-			if oneof != nil {
-				return p.errorf("nested oneof not permitted")
-			}
-			oneof = new(ast.Oneof)
-			msg.Oneofs = append(msg.Oneofs, oneof)
-			oneof.Position = p.cur.astPosition()
-
-			tok := p.next()
-			if tok.err != nil {
-				return tok.err
+			if err := p.readOneof(msg); err != nil {
+				return err
 			}
-			oneof.Name = tok.value // TODO: validate
-			oneof.Up = msg
-
-			if err := p.readToken("{"); err != nil {
+		case "option":
+			opt, err := p.readOption()
+			if err != nil {
 				return err
 			}
+			msg.Options = append(msg.Options, opt)
 		case "message":
 			// nested message
 			p.back()
@@ -420,23 +780,25 @@ func (p *parser) readMessageContents(msg *ast.Message) *parseError {
 				return err
 			}
 			msg.ExtensionRanges = append(msg.ExtensionRanges, r...)
+		case "reserved":
+			p.back()
+			r, names, err := p.readReserved(1, maxFieldNumber)
+			if err != nil {
+				return err
+			}
+			msg.ReservedRanges = append(msg.ReservedRanges, r...)
+			msg.ReservedNames = append(msg.ReservedNames, names...)
 		default:
 			// field; this token is required/optional/repeated,
 			// a primitive type, or a named type.
 			p.back()
 			field := new(ast.Field)
 			msg.Fields = append(msg.Fields, field)
-			field.Oneof = oneof
 			field.Up = msg // p.readField uses this
 			if err := p.readField(field); err != nil {
 				return err
 			}
 		case "}":
-			if oneof != nil {
-				// end of oneof
-				oneof = nil
-				continue
-			}
 			// end of message
 			p.back()
 			return nil
@@ -445,9 +807,109 @@ func (p *parser) readMessageContents(msg *ast.Message) *parseError {
 	return p.errorf("unexpected EOF while parsing message")
 }
 
-func (p *parser) readField(f *ast.Field) *parseError {
-	_, inMsg := f.Up.(*ast.Message)
+// readOneof reads a oneof, whose "oneof" keyword has been consumed,
+// into msg. Its fields are fields of msg too. Any group in it has its
+// own body, so a oneof in that is read separately, into the group.
+func (p *parser) readOneof(msg *ast.Message) *parseError {
+	oneof := &ast.Oneof{
+		Position: p.cur.astPosition(),
+		Up:       msg,
+	}
+	msg.Oneofs = append(msg.Oneofs, oneof)
+
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	oneof.Name = tok.value // TODO: validate
+
+	if err := p.readToken("{"); err != nil {
+		return err
+	}
+
+	for !p.done {
+		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		stmt := tok.value
+		if messageKeywords[stmt] && p.fieldFollows() {
+			// A field whose type has a keyword's name (e.g. "option o = 1;").
+			stmt = ""
+		}
+		switch {
+		case stmt == "option":
+			opt, err := p.readOption()
+			if err != nil {
+				return err
+			}
+			oneof.Options = append(oneof.Options, opt)
+		case stmt == "}":
+			oneof.EndPosition = p.cur.astEnd()
+			return nil
+		case messageKeywords[stmt]:
+			return p.errorf("%s is not allowed in oneof %s", stmt, oneof.Name)
+		case fieldLabels[stmt]:
+			return p.errorf("fields in oneofs must not have labels (required/optional/repeated) (oneof %s)", oneof.Name)
+		default:
+			p.back()
+			field := &ast.Field{
+				Oneof: oneof,
+				Up:    msg, // p.readField uses this
+			}
+			msg.Fields = append(msg.Fields, field)
+			if err := p.readField(field); err != nil {
+				return err
+			}
+		}
+	}
+	return p.errorf("unexpected EOF while parsing oneof %s", oneof.Name)
+}
 
+// messageKeywords are the words that start statements in a message
+// other than fields. They may still be used as names.
+var messageKeywords = map[string]bool{
+	"extend":     true,
+	"oneof":      true,
+	"option":     true,
+	"message":    true,
+	"enum":       true,
+	"extensions": true,
+	"reserved":   true,
+}
+
+// fieldLabels are the labels that may start a field outside a oneof.
+var fieldLabels = map[string]bool{
+	"required": true,
+	"optional": true,
+	"repeated": true,
+}
+
+// fieldFollows reports whether the tokens after the current one are a field's
+// name, "=" and tag, in which case the current token is the field's type.
+func (p *parser) fieldFollows() bool {
+	toks := p.peek(3)
+	return len(toks) == 3 && toks[0].Kind == lexer.Ident && toks[1].Value == "=" && toks[2].Kind == lexer.Int
+}
+
+// peek returns up to n tokens that follow the current one, without consuming them.
+// Fewer are returned if the input ends or cannot be scanned.
+func (p *parser) peek(n int) []lexer.Token {
+	sc := *p.sc
+	var toks []lexer.Token
+	for len(toks) < n {
+		tok, err := sc.Scan()
+		if err != nil {
+			break
+		}
+		if tok.Kind != lexer.Comment {
+			toks = append(toks, tok)
+		}
+	}
+	return toks
+}
+
+func (p *parser) readField(f *ast.Field) *parseError {
 	// TODO: enforce type limitations if f.Oneof != nil
 
 	// look for required/optional/repeated
@@ -460,7 +922,7 @@ func (p *parser) readField(f *ast.Field) *parseError {
 	case "required":
 		f.Required = true
 	case "optional":
-		// nothing to do
+		f.Optional = true
 	case "repeated":
 		f.Repeated = true
 	case "map":
@@ -496,6 +958,13 @@ func (p *parser) readField(f *ast.Field) *parseError {
 		return tok.err
 	}
 	f.TypeName = tok.value // checked during resolution
+	if tok.value == "map" {
+		// A map field can't have a label, but a message may be called "map".
+		if tok := p.next(); tok.err == nil && tok.value == "<" {
+			return p.errorf("field labels (required/optional/repeated) are not allowed on map fields")
+		}
+		p.back()
+	}
 
 parseFromFieldName:
 	tok = p.next()
@@ -503,38 +972,55 @@ parseFromFieldName:
 		return tok.err
 	}
 	f.Name = tok.value // TODO: validate
+	if f.TypeName == "group" && !('A' <= f.Name[0] && f.Name[0] <= 'Z') {
+		// The field is named by lower-casing the group's name,
+		// so the two can't be the same.
+		return p.errorf("group names must start with a capital letter (group %s)", f.Name)
+	}
 
 	if err := p.readToken("="); err != nil {
 		return err
 	}
 
-	tag, err := p.readTagNumber(false)
+	tag, err := p.readTagNumber()
 	if err != nil {
 		return err
 	}
 	f.Tag = tag
 
-	if f.TypeName == "group" && inMsg {
+	if f.TypeName == "group" {
 		if err := p.readToken("{"); err != nil {
 			return err
 		}
 
+		// The group message is declared in the scope of the field,
+		// which for an extension is where the extend block is.
+		var scope interface{} = f.Up
+		if ext, ok := f.Up.(*ast.Extension); ok {
+			scope = ext.Up
+		}
 		group := &ast.Message{
 			// the current parse position is probably good enough
 			Position: p.cur.astPosition(),
 			Name:     f.Name,
 			Group:    true,
-			Up:       f.Up,
+			Up:       scope,
 		}
 		if err := p.readMessageContents(group); err != nil {
 			return err
 		}
 		f.TypeName = f.Name
-		msg := f.Up.(*ast.Message)
-		msg.Messages = append(msg.Messages, group) // ugh
+		switch up := scope.(type) {
+		case *ast.Message:
+			up.Messages = append(up.Messages, group) // ugh
+		case *ast.File:
+			up.Messages = append(up.Messages, group)
+		}
 		if err := p.readToken("}"); err != nil {
 			return err
 		}
+		group.EndPosition = p.cur.astEnd()
+		f.EndPosition = group.EndPosition
 		// A semicolon after a group is optional.
 		if err := p.readToken(";"); err != nil {
 			p.back()
@@ -554,6 +1040,7 @@ parseFromFieldName:
 	if err := p.readToken(";"); err != nil {
 		return err
 	}
+	f.EndPosition = p.cur.astEnd()
 	return nil
 }
 
@@ -566,7 +1053,6 @@ func (p *parser) readFieldOptions(f *ast.Field) *parseError {
 		if tok.err != nil {
 			return tok.err
 		}
-		// TODO: support more options than just default and packed
 		switch tok.value {
 		case "default":
 			f.HasDefault = true
@@ -579,11 +1065,46 @@ func (p *parser) readFieldOptions(f *ast.Field) *parseError {
 			}
 			// TODO: check type
 			switch f.TypeName {
-			case "string":
+			case "string", "bytes":
+				if tok.kind != lexer.String {
+					return p.errorf("got %q, want string", tok.value)
+				}
+				// Adjacent strings are concatenated.
 				f.Default = tok.unquoted
+				for {
+					tok := p.next()
+					if tok.err != nil || tok.kind != lexer.String {
+						p.back()
+						break
+					}
+					f.Default += tok.unquoted
+				}
+			case "float", "double":
+				switch {
+				case tok.kind == lexer.Int, tok.kind == lexer.Float:
+				case tok.kind == lexer.Ident && (strings.TrimPrefix(tok.value, "-") == "inf" || strings.TrimPrefix(tok.value, "-") == "nan"):
+				default:
+					return p.errorf("got %q, want a number for default of %s field %s", tok.value, f.TypeName, f.Name)
+				}
+				f.Default = tok.value
 			default:
 				f.Default = tok.value
 			}
+		case "json_name":
+			if f.JSONName != "" {
+				return p.errorf("duplicate json_name option for field %s", f.Name)
+			}
+			if err := p.readToken("="); err != nil {
+				return err
+			}
+			tok, err := p.readString()
+			if err != nil {
+				return err
+			}
+			if tok.unquoted == "" {
+				return p.errorf("json_name for field %s may not be empty", f.Name)
+			}
+			f.JSONName = tok.unquoted
 		case "packed":
 			f.HasPacked = true
 			if err := p.readToken("="); err != nil {
@@ -595,7 +1116,19 @@ func (p *parser) readFieldOptions(f *ast.Field) *parseError {
 			}
 			f.Packed = packed
 		default:
-			return p.errorf(`got %q, want "default" or "packed"`, tok.value)
+			p.back()
+			key, err := p.readOptionName()
+			if err != nil {
+				return err
+			}
+			if err := p.readToken("="); err != nil {
+				return err
+			}
+			value, err := p.readOptionValue()
+			if err != nil {
+				return err
+			}
+			f.Options = append(f.Options, [2]string{key, value})
 		}
 		// next should be a comma or ]
 		tok = p.next()
@@ -613,35 +1146,236 @@ func (p *parser) readFieldOptions(f *ast.Field) *parseError {
 	return p.errorf("unexpected EOF while parsing field options")
 }
 
+// readOptionList reads a bracketed list of options, as written after
+// an enum value (e.g. "[deprecated = true, (my.opt) = 3]").
+func (p *parser) readOptionList() ([][2]string, *parseError) {
+	if err := p.readToken("["); err != nil {
+		return nil, err
+	}
+	var opts [][2]string
+	for !p.done {
+		key, err := p.readOptionName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.readToken("="); err != nil {
+			return nil, err
+		}
+		value, err := p.readOptionValue()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, [2]string{key, value})
+
+		tok := p.next()
+		if tok.err != nil {
+			return nil, tok.err
+		}
+		if tok.value == "," {
+			continue
+		}
+		if tok.value == "]" {
+			return opts, nil
+		}
+		return nil, p.errorf(`got %q, want "," or "]"`, tok.value)
+	}
+	return nil, p.errorf("unexpected EOF while parsing options")
+}
+
+// readOptionName reads the name of an option, which may include extension
+// names in parentheses (e.g. "(foo.bar).baz").
+func (p *parser) readOptionName() (string, *parseError) {
+	var name string
+	for {
+		tok := p.next()
+		if tok.err != nil {
+			return "", tok.err
+		}
+		if tok.value == "(" {
+			tok = p.next()
+			if tok.err != nil {
+				return "", tok.err
+			}
+			ext := tok.value
+			if err := p.readToken(")"); err != nil {
+				return "", err
+			}
+			name += "(" + ext + ")"
+		} else {
+			name += tok.value
+		}
+		// Sub-field names after a parenthesized part are separate tokens
+		// starting with a dot. A lone dot is followed by another parenthesized part.
+		for {
+			tok = p.next()
+			if tok.err != nil || !strings.HasPrefix(tok.value, ".") {
+				p.back()
+				return name, nil
+			}
+			name += tok.value
+			if tok.value == "." {
+				break
+			}
+		}
+	}
+}
+
+// readOption reads the rest of an option statement after the "option" keyword.
+func (p *parser) readOption() ([2]string, *parseError) {
+	key, err := p.readOptionName()
+	if err != nil {
+		return [2]string{}, err
+	}
+	if err := p.readToken("="); err != nil {
+		return [2]string{}, err
+	}
+	value, err := p.readOptionValue()
+	if err != nil {
+		return [2]string{}, err
+	}
+	if err := p.readToken(";"); err != nil {
+		return [2]string{}, err
+	}
+	return [2]string{key, value}, nil
+}
+
+// readOptionValue reads the value of an option. A message literal
+// (e.g. "{ foo: 1 bar: \"x\" }") is returned as its tokens separated by
+// single spaces, inside braces. A sign is joined to the number it is
+// separated from, and adjacent strings are joined into one quoted string.
+// Other values are returned as written.
+func (p *parser) readOptionValue() (string, *parseError) {
+	tok := p.next()
+	if tok.err != nil {
+		return "", tok.err
+	}
+	switch {
+	case tok.value == "{":
+		// A message literal, read below.
+	case tok.value == "-":
+		tok := p.next()
+		if tok.err != nil {
+			return "", tok.err
+		}
+		if tok.kind != lexer.Int && tok.kind != lexer.Float && tok.value != "inf" && tok.value != "nan" {
+			return "", p.errorf("got %q after \"-\", want a number", tok.value)
+		}
+		return "-" + tok.value, nil
+	case tok.kind == lexer.String:
+		value, s := tok.value, tok.unquoted
+		for n := 1; ; n++ {
+			tok := p.next()
+			if tok.err != nil || tok.kind != lexer.String {
+				p.back()
+				if n > 1 {
+					value = strconv.Quote(s)
+				}
+				return value, nil
+			}
+			s += tok.unquoted
+		}
+	case tok.kind == lexer.Int, tok.kind == lexer.Float, tok.kind == lexer.Ident:
+		return tok.value, nil
+	default:
+		return "", p.errorf("got %q, want an option value", tok.value)
+	}
+	var toks []string
+	for depth := 1; ; {
+		tok := p.next()
+		if tok.err != nil {
+			if tok.err.eof {
+				return "", p.errorf("unexpected EOF in aggregate option value")
+			}
+			return "", tok.err
+		}
+		switch tok.value {
+		case "{":
+			depth++
+		case "}":
+			depth--
+		}
+		if depth == 0 {
+			break
+		}
+		toks = append(toks, tok.value)
+	}
+	if len(toks) == 0 {
+		return "{}", nil
+	}
+	return "{ " + strings.Join(toks, " ") + " }", nil
+}
+
 func (p *parser) readExtensionRange() ([][2]int, *parseError) {
 	if err := p.readToken("extensions"); err != nil {
 		return nil, err
 	}
+	return p.readRanges(1, maxFieldNumber)
+}
 
+// readReserved reads a reserved statement, which lists either
+// ranges of numbers in [min, max] or names.
+func (p *parser) readReserved(min, max int) (ranges [][2]int, names []string, err *parseError) {
+	if err := p.readToken("reserved"); err != nil {
+		return nil, nil, err
+	}
+	tok := p.next()
+	if tok.err != nil {
+		return nil, nil, tok.err
+	}
+	p.back()
+	if tok.kind != lexer.String {
+		ranges, err := p.readRanges(min, max)
+		return ranges, nil, err
+	}
+	for {
+		tok, err := p.readString()
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, tok.unquoted)
+		tok = p.next()
+		if tok.err != nil {
+			return nil, nil, tok.err
+		}
+		switch tok.value {
+		case ",":
+		case ";":
+			return nil, names, nil
+		default:
+			return nil, nil, p.errorf(`got %q, want "," or ";"`, tok.value)
+		}
+	}
+}
+
+// readRanges reads a list of numbers and ranges ending with a semicolon,
+// as in extensions and reserved statements (e.g. "1, 5 to 10, 100 to max;").
+// Numbers must be in [min, max]; "max" stands for max.
+// The ranges returned are inclusive at both ends.
+func (p *parser) readRanges(min, max int) ([][2]int, *parseError) {
 	var rs [][2]int
 	for {
 		// next token must be a number,
 		// followed by a comma, semicolon or "to".
-		start, err := p.readTagNumber(false)
+		start, err := p.readRangeNumber(min, max, false)
 		if err != nil {
 			return nil, err
 		}
 		end := start
 		tok := p.next()
 		if tok.err != nil {
-			return nil, err
+			return nil, tok.err
 		}
 		if tok.value == "to" {
-			end, err = p.readTagNumber(true) // allow "max"
+			end, err = p.readRangeNumber(min, max, true)
 			if err != nil {
 				return nil, err
 			}
 			if start > end {
-				return nil, p.errorf("bad extension range order: %d > %d", start, end)
+				return nil, p.errorf("bad range order: %d > %d", start, end)
 			}
 			tok = p.next()
 			if tok.err != nil {
-				return nil, err
+				return nil, tok.err
 			}
 		}
 		rs = append(rs, [2]int{start, end})
@@ -655,19 +1389,41 @@ func (p *parser) readExtensionRange() ([][2]int, *parseError) {
 	return rs, nil
 }
 
-func (p *parser) readTagNumber(allowMax bool) (int, *parseError) {
+func (p *parser) readRangeNumber(min, max int, allowMax bool) (int, *parseError) {
 	tok := p.next()
 	if tok.err != nil {
 		return 0, tok.err
 	}
 	if allowMax && tok.value == "max" {
-		return 1<<29 - 1, nil
+		return max, nil
+	}
+	if tok.kind != lexer.Int {
+		return 0, p.errorf("got %q, want a number", tok.value)
+	}
+	n, err := strconv.ParseInt(tok.value, 0, 64)
+	if err != nil || n < int64(min) || n > int64(max) {
+		return 0, p.errorf("number %s out of range [%d, %d]", tok.value, min, max)
+	}
+	return int(n), nil
+}
+
+// Limits of field numbers and enum values.
+const (
+	maxFieldNumber = 1<<29 - 1
+	minEnumValue   = -1 << 31
+	maxEnumValue   = 1<<31 - 1
+)
+
+func (p *parser) readTagNumber() (int, *parseError) {
+	tok := p.next()
+	if tok.err != nil {
+		return 0, tok.err
 	}
 	n, err := strconv.ParseInt(tok.value, 10, 32)
 	if err != nil {
 		return 0, p.errorf("bad field number %q: %v", tok.value, err)
 	}
-	if n < 1 || n >= 1<<29 {
+	if n < 1 || n > maxFieldNumber {
 		return 0, p.errorf("field number %v out of range", n)
 	}
 	if 19000 <= n && n <= 19999 { // TODO: still relevant?
@@ -700,12 +1456,33 @@ func (p *parser) readEnum(enum *ast.Enum) *parseError {
 		}
 		if tok.value == "}" {
 			// end of enum
+			enum.EndPosition = p.cur.astEnd()
 			// A semicolon after an enum is optional.
 			if err := p.readToken(";"); err != nil {
 				p.back()
 			}
 			return nil
 		}
+		// "reserved = 1;" is a value named "reserved".
+		if next := p.peek(1); tok.value == "reserved" && (len(next) == 0 || next[0].Value != "=") {
+			p.back()
+			r, names, err := p.readReserved(minEnumValue, maxEnumValue)
+			if err != nil {
+				return err
+			}
+			enum.ReservedRanges = append(enum.ReservedRanges, r...)
+			enum.ReservedNames = append(enum.ReservedNames, names...)
+			continue
+		}
+		// Likewise "option = 1;" is a value named "option".
+		if next := p.peek(1); tok.value == "option" && (len(next) == 0 || next[0].Value != "=") {
+			opt, err := p.readOption()
+			if err != nil {
+				return err
+			}
+			enum.Options = append(enum.Options, opt)
+			continue
+		}
 		// TODO: verify tok.value is a valid enum value name.
 		ev := new(ast.EnumValue)
 		enum.Values = append(enum.Values, ev)
@@ -728,9 +1505,18 @@ func (p *parser) readEnum(enum *ast.Enum) *parseError {
 		}
 		ev.Number = int32(num) // TODO: validate
 
+		if next := p.peek(1); len(next) > 0 && next[0].Value == "[" {
+			opts, err := p.readOptionList()
+			if err != nil {
+				return err
+			}
+			ev.Options = opts
+		}
+
 		if err := p.readToken(";"); err != nil {
 			return err
 		}
+		ev.EndPosition = p.cur.astEnd()
 	}
 
 	return p.errorf("unexpected EOF while parsing enum")
@@ -761,11 +1547,19 @@ func (p *parser) readService(srv *ast.Service) *parseError {
 		switch tok.value {
 		case "}":
 			// end of service
+			srv.EndPosition = p.cur.astEnd()
 			return nil
+		case "option":
+			opt, err := p.readOption()
+			if err != nil {
+				return err
+			}
+			srv.Options = append(srv.Options, opt)
+			continue
 		case "rpc":
 			// handled below
 		default:
-			return p.errorf(`got %q, want "rpc" or "}"`, tok.value)
+			return p.errorf(`got %q, want "option", "rpc" or "}"`, tok.value)
 		}
 
 		tok = p.next()
@@ -831,7 +1625,7 @@ func (p *parser) readService(srv *ast.Service) *parseError {
 		if err := p.readToken(")"); err != nil {
 			return err
 		}
-		if err := p.readToken(";"); err != nil {
+		if err := p.readMethodBody(mth); err != nil {
 			return err
 		}
 	}
@@ -862,6 +1656,7 @@ func (p *parser) readExtension(ext *ast.Extension) *parseError {
 		}
 		if tok.value == "}" {
 			// end of extension
+			ext.EndPosition = p.cur.astEnd()
 			return nil
 		}
 		p.back()
@@ -875,12 +1670,54 @@ func (p *parser) readExtension(ext *ast.Extension) *parseError {
 	return p.errorf("unexpected EOF while parsing extension")
 }
 
+// readMethodBody reads what follows an rpc's return type:
+// either a semicolon, or a braced body holding option statements.
+func (p *parser) readMethodBody(mth *ast.Method) *parseError {
+	tok := p.next()
+	if tok.err != nil {
+		return tok.err
+	}
+	switch tok.value {
+	case ";":
+		mth.EndPosition = p.cur.astEnd()
+		return nil
+	case "{":
+	default:
+		return p.errorf(`got %q, want ";" or "{"`, tok.value)
+	}
+	for {
+		tok := p.next()
+		if tok.err != nil {
+			return tok.err
+		}
+		switch tok.value {
+		case "}":
+			mth.EndPosition = p.cur.astEnd()
+			// A semicolon may follow the body.
+			if tok := p.next(); tok.err != nil || tok.value != ";" {
+				p.back()
+			}
+			return nil
+		case ";":
+			// empty statement
+		case "option":
+			opt, err := p.readOption()
+			if err != nil {
+				return err
+			}
+			mth.Options = append(mth.Options, opt)
+		default:
+			return p.errorf(`got %q, want "option" or "}"`, tok.value)
+		}
+	}
+}
+
 func (p *parser) readString() (*token, *parseError) {
 	tok := p.next()
 	if tok.err != nil {
 		return nil, tok.err
 	}
-	if tok.value[0] != '"' {
+	if tok.kind != lexer.String {
 		return nil, p.errorf("got %q, want string", tok.value)
 	}
 	return tok, nil
@@ -921,7 +1758,7 @@ func (p *parser) back() {
 	// In case an error was being recovered, ignore any error.
 	// Don't do this for EOF, though, since we know that's what
 	// we'll return next.
-	if p.cur.err != eof {
+	if p.cur.err != nil && !p.cur.err.eof {
 		p.cur.err = nil // in case an error was being recovered
 	}
 }
@@ -934,8 +1771,15 @@ func (p *parser) next() *token {
 		p.advance()
 		debugf("parser·next(): advanced to %q [err: %v]", p.cur.value, p.cur.err)
 		if p.done && p.cur.err == nil {
+			pos := p.sc.Pos()
 			p.cur.value = ""
-			p.cur.err = eof
+			p.cur.err = &parseError{
+				message:  "EOF",
+				filename: p.filename,
+				line:     pos.Line,
+				offset:   pos.Offset,
+				eof:      true,
+			}
 		}
 	}
 	debugf("parser·next(): returning %q [err: %v]", p.cur.value, p.cur.err)
@@ -943,92 +1787,73 @@ func (p *parser) next() *token {
 }
 
 func (p *parser) advance() {
-	// Skip whitespace
-	p.skipWhitespaceAndComments()
-	if p.done {
-		return
-	}
-
-	// Start of non-whitespace
 	p.cur.err = nil
-	p.cur.offset, p.cur.line = p.offset, p.line
-	switch p.s[0] {
-	// TODO: more cases, like punctuation.
-	case ';', '{', '}', '=', '[', ']', ',', '<', '>', '(', ')':
-		// Single symbol
-		p.cur.value, p.s = p.s[:1], p.s[1:]
-	case '"', '\'':
-		// Quoted string
-		i := 1
-		for i < len(p.s) && p.s[i] != p.s[0] {
-			if p.s[i] == '\\' && i+1 < len(p.s) {
-				// skip escaped character
-				i++
-			}
-			i++
-		}
-		if i >= len(p.s) {
-			p.errorf("encountered EOF inside string")
+	for {
+		tok, err := p.sc.Scan()
+		if err == io.EOF {
+			p.done = true
 			return
 		}
-		i++
-		p.cur.value, p.s = p.s[:i], p.s[i:]
-		// TODO: This doesn't work for single quote strings;
-		// quotes will be mangled.
-		unq, err := strconv.Unquote(p.cur.value)
 		if err != nil {
-			p.errorf("invalid quoted string [%s]: %v", p.cur.value, err)
+			le := err.(*lexer.Error)
+			p.cur.line, p.cur.offset = le.Pos.Line, le.Pos.Offset
+			p.errorf("%s", le.Msg)
+			return
 		}
-		p.cur.unquoted = unq
-	default:
-		i := 0
-		for i < len(p.s) && isIdentOrNumberChar(p.s[i]) {
-			i++
+		if tok.Kind == lexer.Comment {
+			p.addComment(tok)
+			continue
 		}
-		if i == 0 {
-			p.errorf("unexpected byte 0x%02x (%q)", p.s[0], string(p.s[:1]))
-			return
+		p.cur.kind, p.cur.value = tok.Kind, tok.Value
+		p.cur.line, p.cur.offset = tok.Pos.Line, tok.Pos.Offset
+		if tok.Kind == lexer.String {
+			// The lexer has already checked that this is well formed.
+			p.cur.unquoted, _ = ast.Unquote(tok.Value)
 		}
-		p.cur.value, p.s = p.s[:i], p.s[i:]
+		return
 	}
-	p.offset += len(p.cur.value)
 }
 
-func (p *parser) skipWhitespaceAndComments() {
-	i := 0
-	for i < len(p.s) {
-		if isWhitespace(p.s[i]) {
-			if p.s[i] == '\n' {
-				p.line++
-			}
-			i++
-			continue
-		}
-		if i+1 < len(p.s) && p.s[i] == '/' && p.s[i+1] == '/' {
-			si := i + 2
-			c := comment{line: p.line, offset: p.offset + i}
-			// XXX: set c.text
-			// comment; skip to end of line or input
-			for i < len(p.s) && p.s[i] != '\n' {
-				i++
-			}
-			c.text = p.s[si:i]
-			p.comments = append(p.comments, c)
-			if i < len(p.s) {
-				// end of line; keep going
-				p.line++
-				i++
-				continue
-			}
-			// end of input; fall out of loop
+// addComment records a comment token for attaching to the AST.
+func (p *parser) addComment(tok lexer.Token) {
+	c := comment{
+		line:      tok.Pos.Line,
+		offset:    tok.Pos.Offset,
+		endLine:   tok.End.Line,
+		endOffset: tok.Pos.Offset,
+		trailing:  p.cur.value != "" && p.cur.line == tok.Pos.Line,
+	}
+	if strings.HasPrefix(tok.Value, "//") {
+		c.lines = []string{tok.Value[2:]}
+	} else {
+		c.lines = blockCommentLines(tok.Value[2 : len(tok.Value)-2])
+		c.endOffset = tok.End.Offset - 2
+		c.block = true
+	}
+	p.comments = append(p.comments, c)
+}
+
+// blockCommentLines splits the text of a block comment into lines.
+// Like protoc, it drops the leading "*" that continuation lines often have,
+// and the blank lines left by a comment's opening and closing lines.
+func blockCommentLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	for i := 1; i < len(lines); i++ {
+		l := strings.TrimLeft(lines[i], " \t")
+		if strings.HasPrefix(l, "*") {
+			lines[i] = l[1:]
 		}
-		break
 	}
-	p.offset += i
-	p.s = p.s[i:]
-	if len(p.s) == 0 {
-		p.done = true
+	if len(lines) > 1 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	if len(lines) > 1 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
 	}
+	return lines
 }
 
 func (p *parser) errorf(format string, a ...interface{}) *parseError {
@@ -1042,23 +1867,3 @@ func (p *parser) errorf(format string, a ...interface{}) *parseError {
 	p.done = true
 	return pe
 }
-
-func isWhitespace(c byte) bool {
-	// TODO: do more accurately
-	return unicode.IsSpace(rune(c))
-}
-
-// Numbers and identifiers are matched by [-+._A-Za-z0-9]
-func isIdentOrNumberChar(c byte) bool {
-	switch {
-	case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z':
-		return true
-	case '0' <= c && c <= '9':
-		return true
-	}
-	switch c {
-	case '-', '+', '.', '_':
-		return true
-	}
-	return false
-}
@@ -1,6 +1,14 @@
 package parser
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/dsymonds/gotoc/ast"
@@ -23,8 +31,12 @@ func tryParse(t *testing.T, input, output string) {
 		t.Errorf("Failed parsing input: %v", pe)
 		return
 	}
+	if err := validate(f); err != nil {
+		t.Errorf("Validating input: %v", err)
+		return
+	}
 	fset := &ast.FileSet{Files: []*ast.File{f}}
-	if err := resolveSymbols(fset); err != nil {
+	if err := resolveSymbols(fset, nil); err != nil {
 		t.Errorf("Resolving symbols: %v", err)
 		return
 	}
@@ -51,147 +63,153 @@ type parseTest struct {
 }
 
 // used to shorten the FieldDefaults expected output.
-const fieldDefaultsEtc = `name:"foo" label:LABEL_REQUIRED number:1`
+func fieldDefaultsEtc(n int) string {
+	return fmt.Sprintf(`name:"f%d" label:LABEL_REQUIRED number:%d json_name:"f%d"`, n, n, n)
+}
 
 var parseTests = []parseTest{
 	{
 		"SimpleMessage",
 		"message TestMessage {\n  required int32 foo = 1;\n}\n",
-		`message_type { name: "TestMessage" field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT32 number:1 } }`,
+		`message_type { name: "TestMessage" field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT32 number:1 json_name:"foo" } }`,
 	},
 	{
 		"ImplicitSyntaxIdentifier",
 		"message TestMessage {\n  required int32 foo = 1;\n}\n",
-		`message_type { name: "TestMessage"  field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT32 number:1 } }`,
+		`message_type { name: "TestMessage"  field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT32 number:1 json_name:"foo" } }`,
 	},
 	{
 		"ExplicitSyntaxIdentifier",
 		"syntax = \"proto2\";\nmessage TestMessage {\n  required int32 foo = 1;\n}\n",
-		`message_type { name: "TestMessage" field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT32 number:1 } }`,
+		`message_type { name: "TestMessage" field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT32 number:1 json_name:"foo" } }`,
 	},
 	{
 		"SimpleFields",
 		"message TestMessage {\n  required int32 foo = 15;\n  optional int32 bar = 34;\n  repeated int32 baz = 3;\n}\n",
 		`message_type {
 		   name: "TestMessage"
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT32 number:15 }
-		   field { name:"bar" label:LABEL_OPTIONAL type:TYPE_INT32 number:34 }
-		   field { name:"baz" label:LABEL_REPEATED type:TYPE_INT32 number:3  }
+		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT32 number:15 json_name:"foo" }
+		   field { name:"bar" label:LABEL_OPTIONAL type:TYPE_INT32 number:34 json_name:"bar" }
+		   field { name:"baz" label:LABEL_REPEATED type:TYPE_INT32 number:3 json_name:"baz" }
 		 }`,
 	},
 	{
 		"PrimitiveFieldTypes",
 		`message TestMessage {
-		   required int32    foo = 1;
-		   required int64    foo = 1;
-		   required uint32   foo = 1;
-		   required uint64   foo = 1;
-		   required sint32   foo = 1;
-		   required sint64   foo = 1;
-		   required fixed32  foo = 1;
-		   required fixed64  foo = 1;
-		   required sfixed32 foo = 1;
-		   required sfixed64 foo = 1;
-		   required float    foo = 1;
-		   required double   foo = 1;
-		   required string   foo = 1;
-		   required bytes    foo = 1;
-		   required bool     foo = 1;
+		   required int32    f1 = 1;
+		   required int64    f2 = 2;
+		   required uint32   f3 = 3;
+		   required uint64   f4 = 4;
+		   required sint32   f5 = 5;
+		   required sint64   f6 = 6;
+		   required fixed32  f7 = 7;
+		   required fixed64  f8 = 8;
+		   required sfixed32 f9 = 9;
+		   required sfixed64 f10 = 10;
+		   required float    f11 = 11;
+		   required double   f12 = 12;
+		   required string   f13 = 13;
+		   required bytes    f14 = 14;
+		   required bool     f15 = 15;
 		}`,
 		`message_type {
 		   name: "TestMessage"
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT32    number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_INT64    number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_UINT32   number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_UINT64   number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_SINT32   number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_SINT64   number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_FIXED32  number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_FIXED64  number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_SFIXED32 number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_SFIXED64 number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_FLOAT    number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_DOUBLE   number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_STRING   number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_BYTES    number:1 }
-		   field { name:"foo" label:LABEL_REQUIRED type:TYPE_BOOL     number:1 }
+		   field { name:"f1" label:LABEL_REQUIRED type:TYPE_INT32    number:1 json_name:"f1" }
+		   field { name:"f2" label:LABEL_REQUIRED type:TYPE_INT64    number:2 json_name:"f2" }
+		   field { name:"f3" label:LABEL_REQUIRED type:TYPE_UINT32   number:3 json_name:"f3" }
+		   field { name:"f4" label:LABEL_REQUIRED type:TYPE_UINT64   number:4 json_name:"f4" }
+		   field { name:"f5" label:LABEL_REQUIRED type:TYPE_SINT32   number:5 json_name:"f5" }
+		   field { name:"f6" label:LABEL_REQUIRED type:TYPE_SINT64   number:6 json_name:"f6" }
+		   field { name:"f7" label:LABEL_REQUIRED type:TYPE_FIXED32  number:7 json_name:"f7" }
+		   field { name:"f8" label:LABEL_REQUIRED type:TYPE_FIXED64  number:8 json_name:"f8" }
+		   field { name:"f9" label:LABEL_REQUIRED type:TYPE_SFIXED32 number:9 json_name:"f9" }
+		   field { name:"f10" label:LABEL_REQUIRED type:TYPE_SFIXED64 number:10 json_name:"f10" }
+		   field { name:"f11" label:LABEL_REQUIRED type:TYPE_FLOAT    number:11 json_name:"f11" }
+		   field { name:"f12" label:LABEL_REQUIRED type:TYPE_DOUBLE   number:12 json_name:"f12" }
+		   field { name:"f13" label:LABEL_REQUIRED type:TYPE_STRING   number:13 json_name:"f13" }
+		   field { name:"f14" label:LABEL_REQUIRED type:TYPE_BYTES    number:14 json_name:"f14" }
+		   field { name:"f15" label:LABEL_REQUIRED type:TYPE_BOOL     number:15 json_name:"f15" }
 		}`,
 	},
 	{
 		"FieldDefaults",
 		`message TestMessage {
-		  required int32  foo = 1 [default=  1  ];
-		  required int32  foo = 1 [default= -2  ];
-		  required int64  foo = 1 [default=  3  ];
-		  required int64  foo = 1 [default= -4  ];
-		  required uint32 foo = 1 [default=  5  ];
-		  required uint64 foo = 1 [default=  6  ];
-		  required float  foo = 1 [default=  7.5];
-		  required float  foo = 1 [default= -8.5];
-		  required float  foo = 1 [default=  9  ];
-		  required double foo = 1 [default= 10.5];
-		  required double foo = 1 [default=-11.5];
-		  required double foo = 1 [default= 12  ];
-		  required double foo = 1 [default= inf ];
-		  required double foo = 1 [default=-inf ];
-		  required double foo = 1 [default= nan ];
-		  // TODO: uncomment these when the string parser handles them.
-		  //required string foo = 1 [default='13\\001'];
-		  //required string foo = 1 [default='a' "b" 
-		  //"c"];
-		  //required bytes  foo = 1 [default='14\\002'];
-		  //required bytes  foo = 1 [default='a' "b" 
-		  //'c'];
-		  required bool   foo = 1 [default=true ];
-		  required Foo    foo = 1 [default=FOO  ];
-		  required int32  foo = 1 [default= 0x7FFFFFFF];
-		  required int32  foo = 1 [default=-0x80000000];
-		  required uint32 foo = 1 [default= 0xFFFFFFFF];
-		  required int64  foo = 1 [default= 0x7FFFFFFFFFFFFFFF];
-		  required int64  foo = 1 [default=-0x8000000000000000];
-		  required uint64 foo = 1 [default= 0xFFFFFFFFFFFFFFFF];
+		  required int32  f1 = 1 [default=  1  ];
+		  required int32  f2 = 2 [default= -2  ];
+		  required int64  f3 = 3 [default=  3  ];
+		  required int64  f4 = 4 [default= -4  ];
+		  required uint32 f5 = 5 [default=  5  ];
+		  required uint64 f6 = 6 [default=  6  ];
+		  required float  f7 = 7 [default=  7.5];
+		  required float  f8 = 8 [default= -8.5];
+		  required float  f9 = 9 [default=  9  ];
+		  required double f10 = 10 [default= 10.5];
+		  required double f11 = 11 [default=-11.5];
+		  required double f12 = 12 [default= 12  ];
+		  required double f13 = 13 [default= inf ];
+		  required double f14 = 14 [default=-inf ];
+		  required double f15 = 15 [default= nan ];
+		  required double f16 = 16 [default= 1e9 ];
+		  required float  f17 = 17 [default=-2.5e-3];
+		  required double f18 = 18 [default= .5  ];
+		  required string f19 = 19 [default='13\001'];
+		  required string f20 = 20 [default='a' "b" 
+		  "c"];
+		  required bytes  f21 = 21 [default='14\002'];
+		  required bytes  f22 = 22 [default='a' "b" 
+		  'c'];
+		  required bytes  f23 = 23 [default="\x41\101\n\"\xff"];
+		  required bool   f24 = 24 [default=true ];
+		  required Foo    f25 = 25 [default=FOO  ];
+		  required int32  f26 = 26 [default= 0x7FFFFFFF];
+		  required int32  f27 = 27 [default=-0x80000000];
+		  required uint32 f28 = 28 [default= 0xFFFFFFFF];
+		  required int64  f29 = 29 [default= 0x7FFFFFFFFFFFFFFF];
+		  required int64  f30 = 30 [default=-0x8000000000000000];
+		  required uint64 f31 = 31 [default= 0xFFFFFFFFFFFFFFFF];
 		}
 		enum Foo { UNKNOWN=0; FOO=1; }
 		`,
 		`message_type {
 		  name: "TestMessage"
-		  field { type:TYPE_INT32   default_value:"1"         ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_INT32   default_value:"-2"        ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_INT64   default_value:"3"         ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_INT64   default_value:"-4"        ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_UINT32  default_value:"5"         ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_UINT64  default_value:"6"         ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_FLOAT   default_value:"7.5"       ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_FLOAT   default_value:"-8.5"      ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_FLOAT   default_value:"9"         ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_DOUBLE  default_value:"10.5"      ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_DOUBLE  default_value:"-11.5"     ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_DOUBLE  default_value:"12"        ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_DOUBLE  default_value:"inf"       ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_DOUBLE  default_value:"-inf"      ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_DOUBLE  default_value:"nan"       ` + fieldDefaultsEtc + ` }
-		  ` +
-			/*
-			  field { type:TYPE_STRING  default_value:"13\\001"   ` + fieldDefaultsEtc + ` }
-			  field { type:TYPE_STRING  default_value:"abc"       ` + fieldDefaultsEtc + ` }
-			  field { type:TYPE_BYTES   default_value:"14\\\\002" ` + fieldDefaultsEtc + ` }
-			*/
-			`
-		  field { type:TYPE_BOOL    default_value:"true"      ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_ENUM    type_name:".Foo"   default_value:"FOO"` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_INT32   default_value:"1"         ` + fieldDefaultsEtc(1) + ` }
+		  field { type:TYPE_INT32   default_value:"-2"        ` + fieldDefaultsEtc(2) + ` }
+		  field { type:TYPE_INT64   default_value:"3"         ` + fieldDefaultsEtc(3) + ` }
+		  field { type:TYPE_INT64   default_value:"-4"        ` + fieldDefaultsEtc(4) + ` }
+		  field { type:TYPE_UINT32  default_value:"5"         ` + fieldDefaultsEtc(5) + ` }
+		  field { type:TYPE_UINT64  default_value:"6"         ` + fieldDefaultsEtc(6) + ` }
+		  field { type:TYPE_FLOAT   default_value:"7.5"       ` + fieldDefaultsEtc(7) + ` }
+		  field { type:TYPE_FLOAT   default_value:"-8.5"      ` + fieldDefaultsEtc(8) + ` }
+		  field { type:TYPE_FLOAT   default_value:"9"         ` + fieldDefaultsEtc(9) + ` }
+		  field { type:TYPE_DOUBLE  default_value:"10.5"      ` + fieldDefaultsEtc(10) + ` }
+		  field { type:TYPE_DOUBLE  default_value:"-11.5"     ` + fieldDefaultsEtc(11) + ` }
+		  field { type:TYPE_DOUBLE  default_value:"12"        ` + fieldDefaultsEtc(12) + ` }
+		  field { type:TYPE_DOUBLE  default_value:"inf"       ` + fieldDefaultsEtc(13) + ` }
+		  field { type:TYPE_DOUBLE  default_value:"-inf"      ` + fieldDefaultsEtc(14) + ` }
+		  field { type:TYPE_DOUBLE  default_value:"nan"       ` + fieldDefaultsEtc(15) + ` }
+		  field { type:TYPE_DOUBLE  default_value:"1e9"       ` + fieldDefaultsEtc(16) + ` }
+		  field { type:TYPE_FLOAT   default_value:"-2.5e-3"   ` + fieldDefaultsEtc(17) + ` }
+		  field { type:TYPE_DOUBLE  default_value:".5"        ` + fieldDefaultsEtc(18) + ` }
+		  field { type:TYPE_STRING  default_value:"13\001"   ` + fieldDefaultsEtc(19) + ` }
+		  field { type:TYPE_STRING  default_value:"abc"       ` + fieldDefaultsEtc(20) + ` }
+		  field { type:TYPE_BYTES   default_value:"14\\002" ` + fieldDefaultsEtc(21) + ` }
+		  field { type:TYPE_BYTES   default_value:"abc"       ` + fieldDefaultsEtc(22) + ` }
+		  field { type:TYPE_BYTES   default_value:"AA\\n\\\"\\377" ` + fieldDefaultsEtc(23) + ` }
+		  field { type:TYPE_BOOL    default_value:"true"      ` + fieldDefaultsEtc(24) + ` }
+		  field { type:TYPE_ENUM    type_name:".Foo"   default_value:"FOO"` + fieldDefaultsEtc(25) + ` }
 
 		  ` +
 			/*
 			  descriptor.proto says "For numeric types, contains the original text representation of the value.";
-			  we match that, and thus diverge from protoc.
+			  we match that, and thus diverge from protoc (see TestProtocDefaults).
 			*/
 			`
-		  field { type:TYPE_INT32   default_value:"0x7FFFFFFF"         ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_INT32   default_value:"-0x80000000"        ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_UINT32  default_value:"0xFFFFFFFF"         ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_INT64   default_value:"0x7FFFFFFFFFFFFFFF" ` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_INT64   default_value:"-0x8000000000000000"` + fieldDefaultsEtc + ` }
-		  field { type:TYPE_UINT64  default_value:"0xFFFFFFFFFFFFFFFF" ` + fieldDefaultsEtc + ` }
+		  field { type:TYPE_INT32   default_value:"0x7FFFFFFF"         ` + fieldDefaultsEtc(26) + ` }
+		  field { type:TYPE_INT32   default_value:"-0x80000000"        ` + fieldDefaultsEtc(27) + ` }
+		  field { type:TYPE_UINT32  default_value:"0xFFFFFFFF"         ` + fieldDefaultsEtc(28) + ` }
+		  field { type:TYPE_INT64   default_value:"0x7FFFFFFFFFFFFFFF" ` + fieldDefaultsEtc(29) + ` }
+		  field { type:TYPE_INT64   default_value:"-0x8000000000000000"` + fieldDefaultsEtc(30) + ` }
+		  field { type:TYPE_UINT64  default_value:"0xFFFFFFFFFFFFFFFF" ` + fieldDefaultsEtc(31) + ` }
 		}
 		enum_type {
 			name:"Foo"
@@ -206,16 +224,16 @@ var parseTests = []parseTest{
 		"message TestMessage {\n  oneof foo {\n    int32 a = 1;\n    string b = 2;\n    TestMessage c = 3;\n    group D = 4 { optional int32 i = 5; }\n  }\n}\n",
 		`message_type {
 		  name: "TestMessage"
-		  field { name:"a" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 oneof_index:0 }
-		  field { name:"b" label:LABEL_OPTIONAL type:TYPE_STRING number:2 oneof_index:0 }
-		  field { name:"c" label:LABEL_OPTIONAL type:TYPE_MESSAGE type_name:".TestMessage" number:3 oneof_index:0 }
-		  field { name:"d" label:LABEL_OPTIONAL type:TYPE_GROUP type_name:".TestMessage.D" number:4 oneof_index:0 }
+		  field { name:"a" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 oneof_index:0 json_name:"a" }
+		  field { name:"b" label:LABEL_OPTIONAL type:TYPE_STRING number:2 oneof_index:0 json_name:"b" }
+		  field { name:"c" label:LABEL_OPTIONAL type:TYPE_MESSAGE type_name:".TestMessage" number:3 oneof_index:0 json_name:"c" }
+		  field { name:"d" label:LABEL_OPTIONAL type:TYPE_GROUP type_name:".TestMessage.D" number:4 oneof_index:0 json_name:"d" }
 		  oneof_decl {
 		    name: "foo"
 		  }
 		  nested_type {
 		    name: "D"
-		    field { name:"i" label:LABEL_OPTIONAL type:TYPE_INT32 number:5 }
+		    field { name:"i" label:LABEL_OPTIONAL type:TYPE_INT32 number:5 json_name:"i" }
 		  }
 		}`,
 	},
@@ -224,10 +242,10 @@ var parseTests = []parseTest{
 		"message TestMessage {\n  oneof foo {\n    int32 a = 1;\n    string b = 2;\n  }\n  oneof bar {\n    int32 c = 3;\n    string d = 4;\n  }\n}\n",
 		`message_type {
 		  name: "TestMessage"
-		  field { name:"a" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 oneof_index:0 }
-		  field { name:"b" label:LABEL_OPTIONAL type:TYPE_STRING number:2 oneof_index:0 }
-		  field { name:"c" label:LABEL_OPTIONAL type:TYPE_INT32 number:3 oneof_index:1 }
-		  field { name:"d" label:LABEL_OPTIONAL type:TYPE_STRING number:4 oneof_index:1 }
+		  field { name:"a" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 oneof_index:0 json_name:"a" }
+		  field { name:"b" label:LABEL_OPTIONAL type:TYPE_STRING number:2 oneof_index:0 json_name:"b" }
+		  field { name:"c" label:LABEL_OPTIONAL type:TYPE_INT32 number:3 oneof_index:1 json_name:"c" }
+		  field { name:"d" label:LABEL_OPTIONAL type:TYPE_STRING number:4 oneof_index:1 json_name:"d" }
 		  oneof_decl {
 		    name: "foo"
 		  }
@@ -236,6 +254,60 @@ var parseTests = []parseTest{
 		  }
 		}`,
 	},
+	{
+		"OneofOptions",
+		"message TestMessage {\n  oneof foo {\n    option (my.oneof_opt) = true;\n    int32 a = 1;\n  }\n}\n",
+		`message_type {
+		  name: "TestMessage"
+		  field { name:"a" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 oneof_index:0 json_name:"a" }
+		  oneof_decl {
+		    name: "foo"
+		    options { uninterpreted_option { name { name_part: "my.oneof_opt" is_extension: true } identifier_value: "true" } }
+		  }
+		}`,
+	},
+	{
+		"OptionValues",
+		"option (a) = 2;\noption (b) = - 3;\noption (c) = 1.5;\noption (d) = true;\noption (e) = -inf;\noption (f) = 0x10;\noption (g) = 'x' \"y\";\n",
+		`options {
+		   uninterpreted_option { name { name_part: "a" is_extension: true } positive_int_value: 2 }
+		   uninterpreted_option { name { name_part: "b" is_extension: true } negative_int_value: -3 }
+		   uninterpreted_option { name { name_part: "c" is_extension: true } double_value: 1.5 }
+		   uninterpreted_option { name { name_part: "d" is_extension: true } identifier_value: "true" }
+		   uninterpreted_option { name { name_part: "e" is_extension: true } double_value: -inf }
+		   uninterpreted_option { name { name_part: "f" is_extension: true } positive_int_value: 16 }
+		   uninterpreted_option { name { name_part: "g" is_extension: true } string_value: "xy" }
+		 }`,
+	},
+	{
+		"OptionValuesAtEachScope",
+		"message M {\n  option (a) = -4;\n  optional int32 f = 1 [(b) = 2.5e3];\n  oneof o {\n    option (c) = { x: 1 };\n    int32 g = 2;\n  }\n}\n" +
+			"enum E {\n  option (d) = 7;\n  ZERO = 0 [(e) = -0.5];\n}\n" +
+			"service S {\n  option (f) = \"s\";\n  rpc R(M) returns (M) { option (g) = IDEMPOTENT; }\n}\n",
+		`message_type {
+		   name: "M"
+		   field { name:"f" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 json_name:"f"
+		     options { uninterpreted_option { name { name_part: "b" is_extension: true } double_value: 2500 } } }
+		   field { name:"g" label:LABEL_OPTIONAL type:TYPE_INT32 number:2 oneof_index:0 json_name:"g" }
+		   options { uninterpreted_option { name { name_part: "a" is_extension: true } negative_int_value: -4 } }
+		   oneof_decl {
+		     name: "o"
+		     options { uninterpreted_option { name { name_part: "c" is_extension: true } aggregate_value: "x : 1" } }
+		   }
+		 }
+		 enum_type {
+		   name: "E"
+		   value { name:"ZERO" number:0
+		     options { uninterpreted_option { name { name_part: "e" is_extension: true } double_value: -0.5 } } }
+		   options { uninterpreted_option { name { name_part: "d" is_extension: true } positive_int_value: 7 } }
+		 }
+		 service {
+		   name: "S"
+		   method { name:"R" input_type:".M" output_type:".M"
+		     options { uninterpreted_option { name { name_part: "g" is_extension: true } identifier_value: "IDEMPOTENT" } } }
+		   options { uninterpreted_option { name { name_part: "f" is_extension: true } string_value: "s" } }
+		 }`,
+	},
 	{
 		"Maps",
 		"message TestMessage {\n  map<int32, string> primitive_type_map = 1;\n}\n",
@@ -243,31 +315,44 @@ var parseTests = []parseTest{
 		   name: "TestMessage"
 		   nested_type {
 		     name: "PrimitiveTypeMapEntry"
-		     field { name: "key" number: 1 label:LABEL_OPTIONAL type:TYPE_INT32 }
-		     field { name: "value" number: 2 label:LABEL_OPTIONAL type:TYPE_STRING }
+		     field { name: "key" number: 1 label:LABEL_OPTIONAL type:TYPE_INT32 json_name:"key" }
+		     field { name: "value" number: 2 label:LABEL_OPTIONAL type:TYPE_STRING json_name:"value" }
 		     options { map_entry: true }
 		   }
-		   field { name: "primitive_type_map" label: LABEL_REPEATED type:TYPE_MESSAGE type_name: ".TestMessage.PrimitiveTypeMapEntry" number: 1 }
+		   field { name: "primitive_type_map" label: LABEL_REPEATED type:TYPE_MESSAGE type_name: ".TestMessage.PrimitiveTypeMapEntry" number: 1 json_name:"primitiveTypeMap" }
 		}`,
 	},
+	{
+		"GroupsInExtensions",
+		"message TestMessage {\n  extensions 10 to 20;\n  extend TestMessage {\n    optional group Inner = 11 { optional int32 i = 1; }\n  }\n}\n" +
+			"extend TestMessage {\n  repeated group Outer = 10 { optional int32 j = 1; }\n}\n",
+		`message_type {
+		   name: "TestMessage"
+		   nested_type { name: "Inner" field { name:"i" label:LABEL_OPTIONAL number:1 type:TYPE_INT32 json_name:"i" } }
+		   extension_range { start:10 end:21 }
+		   extension { name:"inner" label:LABEL_OPTIONAL number:11 type:TYPE_GROUP type_name:".TestMessage.Inner" extendee:".TestMessage" json_name:"inner" }
+		 }
+		 message_type { name: "Outer" field { name:"j" label:LABEL_OPTIONAL number:1 type:TYPE_INT32 json_name:"j" } }
+		 extension { name:"outer" label:LABEL_REPEATED number:10 type:TYPE_GROUP type_name:".Outer" extendee:".TestMessage" json_name:"outer" }`,
+	},
 	{
 		"Group",
 		"message TestMessage {\n  optional group TestGroup = 1 {};\n}\n",
 		`message_type {
 		   name: "TestMessage"
 		   nested_type { name: "TestGroup" }
-		   field { name:"testgroup" label:LABEL_OPTIONAL number:1 type:TYPE_GROUP type_name: ".TestMessage.TestGroup" }
+		   field { name:"testgroup" label:LABEL_OPTIONAL number:1 type:TYPE_GROUP type_name: ".TestMessage.TestGroup" json_name:"testgroup" }
 		 }`,
 	},
 	{
 		"NestedMessage",
 		"message TestMessage {\n  message Nested {}\n  optional Nested test_nested = 1;\n  }\n",
-		`message_type { name: "TestMessage" nested_type { name: "Nested" } field { name:"test_nested" label:LABEL_OPTIONAL number:1 type:TYPE_MESSAGE type_name:".TestMessage.Nested" } }`,
+		`message_type { name: "TestMessage" nested_type { name: "Nested" } field { name:"test_nested" label:LABEL_OPTIONAL number:1 type:TYPE_MESSAGE type_name:".TestMessage.Nested" json_name:"testNested" } }`,
 	},
 	{
 		"NestedEnum",
 		"message TestMessage {\n  enum NestedEnum {}\n  optional NestedEnum test_enum = 1;\n  }\n",
-		`message_type { name: "TestMessage" enum_type { name: "NestedEnum" } field { name:"test_enum" label:LABEL_OPTIONAL number:1 type:TYPE_ENUM type_name:".TestMessage.NestedEnum" } }`,
+		`message_type { name: "TestMessage" enum_type { name: "NestedEnum" } field { name:"test_enum" label:LABEL_OPTIONAL number:1 type:TYPE_ENUM type_name:".TestMessage.NestedEnum" json_name:"testEnum" } }`,
 	},
 	{
 		"ExtensionRange",
@@ -289,8 +374,8 @@ var parseTests = []parseTest{
 		"Extensions",
 		"extend Extendee1 { optional int32 foo = 12; }\nextend Extendee2 { repeated TestMessage bar = 22; }\n" +
 			"message Extendee1 { extensions 12; } message Extendee2 { extensions 20 to 24; } message TestMessage{}",
-		`extension { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:12 extendee: ".Extendee1" } ` +
-			`extension { name:"bar" label:LABEL_REPEATED number:22 type:TYPE_MESSAGE type_name:".TestMessage" extendee: ".Extendee2" }` +
+		`extension { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:12 extendee: ".Extendee1" json_name:"foo" } ` +
+			`extension { name:"bar" label:LABEL_REPEATED number:22 type:TYPE_MESSAGE type_name:".TestMessage" extendee: ".Extendee2" json_name:"bar" }` +
 			`message_type{name:"Extendee1" extension_range{start:12 end:13} } ` +
 			`message_type{name:"Extendee2" extension_range{start:20 end:25} } ` +
 			`message_type{name:"TestMessage"}`,
@@ -300,8 +385,8 @@ var parseTests = []parseTest{
 		"message TestMessage {\n  extend Extendee1 { optional int32 foo = 12; }\n  extend Extendee2 { repeated TestMessage bar = 22; }\n}\n" +
 			"message Extendee1 { extensions 12; } message Extendee2 { extensions 20 to 24; }",
 		`message_type {  name: "TestMessage"` +
-			`  extension { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:12 extendee: ".Extendee1" }` +
-			`  extension { name:"bar" label:LABEL_REPEATED number:22 type:TYPE_MESSAGE type_name:".TestMessage" extendee: ".Extendee2" }` +
+			`  extension { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:12 extendee: ".Extendee1" json_name:"foo" }` +
+			`  extension { name:"bar" label:LABEL_REPEATED number:22 type:TYPE_MESSAGE type_name:".TestMessage" extendee: ".Extendee2" json_name:"bar" }` +
 			`}` +
 			`message_type{name:"Extendee1" extension_range{start:12 end:13} } ` +
 			`message_type{name:"Extendee2" extension_range{start:20 end:25} } `,
@@ -310,17 +395,24 @@ var parseTests = []parseTest{
 		"MultipleExtensionsOneExtendee",
 		"extend Extendee1 {\n  optional int32 foo = 12;\n  repeated TestMessage bar = 22;\n}\n" +
 			"message Extendee1 { extensions 12 to 24; } message TestMessage{}",
-		`extension { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:12 extendee: ".Extendee1" } ` +
-			`extension { name:"bar" label:LABEL_REPEATED number:22 type:TYPE_MESSAGE type_name:".TestMessage" extendee: ".Extendee1" }` +
+		`extension { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:12 extendee: ".Extendee1" json_name:"foo" } ` +
+			`extension { name:"bar" label:LABEL_REPEATED number:22 type:TYPE_MESSAGE type_name:".TestMessage" extendee: ".Extendee1" json_name:"bar" }` +
 			`message_type{name:"Extendee1" extension_range{start:12 end:25} } ` +
 			`message_type{name:"TestMessage"}`,
 	},
 	{
 		"OptionalOptionalLabelProto3",
-		"syntax = \"proto3\";\nmessage TestMessage {\n  int32 foo = 1;\n  optional int32 bar = 2;\n}\n",
+		"syntax = \"proto3\";\nmessage TestMessage {\n  int32 foo = 1;\n  optional int32 bar = 2;\n" +
+			"  oneof o { int32 baz = 3; }\n  optional int32 _qux = 4;\n  int32 _bar = 5;\n}\n",
 		`syntax: "proto3" message_type { name: "TestMessage" ` +
-			`  field { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 }` +
-			`  field { name:"bar" label:LABEL_OPTIONAL type:TYPE_INT32 number:2 }` +
+			`  field { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 json_name:"foo" }` +
+			`  field { name:"bar" label:LABEL_OPTIONAL type:TYPE_INT32 number:2 json_name:"bar" oneof_index:1 proto3_optional:true }` +
+			`  field { name:"baz" label:LABEL_OPTIONAL type:TYPE_INT32 number:3 json_name:"baz" oneof_index:0 }` +
+			`  field { name:"_qux" label:LABEL_OPTIONAL type:TYPE_INT32 number:4 json_name:"Qux" oneof_index:2 proto3_optional:true }` +
+			`  field { name:"_bar" label:LABEL_OPTIONAL type:TYPE_INT32 number:5 json_name:"Bar" }` +
+			`  oneof_decl { name:"o" }` +
+			`  oneof_decl { name:"X_bar" }` +
+			`  oneof_decl { name:"X_qux" }` +
 			`}`,
 	},
 	{
@@ -328,6 +420,41 @@ var parseTests = []parseTest{
 		"enum TestEnum {\n  FOO = 13;\n  BAR = -10;\n  BAZ = 500;\n}\n",
 		`enum_type { name: "TestEnum" value { name:"FOO" number:13 } value { name:"BAR" number:-10 } value { name:"BAZ" number:500 } }`,
 	},
+	{
+		"Reserved",
+		"message M {\n  reserved 1, 5 to 10, 500000 to max;\n  reserved \"foo\", 'bar';\n}\n" +
+			"enum E {\n  A = 0;\n  reserved -10 to -1, 100 to max;\n  reserved \"B\";\n}\n",
+		`message_type {
+		   name: "M"
+		   reserved_range { start:1 end:2 }
+		   reserved_range { start:5 end:11 }
+		   reserved_range { start:500000 end:536870912 }
+		   reserved_name: "foo"
+		   reserved_name: "bar"
+		 }
+		 enum_type {
+		   name: "E"
+		   value { name:"A" number:0 }
+		   reserved_range { start:-10 end:-1 }
+		   reserved_range { start:100 end:2147483647 }
+		   reserved_name: "B"
+		 }`,
+	},
+	{
+		"MessageAndEnumOptions",
+		"message M {\n  option deprecated = true;\n  option (my.msg) = 1;\n}\n" +
+			"enum E {\n  option allow_alias = true;\n  A = 0 [deprecated = true, (my.val) = \"x\"];\n  B = 0;\n  option = 1;\n}\n",
+		`message_type { name: "M" options {` +
+			` uninterpreted_option { name { name_part: "my.msg" is_extension: true } positive_int_value: 1 }` +
+			` deprecated: true } }` +
+			`enum_type { name: "E"` +
+			` value { name:"A" number:0 options {` +
+			` uninterpreted_option { name { name_part: "my.val" is_extension: true } string_value: "x" }` +
+			` deprecated: true } }` +
+			` value { name:"B" number:0 }` +
+			` value { name:"option" number:1 }` +
+			` options { allow_alias: true } }`,
+	},
 	{
 		"SimpleService",
 		"service TestService {\n  rpc Foo(In) returns (Out);\n}\n message In{} message Out{}",
@@ -346,6 +473,37 @@ var parseTests = []parseTest{
 		`service { name: "TestService" method { name:"Foo" input_type:".In" output_type:".Out" client_streaming: true server_streaming: true } }` +
 			`message_type:{name:"In"} message_type:{name:"Out"}`,
 	},
+	{
+		"MethodOptions",
+		"service TestService {\n  rpc Foo(In) returns (Out) {\n    option (google.api.http) = { get: \"/v1/foo\" };\n    option deprecated = true;\n  };\n" +
+			"  rpc Bar(In) returns (Out) {}\n}\n message In{} message Out{}",
+		`service { name: "TestService"` +
+			` method { name:"Foo" input_type:".In" output_type:".Out" options {` +
+			` uninterpreted_option { name { name_part: "google.api.http" is_extension: true } aggregate_value: "get : \"/v1/foo\"" }` +
+			` deprecated: true } }` +
+			` method { name:"Bar" input_type:".In" output_type:".Out" } }` +
+			`message_type:{name:"In"} message_type:{name:"Out"}`,
+	},
+	{
+		"Packed",
+		"message M {\n  repeated int32 a = 1 [packed = true];\n  repeated E b = 2 [packed = false, deprecated = true];\n  repeated int32 c = 3;\n}\nenum E { Z = 0; }\n",
+		`message_type { name: "M"` +
+			` field { name:"a" label:LABEL_REPEATED type:TYPE_INT32 number:1 json_name:"a" options { packed: true } }` +
+			` field { name:"b" label:LABEL_REPEATED type:TYPE_ENUM type_name:".E" number:2 json_name:"b" options { packed: false deprecated: true } }` +
+			` field { name:"c" label:LABEL_REPEATED type:TYPE_INT32 number:3 json_name:"c" } }` +
+			`enum_type { name: "E" value { name:"Z" number:0 } }`,
+	},
+	{
+		"ServiceOptions",
+		"service TestService {\n  option deprecated = true;\n  option (my.svc) = \"x\";\n" +
+			"  rpc Foo(In) returns (Out) {\n    option idempotency_level = NO_SIDE_EFFECTS;\n  }\n}\n message In{} message Out{}",
+		`service { name: "TestService"` +
+			` method { name:"Foo" input_type:".In" output_type:".Out" options { idempotency_level: NO_SIDE_EFFECTS } }` +
+			` options {` +
+			` uninterpreted_option { name { name_part: "my.svc" is_extension: true } string_value: "x" }` +
+			` deprecated: true } }` +
+			`message_type:{name:"In"} message_type:{name:"Out"}`,
+	},
 	{
 		"ParseImport",
 		"import \"foo/bar/baz.proto\";\n",
@@ -364,13 +522,68 @@ var parseTests = []parseTest{
 	{
 		"ParseFileOptions",
 		"option java_package = \"com.google.foo\";\noption optimize_for = CODE_SIZE;",
-		`options { uninterpreted_option { name { name_part: "java_package" is_extension: false } string_value: "com.google.foo"} uninterpreted_option { name { name_part: "optimize_for" is_extension: false } identifier_value: "CODE_SIZE" } }`,
+		`options { java_package: "com.google.foo" optimize_for: CODE_SIZE }`,
+	},
+	{
+		"ParseExtensionFileOptions",
+		"option (foo.bar).baz = true;\noption (qux) = \"x\";",
+		`options { uninterpreted_option { name { name_part: "foo.bar" is_extension: true } name { name_part: "baz" is_extension: false } identifier_value: "true" }` +
+			` uninterpreted_option { name { name_part: "qux" is_extension: true } string_value: "x" } }`,
+	},
+	{
+		"ParseFieldOptions",
+		"message TestMessage {\n  optional int32 foo = 1 [deprecated = true, (my.opt) = \"hi\", default = 3];\n}\n",
+		`message_type { name: "TestMessage" field { name:"foo" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 default_value: "3" json_name:"foo" options {` +
+			` deprecated: true uninterpreted_option { name { name_part: "my.opt" is_extension: true } string_value: "hi" } } } }`,
+	},
+	{
+		"ParseAggregateOptions",
+		"option (my.file) = { foo: 1 bar: \"x\" baz { q: [1, 2] } };\n" +
+			"option (my.empty) = {};\n" +
+			"message M {\n  optional int32 f = 1 [(my.field) = {a:-1\nb:'y'}];\n}\n",
+		`options {` +
+			` uninterpreted_option { name { name_part: "my.file" is_extension: true } aggregate_value: "foo : 1 bar : \"x\" baz { q : [ 1 , 2 ] }" }` +
+			` uninterpreted_option { name { name_part: "my.empty" is_extension: true } aggregate_value: "" } }` +
+			` message_type { name: "M" field { name: "f" number: 1 label: LABEL_OPTIONAL type: TYPE_INT32 json_name: "f" options {` +
+			` uninterpreted_option { name { name_part: "my.field" is_extension: true } aggregate_value: "a : -1 b : 'y'" } } } }`,
+	},
+	{
+		"ParseNumericOptions",
+		"option (a) = 7;\noption (b) = -7;\noption (c) = 1.5e3;\noption (d) = -.5;\noption (e) = inf;\noption (f) = -inf;\noption (g) = 0x10;\n",
+		`options {` +
+			` uninterpreted_option { name { name_part: "a" is_extension: true } positive_int_value: 7 }` +
+			` uninterpreted_option { name { name_part: "b" is_extension: true } negative_int_value: -7 }` +
+			` uninterpreted_option { name { name_part: "c" is_extension: true } double_value: 1500 }` +
+			` uninterpreted_option { name { name_part: "d" is_extension: true } double_value: -0.5 }` +
+			` uninterpreted_option { name { name_part: "e" is_extension: true } identifier_value: "inf" }` +
+			` uninterpreted_option { name { name_part: "f" is_extension: true } double_value: -inf }` +
+			` uninterpreted_option { name { name_part: "g" is_extension: true } positive_int_value: 16 } }`,
+	},
+	{
+		"SingleQuotedStrings",
+		"syntax = 'proto2';\nimport 'foo.proto';\noption go_package = 'a\\'b\\x41\\101';\n",
+		`dependency: "foo.proto"` +
+			` options { go_package: "a'bAA" }`,
 	},
 	{
 		"ParsePublicImports",
 		"import \"foo.proto\";\nimport public \"bar.proto\";\nimport \"baz.proto\";\nimport public \"qux.proto\";\n",
 		`dependency: "foo.proto" dependency: "bar.proto" dependency: "baz.proto" dependency: "qux.proto" public_dependency: 1 public_dependency: 3`,
 	},
+	{
+		"ParseWeakImports",
+		"import weak \"foo.proto\";\nimport public \"bar.proto\";\nimport weak \"baz.proto\";\n",
+		`dependency: "foo.proto" dependency: "bar.proto" dependency: "baz.proto" public_dependency: 1 weak_dependency: 0 weak_dependency: 2`,
+	},
+	{
+		"ParseJSONName",
+		"message TestMessage {\n  optional int32 foo_bar = 1 [json_name = \"@fooBar\"];\n  optional int32 baz = 2;\n}\n",
+		`message_type {
+		   name: "TestMessage"
+		   field { name:"foo_bar" label:LABEL_OPTIONAL type:TYPE_INT32 number:1 json_name:"@fooBar" }
+		   field { name:"baz" label:LABEL_OPTIONAL type:TYPE_INT32 number:2 json_name:"baz" }
+		 }`,
+	},
 }
 
 func TestParsing(t *testing.T) {
@@ -379,3 +592,1500 @@ func TestParsing(t *testing.T) {
 		tryParse(t, pt.input, pt.expected)
 	}
 }
+
+func TestSourceRetention(t *testing.T) {
+	const input = `
+package test;
+message Opts { extensions 100 to 200; }
+extend Opts {
+  optional string dev_note = 100 [retention = RETENTION_SOURCE];
+  optional string keep = 101;
+}
+option (dev_note) = "remove me";
+option (test.keep) = "keep me";
+message M {
+  optional int32 x = 1 [(.test.dev_note) = "remove me too"];
+}
+`
+	p := newParser("-", input)
+	f := new(ast.File)
+	if pe := p.readFile(f); pe != nil {
+		t.Fatalf("Failed parsing input: %v", pe)
+	}
+	fset := &ast.FileSet{Files: []*ast.File{f}}
+	if err := resolveSymbols(fset, nil); err != nil {
+		t.Fatalf("Resolving symbols: %v", err)
+	}
+	fds, err := gendesc.Generate(fset)
+	if err != nil {
+		t.Fatalf("Generating FileDescriptorSet: %v", err)
+	}
+	gendesc.StripSourceRetention(fds)
+
+	fd := fds.File[0]
+	uos := fd.Options.UninterpretedOption
+	if len(uos) != 1 || uos[0].Name[0].GetNamePart() != "test.keep" {
+		t.Errorf("File options after stripping = %v, want only (test.keep)", uos)
+	}
+	if uos := fd.MessageType[1].Field[0].Options.UninterpretedOption; len(uos) != 0 {
+		t.Errorf("Field options after stripping = %v, want none", uos)
+	}
+	if uos := fd.Extension[0].Options.UninterpretedOption; len(uos) != 1 {
+		t.Errorf("Retention option was stripped from the extension declaration: %v", uos)
+	}
+}
+
+func TestSymbolProvider(t *testing.T) {
+	const input = `
+package test;
+message M {
+  optional ext.Money price = 1;
+  optional Status status = 2;
+}
+`
+	ext := &ast.File{Name: "ext.proto", Package: []string{"ext"}}
+	money := &ast.Message{Name: "Money", Up: ext}
+	ext.Messages = []*ast.Message{money}
+	status := &ast.Enum{Name: "Status", Up: ext}
+	ext.Enums = []*ast.Enum{status}
+
+	var asked []string
+	symbols := func(name string) interface{} {
+		asked = append(asked, name)
+		switch name {
+		case "ext.Money":
+			return money
+		case "test.Status":
+			return status
+		}
+		return nil
+	}
+
+	p := newParser("-", input)
+	f := new(ast.File)
+	if pe := p.readFile(f); pe != nil {
+		t.Fatalf("Failed parsing input: %v", pe)
+	}
+	fset := &ast.FileSet{Files: []*ast.File{f}}
+	if err := resolveSymbols(fset, symbols); err != nil {
+		t.Fatalf("Resolving symbols: %v", err)
+	}
+	fields := f.Messages[0].Fields
+	if fields[0].Type != money || fields[1].Type != status {
+		t.Errorf("Field types are %v, %v; want the provided Money and Status", fields[0].Type, fields[1].Type)
+	}
+	// Names are tried innermost scope first.
+	if want := "test.M.ext.Money"; len(asked) == 0 || asked[0] != want {
+		t.Errorf("First name asked of provider = %q, want %q", asked, want)
+	}
+
+	p = newParser("-", "message N { optional Unknown x = 1; }")
+	f = new(ast.File)
+	if pe := p.readFile(f); pe != nil {
+		t.Fatalf("Failed parsing input: %v", pe)
+	}
+	fset = &ast.FileSet{Files: []*ast.File{f}}
+	if err := resolveSymbols(fset, symbols); err == nil {
+		t.Errorf("Resolving an unknown name succeeded")
+	}
+}
+
+func TestBlockComments(t *testing.T) {
+	const input = `/* Header. */
+package test;
+
+/*
+ * A message.
+ *   Indented.
+ */
+message M {
+  optional int32 a = 1; /* inline */
+  optional int32 /* mid */ b = 2;
+  /* looks /* nested */
+  optional int32 c = 3; /* spans
+  lines */
+  // not /* a block
+  optional string d = 4 [default = "/* not a comment */"];
+}
+/* // also one */
+`
+	p := newParser("-", input)
+	f := new(ast.File)
+	if pe := p.readFile(f); pe != nil {
+		t.Fatalf("Failed parsing input: %v", pe)
+	}
+	tests := []struct {
+		start, end int
+		text       []string
+	}{
+		{1, 1, []string{"Header."}},
+		{4, 7, []string{"A message.", "  Indented."}},
+		{9, 9, []string{"inline"}},
+		{10, 10, []string{"mid"}},
+		{11, 11, []string{"looks /* nested"}},
+		{12, 13, []string{"spans", " lines"}},
+		{14, 14, []string{"not /* a block"}},
+		{17, 17, []string{"// also one"}},
+	}
+	if len(f.Comments) != len(tests) {
+		t.Fatalf("Got %d comments, want %d", len(f.Comments), len(tests))
+	}
+	for i, test := range tests {
+		c := f.Comments[i]
+		if c.Start.Line != test.start || c.End.Line != test.end || !reflect.DeepEqual(c.Text, test.text) {
+			t.Errorf("Comment %d is lines %d-%d %q, want lines %d-%d %q",
+				i, c.Start.Line, c.End.Line, c.Text, test.start, test.end, test.text)
+		}
+	}
+	if got, want := f.Comments[1].Start.Offset, strings.Index(input, "/*\n"); got != want {
+		t.Errorf("Block comment starts at offset %d, want %d", got, want)
+	}
+	if got, want := f.Comments[1].End.Offset, strings.Index(input, "*/\nmessage"); got != want {
+		t.Errorf("Block comment ends at offset %d, want %d", got, want)
+	}
+	if d := f.Messages[0].Fields[3]; d.Default != "/* not a comment */" {
+		t.Errorf("Field d has default %q", d.Default)
+	}
+	if c := ast.InlineComment(f.Messages[0].Fields[2]); c != nil {
+		t.Errorf("Multi-line block comment treated as inline: %v", c)
+	}
+
+	p = newParser("-", "message M {}\n/* unterminated\n")
+	if pe := p.readFile(new(ast.File)); pe == nil {
+		t.Errorf("Unterminated block comment parsed without error")
+	}
+}
+
+func TestFloatDefaults(t *testing.T) {
+	for _, input := range []string{
+		"message M { optional double d = 1 [default = foo]; }",
+		"message M { optional float f = 1 [default = \"1.5\"]; }",
+		"message M { optional float f = 1 [default = -]; }",
+	} {
+		if _, err := ParseFile("-", []byte(input)); err == nil {
+			t.Errorf("Parsing %q succeeded, want an error", input)
+		}
+	}
+}
+
+func TestBadJSONNames(t *testing.T) {
+	for _, input := range []string{
+		"message M { optional int32 a = 1 [json_name = foo]; }",
+		"message M { optional int32 a = 1 [json_name = \"\"]; }",
+		"message M { optional int32 a = 1 [json_name = \"x\", json_name = \"y\"]; }",
+	} {
+		if _, err := ParseFile("-", []byte(input)); err == nil {
+			t.Errorf("Parsing %q succeeded, want an error", input)
+		}
+	}
+}
+
+func TestStandardOptions(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{`option java_multiple_files = 1;`, `value must be "true" or "false" for boolean option "java_multiple_files"`},
+		{`option java_package = foo;`, `value must be quoted string for string option "java_package"`},
+		{`option optimize_for = "SPEED";`, `value must be identifier for enum-valued option "optimize_for"`},
+		{`option optimize_for = FAST;`, `enum type "google.protobuf.FileOptions.OptimizeMode" has no value named "FAST" for option "optimize_for"`},
+		{"option deprecated = true;\noption deprecated = false;", `option "deprecated" was already set`},
+		{`option uninterpreted_option = 1;`, `option must not use reserved name "uninterpreted_option"`},
+		{`message M { optional int32 f = 1 [ctype = CORD, ctype = CORD]; }`, `field f: option "ctype" was already set`},
+		{`message M { optional int32 f = 1 [packed = true]; }`, `field f: [packed = true] can only be specified for repeated primitive fields`},
+		{`message M { repeated string f = 1 [packed = false]; }`, `field f: [packed = false] can only be specified for repeated primitive fields`},
+		{`message M { map<int32, int32> f = 1 [packed = true]; }`, `field f: [packed = true] can only be specified for repeated primitive fields`},
+
+		// Valid.
+		{`option java_package = 'a.b'; option (custom) = 1;`, ""},
+		{`message M { optional int32 f = 1 [jstype = JS_STRING, lazy = false]; }`, ""},
+		{`option not_in_descriptor_proto = 7;`, ""},
+	}
+	for _, test := range tests {
+		fset, err := ParseSource([]string{"test.proto"}, map[string][]byte{"test.proto": []byte(test.input)})
+		if err != nil {
+			t.Errorf("Parsing %q: %v", test.input, err)
+			continue
+		}
+		_, err = gendesc.Generate(fset)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Generating %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestBadOptionValues(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{"option (x) = =;", `-:1.13: got "=", want an option value`},
+		{"option (x) = - foo;", `-:1.15: got "foo" after "-", want a number`},
+		{"option (x) = -\n\"s\";", `-:2: got "\"s\"" after "-", want a number`},
+		{"enum E {\n  A = 0 [deprecated = true;\n}", `-:2: got ";", want "," or "]"`},
+	}
+	for _, test := range tests {
+		_, err := ParseFile("-", []byte(test.input))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestCustomOptions(t *testing.T) {
+	const descriptor = "package google.protobuf;\nmessage FieldOptions { extensions 1000 to max; }\n"
+	const input = `
+import "google/protobuf/descriptor.proto";
+package test;
+extend google.protobuf.FieldOptions {
+  optional string note = 1000;
+}
+message M {
+  optional int32 a = 1 [(note) = "resolved", (other) = "unknown"];
+  optional int32 b = 2 [(note) = "x", (test.note) = "y"];
+}
+`
+	fset, err := ParseSource([]string{"test.proto"}, map[string][]byte{
+		"test.proto":                       []byte(input),
+		"google/protobuf/descriptor.proto": []byte(descriptor),
+	})
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	fset.Files[1].Messages[0].Fields = fset.Files[1].Messages[0].Fields[:1]
+	fds, err := gendesc.Generate(fset)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	// Only the option that doesn't resolve is left uninterpreted.
+	uos := fds.File[1].MessageType[0].Field[0].Options.UninterpretedOption
+	if len(uos) != 1 || uos[0].Name[0].GetNamePart() != "other" {
+		t.Errorf("Uninterpreted options are %v, want only (other)", uos)
+	}
+
+	fset, err = ParseSource([]string{"test.proto"}, map[string][]byte{
+		"test.proto":                       []byte(input),
+		"google/protobuf/descriptor.proto": []byte(descriptor),
+	})
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	want := `field b: option "(test.note)" was already set`
+	if _, err := gendesc.Generate(fset); err == nil || err.Error() != want {
+		t.Errorf("Generate with an option set twice: got error %v, want %q", err, want)
+	}
+}
+
+func TestExtensionNumbers(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{"message Foo {}\nextend Foo {\n  optional int32 bar = 5;\n}", `test.proto:3: Foo does not declare 5 as an extension number (field bar)`},
+		{"message Foo { extensions 10 to 20; }\nextend Foo {\n  optional int32 bar = 21;\n}", `test.proto:3: Foo does not declare 21 as an extension number (field bar)`},
+		{"message Foo {\n  extensions 10 to 20;\n  extend Foo { optional int32 bar = 9; }\n}", `test.proto:3: Foo does not declare 9 as an extension number (field bar)`},
+
+		// Valid.
+		{"message Foo { extensions 5, 10 to 20; }\nextend Foo {\n  optional int32 a = 5;\n  optional int32 b = 20;\n}", ""},
+		{"message Foo { extensions 1000 to max; }\nextend Foo {\n  optional int32 a = 536870911;\n}", ""},
+	}
+	for _, test := range tests {
+		_, err := ParseSource([]string{"test.proto"}, map[string][]byte{"test.proto": []byte(test.input)})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestLineTable(t *testing.T) {
+	const input = "// A.\r\nmessage A {\r\n\tint32 x = 1; // x\r\n}\r\n"
+	f, err := ParseFile("a.proto", []byte(input))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	if got, want := f.Comments[0].Text, []string{"A."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Leading comment is %q, want %q", got, want)
+	}
+	if got, want := f.Comments[1].Text, []string{"x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Trailing comment is %q, want %q", got, want)
+	}
+	x := f.Messages[0].Fields[0]
+	if line, col := f.Lines.Line(x.Position.Offset), f.Lines.Column(x.Position.Offset); line != 3 || col != 8 {
+		t.Errorf("Field x is at %d:%d, want 3:8", line, col)
+	}
+	if line, col := f.Lines.Line(x.End().Offset), f.Lines.Column(x.End().Offset); line != 3 || col != 20 {
+		t.Errorf("Field x ends at %d:%d, want 3:20", line, col)
+	}
+	if line := f.Lines.Line(len(input)); line != 5 {
+		t.Errorf("The end of the input is on line %d, want 5", line)
+	}
+}
+
+func TestMissingSyntax(t *testing.T) {
+	sources := map[string][]byte{
+		"a.proto": []byte("import \"b.proto\";\nmessage A {}\n"),
+		"b.proto": []byte("syntax = \"proto2\";\nmessage B {}\n"),
+	}
+	tests := []struct {
+		policy        SyntaxPolicy
+		err, warnings string
+	}{
+		{SyntaxOptional, "", ""},
+		{SyntaxWarn, "", `warning: no syntax specified for a.proto; please use 'syntax = "proto2";' or 'syntax = "proto3";' (defaulted to proto2 syntax)` + "\n"},
+		{SyntaxRequired, `no syntax specified for a.proto; please use 'syntax = "proto2";' or 'syntax = "proto3";'`, ""},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		c := &Config{Sources: sources, MissingSyntax: test.policy, Warnings: &buf}
+		_, err := c.ParseFiles([]string{"a.proto"})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Policy %d: got error %q, want %q", test.policy, got, test.err)
+		}
+		if buf.String() != test.warnings {
+			t.Errorf("Policy %d: got warnings %q, want %q", test.policy, buf.String(), test.warnings)
+		}
+	}
+}
+
+func TestMapValidation(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{"message M {\n  repeated map<int32, string> m = 1;\n}", `-:2: field labels (required/optional/repeated) are not allowed on map fields`},
+		{"message M {\n  oneof o {\n    map<int32, string> m = 1;\n  }\n}", `-:3: map fields are not allowed in oneofs (field m)`},
+		{"message M {\n  extensions 10;\n}\nextend M {\n  map<int32, string> m = 10;\n}", `-:5: map fields are not allowed to be extensions (field m)`},
+		{"message M {\n  map<double, string> m = 1;\n}", `-:2: key in map fields cannot be float/double, bytes or message types (field m)`},
+		{"message M {\n  map<bytes, string> m = 1;\n}", `-:2: key in map fields cannot be float/double, bytes or message types (field m)`},
+		{"enum E { A = 0; }\nmessage M {\n  map<E, string> m = 1;\n}", `-:3: key in map fields cannot be enum or message types (field m)`},
+
+		// Valid.
+		{"message M {\n  map<sint64, M> m = 1;\n}", ""},
+		{"message map {}\nmessage M {\n  repeated map m = 1;\n}", ""},
+	}
+	for _, test := range tests {
+		_, err := ParseFile("-", []byte(test.input))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestOneofs(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{"message M {\n  oneof o {\n    oneof p {}\n  }\n}", `-:3: oneof is not allowed in oneof o`},
+		{"message M {\n  oneof o {\n    message N {}\n  }\n}", `-:3: message is not allowed in oneof o`},
+		{"message M {\n  oneof o {\n    reserved 2;\n  }\n}", `-:3: reserved is not allowed in oneof o`},
+		{"message M {\n  oneof o {\n    optional int32 a = 1;\n  }\n}", `-:3: fields in oneofs must not have labels (required/optional/repeated) (oneof o)`},
+		{"message M {\n  oneof o {\n    group G = 1 {\n      oneof o {\n        message N {}\n      }\n    }\n  }\n}", `-:5: message is not allowed in oneof o`},
+
+		// Valid.
+		{"message M {\n  oneof o {\n    group G = 1 {\n      oneof p {\n        int32 a = 2;\n      }\n      optional int32 b = 3;\n    }\n  }\n  optional int32 c = 4;\n}", ""},
+		{"message M {\n  optional group G = 1 {\n    oneof o {\n      group H = 2 {}\n    }\n  }\n  oneof o {\n    int32 a = 3;\n  }\n}", ""},
+	}
+	for _, test := range tests {
+		_, err := ParseFile("-", []byte(test.input))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+
+	// Each body has its own oneofs.
+	const input = "message M {\n  oneof o {\n    group G = 1 {\n      oneof p {\n        int32 a = 2;\n      }\n      optional int32 b = 3;\n    }\n  }\n  optional int32 c = 4;\n}"
+	f, err := ParseFile("-", []byte(input))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	m := f.Messages[0]
+	g := m.Messages[0]
+	if len(m.Oneofs) != 1 || len(g.Oneofs) != 1 {
+		t.Fatalf("M has %d oneofs and G has %d, want 1 each", len(m.Oneofs), len(g.Oneofs))
+	}
+	for _, test := range []struct {
+		field *ast.Field
+		oneof *ast.Oneof
+	}{
+		{m.Fields[0], m.Oneofs[0]},
+		{m.Fields[1], nil},
+		{g.Fields[0], g.Oneofs[0]},
+		{g.Fields[1], nil},
+	} {
+		if test.field.Oneof != test.oneof {
+			t.Errorf("Field %s is in oneof %v, want %v", test.field.Name, test.field.Oneof, test.oneof)
+		}
+	}
+}
+
+func TestNameValidation(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{"message M {\n  optional int32 foo = 1;\n  optional string foo = 2;\n}", `-:3: "foo" is already defined in message M (at line 2)`},
+		{"message M {\n  oneof o {\n    int32 a = 1;\n  }\n  oneof p {\n    int32 a = 2;\n  }\n}", `-:6: "a" is already defined in message M (at line 3)`},
+		{"message M {\n  optional int32 o = 1;\n  oneof o {\n    int32 a = 2;\n  }\n}", `-:3: "o" is already defined in message M (at line 2)`},
+		{"message M {\n  optional group Foo = 1 {}\n  optional int32 foo = 2;\n}", `-:3: "foo" is already defined in message M (at line 2)`},
+		{"message M {\n  message N {\n    optional int32 a = 1;\n    optional int32 a = 2;\n  }\n}", `-:4: "a" is already defined in message N (at line 3)`},
+		{"message M {\n  optional group foo = 1 {}\n}", `-:2: group names must start with a capital letter (group foo)`},
+		{"message M {\n  optional group _Foo = 1 {}\n}", `-:2: group names must start with a capital letter (group _Foo)`},
+		{"message M {\n  optional group FooBar = 1 {}\n  optional int32 foobar = 2;\n}", `-:3: "foobar" is already defined in message M (at line 2)`},
+
+		// Valid.
+		{"message M {\n  optional int32 foo = 1;\n  optional int32 Foo = 2;\n}", ""},
+		{"message M {\n  optional int32 a = 1;\n  message N {\n    optional int32 a = 1;\n  }\n}", ""},
+	}
+	for _, test := range tests {
+		_, err := ParseFile("-", []byte(test.input))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestTagValidation(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{"message M {\n  optional int32 a = 1;\n  optional int32 b = 1;\n}", `-:3: field b in message M has tag 1, which is already used by field a`},
+		{"message M {\n  optional int32 a = 1;\n  oneof o {\n    int32 b = 1;\n  }\n}", `-:4: field b in message M has tag 1, which is already used by field a`},
+		{"message M {\n  optional int32 a = 1;\n  optional group G = 1 {}\n}", `-:3: field G in message M has tag 1, which is already used by field a`},
+		{"message M {\n  extensions 100 to 199;\n  optional int32 a = 150;\n}", `-:3: field a in message M has tag 150, which is in the extension range 100 to 199`},
+		{"message M {\n  optional int32 a = 1000;\n  extensions 1000 to max;\n}", `-:2: field a in message M has tag 1000, which is in the extension range 1000 to max`},
+		{"message M {\n  reserved 5, 10 to 20;\n  optional int32 a = 5;\n}", `-:3: field a in message M has tag 5, which is in the reserved range 5`},
+		{"message M {\n  reserved 5, 10 to 20;\n  optional int32 a = 20;\n}", `-:3: field a in message M has tag 20, which is in the reserved range 10 to 20`},
+
+		// Valid.
+		{"message M {\n  optional int32 a = 1;\n  message N {\n    optional int32 b = 1;\n  }\n}", ""},
+		{"message M {\n  reserved 5, 10 to 20;\n  extensions 100 to 199;\n  optional int32 a = 9;\n  optional int32 b = 200;\n}", ""},
+	}
+	for _, test := range tests {
+		_, err := ParseFile("-", []byte(test.input))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestProto3Validation(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{"message M {\n  required int32 a = 1;\n}", `-:3: required fields are not allowed in proto3 (field a)`},
+		{"message M {\n  group G = 1 {}\n}", `-:3: groups are not allowed in proto3 (group G)`},
+		{"message M {\n  extensions 100 to 200;\n}", `-:2: extension ranges are not allowed in proto3 (message M)`},
+		{"message M {\n  int32 a = 1 [default = 3];\n}", `-:3: default values are not allowed in proto3 (field a)`},
+		{"message M {}\nextend M {\n  int32 a = 100;\n}", `-:3: extensions in proto3 must extend an options message, not M`},
+		{"extend FileOptions {\n  int32 a = 100;\n}", `-:2: extensions in proto3 must extend an options message, not FileOptions`},
+		{"enum E {\n  A = 1;\n  B = 0;\n}", `-:3: the first value of a proto3 enum must be zero (E.A = 1)`},
+		{"message M {\n  enum E {\n    A = -1;\n  }\n}", `-:4: the first value of a proto3 enum must be zero (E.A = -1)`},
+
+		// Valid.
+		{"import \"google/protobuf/descriptor.proto\";\nextend google.protobuf.FieldOptions {\n  int32 a = 100;\n}", ""},
+		{"message M {\n  optional int32 a = 1;\n}", ""},
+		{"enum E {\n  A = 0;\n  B = 2;\n}", ""},
+	}
+	for _, test := range tests {
+		_, err := ParseFile("-", []byte("syntax = \"proto3\";\n"+test.input))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+
+	// The same things are fine in proto2.
+	if _, err := ParseFile("-", []byte("message M {\n  required int32 a = 1 [default = 3];\n  extensions 100 to 200;\n}")); err != nil {
+		t.Errorf("proto2 file failed validation: %v", err)
+	}
+}
+
+func TestReserved(t *testing.T) {
+	const input = `
+message M {
+  extensions 100, 200 to 300, 1000 to max;
+  reserved 1, 5 to 10, 500000 to max;
+  reserved "foo", 'bar';
+}
+enum E {
+  A = 0;
+  reserved -10 to -1, 0x10, 100 to max;
+  reserved "B";
+}
+`
+	f, err := ParseFile("-", []byte(input))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	m, e := f.Messages[0], f.Enums[0]
+	check := func(what string, got, want interface{}) {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", what, got, want)
+		}
+	}
+	check("M.ExtensionRanges", m.ExtensionRanges, [][2]int{{100, 100}, {200, 300}, {1000, maxFieldNumber}})
+	check("M.ReservedRanges", m.ReservedRanges, [][2]int{{1, 1}, {5, 10}, {500000, maxFieldNumber}})
+	check("M.ReservedNames", m.ReservedNames, []string{"foo", "bar"})
+	check("E.ReservedRanges", e.ReservedRanges, [][2]int{{-10, -1}, {16, 16}, {100, maxEnumValue}})
+	check("E.ReservedNames", e.ReservedNames, []string{"B"})
+
+	for _, input := range []string{
+		"message M { reserved 0; }",
+		"message M { reserved 10 to 5; }",
+		"message M { reserved 536870912; }",
+		"message M { reserved max; }",
+		"message M { reserved 1 to; }",
+		"message M { reserved \"a\" \"b\"; }",
+		"message M { extensions -1; }",
+		"enum E { A = 0; reserved 2147483648; }",
+	} {
+		if _, err := ParseFile("-", []byte(input)); err == nil {
+			t.Errorf("Parsing %q succeeded, want an error", input)
+		}
+	}
+}
+
+func TestNonASCII(t *testing.T) {
+	const input = "\uFEFF// Ünïcode comment.\nmessage M {\n  optional string s = 1 [default = \"héllo, 世界\"];\n}\n"
+	f, err := ParseFile("-", []byte(input))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	if got, want := f.Messages[0].Fields[0].Default, "héllo, 世界"; got != want {
+		t.Errorf("Default = %q, want %q", got, want)
+	}
+	if got, want := f.Comments[0].Text, []string{"Ünïcode comment."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Comment = %q, want %q", got, want)
+	}
+	if got, want := f.Comments[0].Start.Offset, 3; got != want {
+		t.Errorf("Comment offset = %d, want %d", got, want)
+	}
+
+	_, err = ParseFile("-", []byte("message Mé {}"))
+	if want := `non-ASCII character 'é' is only allowed in strings and comments`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Parsing a non-ASCII identifier gave error %v, want %q", err, want)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	nested := func(n int) string {
+		return strings.Repeat("message M {\n", n) + strings.Repeat("}\n", n)
+	}
+	if _, err := ParseFile("-", []byte(nested(DefaultMaxDepth))); err != nil {
+		t.Errorf("Parsing %d nested messages: %v", DefaultMaxDepth, err)
+	}
+	_, err := ParseFile("-", []byte(nested(DefaultMaxDepth+1)))
+	if err == nil || !strings.Contains(err.Error(), "nesting too deep") {
+		t.Errorf("Parsing %d nested messages gave error %v, want nesting too deep", DefaultMaxDepth+1, err)
+	}
+	groups := "message M {\n" + strings.Repeat("optional group G = 1 {\n", DefaultMaxDepth) + strings.Repeat("}\n", DefaultMaxDepth+1)
+	if _, err := ParseFile("-", []byte(groups)); err == nil {
+		t.Errorf("Parsing deeply nested groups succeeded, want an error")
+	}
+
+	dir, err := ioutil.TempDir("", "parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.proto"), []byte(nested(4)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, limit := range []int{3, 4} {
+		c := &Config{ImportPaths: []string{dir}, MaxDepth: limit}
+		_, err := c.ParseFiles([]string{"a.proto"})
+		if ok := err == nil; ok != (limit >= 4) {
+			t.Errorf("Parsing 4 nested messages with MaxDepth %d gave error %v", limit, err)
+		}
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	f, err := Parse("a.proto", strings.NewReader("package a;\nmessage A {}\n"))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(f.Messages) != 1 || f.Messages[0].Name != "A" {
+		t.Errorf("Parse gave messages %v, want [A]", f.Messages)
+	}
+
+	sources := map[string][]byte{
+		"a.proto":     []byte("package a;\nimport \"b/b.proto\";\nmessage A { optional b.B b = 1; }\n"),
+		"b/b.proto":   []byte("package b;\nimport \"empty.proto\";\nmessage B {}\n"),
+		"empty.proto": nil,
+	}
+	fset, err := ParseSource([]string{"a.proto"}, sources)
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	if len(fset.Files) != 3 {
+		t.Fatalf("ParseSource gave %d files, want 3", len(fset.Files))
+	}
+	var a *ast.File
+	for _, f := range fset.Files {
+		if f.Name == "a.proto" {
+			a = f
+		}
+	}
+	if a == nil {
+		t.Fatalf("ParseSource result lacks a.proto")
+	}
+	if typ, ok := a.Messages[0].Fields[0].Type.(*ast.Message); !ok || typ.Name != "B" {
+		t.Errorf("A.b has type %v, want b.B", a.Messages[0].Fields[0].Type)
+	}
+
+	if _, err := ParseSource([]string{"a.proto"}, map[string][]byte{"a.proto": sources["a.proto"]}); err == nil {
+		t.Errorf("ParseSource with a missing import succeeded")
+	}
+}
+
+func TestEndPositions(t *testing.T) {
+	const input = `message M {
+  optional int32 a = 1 [default = 3];
+  oneof o { string b = 2; }
+  optional group G = 3 { optional int32 c = 4; };
+  extensions 100 to 200;
+}
+enum E { X = 0; };
+service S {
+  rpc Foo (M) returns (M);
+  rpc Bar (M) returns (M) { option deprecated = true; };
+}
+extend M { optional int32 d = 100; }
+`
+	f, err := ParseFile("-", []byte(input))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	m := f.Messages[0]
+	tests := []struct {
+		node interface {
+			Pos() ast.Position
+			End() ast.Position
+		}
+		want string
+	}{
+		{m.Fields[0], "optional int32 a = 1 [default = 3];"},
+		{m.Oneofs[0], "oneof o { string b = 2; }"},
+		{m.Fields[1], "string b = 2;"},
+		{m.Fields[2], "optional group G = 3 { optional int32 c = 4; }"},
+		{f.Enums[0], "enum E { X = 0; }"},
+		{f.Enums[0].Values[0], "X = 0;"},
+		{f.Services[0].Methods[0], "Foo (M) returns (M);"},
+		{f.Services[0].Methods[1], "Bar (M) returns (M) { option deprecated = true; }"},
+		{f.Extensions[0], "extend M { optional int32 d = 100; }"},
+	}
+	for _, test := range tests {
+		pos, end := test.node.Pos(), test.node.End()
+		if got := input[pos.Offset:end.Offset]; got != test.want {
+			t.Errorf("%T spans %q, want %q", test.node, got, test.want)
+		}
+		if n := ast.Span(test.node); n != len(test.want) {
+			t.Errorf("ast.Span(%T) = %d, want %d", test.node, n, len(test.want))
+		}
+	}
+	if !strings.HasPrefix(input[m.Pos().Offset:m.End().Offset], "message M {") || m.End().Line != 6 {
+		t.Errorf("Message M ends at %v, want line 6", m.End())
+	}
+	if s := f.Services[0]; s.End().Line != 11 || input[s.End().Offset-1] != '}' {
+		t.Errorf("Service S ends at %v, want just after the \"}\" on line 11", s.End())
+	}
+	if n := ast.Span(&ast.Message{}); n != 0 {
+		t.Errorf("ast.Span of an unparsed message = %d, want 0", n)
+	}
+}
+
+func TestKeywordsAsNames(t *testing.T) {
+	for _, input := range []string{
+		"message M {\n  optional int32 option = 1;\n  optional int32 message = 2;\n  optional int32 reserved = 3;\n  optional int32 syntax = 4;\n}",
+		"message message {\n  optional message message = 1;\n}",
+		"syntax = \"proto3\";\nmessage reserved {}\nmessage M {\n  reserved r = 1;\n}",
+		"syntax = \"proto3\";\nmessage option {}\nmessage M {\n  option o = 1;\n  oneof x {\n    option y = 2;\n  }\n}",
+		"syntax = \"proto3\";\nmessage extensions {}\nmessage M {\n  extensions /* comment */ e = 1;\n}",
+		"syntax = \"proto3\";\nmessage message {}\nmessage M {\n  message m = 1;\n  enum E { A = 0; }\n}",
+		"enum E {\n  option = 0;\n  reserved = 1;\n  syntax = 2;\n  reserved 5;\n}",
+		"message M {\n  oneof option {\n    int32 syntax = 1;\n  }\n}",
+	} {
+		if _, err := ParseFile("-", []byte(input)); err != nil {
+			t.Errorf("Parsing %q: %v", input, err)
+		}
+	}
+
+	f, err := ParseFile("-", []byte("message M {\n  reserved r = 1;\n  reserved 2;\n}"))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	m := f.Messages[0]
+	if len(m.Fields) != 1 || m.Fields[0].TypeName != "reserved" || m.Fields[0].Name != "r" {
+		t.Errorf("Fields = %+v, want one field r of type reserved", m.Fields)
+	}
+	if want := [][2]int{{2, 2}}; !reflect.DeepEqual(m.ReservedRanges, want) {
+		t.Errorf("ReservedRanges = %v, want %v", m.ReservedRanges, want)
+	}
+}
+
+func TestImportCycles(t *testing.T) {
+	tests := []struct {
+		sources map[string]string
+		err     string
+	}{
+		{
+			map[string]string{
+				"a.proto": `import "b.proto";`,
+				"b.proto": `import "a.proto";`,
+			},
+			"import cycle: a.proto -> b.proto -> a.proto",
+		},
+		{
+			map[string]string{
+				"a.proto": `import "b.proto";`,
+				"b.proto": `import "c.proto"; import "d.proto";`,
+				"c.proto": ``,
+				"d.proto": `import "b.proto";`,
+			},
+			"import cycle: b.proto -> d.proto -> b.proto",
+		},
+		{
+			map[string]string{
+				"a.proto": `import "a.proto";`,
+			},
+			"import cycle: a.proto -> a.proto",
+		},
+		{
+			// A diamond is not a cycle.
+			map[string]string{
+				"a.proto": `import "b.proto"; import "c.proto";`,
+				"b.proto": `import "d.proto";`,
+				"c.proto": `import "d.proto";`,
+				"d.proto": ``,
+			},
+			"",
+		},
+	}
+	for _, test := range tests {
+		sources := make(map[string][]byte)
+		for name, src := range test.sources {
+			sources[name] = []byte(src)
+		}
+		_, err := ParseSource([]string{"a.proto"}, sources)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %v: got error %q, want %q", test.sources, got, test.err)
+		}
+	}
+}
+
+func TestFileNotFound(t *testing.T) {
+	sources := map[string][]byte{
+		"a.proto": []byte(`import "b.proto";`),
+		"b.proto": []byte(`import "missing.proto";`),
+	}
+	c := &Config{ImportPaths: []string{"testdata", "include"}, Sources: sources}
+	_, err := c.ParseFiles([]string{"a.proto"})
+	want := "file not found: missing.proto (imported via a.proto -> b.proto -> missing.proto; searched import paths testdata, include)"
+	if err == nil || err.Error() != want {
+		t.Errorf("Parsing with a missing import gave error %v, want %q", err, want)
+	}
+
+	_, err = c.ParseFiles([]string{"missing.proto"})
+	want = "file not found: missing.proto (searched import paths testdata, include)"
+	if err == nil || err.Error() != want {
+		t.Errorf("Parsing a missing file gave error %v, want %q", err, want)
+	}
+
+	c = &Config{Importer: ImporterFunc(func(string) (io.ReadCloser, error) { return nil, os.ErrNotExist })}
+	_, err = c.ParseFiles([]string{"missing.proto"})
+	want = "file not found: missing.proto"
+	if err == nil || err.Error() != want {
+		t.Errorf("Parsing a missing file with an Importer gave error %v, want %q", err, want)
+	}
+}
+
+func TestSamePackageNames(t *testing.T) {
+	sources := map[string][]byte{
+		"a.proto": []byte("package p.q;\nimport \"b.proto\";\nmessage A { optional B b = 1; optional E e = 2; }\n"),
+		"b.proto": []byte("package p.q;\nmessage B {}\nenum E { X = 0; }\n"),
+	}
+	fset, err := ParseSource([]string{"a.proto"}, sources)
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	for _, f := range fset.Files {
+		if f.Name != "a.proto" {
+			continue
+		}
+		fields := f.Messages[0].Fields
+		if m, ok := fields[0].Type.(*ast.Message); !ok || m.Name != "B" {
+			t.Errorf("A.b has type %v, want p.q.B", fields[0].Type)
+		}
+		if e, ok := fields[1].Type.(*ast.Enum); !ok || e.Name != "E" {
+			t.Errorf("A.e has type %v, want p.q.E", fields[1].Type)
+		}
+	}
+}
+
+func TestFullyQualifiedNames(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		// .a.X is found from the root, even though M.a is nearer.
+		{"package a;\nmessage X { extensions 10; }\nmessage M {\n  message a {}\n  optional .a.X x = 1;\n}\nextend .a.X { optional .a.M m = 10; }\nservice S { rpc R(.a.M) returns (.a.X); }\n", ""},
+		{"message X {}\nmessage M { optional .X x = 1; }\n", ""},
+
+		{"package a;\nmessage X {}\nmessage M { optional .X x = 1; }\n", `test.proto:3: unresolved type ".X" (referenced from message a.M)`},
+		{"package a;\nmessage M {\n  message N {}\n  optional .N n = 1;\n}\n", `test.proto:4: unresolved type ".N" (referenced from message a.M)`},
+	}
+	for _, test := range tests {
+		_, err := ParseSource([]string{"test.proto"}, map[string][]byte{"test.proto": []byte(test.input)})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestScoping(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		// b.X is found in package a, which encloses package a.b.
+		{"package a.b;\nmessage X {}\nmessage M { optional b.X x = 1; }\n", ""},
+		// N is found in M, so N.O must be there too; the outer N.O isn't tried.
+		{"package a;\nmessage N { message O {} }\nmessage M {\n  message N {}\n  optional N.O o = 1;\n}\n", `test.proto:5: unresolved type "N.O" (referenced from message a.M)`},
+		// Likewise for packages.
+		{"package foo.bar;\nmessage Baz {}\nmessage M {\n  message foo {}\n  optional foo.bar.Baz b = 1;\n}\n", `test.proto:5: unresolved type "foo.bar.Baz" (referenced from message foo.bar.M)`},
+	}
+	for _, test := range tests {
+		_, err := ParseSource([]string{"test.proto"}, map[string][]byte{"test.proto": []byte(test.input)})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestExtendees(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{"package a;\nmessage M {\n  extensions 10;\n  message N { extensions 20; }\n  extend N { optional int32 x = 20; }\n}\nextend M { optional int32 y = 10; }\n", ""},
+		{"package a.b;\nmessage M { extensions 10; }\nextend b.M { optional int32 x = 10; }\nextend .a.b.M { optional int32 y = 11; }\n", `test.proto:4: .a.b.M does not declare 11 as an extension number (field y)`},
+
+		{"package a;\nmessage M {}\nextend N {\n  optional int32 x = 10;\n}\n", `test.proto:3: unresolved extendee "N"`},
+		{"package a;\nmessage M {\n  enum E { Z = 0; }\n  extend E {\n    optional int32 x = 10;\n  }\n}\n", `test.proto:4: extendee "E" is an enum, not a message`},
+		{"package a;\nmessage M {}\nservice S {}\nextend S {\n  optional int32 x = 10;\n}\n", `test.proto:4: extendee "S" is a service, not a message`},
+		{"package a;\nmessage M {}\nservice S {}\nmessage N { optional S s = 1; }\n", `test.proto:4: "S" is a service, not a type (referenced from message a.N)`},
+		{"package a;\nmessage M {}\nenum E { Z = 0; }\nservice S { rpc R(M) returns (E); }\n", `test.proto:4: output type "E" is an enum, not a message (method S.R)`},
+	}
+	for _, test := range tests {
+		_, err := ParseSource([]string{"test.proto"}, map[string][]byte{"test.proto": []byte(test.input)})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestResolveEverything(t *testing.T) {
+	const input = `
+package test;
+message M {
+  optional E e = 1;
+  oneof o {
+    group G = 2 {
+      optional E e = 3;
+      oneof p { N n = 4; }
+      extend M { optional E ge = 100; }
+    }
+  }
+  message N {
+    oneof q { M m = 5; }
+    optional group H = 6 { optional N n = 7; }
+  }
+  extensions 100 to 200;
+  extend M {
+    optional group X = 101 { optional E e = 8; }
+  }
+}
+extend M { optional M.N.H h = 102; }
+service S { rpc R(stream M.N) returns (stream M.G); }
+enum E { Z = 0; }
+`
+	p := newParser("-", input)
+	f := new(ast.File)
+	if pe := p.readFile(f); pe != nil {
+		t.Fatalf("Parsing: %v", pe)
+	}
+	// Pretend that part of the AST was resolved already.
+	f.Extensions[0].ExtendeeType = f.Messages[0]
+	if err := resolveSymbols(&ast.FileSet{Files: []*ast.File{f}}, nil); err != nil {
+		t.Fatalf("Resolving symbols: %v", err)
+	}
+
+	var checkFields func(where string, fields []*ast.Field)
+	checkFields = func(where string, fields []*ast.Field) {
+		for _, field := range fields {
+			if field.Type == nil {
+				t.Errorf("Field %s in %s has no type", field.Name, where)
+			}
+		}
+	}
+	var checkMessage func(m *ast.Message)
+	checkMessage = func(m *ast.Message) {
+		checkFields(m.Name, m.Fields)
+		for _, ext := range m.Extensions {
+			if ext.ExtendeeType == nil {
+				t.Errorf("Extension of %s in %s has no extendee type", ext.Extendee, m.Name)
+			}
+			checkFields("extension in "+m.Name, ext.Fields)
+		}
+		for _, nm := range m.Messages {
+			checkMessage(nm)
+		}
+	}
+	for _, m := range f.Messages {
+		checkMessage(m)
+	}
+	checkFields("top-level extension", f.Extensions[0].Fields)
+	if mth := f.Services[0].Methods[0]; mth.InType == nil || mth.OutType == nil {
+		t.Errorf("Method R has types %v and %v, want both set", mth.InType, mth.OutType)
+	}
+}
+
+func TestConflictingDeclarations(t *testing.T) {
+	tests := []struct {
+		sources map[string]string
+		err     string
+	}{
+		{map[string]string{"a.proto": "package p;\nmessage M {}\nenum M { Z = 0; }\n"}, `a.proto:3: "p.M" is already defined as a message (at a.proto:2)`},
+		{map[string]string{"a.proto": "enum M { Z = 0; }\nmessage M {}\n"}, `a.proto:2: "M" is already defined as an enum (at a.proto:1)`},
+		{map[string]string{"a.proto": "message M {\n  message G {}\n  optional group G = 1 {}\n}\n"}, `a.proto:3: "M.G" is already defined as a message (at a.proto:2)`},
+		{map[string]string{"a.proto": "message M {}\nservice M {}\n"}, `a.proto:2: "M" is already defined as a message (at a.proto:1)`},
+		{map[string]string{"a.proto": "package p;\nimport \"b.proto\";\nmessage M {}\n", "b.proto": "package p;\n\nmessage M {}\n"}, `b.proto:3: "p.M" is already defined as a message (at a.proto:3)`},
+		{map[string]string{"a.proto": "package p;\nimport \"b.proto\";\nmessage q {}\n", "b.proto": "package p.q.r;\n"}, `a.proto:3: "p.q" is declared as both a message and a package (in b.proto)`},
+
+		// Valid.
+		{map[string]string{"a.proto": "package p;\nimport \"b.proto\";\nmessage M {}\n", "b.proto": "package p;\nmessage N { message M {} }\n"}, ""},
+		{map[string]string{"a.proto": "message M { enum E { Z = 0; } }\nmessage N { enum E { Z = 0; } }\n"}, ""},
+	}
+	for _, test := range tests {
+		sources := make(map[string][]byte)
+		for name, src := range test.sources {
+			sources[name] = []byte(src)
+		}
+		_, err := ParseSource([]string{"a.proto"}, sources)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %v: got error %q, want %q", test.sources, got, test.err)
+		}
+	}
+}
+
+func TestPublicImports(t *testing.T) {
+	tests := []struct {
+		sources map[string]string
+		err     string
+	}{
+		// c.proto's C reaches a.proto through b.proto's public imports.
+		{map[string]string{
+			"a.proto":  "import \"b.proto\";\nmessage A { optional C c = 1; optional B b = 2; }\n",
+			"b.proto":  "import public \"b2.proto\";\nmessage B {}\n",
+			"b2.proto": "import public \"c.proto\";\n",
+			"c.proto":  "message C {}\n",
+		}, ""},
+		// An ordinary import isn't passed on.
+		{map[string]string{
+			"a.proto": "import \"b.proto\";\nmessage A { optional C c = 1; }\n",
+			"b.proto": "import \"c.proto\";\nmessage B { optional C c = 1; }\n",
+			"c.proto": "message C {}\n",
+		}, `a.proto:2: unresolved type "C" (referenced from message A)`},
+		// Nor is a public import of a file that a.proto doesn't import.
+		{map[string]string{
+			"a.proto": "import \"b.proto\";\nmessage A { optional D d = 1; }\n",
+			"b.proto": "import \"c.proto\";\n",
+			"c.proto": "import public \"d.proto\";\n",
+			"d.proto": "message D {}\n",
+		}, `a.proto:2: unresolved type "D" (referenced from message A)`},
+	}
+	for _, test := range tests {
+		sources := make(map[string][]byte)
+		for name, src := range test.sources {
+			sources[name] = []byte(src)
+		}
+		_, err := ParseSource([]string{"a.proto"}, sources)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %v: got error %q, want %q", test.sources, got, test.err)
+		}
+	}
+}
+
+func TestWeakImports(t *testing.T) {
+	tests := []struct {
+		sources map[string]string
+		err     string
+	}{
+		// A weak import may be missing.
+		{map[string]string{"a.proto": "import weak \"missing.proto\";\nimport \"b.proto\";\nmessage A { optional B b = 1; }\n", "b.proto": "message B {}\n"}, ""},
+		// Types from a weak import that is present can be used.
+		{map[string]string{"a.proto": "import weak \"b.proto\";\nmessage A { optional B b = 1; }\n", "b.proto": "message B {}\n"}, ""},
+		// But not types from one that is missing.
+		{map[string]string{"a.proto": "import weak \"b.proto\";\nmessage A { optional B b = 1; }\n"}, `a.proto:2: unresolved type "B" (referenced from message A)`},
+		// A file imported both weakly and not must exist.
+		{map[string]string{"a.proto": "import weak \"missing.proto\";\nimport \"b.proto\";\n", "b.proto": "import \"missing.proto\";\n"}, `file not found: missing.proto (imported via a.proto -> b.proto -> missing.proto; searched import paths .)`},
+	}
+	for _, test := range tests {
+		sources := make(map[string][]byte)
+		for name, src := range test.sources {
+			sources[name] = []byte(src)
+		}
+		fset, err := ParseSource([]string{"a.proto"}, sources)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %v: got error %q, want %q", test.sources, got, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		fds, err := gendesc.Generate(fset)
+		if err != nil {
+			t.Errorf("Generating %v: %v", test.sources, err)
+			continue
+		}
+		for _, fd := range fds.File {
+			if fd.GetName() == "a.proto" && (len(fd.WeakDependency) != 1 || fd.WeakDependency[0] != 0) {
+				t.Errorf("a.proto has weak_dependency %v, want [0]", fd.WeakDependency)
+			}
+		}
+	}
+}
+
+func TestCrossSyntaxEnums(t *testing.T) {
+	const e2 = "syntax = \"proto2\";\nenum E2 { A = 0; }\n"
+	const e3 = "syntax = \"proto3\";\nenum E3 { B = 0; }\n"
+	tests := []struct {
+		input, err string
+	}{
+		{"syntax = \"proto3\";\nimport \"e2.proto\";\nmessage M {\n  E2 e = 1;\n}\n", `a.proto:4: enum type "E2" is not a proto3 enum, but is used in "M" which is a proto3 message type`},
+		{"syntax = \"proto3\";\nimport \"e2.proto\";\nmessage M {\n  message N { map<string, E2> m = 1; }\n}\n", `a.proto:4: enum type "E2" is not a proto3 enum, but is used in "N" which is a proto3 message type`},
+
+		// Valid.
+		{"syntax = \"proto3\";\nimport \"e3.proto\";\nmessage M {\n  E3 e = 1;\n}\n", ""},
+		{"syntax = \"proto2\";\nimport \"e2.proto\";\nimport \"e3.proto\";\nmessage M {\n  optional E2 e2 = 1;\n  optional E3 e3 = 2;\n}\n", ""},
+	}
+	for _, test := range tests {
+		sources := map[string][]byte{
+			"a.proto":  []byte(test.input),
+			"e2.proto": []byte(e2),
+			"e3.proto": []byte(e3),
+		}
+		_, err := ParseSource([]string{"a.proto"}, sources)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestEnumDefaults(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{"enum Foo { A = 1; B = 2; }\nmessage M {\n  required Foo f = 1 [default = NOPE];\n}\n", `test.proto:3: enum type "Foo" has no value named "NOPE" (default of field f)`},
+		{"message M {\n  enum Foo { A = 1; }\n  extensions 10;\n}\nextend M {\n  optional M.Foo f = 10 [default = 1];\n}\n", `test.proto:6: enum type "M.Foo" has no value named "1" (default of field f)`},
+		{"message M {\n  optional M m = 1 [default = A];\n}\n", `test.proto:2: messages can't have default values (field m)`},
+
+		// Valid.
+		{"enum Foo { A = 1; B = 2; }\nmessage M {\n  required Foo f = 1 [default = B];\n}\n", ""},
+	}
+	for _, test := range tests {
+		_, err := ParseSource([]string{"test.proto"}, map[string][]byte{"test.proto": []byte(test.input)})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("Parsing %q: got error %q, want %q", test.input, got, test.err)
+		}
+	}
+}
+
+func TestSymbolTable(t *testing.T) {
+	const input = `
+package p;
+message M {
+  optional E e = 1;
+  oneof o { M m = 2; }
+  optional group G = 3 { optional E e = 4; }
+  extensions 100 to 200;
+}
+enum E { ZERO = 0; }
+extend M { optional E x = 100; }
+service S { rpc R(M) returns (M.G); }
+`
+	fset, err := ParseSource([]string{"test.proto"}, map[string][]byte{"test.proto": []byte(input)})
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	st := ast.NewSymbolTable(fset)
+
+	want := []string{"p.E", "p.M", "p.M.G", "p.M.G.e", "p.M.e", "p.M.g", "p.M.m", "p.M.o", "p.S", "p.S.R", "p.ZERO", "p.x"}
+	if got := st.Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %q, want %q", got, want)
+	}
+
+	f := fset.Files[0]
+	m, e := f.Messages[0], f.Enums[0]
+	if got := st.Lookup(".p.M"); got != m {
+		t.Errorf("Lookup(.p.M) = %v, want message M", got)
+	}
+	if got := st.Lookup("p.ZERO"); got != e.Values[0] {
+		t.Errorf("Lookup(p.ZERO) = %v, want enum value ZERO", got)
+	}
+	if got := st.Lookup("p.Nope"); got != nil {
+		t.Errorf("Lookup(p.Nope) = %v, want nil", got)
+	}
+	if got := st.FullName(m.Messages[0]); got != "p.M.G" {
+		t.Errorf("FullName(G) = %q, want p.M.G", got)
+	}
+
+	refs := func(n ast.Node) []string {
+		var names []string
+		for _, r := range st.References(n) {
+			if ext, ok := r.(*ast.Extension); ok {
+				names = append(names, "extend "+ext.Extendee)
+				continue
+			}
+			names = append(names, st.FullName(r))
+		}
+		return names
+	}
+	if got, want := refs(e), []string{"p.M.e", "p.M.G.e", "p.x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("References(E) = %q, want %q", got, want)
+	}
+	if got, want := refs(m), []string{"p.M.m", "extend M", "p.S.R"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("References(M) = %q, want %q", got, want)
+	}
+	if got, want := refs(m.Messages[0]), []string{"p.M.g", "p.S.R"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("References(G) = %q, want %q", got, want)
+	}
+}
+
+func TestSourceCodeInfo(t *testing.T) {
+	const input = `syntax = "proto2";
+
+// Detached.
+
+// Leading
+// comment.
+message M {
+  optional int32 a = 1; // Trailing.
+  /* Block. */
+  enum E { ZERO = 0; }
+}
+service S {
+	rpc R(M) returns (M);
+}
+`
+	fset, err := ParseSource([]string{"test.proto"}, map[string][]byte{"test.proto": []byte(input)})
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	fds, err := gendesc.Generate(fset)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	gendesc.AddSourceCodeInfo(fset, fds)
+
+	var got []string
+	for _, loc := range fds.File[0].GetSourceCodeInfo().GetLocation() {
+		s := fmt.Sprint(loc.Path, loc.Span)
+		if loc.LeadingComments != nil {
+			s += fmt.Sprintf(" leading=%q", loc.GetLeadingComments())
+		}
+		if loc.TrailingComments != nil {
+			s += fmt.Sprintf(" trailing=%q", loc.GetTrailingComments())
+		}
+		if len(loc.LeadingDetachedComments) > 0 {
+			s += fmt.Sprintf(" detached=%q", loc.LeadingDetachedComments)
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		`[] [0 0 13 1]`,
+		`[12] [0 0 18]`,
+		`[4 0] [6 0 10 1] leading=" Leading\n comment.\n" detached=[" Detached.\n"]`,
+		`[4 0 2 0] [7 2 23] trailing=" Trailing.\n"`,
+		`[4 0 4 0] [9 2 22] leading=" Block.\n"`,
+		`[4 0 4 0 2 0] [9 11 20]`,
+		`[6 0] [11 0 13 1]`,
+		`[6 0 2 0] [12 12 29]`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Locations:\n got %s\nwant %s", strings.Join(got, "\n     "), strings.Join(want, "\n     "))
+	}
+}
+
+func TestSourceCodeInfoStatements(t *testing.T) {
+	const input = `// Package foo does things.
+package foo;
+// about the import
+import "b.proto";
+
+option java_package = "x"; // Trailing.
+// lead M
+message M {}
+`
+	fset, err := ParseSource([]string{"a.proto"}, map[string][]byte{
+		"a.proto": []byte(input),
+		"b.proto": nil,
+	})
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	fds, err := gendesc.Generate(fset)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	gendesc.AddSourceCodeInfo(fset, fds)
+
+	var got []string
+	for _, loc := range fds.File[1].GetSourceCodeInfo().GetLocation() {
+		s := fmt.Sprint(loc.Path, loc.Span)
+		if loc.LeadingComments != nil {
+			s += fmt.Sprintf(" leading=%q", loc.GetLeadingComments())
+		}
+		if loc.TrailingComments != nil {
+			s += fmt.Sprintf(" trailing=%q", loc.GetTrailingComments())
+		}
+		if len(loc.LeadingDetachedComments) > 0 {
+			s += fmt.Sprintf(" detached=%q", loc.LeadingDetachedComments)
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		`[] [1 0 7 12]`,
+		`[2] [1 0 12] leading=" Package foo does things.\n"`,
+		`[3 0] [3 0 17] leading=" about the import\n"`,
+		`[8] [5 0 26] trailing=" Trailing.\n"`,
+		`[4 0] [7 0 12] leading=" lead M\n"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Locations:\n got %s\nwant %s", strings.Join(got, "\n     "), strings.Join(want, "\n     "))
+	}
+}
+
+func TestFileOrder(t *testing.T) {
+	sources := map[string][]byte{
+		"a.proto": []byte(`import "b.proto"; import "c.proto";`),
+		"b.proto": []byte(`import "d.proto";`),
+		"c.proto": nil,
+		"d.proto": nil,
+		"e.proto": []byte(`import "c.proto";`),
+	}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"a.proto"}, []string{"d.proto", "b.proto", "c.proto", "a.proto"}},
+		{[]string{"e.proto", "a.proto"}, []string{"c.proto", "e.proto", "d.proto", "b.proto", "a.proto"}},
+		{[]string{"a.proto", "e.proto"}, []string{"d.proto", "b.proto", "c.proto", "a.proto", "e.proto"}},
+		{[]string{"b.proto", "a.proto"}, []string{"d.proto", "b.proto", "c.proto", "a.proto"}},
+	}
+	for _, test := range tests {
+		fset, err := ParseSource(test.args, sources)
+		if err != nil {
+			t.Errorf("ParseSource(%q): %v", test.args, err)
+			continue
+		}
+		var got []string
+		for _, f := range fset.Files {
+			got = append(got, f.Name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseSource(%q) gave files %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestProtocDefaults(t *testing.T) {
+	const input = `
+message M {
+  optional int32  a = 1 [default = 0x7FFFFFFF];
+  optional int64  b = 2 [default = -0x8000000000000000];
+  optional uint64 c = 3 [default = 0xFFFFFFFFFFFFFFFF];
+  optional sint32 d = 4 [default = 010];
+  optional double e = 5 [default = 1e9];
+  optional float  f = 6 [default = .5];
+  optional double g = 7 [default = -2.5e-3];
+  optional double h = 8 [default = 0.1];
+  optional double i = 9 [default = 1e100];
+  optional double j = 10 [default = -inf];
+  optional float  k = 11 [default = nan];
+  optional string l = 12 [default = "0x10"];
+  optional double m = 13 [default = 010];
+  optional double n = 14 [default = -0x10];
+  optional float  o = 15 [default = 0x10];
+}
+`
+	fset, err := ParseSource([]string{"test.proto"}, map[string][]byte{"test.proto": []byte(input)})
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	fds, err := gendesc.GenerateWithOptions(fset, gendesc.Options{ProtocDefaults: true})
+	if err != nil {
+		t.Fatalf("GenerateWithOptions: %v", err)
+	}
+	var got []string
+	for _, f := range fds.File[0].MessageType[0].Field {
+		got = append(got, f.GetDefaultValue())
+	}
+	want := []string{"2147483647", "-9223372036854775808", "18446744073709551615", "8", "1000000000", "0.5", "-0.0025", "0.1", "1e+100", "-inf", "nan", "0x10", "8", "-16", "16"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Defaults = %q, want %q", got, want)
+	}
+}
+
+func TestExplicitSyntax(t *testing.T) {
+	fset, err := ParseSource([]string{"a.proto", "b.proto", "c.proto"}, map[string][]byte{
+		"a.proto": []byte("message A {}\n"),
+		"b.proto": []byte("syntax = \"proto2\";\nmessage B {}\n"),
+		"c.proto": []byte("syntax = \"proto3\";\nmessage C {}\n"),
+	})
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	for _, explicit := range []bool{false, true} {
+		fds, err := gendesc.GenerateWithOptions(fset, gendesc.Options{ExplicitSyntax: explicit})
+		if err != nil {
+			t.Fatalf("GenerateWithOptions: %v", err)
+		}
+		var got []string
+		for _, fd := range fds.File {
+			s := "<unset>"
+			if fd.Syntax != nil {
+				s = fd.GetSyntax()
+			}
+			got = append(got, fd.GetName()+": "+s)
+		}
+		want := []string{"a.proto: <unset>", "b.proto: <unset>", "c.proto: proto3"}
+		if explicit {
+			want = []string{"a.proto: proto2", "b.proto: proto2", "c.proto: proto3"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ExplicitSyntax = %t: got %q, want %q", explicit, got, want)
+		}
+	}
+}
+
+func TestGenerateFile(t *testing.T) {
+	const input = `
+import "opts.proto";
+package test;
+message M {
+  optional int32 a = 1 [(note) = "x", default = 0x10];
+}
+`
+	fset, err := ParseSource([]string{"test.proto"}, map[string][]byte{
+		"test.proto":                       []byte(input),
+		"opts.proto":                       []byte("import \"google/protobuf/descriptor.proto\";\npackage test;\nextend google.protobuf.FieldOptions { optional string note = 1000; }\n"),
+		"google/protobuf/descriptor.proto": []byte("package google.protobuf;\nmessage FieldOptions { extensions 1000 to max; }\n"),
+	})
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	f := fset.Files[len(fset.Files)-1]
+	if f.Name != "test.proto" {
+		t.Fatalf("Last file is %s, want test.proto", f.Name)
+	}
+
+	// Without its imports, the custom option can't be interpreted.
+	fdp, err := gendesc.GenerateFile(f, gendesc.Options{})
+	if err != nil {
+		t.Fatalf("GenerateFile: %v", err)
+	}
+	field := fdp.MessageType[0].Field[0]
+	if n := len(field.Options.UninterpretedOption); n != 1 {
+		t.Errorf("Without deps, field has %d uninterpreted options, want 1", n)
+	}
+	if fdp.SourceCodeInfo != nil {
+		t.Errorf("Without SourceInfo, SourceCodeInfo is set")
+	}
+	if got := field.GetDefaultValue(); got != "0x10" {
+		t.Errorf("Without ProtocDefaults, default is %q, want 0x10", got)
+	}
+
+	fdp, err = gendesc.GenerateFile(f, gendesc.Options{
+		SourceInfo:     true,
+		ProtocDefaults: true,
+		Deps:           fset.Files[:len(fset.Files)-1],
+	})
+	if err != nil {
+		t.Fatalf("GenerateFile: %v", err)
+	}
+	field = fdp.MessageType[0].Field[0]
+	if n := len(field.Options.UninterpretedOption); n != 0 {
+		t.Errorf("With deps, field has %d uninterpreted options, want 0", n)
+	}
+	if fdp.SourceCodeInfo == nil {
+		t.Errorf("With SourceInfo, SourceCodeInfo is not set")
+	}
+	if got := field.GetDefaultValue(); got != "16" {
+		t.Errorf("With ProtocDefaults, default is %q, want 16", got)
+	}
+}
@@ -0,0 +1,71 @@
+package parser
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/golang/protobuf/proto"
+)
+
+// TestReproducible checks that compiling the same files from different
+// places on disk produces identical descriptors.
+func TestReproducible(t *testing.T) {
+	var text []string
+	var raw [][]byte
+	for i := 0; i < 2; i++ {
+		dir := writeTree(t, 1)
+		defer os.RemoveAll(dir)
+		// Name the input by its absolute path, as a build system might.
+		c := &Config{ImportPaths: []string{dir}}
+		fs, err := c.ParseFiles([]string{filepath.Join(dir, "api", "service.proto")})
+		if err != nil {
+			t.Fatalf("ParseFiles: %v", err)
+		}
+		fds, err := gendesc.Generate(fs)
+		if err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+		if got := fds.File[len(fds.File)-1].GetName(); got != "api/service.proto" {
+			t.Errorf("Input file is named %q, want %q", got, "api/service.proto")
+		}
+		b, err := proto.Marshal(fds)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		text, raw = append(text, proto.MarshalTextString(fds)), append(raw, b)
+	}
+	if text[0] != text[1] || !bytes.Equal(raw[0], raw[1]) {
+		t.Errorf("Two compilations produced different descriptors:\n%s\n%s", text[0], text[1])
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{ImportPaths: []string{"testdata.zip", "protos"}}
+	tests := []struct {
+		in, want string
+	}{
+		{"foo/bar.proto", "foo/bar.proto"},
+		{"./protos/foo/bar.proto", "foo/bar.proto"},
+		{filepath.Join(wd, "protos", "bar.proto"), "bar.proto"},
+		{"../bar.proto", ""},
+	}
+	for _, tt := range tests {
+		got, err := c.CanonicalName(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("CanonicalName(%q) = %q, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("CanonicalName(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
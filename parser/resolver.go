@@ -10,11 +10,12 @@ import (
 	"github.com/dsymonds/gotoc/ast"
 )
 
-func resolveSymbols(fset *ast.FileSet) error {
-	r := &resolver{fset: fset}
-	s := new(scope)
-	s.push(fset)
+func resolveSymbols(fset *ast.FileSet, symbols func(string) interface{}) error {
+	r := &resolver{symbols: symbols}
 	for _, f := range fset.Files {
+		// Each file can only refer to what is visible to it.
+		s := new(scope)
+		s.push(&ast.FileSet{Files: visibleFiles(fset, f)})
 		if err := r.resolveFile(s, f); err != nil {
 			return err
 		}
@@ -22,6 +23,37 @@ func resolveSymbols(fset *ast.FileSet) error {
 	return nil
 }
 
+// visibleFiles returns the files in fset whose declarations f can refer to,
+// in the order they are in fset. As in protoc, these are f, the files it
+// imports, and the files that any of those publicly import, transitively.
+func visibleFiles(fset *ast.FileSet, f *ast.File) []*ast.File {
+	byName := make(map[string]*ast.File)
+	for _, g := range fset.Files {
+		byName[g.Name] = g
+	}
+	visible := map[*ast.File]bool{f: true}
+	var add func(g *ast.File)
+	add = func(g *ast.File) {
+		if g == nil || visible[g] {
+			return
+		}
+		visible[g] = true
+		for _, i := range g.PublicImports {
+			add(byName[g.Imports[i]])
+		}
+	}
+	for _, imp := range f.Imports {
+		add(byName[imp])
+	}
+	var files []*ast.File
+	for _, g := range fset.Files {
+		if visible[g] {
+			files = append(files, g)
+		}
+	}
+	return files
+}
+
 // A scope represents the context of the traversal.
 type scope struct {
 	// Valid types: FileSet, File, Message, Enum
@@ -63,24 +95,40 @@ func (s *scope) findName(name string) []interface{} {
 				fs := s.dup()
 				fs.push(f)
 				ret = append(ret, fs.findName(name)...)
-			} else {
-				// Match on package name
-				// TODO: fix this for dotted package names
-				if f.Package[0] == name {
-					return []interface{}{f}
-				}
+			} else if f.Package[0] == name {
+				// Match on the first component of the package name;
+				// matchNameComponents matches the rest.
+				ret = append(ret, f)
 			}
 		}
 		return ret
 	case *ast.File:
-		for _, msg := range ov.Messages {
-			if msg.Name == name {
-				return []interface{}{msg}
+		files := []*ast.File{ov}
+		if fset, ok := s.objects[0].(*ast.FileSet); ok && len(ov.Package) > 0 {
+			// Names from other files in the same package are also visible.
+			for _, f := range fset.Files {
+				if f != ov && strings.Join(f.Package, ".") == strings.Join(ov.Package, ".") {
+					files = append(files, f)
+				}
 			}
 		}
-		for _, enum := range ov.Enums {
-			if enum.Name == name {
-				return []interface{}{enum}
+		for _, f := range files {
+			for _, msg := range f.Messages {
+				if msg.Name == name {
+					return []interface{}{msg}
+				}
+			}
+			for _, enum := range f.Enums {
+				if enum.Name == name {
+					return []interface{}{enum}
+				}
+			}
+			// Services aren't types, but their names are in scope,
+			// so that using one as a type can be reported.
+			for _, srv := range f.Services {
+				if srv.Name == name {
+					return []interface{}{srv}
+				}
 			}
 		}
 	case *ast.Message:
@@ -115,7 +163,7 @@ func (s *scope) fullName() string {
 }
 
 type resolver struct {
-	fset *ast.FileSet
+	symbols func(string) interface{} // see Config.Symbols
 }
 
 func (r *resolver) resolveFile(s *scope, f *ast.File) error {
@@ -125,25 +173,26 @@ func (r *resolver) resolveFile(s *scope, f *ast.File) error {
 	// Resolve messages.
 	for _, msg := range f.Messages {
 		if err := r.resolveMessage(fs, msg); err != nil {
-			return fmt.Errorf("(%v): %v", msg.Name, err)
+			return err
 		}
 	}
 	// Resolve messages in services.
 	for _, srv := range f.Services {
 		for _, mth := range srv.Methods {
 			if err := r.resolveMethod(fs, mth); err != nil {
-				return fmt.Errorf("(%s.%s): %v", srv.Name, mth.Name, err)
+				return err
 			}
 		}
 	}
 	// Resolve types in extensions.
 	for _, ext := range f.Extensions {
 		if err := r.resolveExtension(fs, ext); err != nil {
-			return fmt.Errorf("(ext %s): %v", ext.Extendee, err)
+			return err
 		}
 	}
-
-	// TODO: resolve other types.
+	// Enums refer to no other types, so there is nothing else to resolve.
+	// Groups are nested messages, and oneof members are fields of their
+	// messages, so those are resolved with the rest of each message.
 
 	return nil
 }
@@ -177,15 +226,24 @@ func (r *resolver) resolveMessage(s *scope, msg *ast.Message) error {
 
 	// Resolve fields.
 	for _, field := range msg.Fields {
-		ft, ok := r.resolveFieldTypeName(ms, field.TypeName)
-		if !ok {
-			return fmt.Errorf("failed to resolve name %q", field.TypeName)
+		if field.Type != nil {
+			// already resolved (e.g. the AST was built from a descriptor)
+			continue
+		}
+		if err := r.resolveFieldType(ms, field, "message "+ms.fullName()[1:]); err != nil {
+			return err
+		}
+		if enum, ok := field.Type.(*ast.Enum); ok && isProto3(msg.File()) && !isProto3(enum.File()) {
+			// proto2 enums are closed, which proto3 messages can't represent.
+			return errorAt(field, "enum type %q is not a proto3 enum, but is used in %q which is a proto3 message type", field.TypeName, msg.Name)
+		}
+		if err := checkDefault(field); err != nil {
+			return err
 		}
-		field.Type = ft
 
 		if ktn := field.KeyTypeName; ktn != "" {
 			if !validMapKeyTypes[ktn] {
-				return fmt.Errorf("invalid map key type %q", ktn)
+				return errorAt(field, "invalid map key type %q", ktn)
 			}
 			field.KeyType = fieldTypeInverseMap[ktn]
 		}
@@ -205,76 +263,198 @@ func (r *resolver) resolveMessage(s *scope, msg *ast.Message) error {
 	return nil
 }
 
-func (r *resolver) resolveFieldTypeName(s *scope, name string) (interface{}, bool) {
-	if ft, ok := fieldTypeInverseMap[name]; ok {
+// resolveFieldType sets the type of f, which is used in from
+// (e.g. "message foo.Bar"), as written in error messages.
+func (r *resolver) resolveFieldType(s *scope, f *ast.Field, from string) error {
+	if ft, ok := fieldTypeInverseMap[f.TypeName]; ok {
 		// field is a primitive type
-		return ft, true
+		f.Type = ft
+		return nil
 	}
 	// field must be a named type, message or enum
-	o := r.resolveName(s, name)
-	if o != nil {
-		//log.Printf("(resolved %q to %q)", name, o.fullName())
-		return o.last(), true
+	o := r.resolveName(s, f.TypeName)
+	if o == nil {
+		return errorAt(f, "unresolved type %q (referenced from %s)", f.TypeName, from)
+	}
+	switch x := o.last().(type) {
+	case *ast.Message, *ast.Enum:
+		f.Type = x
+		return nil
 	}
-	return nil, false
+	return errorAt(f, "%q is %s, not a type (referenced from %s)", f.TypeName, describe(o.last()), from)
 }
 
 func (r *resolver) resolveMethod(s *scope, mth *ast.Method) error {
-	o := r.resolveName(s, mth.InTypeName)
-	if o == nil {
-		return fmt.Errorf("failed to resolve name %q", mth.InTypeName)
+	// Either type may be resolved already (e.g. the AST was built from a descriptor).
+	var err error
+	if mth.InType == nil {
+		if mth.InType, err = r.resolveMethodType(s, mth, "input", mth.InTypeName); err != nil {
+			return err
+		}
 	}
-	mth.InType = o.last()
-
-	o = r.resolveName(s, mth.OutTypeName)
-	if o == nil {
-		return fmt.Errorf("failed to resolve name %q", mth.OutTypeName)
+	if mth.OutType == nil {
+		if mth.OutType, err = r.resolveMethodType(s, mth, "output", mth.OutTypeName); err != nil {
+			return err
+		}
 	}
-	mth.OutType = o.last()
-
 	return nil
 }
 
-func (r *resolver) resolveExtension(s *scope, ext *ast.Extension) error {
-	o := r.resolveName(s, ext.Extendee)
+// resolveMethodType resolves the input or output type of a method,
+// which must be a message.
+func (r *resolver) resolveMethodType(s *scope, mth *ast.Method, which, name string) (interface{}, error) {
+	o := r.resolveName(s, name)
 	if o == nil {
-		return fmt.Errorf("failed to resolve name %q", ext.Extendee)
+		return nil, errorAt(mth, "unresolved type %q (referenced from method %s.%s)", name, mth.Up.Name, mth.Name)
 	}
-	m, ok := o.last().(*ast.Message)
-	if !ok {
-		return fmt.Errorf("extendee %q resolved to non-message %T", ext.Extendee, o.last())
+	if _, ok := o.last().(*ast.Message); !ok {
+		return nil, errorAt(mth, "%s type %q is %s, not a message (method %s.%s)", which, name, describe(o.last()), mth.Up.Name, mth.Name)
+	}
+	return o.last(), nil
+}
+
+func (r *resolver) resolveExtension(s *scope, ext *ast.Extension) error {
+	m := ext.ExtendeeType
+	if m == nil {
+		o := r.resolveName(s, ext.Extendee)
+		if o == nil {
+			return errorAt(ext, "unresolved extendee %q", ext.Extendee)
+		}
+		var ok bool
+		m, ok = o.last().(*ast.Message)
+		if !ok {
+			return errorAt(ext, "extendee %q is %s, not a message", ext.Extendee, describe(o.last()))
+		}
+		ext.ExtendeeType = m
 	}
-	ext.ExtendeeType = m
 	// Resolve fields.
 	for _, field := range ext.Fields {
-		ft, ok := r.resolveFieldTypeName(s, field.TypeName)
-		if !ok {
-			return fmt.Errorf("failed to resolve name %q", field.TypeName)
+		if field.Type != nil {
+			// already resolved (e.g. the AST was built from a descriptor)
+			continue
+		}
+		if !inRanges(field.Tag, m.ExtensionRanges) {
+			return errorAt(field, "%s does not declare %d as an extension number (field %s)", ext.Extendee, field.Tag, field.Name)
+		}
+		if err := r.resolveFieldType(s, field, "extension of "+ext.Extendee); err != nil {
+			return err
+		}
+		if err := checkDefault(field); err != nil {
+			return err
 		}
-		field.Type = ft
 
 		// TODO: Map fields should be forbidden?
 	}
 	return nil
 }
 
+// resolveName finds the message or enum that name refers to in s.
+// It follows protoc's rules: a fully-qualified name (with a leading dot)
+// is looked up from the root. Otherwise the first component of the name
+// is looked for in s, then in each enclosing scope (including each
+// enclosing package) in turn. Once it is found, the rest of the name
+// must be found in what it refers to, without trying any further scopes.
 func (r *resolver) resolveName(s *scope, name string) *scope {
+	root := &scope{objects: s.objects[:1]}
+	if strings.HasPrefix(name, ".") {
+		if os := matchNameComponents(root, strings.Split(name[1:], ".")); os != nil {
+			return os
+		}
+		return r.provideName(s, name)
+	}
 	parts := strings.Split(name, ".")
 
-	// Move up the scope, finding a place where the name makes sense.
-	for ws := s.dup(); !ws.global(); ws.pop() {
-		//log.Printf("Trying to resolve %q in %q", name, ws.fullName())
-		if os := matchNameComponents(ws, parts); os != nil {
+	var enclosing []string // the full name of s, split into components
+	if fn := s.fullName(); fn != "." {
+		enclosing = strings.Split(fn[1:], ".")
+	}
+	for i := len(enclosing); i >= 0; i-- {
+		prefix := enclosing[:i:i]
+		os := matchNameComponents(root, append(prefix, parts[0]))
+		if len(parts) == 1 {
+			if os != nil {
+				if _, ok := os.last().(*ast.File); !ok {
+					return os
+				}
+			}
+			// Only types are wanted; a package of this name doesn't hide one further out.
+			continue
+		}
+		if os == nil && !isPackage(root.objects[0].(*ast.FileSet), append(prefix, parts[0])) {
+			continue
+		}
+		full := append(prefix, parts...)
+		if os := matchNameComponents(root, full); os != nil {
 			return os
 		}
+		return r.provide(strings.Join(full, "."))
+	}
+
+	return r.provideName(s, name)
+}
+
+// isPackage reports whether parts are the components of the package of a file
+// in fset, or the leading components of one (e.g. "foo" for package foo.bar).
+func isPackage(fset *ast.FileSet, parts []string) bool {
+	for _, f := range fset.Files {
+		if len(f.Package) >= len(parts) && strings.Join(f.Package[:len(parts)], ".") == strings.Join(parts, ".") {
+			return true
+		}
 	}
+	return false
+}
 
+// provideName asks the symbol provider, if any, for a name not found in the FileSet.
+func (r *resolver) provideName(s *scope, name string) *scope {
+	if r.symbols == nil {
+		return nil
+	}
+	var candidates []string
+	if strings.HasPrefix(name, ".") {
+		candidates = []string{name[1:]}
+	} else {
+		for ws := s.dup(); !ws.global(); ws.pop() {
+			fullName := name
+			if prefix := ws.fullName(); prefix != "." {
+				fullName = prefix[1:] + "." + name
+			}
+			if n := len(candidates); n == 0 || candidates[n-1] != fullName {
+				candidates = append(candidates, fullName)
+			}
+		}
+	}
+	for _, fullName := range candidates {
+		if os := r.provide(fullName); os != nil {
+			return os
+		}
+	}
 	return nil // failed
 }
 
+// provide asks the symbol provider, if any, for the type with the given full name,
+// which has no leading dot.
+func (r *resolver) provide(fullName string) *scope {
+	if r.symbols == nil {
+		return nil
+	}
+	switch o := r.symbols(fullName).(type) {
+	case *ast.Message, *ast.Enum:
+		return &scope{objects: []interface{}{o}}
+	}
+	return nil
+}
+
 func matchNameComponents(s *scope, parts []string) *scope {
 	first, rem := parts[0], parts[1:]
 	for _, o := range s.findName(first) {
+		rem := rem
+		if f, ok := o.(*ast.File); ok && len(f.Package) > 1 {
+			pkg := f.Package[1:]
+			if len(rem) < len(pkg) || strings.Join(rem[:len(pkg)], ".") != strings.Join(pkg, ".") {
+				continue
+			}
+			rem = rem[len(pkg):]
+		}
 		os := s.dup()
 		os.push(o)
 		if len(rem) == 0 {
@@ -287,3 +467,59 @@ func matchNameComponents(s *scope, parts []string) *scope {
 	}
 	return nil
 }
+
+// checkDefault checks the default value, if any, of a field whose type
+// has just been resolved. That of an enum field must name one of its values.
+func checkDefault(f *ast.Field) error {
+	if !f.HasDefault {
+		return nil
+	}
+	switch t := f.Type.(type) {
+	case *ast.Enum:
+		for _, ev := range t.Values {
+			if ev.Name == f.Default {
+				return nil
+			}
+		}
+		return errorAt(f, "enum type %q has no value named %q (default of field %s)", f.TypeName, f.Default, f.Name)
+	case *ast.Message:
+		return errorAt(f, "messages can't have default values (field %s)", f.Name)
+	}
+	return nil
+}
+
+func isProto3(f *ast.File) bool { return f.Syntax == "proto3" }
+
+// describe returns a phrase describing what x is, for error messages.
+func describe(x interface{}) string {
+	switch x.(type) {
+	case *ast.Message:
+		return "a message"
+	case *ast.Enum:
+		return "an enum"
+	case *ast.Service:
+		return "a service"
+	}
+	return fmt.Sprintf("a %T", x)
+}
+
+// errorAt returns an error reported at the position of n.
+func errorAt(n ast.Node, format string, a ...interface{}) error {
+	pos := n.Pos()
+	return &parseError{
+		message:  fmt.Sprintf(format, a...),
+		filename: n.File().Name,
+		line:     pos.Line,
+		offset:   pos.Offset,
+	}
+}
+
+// inRanges reports whether tag is in one of ranges, which are inclusive at both ends.
+func inRanges(tag int, ranges [][2]int) bool {
+	for _, r := range ranges {
+		if r[0] <= tag && tag <= r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,284 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dsymonds/gotoc/ast"
+)
+
+// optionsMessages are the messages that proto3 files may extend,
+// to define custom options.
+var optionsMessages = map[string]bool{
+	"FileOptions":           true,
+	"MessageOptions":        true,
+	"FieldOptions":          true,
+	"OneofOptions":          true,
+	"EnumOptions":           true,
+	"EnumValueOptions":      true,
+	"ServiceOptions":        true,
+	"MethodOptions":         true,
+	"ExtensionRangeOptions": true,
+}
+
+// validate checks rules that the grammar doesn't capture, such as those
+// that depend on a file's syntax. It is done before resolution.
+func validate(f *ast.File) error {
+	v := &validator{f: f, proto3: f.Syntax == "proto3"}
+	for _, m := range f.Messages {
+		if v.proto3 && m.Group {
+			v.errorf(m.Position, "groups are not allowed in proto3 (group %s)", m.Name)
+		}
+		v.message(m)
+	}
+	for _, enum := range f.Enums {
+		v.enum(enum)
+	}
+	for _, ext := range f.Extensions {
+		v.extension(ext)
+	}
+	if v.err != nil {
+		return v.err
+	}
+	return nil
+}
+
+type validator struct {
+	f      *ast.File
+	proto3 bool
+	err    *parseError // the first error found
+}
+
+func (v *validator) errorf(pos ast.Position, format string, a ...interface{}) {
+	if v.err != nil {
+		return
+	}
+	v.err = &parseError{
+		message:  fmt.Sprintf(format, a...),
+		filename: v.f.Name,
+		line:     pos.Line,
+		offset:   pos.Offset,
+	}
+}
+
+func (v *validator) message(m *ast.Message) {
+	if v.proto3 && len(m.ExtensionRanges) > 0 {
+		v.errorf(m.Position, "extension ranges are not allowed in proto3 (message %s)", m.Name)
+	}
+	v.memberNames(m)
+	v.tags(m)
+	for _, f := range m.Fields {
+		v.field(f)
+	}
+	for _, nm := range m.Messages {
+		if v.proto3 && nm.Group {
+			pos := nm.Position
+			for _, f := range m.Fields {
+				if f.TypeName == nm.Name {
+					pos = f.Position
+				}
+			}
+			v.errorf(pos, "groups are not allowed in proto3 (group %s)", nm.Name)
+		}
+		v.message(nm)
+	}
+	for _, enum := range m.Enums {
+		v.enum(enum)
+	}
+	for _, ext := range m.Extensions {
+		v.extension(ext)
+	}
+}
+
+// memberNames checks that the fields and oneofs of a message have distinct
+// names. Oneof members are fields of the message too, so this also
+// catches clashes between members of different oneofs.
+func (v *validator) memberNames(m *ast.Message) {
+	seen := make(map[string]ast.Position)
+	check := func(name string, pos ast.Position) {
+		if prev, ok := seen[name]; ok {
+			v.errorf(pos, "%q is already defined in message %s (at line %d)", name, m.Name, prev.Line)
+			return
+		}
+		seen[name] = pos
+	}
+	groups := make(map[string]bool)
+	for _, nm := range m.Messages {
+		if nm.Group {
+			groups[nm.Name] = true
+		}
+	}
+	for _, f := range m.Fields {
+		name := f.Name
+		if f.TypeName == f.Name && groups[f.Name] {
+			// A group's field is named after the group, lower-cased.
+			name = ast.GroupFieldName(name)
+		}
+		check(name, f.Position)
+	}
+	for _, oo := range m.Oneofs {
+		check(oo.Name, oo.Position)
+	}
+}
+
+// tags checks that the fields of a message have distinct tags,
+// none of which fall in the message's extension or reserved ranges.
+func (v *validator) tags(m *ast.Message) {
+	seen := make(map[int]*ast.Field)
+	for _, f := range m.Fields {
+		if prev, ok := seen[f.Tag]; ok {
+			v.errorf(f.Position, "field %s in message %s has tag %d, which is already used by field %s", f.Name, m.Name, f.Tag, prev.Name)
+			continue
+		}
+		seen[f.Tag] = f
+		for _, r := range m.ExtensionRanges {
+			if r[0] <= f.Tag && f.Tag <= r[1] {
+				v.errorf(f.Position, "field %s in message %s has tag %d, which is in the extension range %s", f.Name, m.Name, f.Tag, formatRange(r))
+			}
+		}
+		for _, r := range m.ReservedRanges {
+			if r[0] <= f.Tag && f.Tag <= r[1] {
+				v.errorf(f.Position, "field %s in message %s has tag %d, which is in the reserved range %s", f.Name, m.Name, f.Tag, formatRange(r))
+			}
+		}
+	}
+}
+
+// formatRange formats an inclusive range of field numbers as it would be written.
+func formatRange(r [2]int) string {
+	switch {
+	case r[0] == r[1]:
+		return fmt.Sprint(r[0])
+	case r[1] == maxFieldNumber:
+		return fmt.Sprintf("%d to max", r[0])
+	}
+	return fmt.Sprintf("%d to %d", r[0], r[1])
+}
+
+func (v *validator) field(f *ast.Field) {
+	if f.KeyTypeName != "" {
+		v.mapField(f)
+	}
+	if v.proto3 && f.Required {
+		v.errorf(f.Position, "required fields are not allowed in proto3 (field %s)", f.Name)
+	}
+	if v.proto3 && f.HasDefault {
+		v.errorf(f.Position, "default values are not allowed in proto3 (field %s)", f.Name)
+	}
+}
+
+func (v *validator) mapField(f *ast.Field) {
+	if f.Oneof != nil {
+		v.errorf(f.Position, "map fields are not allowed in oneofs (field %s)", f.Name)
+	}
+	if _, ok := f.Up.(*ast.Extension); ok {
+		v.errorf(f.Position, "map fields are not allowed to be extensions (field %s)", f.Name)
+	}
+	if !validMapKeyTypes[f.KeyTypeName] {
+		if _, ok := fieldTypeInverseMap[f.KeyTypeName]; ok {
+			v.errorf(f.Position, "key in map fields cannot be float/double, bytes or message types (field %s)", f.Name)
+		} else {
+			v.errorf(f.Position, "key in map fields cannot be enum or message types (field %s)", f.Name)
+		}
+	}
+}
+
+// enum checks that the first value of a proto3 enum is zero,
+// which proto3 uses as the default for its open enums.
+func (v *validator) enum(enum *ast.Enum) {
+	if !v.proto3 || len(enum.Values) == 0 {
+		return
+	}
+	if ev := enum.Values[0]; ev.Number != 0 {
+		v.errorf(ev.Position, "the first value of a proto3 enum must be zero (%s.%s = %d)", enum.Name, ev.Name, ev.Number)
+	}
+}
+
+// extension checks that a proto3 extension extends one of the options
+// messages, which is the only use of extensions that proto3 permits.
+func (v *validator) extension(ext *ast.Extension) {
+	name := strings.TrimPrefix(ext.Extendee, ".")
+	if strings.HasPrefix(name, "google.protobuf.") {
+		name = strings.TrimPrefix(name, "google.protobuf.")
+	} else if strings.Join(v.f.Package, ".") != "google.protobuf" {
+		name = ""
+	}
+	if v.proto3 && !optionsMessages[name] {
+		v.errorf(ext.Position, "extensions in proto3 must extend an options message, not %s", ext.Extendee)
+	}
+	for _, f := range ext.Fields {
+		v.field(f)
+	}
+}
+
+// checkDeclarations checks that the messages, enums and services in fset
+// have distinct full names, which are also not the names of packages.
+// Packages may be shared by any number of files, and include the packages
+// that enclose them (e.g. "a" encloses a.b).
+func checkDeclarations(fset *ast.FileSet) error {
+	pkgs := make(map[string]string) // package name => first file to declare it
+	for _, f := range fset.Files {
+		for i := range f.Package {
+			name := strings.Join(f.Package[:i+1], ".")
+			if _, ok := pkgs[name]; !ok {
+				pkgs[name] = f.Name
+			}
+		}
+	}
+
+	seen := make(map[string]ast.Node)
+	for _, f := range fset.Files {
+		prefix := strings.Join(f.Package, ".")
+		var decls []ast.Node
+		var names []string
+		var add func(prefix string, n ast.Node, name string, msgs []*ast.Message, enums []*ast.Enum)
+		add = func(prefix string, n ast.Node, name string, msgs []*ast.Message, enums []*ast.Enum) {
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			decls, names = append(decls, n), append(names, name)
+			for _, m := range msgs {
+				add(name, m, m.Name, m.Messages, m.Enums)
+			}
+			for _, enum := range enums {
+				add(name, enum, enum.Name, nil, nil)
+			}
+		}
+		for _, m := range f.Messages {
+			add(prefix, m, m.Name, m.Messages, m.Enums)
+		}
+		for _, enum := range f.Enums {
+			add(prefix, enum, enum.Name, nil, nil)
+		}
+		for _, srv := range f.Services {
+			add(prefix, srv, srv.Name, nil, nil)
+		}
+		// Report the later of two declarations in the same file.
+		order := make([]int, len(decls))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool { return decls[order[i]].Pos().Before(decls[order[j]].Pos()) })
+
+		for _, i := range order {
+			n, name := decls[i], names[i]
+			if file, ok := pkgs[name]; ok {
+				return errorAt(n, "%q is declared as both %s and a package (in %s)", name, declKind(n), file)
+			}
+			if prev, ok := seen[name]; ok {
+				return errorAt(n, "%q is already defined as %s (at %s:%d)", name, declKind(prev), prev.File().Name, prev.Pos().Line)
+			}
+			seen[name] = n
+		}
+	}
+	return nil
+}
+
+// declKind describes what n declares, for error messages.
+func declKind(n ast.Node) string {
+	if m, ok := n.(*ast.Message); ok && m.Group {
+		return "a group"
+	}
+	return describe(n)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+
+	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/dsymonds/gotoc/generator"
+)
+
+// pluginName is the name under which gotoc acts as a protoc plugin
+// without being given the plugin subcommand.
+const pluginName = "protoc-gen-gotoc"
+
+// isPlugin reports whether gotoc was invoked as a protoc plugin.
+func isPlugin() bool {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	return name == pluginName
+}
+
+// runPlugin acts as a protoc plugin, reading a CodeGeneratorRequest from
+// stdin and writing a CodeGeneratorResponse to stdout.
+func runPlugin(args []string) {
+	if len(args) != 0 {
+		fatalf("The plugin subcommand takes no arguments; configure it with the plugin parameter")
+	}
+	if err := pluginMain(os.Stdin, os.Stdout); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// pluginMain handles a request from protoc. The request's parameter is a
+// comma-separated list, whose elements are:
+//
+//	generator=NAME		run this generator (compiled-in, or a plugin binary);
+//				may be repeated to run several
+//	strip_source_retention	remove source-retention options before generating
+//
+// Other elements are passed on to each generator as its parameter.
+// The response holds the files produced by all the generators, in order.
+func pluginMain(in io.Reader, out io.Writer) error {
+	raw, err := ioutil.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("reading request: %v", err)
+	}
+	req := new(plugin.CodeGeneratorRequest)
+	if err := proto.Unmarshal(raw, req); err != nil {
+		return fmt.Errorf("bad request: %v", err)
+	}
+	resp := handlePluginRequest(req)
+	raw, err = proto.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("encoding response: %v", err)
+	}
+	_, err = out.Write(raw)
+	return err
+}
+
+func handlePluginRequest(req *plugin.CodeGeneratorRequest) *plugin.CodeGeneratorResponse {
+	var gens, params []string
+	strip := false
+	for _, p := range strings.Split(req.GetParameter(), ",") {
+		switch {
+		case p == "":
+		case strings.HasPrefix(p, "generator="):
+			gens = append(gens, p[len("generator="):])
+		case p == "strip_source_retention":
+			strip = true
+		default:
+			params = append(params, p)
+		}
+	}
+	if len(gens) == 0 {
+		return &plugin.CodeGeneratorResponse{Error: proto.String("no generator=NAME in parameter")}
+	}
+	if strip {
+		gendesc.StripSourceRetention(&pb.FileDescriptorSet{File: req.ProtoFile})
+	}
+
+	subReq := &plugin.CodeGeneratorRequest{
+		FileToGenerate: req.FileToGenerate,
+		ProtoFile:      req.ProtoFile,
+	}
+	if len(params) > 0 {
+		subReq.Parameter = proto.String(strings.Join(params, ","))
+	}
+	resp := new(plugin.CodeGeneratorResponse)
+	for _, g := range gens {
+		subResp, err := generator.Run(g, subReq)
+		if err != nil {
+			return &plugin.CodeGeneratorResponse{Error: proto.String(fmt.Sprintf("%s: %v", g, err))}
+		}
+		if subResp.Error != nil {
+			return &plugin.CodeGeneratorResponse{Error: proto.String(fmt.Sprintf("%s: %s", g, subResp.GetError()))}
+		}
+		resp.File = append(resp.File, subResp.File...)
+	}
+	return resp
+}
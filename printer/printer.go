@@ -0,0 +1,520 @@
+/*
+Package printer formats an AST as .proto source.
+*/
+package printer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dsymonds/gotoc/ast"
+)
+
+// maxTag is the largest field number, written as "max" in ranges.
+const maxTag = 1<<29 - 1
+
+// Fprint writes f to w as .proto source.
+// Comments are kept: those on the same line as a declaration stay there,
+// and others are placed before the declaration that follows them.
+// A comment starting on the first line stays at the top of the file.
+func Fprint(w io.Writer, f *ast.File) error {
+	p := &printer{f: f}
+	p.placeComments()
+	p.file()
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+// Format returns f as .proto source.
+func Format(f *ast.File) []byte {
+	var buf bytes.Buffer
+	Fprint(&buf, f)
+	return buf.Bytes()
+}
+
+type printer struct {
+	f      *ast.File
+	buf    bytes.Buffer
+	indent int
+
+	inline   map[*ast.Comment]bool       // comments on the same line as a node
+	detached map[ast.Node][]*ast.Comment // other comments, keyed by the node that follows them
+	header   []*ast.Comment              // comment at the top of the file
+	trailing []*ast.Comment              // comments after the last node
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	p.buf.WriteString(strings.Repeat("  ", p.indent))
+	fmt.Fprintf(&p.buf, format, args...)
+	p.buf.WriteString("\n")
+}
+
+// line is like printf, but appends n's inline comment, if any.
+func (p *printer) line(n ast.Node, format string, args ...interface{}) {
+	s := fmt.Sprintf(format, args...)
+	if len(p.f.Comments) > 0 {
+		if c := ast.InlineComment(n); c != nil {
+			s += " //"
+			if c.Text[0] != "" {
+				s += " " + c.Text[0]
+			}
+		}
+	}
+	p.printf("%s", s)
+}
+
+func (p *printer) commentText(c *ast.Comment) {
+	for _, line := range c.Text {
+		if line == "" {
+			p.printf("//")
+		} else {
+			p.printf("// %s", line)
+		}
+	}
+}
+
+// placeComments decides where each of the file's comments will be printed.
+func (p *printer) placeComments() {
+	if len(p.f.Comments) == 0 {
+		return
+	}
+	var nodes []ast.Node
+	walk(p.f, func(n ast.Node) { nodes = append(nodes, n) })
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Pos().Line < nodes[j].Pos().Line })
+
+	p.inline = make(map[*ast.Comment]bool)
+	p.detached = make(map[ast.Node][]*ast.Comment)
+	leading := make(map[*ast.Comment]bool)
+	for _, n := range nodes {
+		if c := ast.InlineComment(n); c != nil {
+			p.inline[c] = true
+		}
+	}
+	for _, n := range nodes {
+		if c := ast.LeadingComment(n); c != nil && !p.inline[c] {
+			leading[c] = true
+		}
+	}
+	for _, c := range p.f.Comments {
+		if p.inline[c] || leading[c] {
+			continue
+		}
+		i := sort.Search(len(nodes), func(i int) bool { return nodes[i].Pos().Line > c.End.Line })
+		switch {
+		case c.Start.Line == 1:
+			// Probably a copyright notice or file description.
+			p.header = append(p.header, c)
+		case i == len(nodes):
+			p.trailing = append(p.trailing, c)
+		default:
+			p.detached[nodes[i]] = append(p.detached[nodes[i]], c)
+		}
+	}
+}
+
+// walk calls fn for each node in f that can have comments attached.
+func walk(f *ast.File, fn func(ast.Node)) {
+	var msg func(m *ast.Message)
+	ext := func(e *ast.Extension) {
+		fn(e)
+		for _, f := range e.Fields {
+			fn(f)
+		}
+	}
+	enum := func(e *ast.Enum) {
+		fn(e)
+		for _, v := range e.Values {
+			fn(v)
+		}
+	}
+	msg = func(m *ast.Message) {
+		if !m.Group {
+			fn(m)
+		}
+		for _, f := range m.Fields {
+			fn(f)
+		}
+		for _, e := range m.Extensions {
+			ext(e)
+		}
+		for _, nm := range m.Messages {
+			msg(nm)
+		}
+		for _, e := range m.Enums {
+			enum(e)
+		}
+	}
+	for _, m := range f.Messages {
+		msg(m)
+	}
+	for _, e := range f.Enums {
+		enum(e)
+	}
+	for _, srv := range f.Services {
+		fn(srv)
+		for _, mth := range srv.Methods {
+			fn(mth)
+		}
+	}
+	for _, e := range f.Extensions {
+		ext(e)
+	}
+}
+
+// blank writes an empty line, unless at the start of output or a block.
+func (p *printer) blank() {
+	b := p.buf.Bytes()
+	if len(b) == 0 || bytes.HasSuffix(b, []byte("{\n")) || bytes.HasSuffix(b, []byte("\n\n")) {
+		return
+	}
+	p.buf.WriteString("\n")
+}
+
+// comment prints the comments that precede n.
+func (p *printer) comment(n ast.Node) {
+	if len(p.f.Comments) == 0 {
+		return
+	}
+	for _, c := range p.detached[n] {
+		p.commentText(c)
+		p.blank()
+	}
+	if c := ast.LeadingComment(n); c != nil && !p.inline[c] {
+		p.commentText(c)
+	}
+}
+
+func (p *printer) file() {
+	f := p.f
+	for _, c := range p.header {
+		p.commentText(c)
+		p.blank()
+	}
+	if f.Syntax != "" {
+		p.printf("syntax = %q;", f.Syntax)
+	}
+	if len(f.Package) > 0 {
+		p.blank()
+		p.printf("package %s;", strings.Join(f.Package, "."))
+	}
+	if len(f.Imports) > 0 {
+		p.blank()
+		kind := make(map[int]string)
+		for _, i := range f.PublicImports {
+			kind[i] = "public "
+		}
+		for _, i := range f.WeakImports {
+			kind[i] = "weak "
+		}
+		for i, imp := range f.Imports {
+			p.printf("import %s%q;", kind[i], imp)
+		}
+	}
+	if len(f.Options) > 0 {
+		p.blank()
+		for _, opt := range f.Options {
+			p.printf("option %s = %s;", opt[0], opt[1])
+		}
+	}
+	for _, msg := range f.Messages {
+		if msg.Group {
+			continue // printed with its extension field
+		}
+		p.blank()
+		p.message(msg)
+	}
+	for _, enum := range f.Enums {
+		p.blank()
+		p.enum(enum)
+	}
+	for _, srv := range f.Services {
+		p.blank()
+		p.service(srv)
+	}
+	for _, ext := range f.Extensions {
+		p.blank()
+		p.extension(ext)
+	}
+	for _, c := range p.trailing {
+		p.blank()
+		p.commentText(c)
+	}
+}
+
+func (p *printer) message(msg *ast.Message) {
+	p.comment(msg)
+	p.line(msg, "message %s {", msg.Name)
+	p.indent++
+	p.messageBody(msg)
+	p.indent--
+	p.printf("}")
+}
+
+func (p *printer) messageBody(msg *ast.Message) {
+	for _, opt := range msg.Options {
+		p.printf("option %s = %s;", opt[0], opt[1])
+	}
+	var oneof *ast.Oneof
+	for _, field := range msg.Fields {
+		if field.Oneof != oneof {
+			if oneof != nil {
+				p.indent--
+				p.printf("}")
+			}
+			oneof = field.Oneof
+			if oneof != nil {
+				p.printf("oneof %s {", oneof.Name)
+				p.indent++
+				for _, opt := range oneof.Options {
+					p.printf("option %s = %s;", opt[0], opt[1])
+				}
+			}
+		}
+		p.field(field)
+	}
+	if oneof != nil {
+		p.indent--
+		p.printf("}")
+	}
+	for _, r := range msg.ExtensionRanges {
+		p.printf("extensions %s;", formatRange(r, maxTag))
+	}
+	p.reserved(msg.ReservedRanges, msg.ReservedNames, maxTag)
+	for _, ext := range msg.Extensions {
+		p.blank()
+		p.extension(ext)
+	}
+	for _, nmsg := range msg.Messages {
+		if nmsg.Group {
+			continue // printed with its field
+		}
+		p.blank()
+		p.message(nmsg)
+	}
+	for _, enum := range msg.Enums {
+		p.blank()
+		p.enum(enum)
+	}
+}
+
+func (p *printer) field(f *ast.Field) {
+	p.comment(f)
+	label := ""
+	switch {
+	case f.KeyTypeName != "":
+		// Map fields are implicitly repeated.
+	case f.Required:
+		label = "required "
+	case f.Repeated:
+		label = "repeated "
+	case f.Optional, f.Oneof == nil && p.f.Syntax != "proto3":
+		label = "optional "
+	}
+
+	if group := groupOf(f); group != nil {
+		p.line(f, "%sgroup %s = %d {", label, group.Name, f.Tag)
+		p.indent++
+		p.messageBody(group)
+		p.indent--
+		p.printf("}")
+		return
+	}
+
+	typ := typeName(f.TypeName, f.Type)
+	if f.KeyTypeName != "" {
+		typ = fmt.Sprintf("map<%s, %s>", f.KeyTypeName, typ)
+	}
+	p.line(f, "%s%s %s = %d%s;", label, typ, f.Name, f.Tag, fieldOptions(f))
+}
+
+// groupOf returns the group message declared by f, or nil if f isn't a group.
+func groupOf(f *ast.Field) *ast.Message {
+	if m, ok := f.Type.(*ast.Message); ok {
+		if m.Group {
+			return m
+		}
+		return nil
+	}
+	// The group message is a sibling of the field,
+	// or of the extend block that the field is in.
+	var msgs []*ast.Message
+	switch up := f.Up.(type) {
+	case *ast.Message:
+		msgs = up.Messages
+	case *ast.Extension:
+		switch scope := up.Up.(type) {
+		case *ast.Message:
+			msgs = scope.Messages
+		case *ast.File:
+			msgs = scope.Messages
+		}
+	}
+	for _, m := range msgs {
+		if m.Group && m.Name == f.TypeName {
+			return m
+		}
+	}
+	return nil
+}
+
+// typeName returns the name to print for a type, preferring the name
+// as it was written in the source.
+func typeName(name string, typ interface{}) string {
+	if name != "" {
+		return name
+	}
+	switch t := typ.(type) {
+	case ast.FieldType:
+		return t.String()
+	case *ast.Message:
+		return qualifiedName(t.Name, t.Up)
+	case *ast.Enum:
+		return qualifiedName(t.Name, t.Up)
+	}
+	return "UNKNOWN"
+}
+
+func qualifiedName(name string, up interface{}) string {
+	parts := []string{name}
+	for {
+		switch u := up.(type) {
+		case *ast.Message:
+			parts = append([]string{u.Name}, parts...)
+			up = u.Up
+			continue
+		case *ast.File:
+			parts = append(append([]string(nil), u.Package...), parts...)
+		}
+		return "." + strings.Join(parts, ".")
+	}
+}
+
+func fieldOptions(f *ast.Field) string {
+	var opts []string
+	if f.HasDefault {
+		v := f.Default
+		if f.TypeName == "string" || f.TypeName == "bytes" || f.Type == ast.String || f.Type == ast.Bytes {
+			v = strconv.Quote(v)
+		}
+		opts = append(opts, "default = "+v)
+	}
+	if f.JSONName != "" {
+		opts = append(opts, "json_name = "+strconv.Quote(f.JSONName))
+	}
+	if f.HasPacked {
+		opts = append(opts, "packed = "+strconv.FormatBool(f.Packed))
+	}
+	for _, opt := range f.Options {
+		opts = append(opts, opt[0]+" = "+opt[1])
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(opts, ", ") + "]"
+}
+
+func (p *printer) enum(enum *ast.Enum) {
+	p.comment(enum)
+	p.line(enum, "enum %s {", enum.Name)
+	p.indent++
+	for _, opt := range enum.Options {
+		p.printf("option %s = %s;", opt[0], opt[1])
+	}
+	for _, v := range enum.Values {
+		p.comment(v)
+		var opts string
+		if len(v.Options) > 0 {
+			var kvs []string
+			for _, opt := range v.Options {
+				kvs = append(kvs, opt[0]+" = "+opt[1])
+			}
+			opts = " [" + strings.Join(kvs, ", ") + "]"
+		}
+		p.line(v, "%s = %d%s;", v.Name, v.Number, opts)
+	}
+	p.reserved(enum.ReservedRanges, enum.ReservedNames, math.MaxInt32)
+	p.indent--
+	p.printf("}")
+}
+
+// reserved prints reserved statements, with max standing for "max".
+func (p *printer) reserved(ranges [][2]int, names []string, max int) {
+	if len(ranges) > 0 {
+		var rs []string
+		for _, r := range ranges {
+			rs = append(rs, formatRange(r, max))
+		}
+		p.printf("reserved %s;", strings.Join(rs, ", "))
+	}
+	if len(names) > 0 {
+		var qs []string
+		for _, name := range names {
+			qs = append(qs, strconv.Quote(name))
+		}
+		p.printf("reserved %s;", strings.Join(qs, ", "))
+	}
+}
+
+// formatRange formats an inclusive range as in an extensions or reserved statement.
+func formatRange(r [2]int, max int) string {
+	switch {
+	case r[0] == r[1]:
+		return strconv.Itoa(r[0])
+	case r[1] == max:
+		return fmt.Sprintf("%d to max", r[0])
+	default:
+		return fmt.Sprintf("%d to %d", r[0], r[1])
+	}
+}
+
+func (p *printer) service(srv *ast.Service) {
+	p.comment(srv)
+	p.line(srv, "service %s {", srv.Name)
+	p.indent++
+	for _, opt := range srv.Options {
+		p.printf("option %s = %s;", opt[0], opt[1])
+	}
+	for _, mth := range srv.Methods {
+		p.comment(mth)
+		in, out := typeName(mth.InTypeName, mth.InType), typeName(mth.OutTypeName, mth.OutType)
+		if mth.ClientStreaming {
+			in = "stream " + in
+		}
+		if mth.ServerStreaming {
+			out = "stream " + out
+		}
+		if len(mth.Options) == 0 {
+			p.line(mth, "rpc %s(%s) returns (%s);", mth.Name, in, out)
+			continue
+		}
+		p.line(mth, "rpc %s(%s) returns (%s) {", mth.Name, in, out)
+		p.indent++
+		for _, opt := range mth.Options {
+			p.printf("option %s = %s;", opt[0], opt[1])
+		}
+		p.indent--
+		p.printf("}")
+	}
+	p.indent--
+	p.printf("}")
+}
+
+func (p *printer) extension(ext *ast.Extension) {
+	p.comment(ext)
+	extendee := ext.Extendee
+	if extendee == "" && ext.ExtendeeType != nil {
+		extendee = typeName("", ext.ExtendeeType)
+	}
+	p.line(ext, "extend %s {", extendee)
+	p.indent++
+	for _, f := range ext.Fields {
+		p.field(f)
+	}
+	p.indent--
+	p.printf("}")
+}
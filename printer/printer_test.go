@@ -0,0 +1,203 @@
+package printer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/dsymonds/gotoc/parser"
+)
+
+const proto2Src = `syntax = "proto2";
+
+package foo.bar;
+
+option go_package = "foopb";
+
+// A message with comments.
+message Outer {
+  required int32 a = 1 [default = 7];
+  repeated int32 b = 2 [packed = false];
+  optional string c = 3 [default = "hi \"there\""];
+  optional int64 d = 8 [json_name = "dee"];
+  optional group Result = 4 {
+    optional int64 x = 1;
+  }
+  oneof choice {
+    option (choice_opt) = true;
+    Inner inner = 5;
+    Kind kind = 6;
+  }
+  extensions 100 to 199;
+  extensions 1000 to max;
+  reserved 7, 9 to 11, 5000 to max;
+  reserved "old", "older";
+
+  message Inner {
+    option deprecated = true;
+    optional bool ok = 1;
+  }
+
+  enum Kind {
+    option allow_alias = true;
+    // The zero value.
+    UNKNOWN = 0;
+    OTHER = 1 [deprecated = true, (value_opt) = "x"];
+    reserved -5 to -1, 100 to max;
+  }
+}
+
+service Svc {
+  option deprecated = true;
+  rpc Get(Outer) returns (Outer.Inner);
+  rpc Put(Outer) returns (Outer) {
+    option deprecated = true;
+  }
+  rpc Watch(stream Outer) returns (stream Outer);
+}
+
+extend Outer {
+  optional int32 ext = 100;
+  optional group ExtGroup = 101 {
+    optional string s = 1;
+  }
+}
+`
+
+const proto3Src = `syntax = "proto3";
+
+package baz;
+
+message M {
+  map<string, int64> counts = 1;
+  repeated double values = 2;
+  N n = 3;
+  optional string label = 4;
+}
+
+message N {
+  bytes data = 1;
+}
+`
+
+// compile parses src as a file named name, and returns its descriptor.
+func compile(t *testing.T, name, src string) *pb.FileDescriptorProto {
+	dir, err := ioutil.TempDir("", "printer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := parser.ParseFiles([]string{name}, []string{dir})
+	if err != nil {
+		t.Fatalf("Parsing:\n%s\nfailed: %v", src, err)
+	}
+	fds, err := gendesc.Generate(fs)
+	if err != nil {
+		t.Fatalf("Generating descriptors: %v", err)
+	}
+	return fds.File[0]
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, src := range []string{proto2Src, proto3Src} {
+		f, err := parser.ParseFile("test.proto", []byte(src))
+		if err != nil {
+			t.Fatalf("ParseFile: %v", err)
+		}
+		out := string(Format(f))
+		if out != src {
+			t.Errorf("Format changed the source.\nGot:\n%s\nWant:\n%s", out, src)
+		}
+
+		want := compile(t, "test.proto", src)
+		got := compile(t, "test.proto", out)
+		if !proto.Equal(got, want) {
+			t.Errorf("Descriptors differ after printing.\nGot:\n%v\nWant:\n%v", got, want)
+		}
+	}
+}
+
+func TestResolvedNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "printer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.proto"), []byte(proto3Src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := parser.ParseFiles([]string{"test.proto"}, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the names from the source, resolved types are printed fully qualified.
+	f := fs.Files[0]
+	f.Messages[0].Fields[2].TypeName = ""
+	if out := string(Format(f)); !strings.Contains(out, "  .baz.N n = 3;\n") {
+		t.Errorf("Output doesn't use the qualified name:\n%s", out)
+	}
+}
+
+func TestComments(t *testing.T) {
+	const src = `// Copyright notice.
+
+syntax = "proto3";
+
+package c;
+
+// Detached comment.
+
+// Leading comment.
+message M {
+  int32 a = 1; // inline on a
+  // Leading on b.
+  int32 b = 2;
+  // Before the end of M.
+}
+
+enum E {
+  ZERO = 0; // zero
+}
+
+// At the end.
+`
+	const want = `// Copyright notice.
+
+syntax = "proto3";
+
+package c;
+
+// Detached comment.
+
+// Leading comment.
+message M {
+  int32 a = 1; // inline on a
+  // Leading on b.
+  int32 b = 2;
+}
+
+// Before the end of M.
+
+enum E {
+  ZERO = 0; // zero
+}
+
+// At the end.
+`
+	f, err := parser.ParseFile("c.proto", []byte(src))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	if got := string(Format(f)); got != want {
+		t.Errorf("Format:\n%s\nwant\n%s", got, want)
+	}
+}
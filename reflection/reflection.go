@@ -0,0 +1,159 @@
+/*
+Package reflection supplies imports by fetching their file descriptors
+from a running server's gRPC reflection service.
+*/
+package reflection
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/descast"
+)
+
+// codeNotFound is the gRPC status code for NOT_FOUND.
+const codeNotFound = 5
+
+// Importer fetches files from a gRPC reflection service.
+// Its Import method is suitable as a fallback for parser.ParseFilesWithFallback.
+type Importer struct {
+	addr string
+
+	conn   *grpc.ClientConn
+	stream rpb.ServerReflection_ServerReflectionInfoClient
+
+	fetched map[string]*pb.FileDescriptorProto // filename => descriptor, not yet converted
+	files   map[string]*ast.File               // filename => converted file
+}
+
+// NewImporter returns an Importer that talks to the server at addr (host:port).
+// No connection is made until a file is requested.
+func NewImporter(addr string) *Importer {
+	return &Importer{
+		addr:    addr,
+		fetched: make(map[string]*pb.FileDescriptorProto),
+		files:   make(map[string]*ast.File),
+	}
+}
+
+// Close closes the connection to the server, if one was made.
+func (imp *Importer) Close() error {
+	if imp.conn == nil {
+		return nil
+	}
+	imp.stream.CloseSend()
+	return imp.conn.Close()
+}
+
+// Import returns the named file, fetching it and any files it depends on
+// from the server. It returns a nil *ast.File if the server does not know the file.
+func (imp *Importer) Import(filename string) (*ast.File, error) {
+	if f, ok := imp.files[filename]; ok {
+		return f, nil
+	}
+	found, err := imp.fetch(filename)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	// Make sure the full transitive closure of dependencies is present,
+	// since the server is not required to send it all at once.
+	for more := true; more; {
+		more = false
+		for _, fdp := range imp.fetched {
+			for _, dep := range fdp.Dependency {
+				if _, ok := imp.files[dep]; ok {
+					continue
+				}
+				if _, ok := imp.fetched[dep]; ok {
+					continue
+				}
+				found, err := imp.fetch(dep)
+				if err != nil {
+					return nil, err
+				}
+				if !found {
+					return nil, fmt.Errorf("reflection server at %s does not know %s (needed by %s)", imp.addr, dep, fdp.GetName())
+				}
+				more = true
+			}
+		}
+	}
+
+	var fdps []*pb.FileDescriptorProto
+	for _, fdp := range imp.fetched {
+		fdps = append(fdps, fdp)
+	}
+	var deps []*ast.File
+	for _, f := range imp.files {
+		deps = append(deps, f)
+	}
+	files, err := descast.Files(fdps, deps)
+	if err != nil {
+		return nil, fmt.Errorf("converting descriptors from %s: %v", imp.addr, err)
+	}
+	for _, f := range files {
+		imp.files[f.Name] = f
+	}
+	imp.fetched = make(map[string]*pb.FileDescriptorProto)
+	return imp.files[filename], nil
+}
+
+// fetch asks the server for the named file, recording every descriptor it returns.
+// It reports whether the server knew the file.
+func (imp *Importer) fetch(filename string) (bool, error) {
+	if imp.conn == nil {
+		conn, err := grpc.Dial(imp.addr, grpc.WithInsecure())
+		if err != nil {
+			return false, fmt.Errorf("dialing reflection server %s: %v", imp.addr, err)
+		}
+		stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+		if err != nil {
+			conn.Close()
+			return false, fmt.Errorf("starting reflection stream to %s: %v", imp.addr, err)
+		}
+		imp.conn, imp.stream = conn, stream
+	}
+
+	req := &rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: filename},
+	}
+	if err := imp.stream.Send(req); err != nil {
+		return false, fmt.Errorf("requesting %s from %s: %v", filename, imp.addr, err)
+	}
+	resp, err := imp.stream.Recv()
+	if err != nil {
+		return false, fmt.Errorf("requesting %s from %s: %v", filename, imp.addr, err)
+	}
+	if er := resp.GetErrorResponse(); er != nil {
+		if er.ErrorCode == codeNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("requesting %s from %s: %s", filename, imp.addr, er.ErrorMessage)
+	}
+	fdr := resp.GetFileDescriptorResponse()
+	if fdr == nil {
+		return false, fmt.Errorf("requesting %s from %s: unexpected response type", filename, imp.addr)
+	}
+	found := false
+	for _, buf := range fdr.FileDescriptorProto {
+		fdp := new(pb.FileDescriptorProto)
+		if err := proto.Unmarshal(buf, fdp); err != nil {
+			return false, fmt.Errorf("bad descriptor from %s: %v", imp.addr, err)
+		}
+		if _, ok := imp.files[fdp.GetName()]; ok {
+			continue
+		}
+		imp.fetched[fdp.GetName()] = fdp
+		if fdp.GetName() == filename {
+			found = true
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,55 @@
+package reflection
+
+import (
+	"net"
+	"testing"
+
+	_ "github.com/golang/protobuf/protoc-gen-go/plugin" // registers google/protobuf/compiler/plugin.proto
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+)
+
+// startServer starts a gRPC server with the reflection service,
+// which serves the files registered in this binary, and returns its address.
+func startServer(t *testing.T) (addr string, stop func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := grpc.NewServer()
+	reflection.Register(s)
+	go s.Serve(lis)
+	return lis.Addr().String(), s.Stop
+}
+
+func TestImport(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+	imp := NewImporter(addr)
+	defer imp.Close()
+
+	f, err := imp.Import("google/protobuf/compiler/plugin.proto")
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if f == nil {
+		t.Fatalf("Import returned no file")
+	}
+	found := false
+	for _, m := range f.Messages {
+		found = found || m.Name == "CodeGeneratorRequest"
+	}
+	if !found {
+		t.Errorf("plugin.proto has no CodeGeneratorRequest message")
+	}
+
+	// The dependency was fetched and converted along with it.
+	if dep := imp.files["google/protobuf/descriptor.proto"]; dep == nil {
+		t.Errorf("descriptor.proto, imported by plugin.proto, was not fetched")
+	}
+
+	f, err = imp.Import("no/such.proto")
+	if f != nil || err != nil {
+		t.Errorf("Import of an unknown file = %v, %v; want nil, nil", f, err)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Package remote supplies imports by fetching their source over HTTPS.
+
+Files may be pinned to the SHA-256 hash of their expected content.
+Pinned files are stored in a local, content-addressed cache,
+so once fetched they are not downloaded again.
+*/
+package remote
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/parser"
+)
+
+// Importer fetches files relative to a list of HTTPS base URLs.
+// Its Import method is suitable as a fallback for parser.ParseFilesWithFallback.
+type Importer struct {
+	// BaseURLs are tried in order; the import name is appended to each.
+	BaseURLs []string
+
+	// Pins maps import names to the hex-encoded SHA-256 hash of their content.
+	// Fetched content that does not match its pin is rejected.
+	Pins map[string]string
+
+	// CacheDir is where pinned content is cached. If empty, nothing is cached.
+	CacheDir string
+
+	// Client is used to make requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// NewImporter returns an Importer for the given base URLs,
+// which must all use the https scheme.
+func NewImporter(baseURLs []string) (*Importer, error) {
+	for _, base := range baseURLs {
+		u, err := url.Parse(base)
+		if err != nil {
+			return nil, fmt.Errorf("bad base URL %q: %v", base, err)
+		}
+		if u.Scheme != "https" {
+			return nil, fmt.Errorf("base URL %q does not use https", base)
+		}
+	}
+	return &Importer{BaseURLs: baseURLs}, nil
+}
+
+// Import returns the named file, parsed but not resolved.
+// It returns a nil *ast.File if no base URL has the file.
+func (imp *Importer) Import(filename string) (*ast.File, error) {
+	src, err := imp.fetch(filename)
+	if err != nil || src == nil {
+		return nil, err
+	}
+	return parser.ParseFile(filename, src)
+}
+
+func (imp *Importer) fetch(filename string) ([]byte, error) {
+	rel, err := urlPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	pin, pinned := imp.Pins[filename]
+	if pinned {
+		pin = strings.ToLower(pin)
+		if src, err := imp.readCache(pin); err != nil {
+			return nil, err
+		} else if src != nil {
+			return src, nil
+		}
+	}
+
+	client := imp.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for _, base := range imp.BaseURLs {
+		u := strings.TrimSuffix(base, "/") + "/" + rel
+		resp, err := client.Get(u)
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %v", u, err)
+		}
+		src, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", u, resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %v", u, err)
+		}
+		if pinned {
+			if got := hash(src); got != pin {
+				return nil, fmt.Errorf("fetching %s: content hash %s does not match pinned hash %s", u, got, pin)
+			}
+			if err := imp.writeCache(pin, src); err != nil {
+				return nil, err
+			}
+		}
+		return src, nil
+	}
+	return nil, nil
+}
+
+// urlPath returns filename as a relative URL path, with each element escaped.
+// Only canonical relative names are accepted, so that a file can't be
+// fetched from outside the base URLs.
+func urlPath(filename string) (string, error) {
+	if filename == "" || path.Clean(filename) != filename || path.IsAbs(filename) ||
+		filename == ".." || strings.HasPrefix(filename, "../") || strings.Contains(filename, `\`) {
+		return "", fmt.Errorf("import %q is not a canonical relative path", filename)
+	}
+	elems := strings.Split(filename, "/")
+	for i, e := range elems {
+		elems[i] = url.PathEscape(e)
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// readCache returns the cached content with the given hash,
+// or nil if it is not cached.
+func (imp *Importer) readCache(pin string) ([]byte, error) {
+	if imp.CacheDir == "" {
+		return nil, nil
+	}
+	src, err := ioutil.ReadFile(filepath.Join(imp.CacheDir, pin))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if hash(src) != pin {
+		// Corrupt cache entry; ignore it, and it'll be overwritten.
+		return nil, nil
+	}
+	return src, nil
+}
+
+func (imp *Importer) writeCache(pin string, src []byte) error {
+	if imp.CacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(imp.CacheDir, 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so a partial write is never visible.
+	tmp, err := ioutil.TempFile(imp.CacheDir, "tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(imp.CacheDir, pin))
+}
+
+func hash(src []byte) string {
+	h := sha256.Sum256(src)
+	return hex.EncodeToString(h[:])
+}
+
+// LoadPins reads a file of pins, in the format produced by sha256sum:
+// each line holds a hex-encoded hash and an import name, separated by whitespace.
+// Blank lines and lines starting with "#" are ignored.
+func LoadPins(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pins := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.Fields(text)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: want hash and filename", filename, line)
+		}
+		// sha256sum marks binary mode with a leading "*".
+		pins[strings.TrimPrefix(parts[1], "*")] = parts[0]
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
@@ -0,0 +1,112 @@
+package remote
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const typesProto = "syntax = \"proto2\";\npackage common;\nmessage Money { optional int64 units = 1; }\n"
+
+func newServer(t *testing.T, requests *int) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if r.URL.Path != "/protos/company.com/common/types.proto" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(typesProto))
+	}))
+}
+
+func TestImport(t *testing.T) {
+	requests := 0
+	ts := newServer(t, &requests)
+	defer ts.Close()
+
+	cacheDir, err := ioutil.TempDir("", "gotoc-remote-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	imp, err := NewImporter([]string{ts.URL + "/protos/"})
+	if err != nil {
+		t.Fatalf("NewImporter: %v", err)
+	}
+	imp.Client = ts.Client()
+	imp.CacheDir = cacheDir
+	imp.Pins = map[string]string{"company.com/common/types.proto": hash([]byte(typesProto))}
+
+	for i := 0; i < 2; i++ {
+		f, err := imp.Import("company.com/common/types.proto")
+		if err != nil {
+			t.Fatalf("Import: %v", err)
+		}
+		if f == nil || len(f.Messages) != 1 || f.Messages[0].Name != "Money" {
+			t.Fatalf("Import returned %+v, want a file with message Money", f)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Made %d requests, want 1 (the second should be cached)", requests)
+	}
+
+	f, err := imp.Import("company.com/common/missing.proto")
+	if err != nil || f != nil {
+		t.Errorf("Import of missing file = %v, %v; want nil, nil", f, err)
+	}
+}
+
+func TestPinMismatch(t *testing.T) {
+	requests := 0
+	ts := newServer(t, &requests)
+	defer ts.Close()
+
+	imp, err := NewImporter([]string{ts.URL + "/protos"})
+	if err != nil {
+		t.Fatalf("NewImporter: %v", err)
+	}
+	imp.Client = ts.Client()
+	imp.Pins = map[string]string{"company.com/common/types.proto": hash([]byte("something else"))}
+	if _, err := imp.Import("company.com/common/types.proto"); err == nil {
+		t.Errorf("Import succeeded despite a pin mismatch")
+	}
+}
+
+func TestInsecureBaseURL(t *testing.T) {
+	if _, err := NewImporter([]string{"http://example.com/protos"}); err == nil {
+		t.Errorf("NewImporter accepted a non-https base URL")
+	}
+}
+
+func TestImportNames(t *testing.T) {
+	var paths []string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	imp, err := NewImporter([]string{ts.URL + "/protos"})
+	if err != nil {
+		t.Fatalf("NewImporter: %v", err)
+	}
+	imp.Client = ts.Client()
+
+	for _, name := range []string{"../secret.proto", "a/../../b.proto", "/etc/x.proto", "a//b.proto", "./a.proto", `a\b.proto`, ""} {
+		if _, err := imp.Import(name); err == nil {
+			t.Errorf("Import(%q) succeeded, want an error", name)
+		}
+	}
+	if len(paths) != 0 {
+		t.Errorf("Requests were made for bad names: %q", paths)
+	}
+
+	if _, err := imp.Import("a b/c?d#e.proto"); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if want := "/protos/a%20b/c%3Fd%23e.proto"; len(paths) != 1 || paths[0] != want {
+		t.Errorf("Requested %q, want [%q]", paths, want)
+	}
+}
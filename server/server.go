@@ -0,0 +1,260 @@
+/*
+Package server implements compilation as a service over HTTP.
+
+Clients POST a JSON-encoded Request holding a set of .proto sources to
+one of these paths:
+
+	/descriptors	responds with the compiled FileDescriptorSet,
+			in binary form, or in text form given ?format=text.
+	/generate	runs a code generator over the compiled files,
+			and responds with a JSON-encoded Response.
+
+Sources are only ever read from the request; imports of files
+that the request does not include fail to compile.
+
+Plugin binaries run by /generate get a scrubbed environment, holding only
+PATH and, in HOME and TMPDIR, a temporary directory that is also their
+working directory and is removed when they finish. They are killed if the
+request is cancelled or they run for longer than the server's PluginTimeout.
+*/
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/dsymonds/gotoc/generator"
+	"github.com/dsymonds/gotoc/parser"
+)
+
+// DefaultMaxRequestBytes is the default limit on the size of a request body.
+const DefaultMaxRequestBytes = 10 << 20
+
+// DefaultPluginTimeout is the default limit on how long a plugin may run.
+const DefaultPluginTimeout = 30 * time.Second
+
+// maxStderrBytes limits how much of a plugin's standard error is reported.
+const maxStderrBytes = 4 << 10
+
+// Request is the body of a request.
+type Request struct {
+	// Files maps file names to their source.
+	Files map[string]string `json:"files"`
+
+	// Inputs are the names of the files to compile.
+	// If empty, all of Files are compiled.
+	Inputs []string `json:"inputs,omitempty"`
+
+	// Generator and Parameter name the code generator to run
+	// and the parameter to pass to it. They are only used by /generate.
+	Generator string `json:"generator,omitempty"`
+	Parameter string `json:"parameter,omitempty"`
+}
+
+// Response is the body of a successful response from /generate.
+type Response struct {
+	Files []File `json:"files"`
+}
+
+// File is a generated file.
+type File struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// Server is an http.Handler that compiles .proto sources.
+type Server struct {
+	// Plugins lists the plugin binaries that clients may run.
+	// Compiled-in generators (see package generator) may always be run,
+	// since they do not start subprocesses.
+	Plugins []string
+
+	// MaxRequestBytes limits the size of request bodies.
+	// If zero, DefaultMaxRequestBytes is used.
+	MaxRequestBytes int64
+
+	// PluginTimeout limits how long a plugin binary may run.
+	// If zero, DefaultPluginTimeout is used.
+	PluginTimeout time.Duration
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/descriptors" && r.URL.Path != "/generate" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	max := s.MaxRequestBytes
+	if max == 0 {
+		max = DefaultMaxRequestBytes
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, max))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading request: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	req := new(Request)
+	if err := json.Unmarshal(body, req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	fds, inputs, err := compile(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Path == "/descriptors" {
+		if r.FormValue("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			proto.MarshalText(w, fds)
+			return
+		}
+		raw, err := proto.Marshal(fds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(raw)
+		return
+	}
+
+	if !s.allowed(req.Generator) {
+		http.Error(w, fmt.Sprintf("generator %q is not available", req.Generator), http.StatusBadRequest)
+		return
+	}
+	cgRequest := &plugin.CodeGeneratorRequest{
+		FileToGenerate: inputs,
+		ProtoFile:      fds.File,
+	}
+	if req.Parameter != "" {
+		cgRequest.Parameter = proto.String(req.Parameter)
+	}
+	cgResponse, err := s.run(r.Context(), req.Generator, cgRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cgResponse.Error != nil {
+		http.Error(w, cgResponse.GetError(), http.StatusBadRequest)
+		return
+	}
+	resp := &Response{Files: []File{}}
+	for _, f := range cgResponse.File {
+		resp.Files = append(resp.Files, File{Name: f.GetName(), Content: f.GetContent()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) allowed(name string) bool {
+	if name == "" {
+		return false
+	}
+	if generator.Lookup(name) != nil {
+		return true
+	}
+	for _, p := range s.Plugins {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs the named generator. Plugin binaries are run in a temporary
+// directory, with a scrubbed environment and a deadline.
+func (s *Server) run(ctx context.Context, name string, req *plugin.CodeGeneratorRequest) (*plugin.CodeGeneratorResponse, error) {
+	if generator.Lookup(name) != nil {
+		return generator.Run(name, req)
+	}
+	timeout := s.PluginTimeout
+	if timeout == 0 {
+		timeout = DefaultPluginTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	dir, err := ioutil.TempDir("", "gotoc-plugin")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	stderr := new(limitedBuffer)
+	resp, err := generator.RunContext(ctx, name, req, &generator.PluginOptions{
+		Env:    []string{"PATH=" + os.Getenv("PATH"), "HOME=" + dir, "TMPDIR=" + dir},
+		Dir:    dir,
+		Stderr: stderr,
+	})
+	if err != nil && stderr.Len() > 0 {
+		err = fmt.Errorf("%v\n%s", err, stderr)
+	}
+	return resp, err
+}
+
+// A limitedBuffer keeps the first maxStderrBytes bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := maxStderrBytes - b.Len(); n < len(p) {
+		b.Buffer.Write(p[:n])
+	} else {
+		b.Buffer.Write(p)
+	}
+	return len(p), nil
+}
+
+// compile compiles the files in req, returning their descriptors
+// and the names of the input files.
+func compile(ctx context.Context, req *Request) (*pb.FileDescriptorSet, []string, error) {
+	inputs := req.Inputs
+	if len(inputs) == 0 {
+		for name := range req.Files {
+			inputs = append(inputs, name)
+		}
+		sort.Strings(inputs)
+	}
+	if len(inputs) == 0 {
+		return nil, nil, fmt.Errorf("no files to compile")
+	}
+	config := &parser.Config{
+		// Supply every file from the request, so nothing is read from disk.
+		Override: func(filename string) (*ast.File, error) {
+			src, ok := req.Files[filename]
+			if !ok {
+				return nil, fmt.Errorf("file not found: %s", filename)
+			}
+			return parser.ParseFile(filename, []byte(src))
+		},
+	}
+	fs, err := config.ParseFilesContext(ctx, inputs)
+	if err != nil {
+		return nil, nil, err
+	}
+	fds, err := gendesc.Generate(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	gendesc.StripSourceRetention(fds)
+	return fds, inputs, nil
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+
+	"github.com/dsymonds/gotoc/generator"
+)
+
+func init() {
+	generator.Register("server-test", generator.GeneratorFunc(func(req *plugin.CodeGeneratorRequest) (*plugin.CodeGeneratorResponse, error) {
+		resp := new(plugin.CodeGeneratorResponse)
+		for _, fd := range req.ProtoFile {
+			resp.File = append(resp.File, &plugin.CodeGeneratorResponse_File{
+				Name:    proto.String(fd.GetName() + ".txt"),
+				Content: proto.String(req.GetParameter()),
+			})
+		}
+		return resp, nil
+	}))
+}
+
+var testFiles = map[string]string{
+	"a.proto": "package a;\nimport \"b.proto\";\nmessage A { optional B b = 1; }\n",
+	"b.proto": "message B {}\n",
+}
+
+func post(t *testing.T, ts *httptest.Server, path string, req *Request) (int, string) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	return resp.StatusCode, string(out)
+}
+
+func TestDescriptors(t *testing.T) {
+	ts := httptest.NewServer(&Server{})
+	defer ts.Close()
+
+	code, body := post(t, ts, "/descriptors?format=text", &Request{Files: testFiles, Inputs: []string{"a.proto"}})
+	if code != http.StatusOK {
+		t.Fatalf("/descriptors failed: %d %s", code, body)
+	}
+	if !strings.Contains(body, `name: "a.proto"`) || !strings.Contains(body, `name: "b.proto"`) {
+		t.Errorf("/descriptors response is missing a file:\n%s", body)
+	}
+
+	// Imports must come from the request.
+	code, body = post(t, ts, "/descriptors", &Request{Files: map[string]string{"a.proto": testFiles["a.proto"]}})
+	if code != http.StatusBadRequest || !strings.Contains(body, "b.proto") {
+		t.Errorf("Compiling with a missing import = %d %s, want a 400 error mentioning b.proto", code, body)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	ts := httptest.NewServer(&Server{})
+	defer ts.Close()
+
+	code, body := post(t, ts, "/generate", &Request{Files: testFiles, Generator: "server-test", Parameter: "p"})
+	if code != http.StatusOK {
+		t.Fatalf("/generate failed: %d %s", code, body)
+	}
+	resp := new(Response)
+	if err := json.Unmarshal([]byte(body), resp); err != nil {
+		t.Fatalf("Bad response: %v", err)
+	}
+	if len(resp.Files) != 2 || resp.Files[0].Content != "p" {
+		t.Errorf("/generate returned %+v", resp)
+	}
+
+	// Plugin binaries may only be run if configured.
+	code, _ = post(t, ts, "/generate", &Request{Files: testFiles, Generator: "protoc-gen-go"})
+	if code != http.StatusBadRequest {
+		t.Errorf("/generate with an unconfigured plugin returned status %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+// pluginScript is a plugin that reports its working directory and the value
+// of $GOTOC_SECRET in the content of a file named "out".
+const pluginScript = `#!/bin/sh
+cat >/dev/null
+out="dir=$(pwd) secret=$GOTOC_SECRET"
+oct() { printf "\\$(printf %03o "$1")"; }
+n=${#out}
+oct 122; oct $((n + 7))
+oct 10; oct 3; printf out
+oct 122; oct $n; printf %s "$out"
+`
+
+func writePlugin(t *testing.T, dir, name, script string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeneratePlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin scripts need a Unix shell")
+	}
+	dir, err := ioutil.TempDir("", "server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	good := writePlugin(t, dir, "good", pluginScript)
+	slow := writePlugin(t, dir, "slow", "#!/bin/sh\nexec sleep 10\n")
+
+	os.Setenv("GOTOC_SECRET", "leaked")
+	defer os.Unsetenv("GOTOC_SECRET")
+	ts := httptest.NewServer(&Server{Plugins: []string{good, slow}, PluginTimeout: 100 * time.Millisecond})
+	defer ts.Close()
+
+	code, body := post(t, ts, "/generate", &Request{Files: testFiles, Generator: good})
+	if code != http.StatusOK {
+		t.Fatalf("/generate failed: %d %s", code, body)
+	}
+	resp := new(Response)
+	if err := json.Unmarshal([]byte(body), resp); err != nil {
+		t.Fatalf("Bad response: %v", err)
+	}
+	if len(resp.Files) != 1 || resp.Files[0].Name != "out" {
+		t.Fatalf("/generate returned %+v, want one file named out", resp)
+	}
+	var pluginDir, secret string
+	for _, kv := range strings.Fields(resp.Files[0].Content) {
+		if strings.HasPrefix(kv, "dir=") {
+			pluginDir = kv[len("dir="):]
+		}
+		if strings.HasPrefix(kv, "secret=") {
+			secret = kv[len("secret="):]
+		}
+	}
+	if secret != "" {
+		t.Errorf("Plugin saw $GOTOC_SECRET = %q, want it unset", secret)
+	}
+	if wd, _ := os.Getwd(); pluginDir == "" || pluginDir == wd {
+		t.Errorf("Plugin ran in %q, want a temporary directory", pluginDir)
+	} else if _, err := os.Stat(pluginDir); !os.IsNotExist(err) {
+		t.Errorf("Plugin directory %s was not removed (Stat: %v)", pluginDir, err)
+	}
+
+	start := time.Now()
+	code, _ = post(t, ts, "/generate", &Request{Files: testFiles, Generator: slow})
+	if code != http.StatusInternalServerError {
+		t.Errorf("/generate with a slow plugin returned status %d, want %d", code, http.StatusInternalServerError)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("/generate with a slow plugin took %v", d)
+	}
+}
@@ -0,0 +1,170 @@
+// A conformance runner that compiles the .proto files from the protobuf
+// source tree with both gotoc and protoc, and records which cases pass.
+//
+// Each case is one .proto file, named relative to the tree's src directory.
+// A case passes if gotoc accepts it and produces the same descriptors as
+// protoc (as judged by protocmp). Cases that protoc rejects are skipped.
+//
+// The report has one line per case, followed by a summary, so that runs
+// can be diffed to see how compatibility changes.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	gotocBin  = flag.String("gotoc", "../gotoc", "The gotoc binary to test.")
+	protocBin = flag.String("protoc", "protoc", "The protoc binary to compare against.")
+	protocmp  = flag.String("protocmp", "./protocmp", "The protocmp binary used to compare descriptor sets.")
+	protobuf  = flag.String("protobuf", filepath.Join(os.Getenv("HOME"), "src/protobuf"), "Path to the protobuf source tree.")
+	cases     = flag.String("cases", "google/protobuf/*.proto,google/protobuf/compiler/*.proto,google/protobuf/util/*.proto",
+		"Comma-separated list of glob patterns, relative to the source tree's src directory, selecting the cases to run.")
+	report  = flag.String("report", "", "File to write the report to; standard output if empty.")
+	workDir = flag.String("work", "_conformance", "Directory for intermediate files.")
+)
+
+// Case results.
+const (
+	pass     = "PASS"
+	fail     = "FAIL"     // gotoc rejected the input
+	mismatch = "MISMATCH" // gotoc and protoc produced different descriptors
+	skip     = "SKIP"     // protoc rejected the input
+)
+
+func main() {
+	flag.Parse()
+	src := filepath.Join(*protobuf, "src")
+
+	var names []string
+	for _, pattern := range strings.Split(*cases, ",") {
+		matches, err := filepath.Glob(filepath.Join(src, pattern))
+		if err != nil {
+			log.Fatalf("Bad pattern %q: %v", pattern, err)
+		}
+		for _, m := range matches {
+			rel, err := filepath.Rel(src, m)
+			if err != nil {
+				log.Fatal(err)
+			}
+			names = append(names, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		log.Fatalf("No cases found under %s", src)
+	}
+
+	if err := os.MkdirAll(*workDir, 0755); err != nil {
+		log.Fatalf("Failed creating work directory: %v", err)
+	}
+	defer os.RemoveAll(*workDir)
+
+	var w io.Writer = os.Stdout
+	if *report != "" {
+		f, err := os.Create(*report)
+		if err != nil {
+			log.Fatalf("Failed creating report: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	counts := make(map[string]int)
+	for i, name := range names {
+		result, detail := runCase(src, name, i)
+		counts[result]++
+		if detail != "" {
+			fmt.Fprintf(w, "%-8s %s: %s\n", result, name, detail)
+		} else {
+			fmt.Fprintf(w, "%-8s %s\n", result, name)
+		}
+	}
+	fmt.Fprintf(w, "---\n%d case(s): %d passed, %d failed, %d mismatched, %d skipped\n",
+		len(names), counts[pass], counts[fail], counts[mismatch], counts[skip])
+	if counts[fail]+counts[mismatch] > 0 {
+		os.Exit(1)
+	}
+}
+
+// runCase compiles a single file with both compilers, and returns its result
+// and, for cases that don't pass, a short explanation.
+func runCase(src, name string, i int) (result, detail string) {
+	raw, err := filepath.Abs(filepath.Join(*workDir, fmt.Sprintf("%d.raw", i)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := run(src, *protocBin, "--include_imports", "--descriptor_set_out="+raw, name); err != nil {
+		return skip, firstLine(err.Error())
+	}
+	// Decode protoc's output to text format, which is what gotoc emits.
+	cmd := exec.Command(*protocBin, "--decode=google.protobuf.FileDescriptorSet", "google/protobuf/descriptor.proto")
+	cmd.Dir = src
+	in, err := os.Open(raw)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	cmd.Stdin = in
+	baseline, err := cmd.Output()
+	if err != nil {
+		log.Fatalf("Failed decoding protoc output for %s: %v", name, err)
+	}
+
+	gotocPath, err := filepath.Abs(*gotocBin)
+	if err != nil {
+		log.Fatalf("Bad gotoc path: %v", err)
+	}
+	actual, err := run(src, gotocPath, "--descriptor_only", "--include_imports", name)
+	if err != nil {
+		return fail, firstLine(err.Error())
+	}
+
+	dir, _ := filepath.Abs(*workDir)
+	baseFile := filepath.Join(dir, fmt.Sprintf("%d.baseline", i))
+	actualFile := filepath.Join(dir, fmt.Sprintf("%d.actual", i))
+	if err := ioutil.WriteFile(baseFile, baseline, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(actualFile, actual, 0644); err != nil {
+		log.Fatal(err)
+	}
+	protocmpPath, err := filepath.Abs(*protocmp)
+	if err != nil {
+		log.Fatalf("Bad protocmp path: %v", err)
+	}
+	if _, err := run(dir, protocmpPath, baseFile, actualFile); err != nil {
+		return mismatch, firstLine(err.Error())
+	}
+	return pass, ""
+}
+
+func run(dir, binary string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func firstLine(s string) string {
+	if i := strings.Index(s, "\n"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
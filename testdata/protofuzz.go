@@ -0,0 +1,324 @@
+// A differential fuzzer that compares gotoc against protoc.
+//
+// It generates random but mostly-valid .proto files, runs both compilers
+// over each of them, and reports any case where they disagree about
+// whether the input is acceptable, or where they both accept it but
+// produce different descriptors (as judged by protocmp).
+//
+// Divergent inputs are kept in the output directory for later inspection.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	numCases  = flag.Int("n", 100, "Number of random inputs to try.")
+	seed      = flag.Int64("seed", 0, "Random seed; zero means use the current time.")
+	mutate    = flag.Float64("mutate", 0.1, "Probability of injecting a likely-invalid construct into each input.")
+	outDir    = flag.String("out", "_fuzz", "Directory in which to write inputs and divergent cases.")
+	gotocBin  = flag.String("gotoc", "../gotoc", "The gotoc binary to test.")
+	protocBin = flag.String("protoc", "protoc", "The protoc binary to compare against.")
+	protocmp  = flag.String("protocmp", "./protocmp", "The protocmp binary used to compare descriptor sets.")
+	protobuf  = flag.String("protobuf", filepath.Join(os.Getenv("HOME"), "src/protobuf"), "Path to the protobuf source tree.")
+)
+
+func main() {
+	flag.Parse()
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("Using seed %d", *seed)
+	rnd := rand.New(rand.NewSource(*seed))
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatalf("Failed creating output directory: %v", err)
+	}
+
+	divergences := 0
+	for i := 0; i < *numCases; i++ {
+		g := &generator{rnd: rnd, mutate: rnd.Float64() < *mutate}
+		src := g.file()
+		name := fmt.Sprintf("fuzz%d.proto", i)
+		if err := ioutil.WriteFile(filepath.Join(*outDir, name), []byte(src), 0644); err != nil {
+			log.Fatalf("Failed writing input: %v", err)
+		}
+		if msg := runCase(name); msg != "" {
+			divergences++
+			log.Printf("DIVERGENCE in %s: %s", name, msg)
+			continue
+		}
+		// Only keep the divergent cases around.
+		os.Remove(filepath.Join(*outDir, name))
+	}
+
+	log.Printf("%d divergence(s) in %d case(s)", divergences, *numCases)
+	if divergences > 0 {
+		os.Exit(1)
+	}
+}
+
+// runCase runs both compilers on a single input,
+// and returns a description of how they diverge, or "" if they agree.
+func runCase(name string) string {
+	base := strings.TrimSuffix(name, ".proto")
+
+	gotocOut, gotocErr := run(*outDir, *gotocBin, "--descriptor_only", name)
+	_, protocErr := run(*outDir, *protocBin, "--descriptor_set_out="+base+".raw", name)
+	defer os.Remove(filepath.Join(*outDir, base+".raw"))
+
+	switch {
+	case gotocErr == nil && protocErr != nil:
+		return "accepted by gotoc, rejected by protoc: " + protocErr.Error()
+	case gotocErr != nil && protocErr == nil:
+		return "rejected by gotoc, accepted by protoc: " + gotocErr.Error()
+	case gotocErr != nil && protocErr != nil:
+		// Both rejected it; that's agreement.
+		return ""
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(*outDir, base+".raw"))
+	if err != nil {
+		log.Fatalf("Failed reading protoc output: %v", err)
+	}
+	cmd := exec.Command(*protocBin, "--decode=google.protobuf.FileDescriptorSet",
+		"-I", *protobuf, filepath.Join(*protobuf, "src/google/protobuf/descriptor.proto"))
+	cmd.Stdin = bytes.NewReader(raw)
+	protocOut, err := cmd.Output()
+	if err != nil {
+		log.Fatalf("Failed decoding protoc output: %v", err)
+	}
+
+	actual, baseline := base+".actual", base+".baseline"
+	if err := ioutil.WriteFile(filepath.Join(*outDir, actual), gotocOut, 0644); err != nil {
+		log.Fatalf("Failed writing gotoc output: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(*outDir, baseline), protocOut, 0644); err != nil {
+		log.Fatalf("Failed writing protoc output: %v", err)
+	}
+	protocmpPath, err := filepath.Abs(*protocmp)
+	if err != nil {
+		log.Fatalf("Bad protocmp path: %v", err)
+	}
+	if _, err := run(*outDir, protocmpPath, baseline, actual); err != nil {
+		return "descriptor mismatch: " + err.Error()
+	}
+	os.Remove(filepath.Join(*outDir, actual))
+	os.Remove(filepath.Join(*outDir, baseline))
+	return ""
+}
+
+// run runs a binary in the given directory, returning its stdout.
+// If it fails, the returned error includes its stderr.
+func run(dir, binary string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+var scalarTypes = []string{
+	"double", "float", "int64", "uint64", "int32", "fixed64", "fixed32", "bool",
+	"string", "bytes", "uint32", "sfixed32", "sfixed64", "sint32", "sint64",
+}
+
+// generator produces a random .proto file.
+type generator struct {
+	rnd    *rand.Rand
+	mutate bool // whether to inject a likely-invalid construct
+
+	buf    bytes.Buffer
+	proto3 bool
+	names  int      // counter for generating unique names
+	types  []string // message and enum names usable as field types
+}
+
+func (g *generator) p(indent int, format string, args ...interface{}) {
+	g.buf.WriteString(strings.Repeat("  ", indent))
+	fmt.Fprintf(&g.buf, format, args...)
+	g.buf.WriteString("\n")
+}
+
+func (g *generator) name(prefix string) string {
+	g.names++
+	return fmt.Sprintf("%s%d", prefix, g.names)
+}
+
+func (g *generator) file() string {
+	g.proto3 = g.rnd.Intn(2) == 0
+	if g.proto3 {
+		g.p(0, `syntax = "proto3";`)
+	} else {
+		g.p(0, `syntax = "proto2";`)
+	}
+	if g.rnd.Intn(2) == 0 {
+		g.p(0, "package %s.%s;", g.name("pkg"), g.name("sub"))
+	}
+	if g.rnd.Intn(3) == 0 {
+		g.p(0, `option java_package = "com.example.%s";`, g.name("j"))
+	}
+
+	for i := g.rnd.Intn(3); i >= 0; i-- {
+		g.enum(0, "")
+	}
+	// Declare message names up front so fields can refer to later messages.
+	var msgs []string
+	for i := g.rnd.Intn(4); i >= 0; i-- {
+		name := g.name("Msg")
+		msgs = append(msgs, name)
+		g.types = append(g.types, name)
+	}
+	for _, name := range msgs {
+		g.message(0, name, name)
+	}
+	if g.rnd.Intn(3) == 0 {
+		g.service(msgs)
+	}
+	if g.mutate {
+		g.p(0, "%s", mutations[g.rnd.Intn(len(mutations))])
+	}
+	return g.buf.String()
+}
+
+// mutations are constructs that are likely (but not certain) to be invalid
+// in the context of a generated file.
+var mutations = []string{
+	"message Dup {} message Dup {}",
+	"message BadTag { optional int32 x = 0; }",
+	"message ReservedTag { optional int32 x = 19500; }",
+	"message SameTag { optional int32 x = 1; optional int32 y = 1; }",
+	"message SameName { optional int32 x = 1; optional int32 x = 2; }",
+	"message Unresolved { optional NoSuchType x = 1; }",
+	"message BadMapKey { map<float, string> m = 1; }",
+	"enum EmptyEnum {}",
+	"enum NonZero { ONE = 1; }",
+	"message RequiredField { required int32 x = 1; }",
+	"import \"no/such/file.proto\";",
+	"message MissingSemicolon { optional int32 x = 1 }",
+}
+
+// enum generates an enum inside the scope named by prefix
+// (which is empty at the top level).
+func (g *generator) enum(indent int, prefix string) {
+	name := g.name("Enum")
+	g.types = append(g.types, qualify(prefix, name))
+	g.p(indent, "enum %s {", name)
+	num := -1
+	for i := g.rnd.Intn(4); i >= 0; i-- {
+		// The first value must be zero in proto3.
+		if num < 0 && g.proto3 {
+			num = 0
+		} else {
+			num += 1 + g.rnd.Intn(3)
+		}
+		g.p(indent+1, "%s_%s = %d;", strings.ToUpper(name), g.name("V"), num)
+	}
+	g.p(indent, "}")
+}
+
+func qualify(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// message generates a message called name,
+// whose package-relative qualified name is fullName.
+func (g *generator) message(indent int, name, fullName string) {
+	g.p(indent, "message %s {", name)
+	tag := 1
+	nextTag := func() int {
+		tag += 1 + g.rnd.Intn(3)
+		return tag
+	}
+	if g.rnd.Intn(3) == 0 {
+		g.enum(indent+1, fullName)
+	}
+	if indent < 4 && g.rnd.Intn(3) == 0 {
+		nested := g.name("Nested")
+		g.types = append(g.types, qualify(fullName, nested))
+		g.message(indent+1, nested, qualify(fullName, nested))
+	}
+	for i := g.rnd.Intn(6); i >= 0; i-- {
+		g.field(indent+1, nextTag())
+	}
+	if g.rnd.Intn(4) == 0 {
+		g.p(indent+1, "oneof %s {", g.name("choice"))
+		for i := g.rnd.Intn(3); i >= 0; i-- {
+			g.p(indent+2, "%s %s = %d;", g.fieldType(), g.name("o"), nextTag())
+		}
+		g.p(indent+1, "}")
+	}
+	if g.rnd.Intn(4) == 0 {
+		key := scalarTypes[2+g.rnd.Intn(len(scalarTypes)-2)] // skip floating point
+		if key == "bytes" {
+			key = "string"
+		}
+		g.p(indent+1, "map<%s, %s> %s = %d;", key, g.fieldType(), g.name("m"), nextTag())
+	}
+	if !g.proto3 {
+		if g.rnd.Intn(4) == 0 {
+			g.p(indent+1, "optional group %s = %d {", g.name("Group"), nextTag())
+			g.p(indent+2, "optional int32 %s = %d;", g.name("g"), nextTag())
+			g.p(indent+1, "}")
+		}
+		if g.rnd.Intn(4) == 0 {
+			start := tag + 100
+			g.p(indent+1, "extensions %d to %d;", start, start+g.rnd.Intn(100))
+		}
+	}
+	g.p(indent, "}")
+}
+
+func (g *generator) fieldType() string {
+	if len(g.types) > 0 && g.rnd.Intn(3) == 0 {
+		return g.types[g.rnd.Intn(len(g.types))]
+	}
+	return scalarTypes[g.rnd.Intn(len(scalarTypes))]
+}
+
+func (g *generator) field(indent, tag int) {
+	var labels []string
+	if g.proto3 {
+		labels = []string{"", "repeated"}
+	} else {
+		labels = []string{"optional", "required", "repeated"}
+	}
+	label := labels[g.rnd.Intn(len(labels))]
+	if label != "" {
+		label += " "
+	}
+	g.p(indent, "%s%s %s = %d;", label, g.fieldType(), g.name("f"), tag)
+}
+
+func (g *generator) service(msgs []string) {
+	g.p(0, "service %s {", g.name("Service"))
+	for i := g.rnd.Intn(3); i >= 0; i-- {
+		in, out := msgs[g.rnd.Intn(len(msgs))], msgs[g.rnd.Intn(len(msgs))]
+		if g.rnd.Intn(4) == 0 {
+			in = "stream " + in
+		}
+		if g.rnd.Intn(4) == 0 {
+			out = "stream " + out
+		}
+		g.p(1, "rpc %s(%s) returns (%s);", g.name("Method"), in, out)
+	}
+	g.p(0, "}")
+}
@@ -0,0 +1,101 @@
+/*
+Package wkt supplies the well-known type files (google/protobuf/*.proto),
+either from copies built into the package or from a user-chosen location.
+*/
+package wkt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"github.com/dsymonds/gotoc/ast"
+	"github.com/dsymonds/gotoc/descast"
+	"github.com/dsymonds/gotoc/parser"
+)
+
+// Prefix is the import path prefix of the well-known type files.
+const Prefix = "google/protobuf/"
+
+// Import returns the named well-known type file, parsed from the copy built
+// into this package, or nil if filename is not a well-known type file.
+// It is suitable as a fallback for parser.ParseFilesWithFallback,
+// so that copies of the files in the import path take precedence.
+func Import(filename string) (*ast.File, error) {
+	src, ok := embedded[filename]
+	if !ok {
+		return nil, nil
+	}
+	return parser.ParseFile(filename, []byte(src))
+}
+
+// Source returns the source of the named well-known type file
+// as built into this package, and whether there is such a file.
+func Source(filename string) (string, bool) {
+	src, ok := embedded[filename]
+	return src, ok
+}
+
+// Overrides supplies the well-known type files from a user-chosen location,
+// for users who need a particular revision of them.
+// Its Import method is suitable as an override for parser.ParseFilesWithOverride.
+type Overrides struct {
+	dir   string               // if non-empty, the directory to read from
+	files map[string]*ast.File // otherwise, the files from a descriptor set
+}
+
+// LoadOverrides returns Overrides for path, which names either a directory
+// holding google/protobuf/*.proto (such as protoc's include directory),
+// or a file holding a serialized FileDescriptorSet.
+func LoadOverrides(path string) (*Overrides, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &Overrides{dir: path}, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fds := new(pb.FileDescriptorSet)
+	if err := proto.Unmarshal(buf, fds); err != nil {
+		return nil, fmt.Errorf("%s is not a FileDescriptorSet: %v", path, err)
+	}
+	fs, err := descast.Files(fds.File, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	o := &Overrides{files: make(map[string]*ast.File)}
+	for _, f := range fs {
+		if strings.HasPrefix(f.Name, Prefix) {
+			o.files[f.Name] = f
+		}
+	}
+	return o, nil
+}
+
+// Import returns the named file if it is a well-known type file
+// present in the overrides, or nil otherwise.
+func (o *Overrides) Import(filename string) (*ast.File, error) {
+	if !strings.HasPrefix(filename, Prefix) {
+		return nil, nil
+	}
+	if o.dir == "" {
+		return o.files[filename], nil
+	}
+	src, err := ioutil.ReadFile(filepath.Join(o.dir, filepath.FromSlash(filename)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parser.ParseFile(filename, src)
+}
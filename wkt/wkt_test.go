@@ -0,0 +1,179 @@
+package wkt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"github.com/dsymonds/gotoc/gendesc"
+	"github.com/dsymonds/gotoc/parser"
+)
+
+func writeFile(t *testing.T, path, src string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectoryOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotoc-wkt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The import path has one revision of empty.proto; the overrides another.
+	src := filepath.Join(dir, "src")
+	writeFile(t, filepath.Join(src, "google/protobuf/empty.proto"), "package google.protobuf;\nmessage Empty {}\n")
+	writeFile(t, filepath.Join(src, "foo.proto"), "import \"google/protobuf/empty.proto\";\nmessage Foo {}\n")
+	pinned := filepath.Join(dir, "pinned")
+	writeFile(t, filepath.Join(pinned, "google/protobuf/empty.proto"), "package google.protobuf;\nmessage Empty {}\nmessage Pinned {}\n")
+	// Only well-known type files are overridden.
+	writeFile(t, filepath.Join(pinned, "foo.proto"), "message NotFoo {}\n")
+
+	o, err := LoadOverrides(pinned)
+	if err != nil {
+		t.Fatalf("LoadOverrides: %v", err)
+	}
+	fs, err := parser.ParseFilesWithOverride([]string{"foo.proto"}, []string{src}, o.Import, nil)
+	if err != nil {
+		t.Fatalf("ParseFilesWithOverride: %v", err)
+	}
+	for _, f := range fs.Files {
+		switch f.Name {
+		case "foo.proto":
+			if len(f.Messages) != 1 || f.Messages[0].Name != "Foo" {
+				t.Errorf("foo.proto was overridden")
+			}
+		case "google/protobuf/empty.proto":
+			if len(f.Messages) != 2 {
+				t.Errorf("google/protobuf/empty.proto was not overridden")
+			}
+		}
+	}
+}
+
+func TestBuiltin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotoc-wkt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := "syntax = \"proto3\";\n"
+	var names []string
+	for name := range embedded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		src += "import \"" + name + "\";\n"
+	}
+	writeFile(t, filepath.Join(dir, "foo.proto"), src)
+
+	fs, err := parser.ParseFilesWithFallback([]string{"foo.proto"}, []string{dir}, Import)
+	if err != nil {
+		t.Fatalf("ParseFilesWithFallback: %v", err)
+	}
+	if got, want := len(fs.Files), len(names)+1; got != want {
+		t.Errorf("Got %d files, want %d", got, want)
+	}
+	if _, err := gendesc.Generate(fs); err != nil {
+		t.Errorf("gendesc.Generate: %v", err)
+	}
+
+	if f, err := Import("google/protobuf/nonexistent.proto"); f != nil || err != nil {
+		t.Errorf("Import of an unknown file = %v, %v; want nil, nil", f, err)
+	}
+	if _, ok := Source("google/protobuf/timestamp.proto"); !ok {
+		t.Errorf("Source(timestamp.proto) reports no such file")
+	}
+}
+
+// TestSelfHosting checks that the built-in descriptor.proto, which describes
+// protocol buffers themselves, compiles to what protoc produces for it.
+func TestSelfHosting(t *testing.T) {
+	var names []string
+	sources := make(map[string][]byte)
+	for _, name := range []string{"google/protobuf/descriptor.proto", "google/protobuf/empty.proto"} {
+		src, ok := Source(name)
+		if !ok {
+			t.Fatalf("No built-in %s", name)
+		}
+		names = append(names, name)
+		sources[name] = []byte(src)
+	}
+	fs, err := parser.ParseSource(names, sources)
+	if err != nil {
+		t.Fatalf("ParseSource: %v", err)
+	}
+	fds, err := gendesc.Generate(fs)
+	if err != nil {
+		t.Fatalf("gendesc.Generate: %v", err)
+	}
+	if len(fds.File) != 2 {
+		t.Fatalf("Got %d files, want 2", len(fds.File))
+	}
+	desc, empty := fds.File[0], fds.File[1]
+
+	if got := len(empty.MessageType); got != 1 || empty.MessageType[0].GetName() != "Empty" {
+		t.Errorf("empty.proto has messages %v, want just Empty", empty.MessageType)
+	}
+	if got, want := empty.GetSyntax(), "proto3"; got != want {
+		t.Errorf("empty.proto has syntax %q, want %q", got, want)
+	}
+
+	msgs := make(map[string]*pb.DescriptorProto)
+	for _, m := range desc.MessageType {
+		msgs[m.GetName()] = m
+	}
+	for name, m := range msgs {
+		if !strings.HasSuffix(name, "Options") {
+			continue
+		}
+		// Every options message holds the options that aren't interpreted,
+		// and may be extended by custom options.
+		var found bool
+		for _, f := range m.Field {
+			if f.GetName() == "uninterpreted_option" {
+				found = true
+				if f.GetNumber() != 999 || f.GetLabel() != pb.FieldDescriptorProto_LABEL_REPEATED || f.GetTypeName() != ".google.protobuf.UninterpretedOption" {
+					t.Errorf("%s.uninterpreted_option is %v", name, f)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s has no uninterpreted_option field", name)
+		}
+		if len(m.ExtensionRange) != 1 || m.ExtensionRange[0].GetStart() != 1000 || m.ExtensionRange[0].GetEnd() != 536870912 {
+			t.Errorf("%s has extension ranges %v, want [1000, 536870912)", name, m.ExtensionRange)
+		}
+	}
+
+	field := msgs["FieldDescriptorProto"]
+	if field == nil || len(field.EnumType) != 2 {
+		t.Fatalf("FieldDescriptorProto is %v, want two nested enums", field)
+	}
+	if typ := field.EnumType[0]; typ.GetName() != "Type" || len(typ.Value) != 18 {
+		t.Errorf("FieldDescriptorProto.Type has %d values, want 18", len(typ.Value))
+	}
+
+	var optimizeFor *pb.FieldDescriptorProto
+	for _, f := range msgs["FileOptions"].Field {
+		if f.GetName() == "optimize_for" {
+			optimizeFor = f
+		}
+	}
+	if optimizeFor == nil || optimizeFor.GetType() != pb.FieldDescriptorProto_TYPE_ENUM ||
+		optimizeFor.GetTypeName() != ".google.protobuf.FileOptions.OptimizeMode" || optimizeFor.GetDefaultValue() != "SPEED" {
+		t.Errorf("FileOptions.optimize_for is %v", optimizeFor)
+	}
+}